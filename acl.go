@@ -1,11 +1,16 @@
 package gontpd
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
 	"net"
+	"os"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -51,30 +56,121 @@ func subNet(n *net.IPNet) (start, end net.IP) {
 }
 
 type dropTable struct {
-	CIDR  []string
-	slice []*cidrItem
-	net   *net.IPNet
+	CIDR []string
+	// v4 and v6 are sorted separately, since they can't be compared
+	v4, v6 []*cidrItem
+	one    *cidrItem
+	// bans is shared with the replaced table on reload
+	bans *banList
 }
 
 func newDropTable(cidr []string) (d *dropTable, err error) {
-	d = &dropTable{CIDR: cidr}
+	d = &dropTable{CIDR: cidr, bans: newBanList()}
 	if len(cidr) == 1 {
-		_, d.net, err = net.ParseCIDR(cidr[0])
+		var n *net.IPNet
+		_, n, err = net.ParseCIDR(cidr[0])
+		if err != nil {
+			return
+		}
+		d.one = newSegNode(n)
 	}
 
 	if len(cidr) > 1 {
-		nl := []*net.IPNet{}
+		nl4, nl6 := []*net.IPNet{}, []*net.IPNet{}
 		for _, c := range cidr {
 			var n *net.IPNet
 			_, n, err = net.ParseCIDR(c)
 			if err != nil {
 				return
 			}
-			nl = append(nl, n)
+			if n.IP.To4() != nil {
+				nl4 = append(nl4, n)
+			} else {
+				nl6 = append(nl6, n)
+			}
+		}
+		d.v4, err = newStaticSegTree(nl4)
+		if err != nil {
+			return
+		}
+		d.v6, err = newStaticSegTree(nl6)
+	}
+
+	return
+}
+
+// loadDropFile reads one CIDR or address per line of path, "#" starts a
+// comment. Invalid lines are logged and skipped, so that a bad entry of
+// external feed doesn't reject the whole file.
+func loadDropFile(path string) (cidr []string, mod time.Time, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	mod = fi.ModTime()
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if ip := net.ParseIP(line); ip != nil {
+			if ip.To4() != nil {
+				line += "/32"
+			} else {
+				line += "/128"
+			}
 		}
-		d.slice, err = newStaticSegTree(nl)
+		if _, _, perr := net.ParseCIDR(line); perr != nil {
+			logger().Warnf("drop file %s line %d: %s", path, n, perr)
+			continue
+		}
+		cidr = append(cidr, line)
 	}
+	err = s.Err()
+	return
+}
 
+// removeNested removes CIDRs within another one of cidr, since items of
+// segment tree can't overlap. cidr must be valid.
+func removeNested(cidr []string) (out []string) {
+	items := make([]*cidrItem, 0, len(cidr))
+	for _, c := range cidr {
+		_, n, _ := net.ParseCIDR(c)
+		items = append(items, newSegNode(n))
+	}
+	// broader one goes first of the same start
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if len(a.left) != len(b.left) {
+			return len(a.left) < len(b.left)
+		}
+		if !a.left.Equal(b.left) {
+			return ipLess(a.left, b.left)
+		}
+		ao, _ := a.ipnet.Mask.Size()
+		bo, _ := b.ipnet.Mask.Size()
+		return ao < bo
+	})
+	var last *cidrItem
+	for _, item := range items {
+		if last != nil && len(last.left) == len(item.left) &&
+			last.ipnet.Contains(item.left) {
+			continue
+		}
+		out = append(out, item.cidr)
+		last = item
+	}
 	return
 }
 
@@ -91,9 +187,11 @@ func ipToUInt128(ip net.IP) (l, h uint64) {
 	return
 }
 
-func (d *dropTable) snlContains(ip net.IP) bool {
-	s := d.slice
+// snlMatch returns the item containing ip, nil if none
+func (d *dropTable) snlMatch(ip net.IP) *cidrItem {
+	var s []*cidrItem
 	if ip.To4() != nil {
+		s = d.v4
 		ipN := ipToUint32(ip)
 		for len(s) > 2 {
 			mid := len(s) / 2
@@ -105,6 +203,7 @@ func (d *dropTable) snlContains(ip net.IP) bool {
 		}
 
 	} else {
+		s = d.v6
 		ipL, ipH := ipToUInt128(ip)
 		for len(s) > 2 {
 			mid := len(s) / 2
@@ -126,33 +225,120 @@ func (d *dropTable) snlContains(ip net.IP) bool {
 		}
 	}
 
-	if s[0].ipnet.Contains(ip) {
-		return true
-	}
-
-	if s[1].ipnet.Contains(ip) {
-		return true
+	for _, item := range s {
+		if item.ipnet.Contains(ip) {
+			return item
+		}
 	}
-	return false
+	return nil
 }
 
 func (d *dropTable) String() string {
 	var w strings.Builder
-	for _, r := range d.slice {
+	for _, r := range d.v4 {
+		fmt.Fprintf(&w, "%s\n", r.ipnet)
+	}
+	for _, r := range d.v6 {
 		fmt.Fprintf(&w, "%s\n", r.ipnet)
 	}
 	return w.String()
 }
 
 func (d *dropTable) contains(ip net.IP) bool {
+	return d.match(ip) != ""
+}
+
+// banRule is the rule matched by temporary bans
+const banRule = "ban"
+
+// match returns the CIDR containing ip, banRule if ip is banned, or
+// empty string if none matches.
+func (d *dropTable) match(ip net.IP) string {
 	switch len(d.CIDR) {
 	case 0:
-		return false
 	case 1:
-		return d.net.Contains(ip)
+		if d.one.ipnet.Contains(ip) {
+			return d.one.cidr
+		}
 	default:
-		return d.snlContains(ip)
+		if item := d.snlMatch(ip); item != nil {
+			return item.cidr
+		}
+	}
+	if d.bans.contains(ip) {
+		return banRule
+	}
+	return ""
+}
+
+// BanFor drops requests from ip for dur in addition to static CIDRs
+func (d *dropTable) BanFor(ip net.IP, dur time.Duration) {
+	if d.bans.add(ip, time.Now().Add(dur)) {
+		logger().Infof("ban %s for %s", ip, dur)
+	}
+}
+
+// banList is temporary bans of IP address until expiry
+type banList struct {
+	// n is number of bans, contains skips locking if it's 0
+	n   int32
+	mu  sync.RWMutex
+	ban map[string]time.Time
+}
+
+func newBanList() *banList {
+	return &banList{ban: map[string]time.Time{}}
+}
+
+func banKey(ip net.IP) string {
+	return string(ip.To16())
+}
+
+// add bans ip until expire, returns false if ip is banned longer.
+func (b *banList) add(ip net.IP, expire time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	k := banKey(ip)
+	if old, ok := b.ban[k]; ok && !old.Before(expire) {
+		return false
+	}
+	b.ban[k] = expire
+	atomic.StoreInt32(&b.n, int32(len(b.ban)))
+	return true
+}
+
+func (b *banList) contains(ip net.IP) bool {
+	if b == nil || atomic.LoadInt32(&b.n) == 0 {
+		return false
+	}
+	b.mu.RLock()
+	expire, ok := b.ban[banKey(ip)]
+	b.mu.RUnlock()
+	return ok && time.Now().Before(expire)
+}
+
+func (b *banList) len() int {
+	if b == nil {
+		return 0
+	}
+	return int(atomic.LoadInt32(&b.n))
+}
+
+// reap removes bans expired at now and returns their addresses
+func (b *banList) reap(now time.Time) (lifted []net.IP) {
+	if b.len() == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for k, expire := range b.ban {
+		if !now.Before(expire) {
+			delete(b.ban, k)
+			lifted = append(lifted, net.IP(k))
+		}
 	}
+	atomic.StoreInt32(&b.n, int32(len(b.ban)))
+	return
 }
 
 func newStaticSegTree(nl []*net.IPNet) (snl []*cidrItem, err error) {
@@ -188,8 +374,11 @@ func ipLess(a, b net.IP) bool {
 	return al < bl
 }
 
+// cidrItem is a node of segment tree, cidr is ipnet in string as
+// label of hit counter
 type cidrItem struct {
 	ipnet        *net.IPNet
+	cidr         string
 	left, right  net.IP
 	mid6L, mid6H uint64
 	mid4         uint32
@@ -198,27 +387,28 @@ type cidrItem struct {
 func newSegNode(ipnet *net.IPNet) (n *cidrItem) {
 
 	l, r := subNet(ipnet)
-	n = &cidrItem{ipnet: ipnet, left: l, right: r}
+	n = &cidrItem{ipnet: ipnet, cidr: ipnet.String(), left: l, right: r}
 	if l.To4() != nil {
 		low := ipToUint32(l)
 		n.mid4 = (ipToUint32(r)-low)/2 + low
 		return
 	}
-	ln := binary.BigEndian.Uint64([]byte(l)[:8])
-	rn := binary.BigEndian.Uint64([]byte(r)[:8])
-	carry := rn < ln
-	if carry {
-		n.mid6L = (uint64Full-ln+1+rn)/2 + ln
-	} else {
-		n.mid6L = (rn-ln)/2 + ln
+	// mid = l + (r-l)/2 in 128 bits
+	ll, lh := ipToUInt128(l)
+	rl, rh := ipToUInt128(r)
+	dl := rl - ll
+	dh := rh - lh
+	if rl < ll {
+		dh--
 	}
+	hl := dl>>1 | dh<<63
+	hh := dh >> 1
 
-	ln = binary.BigEndian.Uint64([]byte(l)[8:])
-	rn = binary.BigEndian.Uint64([]byte(r)[8:])
-	if carry {
-		rn -= 1
+	n.mid6L = ll + hl
+	n.mid6H = lh + hh
+	if n.mid6L < ll {
+		n.mid6H++
 	}
-	n.mid6H = (rn-ln)/2 + ln
 	return
 }
 
@@ -235,3 +425,76 @@ func (b byIP) Swap(i, j int) {
 func (b byIP) Len() (i int) {
 	return len(b)
 }
+
+// restrict actions, from the most permissive
+const (
+	restrictAllow uint8 = iota
+	restrictNoControl
+	restrictNoServe
+	restrictIgnore
+)
+
+var restrictActions = map[string]uint8{
+	"allow":     restrictAllow,
+	"nocontrol": restrictNoControl,
+	"noserve":   restrictNoServe,
+	"ignore":    restrictIgnore,
+}
+
+type restrictRule struct {
+	net    *net.IPNet
+	action uint8
+	// cidr and name label hit counter of rule
+	cidr, name string
+}
+
+// restrictTable is evaluated in order, rules are few so it's a plain
+// list instead of segment tree of dropTable.
+type restrictTable struct {
+	rules []restrictRule
+	def   restrictRule
+}
+
+func newRestrictTable(rules []RestrictRule, def string) (t *restrictTable, err error) {
+	t = &restrictTable{}
+	if def == "" {
+		def = "allow"
+	}
+	action, ok := restrictActions[def]
+	if !ok {
+		err = fmt.Errorf("unknown action %q", def)
+		return
+	}
+	t.def = restrictRule{action: action, cidr: "default", name: def}
+
+	for _, r := range rules {
+		rule := restrictRule{cidr: r.CIDR, name: r.Action}
+		rule.action, ok = restrictActions[r.Action]
+		if !ok {
+			err = fmt.Errorf("%s: unknown action %q", r.CIDR, r.Action)
+			return
+		}
+		_, rule.net, err = net.ParseCIDR(r.CIDR)
+		if err != nil {
+			return
+		}
+		t.rules = append(t.rules, rule)
+	}
+	return
+}
+
+// enabled is false if every request is allowed, so handler can skip
+// matching and hit counter.
+func (t *restrictTable) enabled() bool {
+	return t != nil && (len(t.rules) > 0 || t.def.action != restrictAllow)
+}
+
+// match returns the first rule containing ip or the default rule
+func (t *restrictTable) match(ip net.IP) *restrictRule {
+	for i := range t.rules {
+		if t.rules[i].net.Contains(ip) {
+			return &t.rules[i]
+		}
+	}
+	return &t.def
+}
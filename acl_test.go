@@ -1,8 +1,13 @@
 package gontpd
 
 import (
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestSubNet(t *testing.T) {
@@ -77,3 +82,206 @@ func BenchmarkDropTableMulti(b *testing.B) {
 		dt.contains(ip)
 	}
 }
+
+func TestDropTableMixed(t *testing.T) {
+	dt, err := newDropTable([]string{
+		"10.0.0.0/8", "2001:db8::/32", "192.168.0.0/16", "fc00::/7",
+		"2001:df6:f400::/48", "fe80::1/128",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gold := []struct {
+		ip string
+		in bool
+	}{
+		{"10.1.2.3", true},
+		{"192.168.7.7", true},
+		{"11.1.2.3", false},
+		{"2001:db8::1", true},
+		{"2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", true},
+		{"2001:db9::1", false},
+		{"fd00::1", true},
+		{"2001:df6:f400:1::1", true},
+		{"2001:df6:f401::1", false},
+		{"fe80::1", true},
+		{"fe80::2", false},
+		{"::ffff:10.1.2.3", true},
+		{"2400::1", false},
+	}
+
+	for _, g := range gold {
+		ip := net.ParseIP(g.ip)
+		if dt.contains(ip) != g.in {
+			t.Errorf("table contains:%s expect:%v got:%v", ip, g.in, !g.in)
+		}
+	}
+}
+
+func TestSegNodeMid6(t *testing.T) {
+	_, n, _ := net.ParseCIDR("2001:db8::/32")
+	item := newSegNode(n)
+	mid := net.ParseIP("2001:db8:7fff:ffff:ffff:ffff:ffff:ffff")
+	l, h := ipToUInt128(mid)
+	if item.mid6L != l || item.mid6H != h {
+		t.Errorf("mid=%x%x expect %s", item.mid6H, item.mid6L, mid)
+	}
+}
+
+func TestRestrictTable(t *testing.T) {
+	rt, err := newRestrictTable([]RestrictRule{
+		{"10.1.0.0/16", "ignore"},
+		{"10.0.0.0/8", "allow"},
+		{"192.0.2.0/24", "nocontrol"},
+		{"2001:db8::/32", "noserve"},
+	}, "ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		ip     string
+		action uint8
+		cidr   string
+	}{
+		{"10.1.2.3", restrictIgnore, "10.1.0.0/16"},
+		{"10.2.3.4", restrictAllow, "10.0.0.0/8"},
+		{"192.0.2.1", restrictNoControl, "192.0.2.0/24"},
+		{"2001:db8::1", restrictNoServe, "2001:db8::/32"},
+		{"198.51.100.1", restrictIgnore, "default"},
+	} {
+		r := rt.match(net.ParseIP(c.ip))
+		if r.action != c.action || r.cidr != c.cidr {
+			t.Errorf("%s: got %s %s, want %d of %s", c.ip, r.cidr, r.name, c.action, c.cidr)
+		}
+	}
+
+	empty, err := newRestrictTable(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.enabled() {
+		t.Error("empty table with allow default is enabled")
+	}
+
+	for _, c := range []struct {
+		rules []RestrictRule
+		def   string
+	}{
+		{nil, "deny"},
+		{[]RestrictRule{{"10.0.0.0/8", "limited"}}, ""},
+		{[]RestrictRule{{"10.0.0.0", "allow"}}, ""},
+	} {
+		if _, err = newRestrictTable(c.rules, c.def); err == nil {
+			t.Errorf("no error on %v default %q", c.rules, c.def)
+		}
+	}
+}
+
+func TestDropTableBan(t *testing.T) {
+	dt, err := newDropTable([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	banned := net.ParseIP("192.0.2.1")
+	expired := net.ParseIP("2001:db8::1")
+	dt.BanFor(banned, time.Hour)
+	dt.bans.add(expired, time.Now().Add(-time.Second))
+
+	for _, c := range []struct {
+		ip string
+		in bool
+	}{
+		{"10.0.0.1", true},
+		{"192.0.2.1", true},
+		{"::ffff:192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"2001:db8::1", false},
+	} {
+		if dt.contains(net.ParseIP(c.ip)) != c.in {
+			t.Errorf("contains %s, expect %v", c.ip, c.in)
+		}
+	}
+
+	// shorter ban doesn't shorten the existing one
+	dt.BanFor(banned, time.Second)
+	lifted := dt.bans.reap(time.Now().Add(time.Minute))
+	if len(lifted) != 1 || !lifted[0].Equal(expired) {
+		t.Errorf("lifted %v", lifted)
+	}
+	if n := dt.bans.len(); n != 1 {
+		t.Errorf("%d bans left", n)
+	}
+}
+
+func TestLoadDropFile(t *testing.T) {
+	path := writeTemp(t, "drop.list", `# feed
+10.0.0.0/8
+10.1.0.0/16   # nested
+192.0.2.1
+not a cidr
+2001:db8::/32
+2001:db8::5
+198.51.100.0/33
+
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cidr, mod, err := loadDropFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mod.IsZero() {
+		t.Error("no modification time")
+	}
+	want := []string{"10.0.0.0/8", "10.1.0.0/16", "192.0.2.1/32", "2001:db8::/32", "2001:db8::5/128"}
+	if !reflect.DeepEqual(cidr, want) {
+		t.Fatalf("got %v, want %v", cidr, want)
+	}
+
+	dt, _, err := loadDropTable(&Config{DropCIDR: []string{"172.16.0.0/12", "10.2.0.0/16"}, DropFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"10.0.0.0/8", "172.16.0.0/12", "192.0.2.1/32", "2001:db8::/32"}
+	if !reflect.DeepEqual(dt.CIDR, want) {
+		t.Errorf("got %v, want %v", dt.CIDR, want)
+	}
+	for _, ip := range []string{"10.2.3.4", "172.16.0.1", "192.0.2.1", "2001:db8::5"} {
+		if !dt.contains(net.ParseIP(ip)) {
+			t.Errorf("%s is not dropped", ip)
+		}
+	}
+
+	if _, _, err = loadDropFile(path + ".missing"); err == nil {
+		t.Error("missing file loaded")
+	}
+}
+
+func TestCheckDropFile(t *testing.T) {
+	path := writeTemp(t, "drop.list", "10.0.0.0/8\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	d, err := New(&Config{PeerList: Peers("127.0.0.1"), DropFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	banned := net.ParseIP("203.0.113.1")
+	d.BanFor(banned, time.Hour)
+	if !d.drops().contains(net.IP{10, 0, 0, 1}) {
+		t.Fatal("drop file not loaded")
+	}
+
+	if err = ioutil.WriteFile(path, []byte("192.0.2.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// modification time may not change within its resolution
+	later := time.Now().Add(time.Minute)
+	if err = os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	d.checkDropFile()
+	if dt := d.drops(); dt.contains(net.IP{10, 0, 0, 1}) ||
+		!dt.contains(net.IP{192, 0, 2, 1}) || !dt.contains(banned) {
+		t.Errorf("drop table not reloaded: %v", dt.CIDR)
+	}
+}
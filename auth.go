@@ -0,0 +1,168 @@
+package gontpd
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const keyIDSize = 4
+
+type symKey struct {
+	id      uint32
+	newHash func() hash.Hash
+	size    int
+	key     []byte
+}
+
+// keyTable holds trusted symmetric keys indexed by key id
+type keyTable map[uint32]*symKey
+
+// loadKeyFile reads a ntp.keys style file, only trusted keys are kept.
+// All keys in the file are trusted if trusted is empty.
+func loadKeyFile(path string, trusted []uint32) (kt keyTable, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return parseKeys(f, trusted)
+}
+
+// parseKeys parses lines in format of "keyid type key", # starts a comment.
+// Keys longer than 20 characters are hex encoded.
+func parseKeys(r io.Reader, trusted []uint32) (kt keyTable, err error) {
+	all := keyTable{}
+	sc := bufio.NewScanner(r)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := sc.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 {
+			err = fmt.Errorf("line %d: expect \"keyid type key\"", line)
+			return
+		}
+
+		var k *symKey
+		k, err = newSymKey(fields[0], fields[1], fields[2])
+		if err != nil {
+			err = fmt.Errorf("line %d: %s", line, err)
+			return
+		}
+		all[k.id] = k
+	}
+	if err = sc.Err(); err != nil {
+		return
+	}
+
+	if len(trusted) == 0 {
+		kt = all
+		return
+	}
+
+	kt = keyTable{}
+	for _, id := range trusted {
+		k, ok := all[id]
+		if !ok {
+			err = fmt.Errorf("trusted key %d not found", id)
+			return
+		}
+		kt[id] = k
+	}
+	return
+}
+
+func newSymKey(id, typ, key string) (k *symKey, err error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return
+	}
+	if n == 0 {
+		err = fmt.Errorf("key id 0 is reserved")
+		return
+	}
+	k = &symKey{id: uint32(n)}
+
+	switch strings.ToUpper(typ) {
+	case "M", "MD5":
+		k.newHash, k.size = md5.New, md5.Size
+	case "SHA", "SHA1":
+		k.newHash, k.size = sha1.New, sha1.Size
+	default:
+		err = fmt.Errorf("unsupported key type %s", typ)
+		return
+	}
+
+	if len(key) > 20 {
+		k.key, err = hex.DecodeString(key)
+		return
+	}
+	k.key = []byte(key)
+	return
+}
+
+// digest computes hash(key || header) per RFC 5905 Appendix A.
+func (k *symKey) digest(dst, header []byte) []byte {
+	h := k.newHash()
+	h.Write(k.key)
+	h.Write(header)
+	return h.Sum(dst)
+}
+
+// hasMAC reports if a packet with length n carries a MAC field
+// right after header.
+func hasMAC(n int) bool {
+	return isMACSize(n - headerSize)
+}
+
+// isMACSize reports if n is length of key id and MAC
+func isMACSize(n int) bool {
+	n -= keyIDSize
+	return n == md5.Size || n == sha1.Size
+}
+
+// verify checks the MAC of the packet p, returns the key used
+// or nil if key is not trusted or digest mismatch.
+// MAC covers header and extension fields.
+func (kt keyTable) verify(p []byte) *symKey {
+	_, mac, err := extensions(p)
+	if err != nil || mac == len(p) {
+		return nil
+	}
+	id := binary.BigEndian.Uint32(p[mac:])
+	k, ok := kt[id]
+	if !ok || mac+keyIDSize+k.size != len(p) {
+		return nil
+	}
+
+	var buf [sha1.Size]byte
+	sum := k.digest(buf[:0], p[:mac])
+	if !hmac.Equal(sum, p[mac+keyIDSize:]) {
+		return nil
+	}
+	return k
+}
+
+// sign appends key id and MAC of the header to p, p should have
+// enough capacity, returns the length of signed packet.
+func (k *symKey) sign(p []byte) int {
+	setUint32(p, headerSize, k.id)
+	k.digest(p[headerSize+keyIDSize:headerSize+keyIDSize], p[:headerSize])
+	return headerSize + keyIDSize + k.size
+}
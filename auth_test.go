@@ -0,0 +1,79 @@
+package gontpd
+
+import (
+	"strings"
+	"testing"
+)
+
+const testKeys = `
+# ntp.keys
+1 M  plaintext
+2 MD5 0123456789abcdef0123456789abcdef
+3 SHA1 0123456789abcdef0123456789abcdef01234567 # hex
+`
+
+func TestParseKeys(t *testing.T) {
+	kt, err := parseKeys(strings.NewReader(testKeys), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kt) != 3 {
+		t.Fatalf("expect 3 keys got %d", len(kt))
+	}
+	if string(kt[1].key) != "plaintext" {
+		t.Errorf("key 1=%q", kt[1].key)
+	}
+	if len(kt[2].key) != 16 || len(kt[3].key) != 20 {
+		t.Errorf("hex key not decoded %d %d", len(kt[2].key), len(kt[3].key))
+	}
+
+	kt, err = parseKeys(strings.NewReader(testKeys), []uint32{3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kt[1]; ok || len(kt) != 1 {
+		t.Errorf("untrusted key loaded: %v", kt)
+	}
+
+	_, err = parseKeys(strings.NewReader(testKeys), []uint32{4})
+	if err == nil {
+		t.Error("missing trusted key should fail")
+	}
+
+	for _, bad := range []string{"1 M", "0 M key", "1 RC4 key", "x M key", "1 M zz0123456789abcdef0123"} {
+		if _, err = parseKeys(strings.NewReader(bad), nil); err == nil {
+			t.Errorf("%q should fail", bad)
+		}
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	kt, err := parseKeys(strings.NewReader(testKeys), []uint32{1, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []uint32{1, 3} {
+		p := make([]byte, maxPacketSize)
+		copy(p, newTestRequest())
+		n := kt[id].sign(p)
+		if !hasMAC(n) {
+			t.Fatalf("key %d signed length %d", id, n)
+		}
+		if k := kt.verify(p[:n]); k == nil || k.id != id {
+			t.Errorf("key %d verify failed", id)
+		}
+
+		p[transmitTimeStamp] ^= 1
+		if k := kt.verify(p[:n]); k != nil {
+			t.Errorf("key %d tampered packet passed", id)
+		}
+	}
+
+	all, _ := parseKeys(strings.NewReader(testKeys), nil)
+	p := make([]byte, maxPacketSize)
+	n := all[2].sign(p)
+	if k := kt.verify(p[:n]); k != nil {
+		t.Error("untrusted key passed")
+	}
+}
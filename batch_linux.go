@@ -0,0 +1,95 @@
+package gontpd
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const batchSupported = true
+
+// batchConn is implemented by ipv4.PacketConn and ipv6.PacketConn,
+// both use recvmmsg and sendmmsg on Linux.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(conn *net.UDPConn) batchConn {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		return ipv4.NewPacketConn(conn)
+	}
+	return ipv6.NewPacketConn(conn)
+}
+
+// workBatch reads up to BatchSize packets per recvmmsg, answers them
+// with one sendmmsg. Responses are built in place so each response is
+// paired with the source address of its request.
+func (w *worker) workBatch() {
+	bc := newBatchConn(w.conn)
+	size := w.d.cfg.BatchSize
+	rms := make([]ipv4.Message, size)
+	wms := make([]ipv4.Message, size)
+	stamp := make([]bool, size)
+	received := make([]time.Time, size)
+	for i := range rms {
+		bp := bufPool.Get().(*[]byte)
+		defer bufPool.Put(bp)
+		rms[i].Buffers = [][]byte{*bp}
+		rms[i].OOB = make([]byte, oobSize)
+		wms[i].Buffers = [][]byte{nil}
+	}
+
+	for {
+		n, err := bc.ReadBatch(rms, 0)
+		if err != nil {
+			return
+		}
+
+		wn := 0
+		for i := 0; i < n; i++ {
+			m := &rms[i]
+			raddr, ok := m.Addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			p := m.Buffers[0]
+			// packet without kernel timestamp is late by its waiting
+			// time in socket buffer
+			rt := w.receiveTime(m.OOB[:m.NN])
+			rn, st := w.handleSafe(p, m.N, raddr, rt)
+			if rn == 0 {
+				continue
+			}
+			// response is written in place of request
+			wms[wn].Buffers[0] = p[:rn]
+			wms[wn].Addr = raddr
+			stamp[wn] = st
+			received[wn] = rt
+			wn++
+		}
+
+		for i := 0; i < wn; i++ {
+			if stamp[i] {
+				stampTransmit(wms[i].Buffers[0])
+			}
+		}
+
+		for sent := 0; sent < wn; sent += n {
+			n, err = bc.WriteBatch(wms[sent:wn], 0)
+			if err != nil {
+				if debug {
+					logger().Debugf("worker: %s write batch failed. %s", w.id, err)
+				}
+				break
+			}
+			now := time.Now()
+			for i, m := range wms[sent : sent+n] {
+				w.responded(received[sent+i], now)
+				w.sent(m.Buffers[0], m.Addr.(*net.UDPAddr).IP, now)
+			}
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package gontpd
+
+const batchSupported = false
+
+func (w *worker) workBatch() {
+	w.workSingle()
+}
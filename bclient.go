@@ -0,0 +1,311 @@
+package gontpd
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/beevik/ntp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// defaultBroadcastGroup is the IPv4 multicast group of NTP
+const defaultBroadcastGroup = "224.0.1.1"
+
+// calibration state of broadcast server
+const (
+	bcastUncalibrated uint8 = iota
+	bcastCalibrating
+	bcastCalibrated
+)
+
+// bcastState is samples of a broadcast server and its calibration,
+// guarded by mu of sampleBuf.
+type bcastState struct {
+	sampleBuf
+	// delay is round trip measured by client mode query, broadcast
+	// packet itself has no way to tell it.
+	delay time.Duration
+	state uint8
+}
+
+// sampleBuf is samples pushed by receiver instead of polled, they are
+// taken by poll so it's guarded by mu.
+type sampleBuf struct {
+	mu sync.Mutex
+	// samples are the last replyNum samples, fresh is set if any of
+	// them is received since last poll
+	samples []*ntp.Response
+	fresh   bool
+}
+
+// add appends sample unless it's a copy of the last one, the same packet
+// is received by every socket of the port, and refclock may not be
+// updated since last read.
+func (b *sampleBuf) add(resp *ntp.Response) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n := len(b.samples); n > 0 && b.samples[n-1].Time.Equal(resp.Time) {
+		return
+	}
+	b.samples = append(b.samples, resp)
+	if len(b.samples) > replyNum {
+		b.samples = b.samples[1:]
+	}
+	b.fresh = true
+}
+
+// clear drops all samples, they are taken before clock is stepped
+func (b *sampleBuf) clear() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.samples = nil
+	b.fresh = false
+}
+
+// take returns a copy of samples and whether any is new since last take
+func (b *sampleBuf) take() (samples []*ntp.Response, fresh bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	samples = append(samples, b.samples...)
+	fresh = b.fresh
+	b.fresh = false
+	return
+}
+
+// pushed returns samples of peer if they are pushed instead of polled
+func (p *peer) pushed() *sampleBuf {
+	switch {
+	case p.bcast != nil:
+		return &p.bcast.sampleBuf
+	case p.refclock != nil:
+		return &p.refclock.sampleBuf
+	}
+	return nil
+}
+
+// updateSamples takes samples pushed by broadcast server or refclock
+// instead of querying it, samples are checked by maxstd as update.
+// Samples are taken until replaced, so only those newer than the last
+// one of peer are shifted into clock filter. Samples are left for the
+// next poll if ctx is done.
+func (p *peer) updateSamples(ctx context.Context, maxstd time.Duration, fp filterParams, buf *sampleBuf) {
+	if ctx.Err() != nil {
+		return
+	}
+	p.good, p.noisy = false, false
+	defer func() { p.shiftReach(p.good) }()
+	p.polls++
+
+	samples, fresh := buf.take()
+	if !fresh || len(samples) < goodFilter {
+		if debug {
+			logger().Debugf("peer:%s has %d pushed samples, fresh=%v",
+				p.addr, len(samples), fresh)
+		}
+		return
+	}
+
+	goodList := make([]time.Duration, 0, len(samples))
+	for _, s := range samples {
+		goodList = append(goodList, s.ClockOffset)
+	}
+	if sd := stddev(goodList); maxstd < sd {
+		logger().Warnf("peer:%s stddev out of range:%s", p.addr.String(), sd)
+		p.noisy = true
+		return
+	}
+
+	var last time.Time
+	if n := len(p.samples); n > 0 {
+		last = p.samples[n-1].resp.Time
+	}
+	now := time.Now()
+	for i, s := range samples {
+		if s.Time.After(last) {
+			p.addSamples(samples[i:], now, fp)
+			break
+		}
+	}
+	// delay is the same for every sample, the latest one is the best
+	p.good = true
+	p.filter(now, fp)
+}
+
+// broadcastPeer returns peer of broadcast server at ip, new peer is
+// added on first packet. nil is returned if ip is a unicast peer or
+// there is no room for it.
+func (d *NTPd) broadcastPeer(ip net.IP) *peer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, p := range d.peerList {
+		if !p.addr.Equal(ip) {
+			continue
+		}
+		if p.bcast == nil {
+			return nil
+		}
+		return p
+	}
+	if len(d.peerList) >= d.cfg.MaxPeers {
+		if debug {
+			logger().Debugf("broadcast: %s skipped, max %d peers", ip, d.cfg.MaxPeers)
+		}
+		return nil
+	}
+	p := newPeer("broadcast", ip)
+	p.bcast = &bcastState{}
+	// peerList is copied since snapshots may be in use
+	d.peerList = append(append([]*peer{}, d.peerList...), p)
+	return p
+}
+
+// receiveBroadcast turns broadcast packet p from src received at rt into
+// sample of its peer. Packets are ignored until the delay to the server
+// is calibrated.
+func (d *NTPd) receiveBroadcast(p []byte, src net.IP, rt time.Time) {
+	if len(p) < headerSize || getMode(p) != modeBroadcast ||
+		getVersion(p) < d.config().MinVersion {
+		return
+	}
+	li := p[liVnModePos] >> 6
+	stratum := p[stratumPos]
+	if li == notSync || stratum == 0 || stratum >= invalidStratum {
+		return
+	}
+
+	peer := d.broadcastPeer(src)
+	if peer == nil {
+		return
+	}
+	b := peer.bcast
+	b.mu.Lock()
+	state, delay := b.state, b.delay
+	if state == bcastUncalibrated {
+		b.state = bcastCalibrating
+	}
+	b.mu.Unlock()
+	switch state {
+	case bcastUncalibrated:
+		go d.calibrate(peer)
+		return
+	case bcastCalibrating:
+		return
+	}
+
+	t3 := fromNtpTime(binary.BigEndian.Uint64(p[transmitTimeStamp:]))
+	b.add(&ntp.Response{
+		Time:           t3,
+		ClockOffset:    t3.Sub(rt) + delay/2,
+		RTT:            delay,
+		Precision:      log2Duration(int8(p[clockPrecisionPos])),
+		Stratum:        stratum,
+		ReferenceID:    binary.BigEndian.Uint32(p[referIDPos:]),
+		ReferenceTime:  fromNtpTime(binary.BigEndian.Uint64(p[referenceTimeStamp:])),
+		RootDelay:      fromNtpShortTime(binary.BigEndian.Uint32(p[rootDelayPos:])),
+		RootDispersion: fromNtpShortTime(binary.BigEndian.Uint32(p[rootDispersionPos:])),
+		Leap:           ntp.LeapIndicator(li),
+		Poll:           log2Duration(int8(p[pollPos])),
+	})
+}
+
+// calibrate measures round trip to broadcast server by client mode
+// query, it's retried on next broadcast if it fails.
+func (d *NTPd) calibrate(p *peer) {
+	cfg := d.config()
+	opt := d.queryOptions(&cfg, p.addr)
+	ctx, cancel := context.WithTimeout(context.Background(), opt.Timeout)
+	resp, err := p.queryContext(ctx, opt)
+	cancel()
+	if err == nil {
+		err = resp.Validate()
+	}
+
+	b := p.bcast
+	b.mu.Lock()
+	if err != nil {
+		b.state = bcastUncalibrated
+	} else {
+		b.state, b.delay = bcastCalibrated, resp.RTT
+	}
+	b.mu.Unlock()
+	if err != nil {
+		logger().Warnf("broadcast: calibrate %s failed: %s", p.addr, err)
+		return
+	}
+	logger().Infof("broadcast: %s calibrated, delay %s", p.addr, resp.RTT)
+}
+
+// broadcastGroups returns multicast groups joined by broadcast client
+func broadcastGroups(cfg *Config) (groups []net.IP) {
+	names := cfg.BroadcastGroups
+	if len(names) == 0 {
+		names = []string{defaultBroadcastGroup}
+	}
+	for _, s := range names {
+		if ip := net.ParseIP(s); ip != nil {
+			groups = append(groups, ip)
+		}
+	}
+	return
+}
+
+// joinGroups joins multicast groups on conn, groups of the other family
+// are skipped.
+func joinGroups(conn *net.UDPConn, groups []net.IP) {
+	local, _ := conn.LocalAddr().(*net.UDPAddr)
+	for _, g := range groups {
+		var err error
+		switch {
+		case g.To4() != nil:
+			err = ipv4.NewPacketConn(conn).JoinGroup(nil, &net.UDPAddr{IP: g})
+		case local != nil && local.IP.To4() == nil:
+			err = ipv6.NewPacketConn(conn).JoinGroup(nil, &net.UDPAddr{IP: g})
+		default:
+			continue
+		}
+		if err != nil {
+			logger().Warnf("broadcast: join %s on %s failed: %s", g, conn.LocalAddr(), err)
+			continue
+		}
+		logger().Infof("broadcast: joined %s on %s", g, conn.LocalAddr())
+	}
+}
+
+// broadcastClientLoop receives broadcast packets at BroadcastListen, it's
+// only used when server is disabled, otherwise they are received by
+// server sockets.
+func (d *NTPd) broadcastClientLoop(ctx context.Context, conn *net.UDPConn) {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	p := make([]byte, maxPacketSize)
+	for {
+		n, raddr, err := conn.ReadFromUDP(p)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger().Errorf("broadcast: %s", err)
+			}
+			return
+		}
+		d.receiveBroadcast(p[:n], raddr.IP, time.Now())
+	}
+}
+
+// listenBroadcast opens broadcast client socket on addr and joins groups
+func (d *NTPd) listenBroadcast(addr string, groups []net.IP) (conn *net.UDPConn, err error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return
+	}
+	conn, err = net.ListenUDP(listenNetwork(addr), laddr)
+	if err != nil {
+		return
+	}
+	joinGroups(conn, groups)
+	return
+}
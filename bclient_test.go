@@ -0,0 +1,146 @@
+package gontpd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+// newTestBroadcast builds broadcast packet of server whose clock is
+// ahead by offset, sent at t3 of server clock.
+func newTestBroadcast(t3 time.Time) []byte {
+	s := newTestNTPd(&Config{})
+	s.setLocalTemplate(1, loclRefer, t3)
+	s.synced = true
+	p, _ := s.broadcastPacket(t3, 64*time.Second)
+	return p
+}
+
+func TestReceiveBroadcast(t *testing.T) {
+	ms := time.Millisecond
+	d := newTestNTPd(&Config{BroadcastClient: true})
+	src := net.ParseIP("192.0.2.1")
+
+	calibrated := make(chan struct{})
+	p := d.broadcastPeer(src)
+	p.query = func(addr string, opt ntp.QueryOptions) (*ntp.Response, error) {
+		defer close(calibrated)
+		return &ntp.Response{Stratum: 1, RTT: 20 * ms}, nil
+	}
+
+	// offset of server is 100ms, one way delay is 10ms
+	now := time.Now()
+	d.receiveBroadcast(newTestBroadcast(now.Add(90*ms)), src, now)
+	select {
+	case <-calibrated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not calibrated")
+	}
+	for {
+		p.bcast.mu.Lock()
+		state := p.bcast.state
+		p.bcast.mu.Unlock()
+		if state == bcastCalibrated {
+			break
+		}
+		time.Sleep(ms)
+	}
+
+	for i := 0; i < replyNum; i++ {
+		rt := now.Add(time.Duration(i) * 64 * time.Second)
+		pkt := newTestBroadcast(rt.Add(90 * ms))
+		d.receiveBroadcast(pkt, src, rt)
+		// copy from another socket of the port
+		d.receiveBroadcast(pkt, src, rt.Add(ms))
+	}
+	if n := len(p.bcast.samples); n != replyNum {
+		t.Fatalf("got %d samples", n)
+	}
+
+	p.updateSamples(context.Background(), 50*ms, testFilter, p.pushed())
+	if !p.good || p.reach != 1 {
+		t.Fatalf("good=%v reach=%d", p.good, p.reach)
+	}
+	if diff := absDuration(p.offset - 100*ms); diff > ms {
+		t.Errorf("offset=%s, want 100ms", p.offset)
+	}
+	if p.delay != 20*ms || p.stratum != 1 {
+		t.Errorf("delay=%s stratum=%d", p.delay, p.stratum)
+	}
+
+	// broadcast peer is a candidate of selection
+	op := d.find()
+	if op == nil || op.peer != p {
+		t.Fatalf("broadcast peer not selected: %v", op)
+	}
+
+	// nothing new since last poll
+	p.updateSamples(context.Background(), 50*ms, testFilter, p.pushed())
+	if p.good {
+		t.Error("good without fresh sample")
+	}
+}
+
+func TestReceiveBroadcastIgnored(t *testing.T) {
+	unicast := newTestPeer("192.0.2.2", 0, time.Millisecond)
+	d := newTestNTPd(&Config{BroadcastClient: true, MaxPeers: 2}, unicast)
+	now := time.Now()
+
+	unsync := newTestBroadcast(now)
+	setLi(unsync, notSync)
+	client := newTestBroadcast(now)
+	setMode(client, modeClient)
+	for _, c := range []struct {
+		name string
+		p    []byte
+		src  string
+	}{
+		{"unsynchronized", unsync, "192.0.2.1"},
+		{"client mode", client, "192.0.2.1"},
+		{"short", newTestBroadcast(now)[:40], "192.0.2.1"},
+		{"unicast peer", newTestBroadcast(now), "192.0.2.2"},
+	} {
+		d.receiveBroadcast(c.p, net.ParseIP(c.src), now)
+		if n := len(d.peers()); n != 1 {
+			t.Errorf("%s: %d peers", c.name, n)
+		}
+	}
+
+	// max peers
+	d.receiveBroadcast(newTestBroadcast(now), net.ParseIP("192.0.2.3"), now)
+	d.receiveBroadcast(newTestBroadcast(now), net.ParseIP("192.0.2.4"), now)
+	if n := len(d.peers()); n != 2 {
+		t.Errorf("%d peers, max 2", n)
+	}
+}
+
+func TestHandleBroadcast(t *testing.T) {
+	d := newTestNTPd(&Config{BroadcastClient: true})
+	w := &worker{lru: newLRU(0), d: d}
+	raddr := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 123}
+
+	p := make([]byte, maxPacketSize)
+	copy(p, newTestBroadcast(time.Now()))
+	if n, _ := w.handle(p, headerSize, raddr, time.Now()); n != 0 {
+		t.Errorf("got %d bytes response to broadcast", n)
+	}
+	if peers := d.peers(); len(peers) != 1 || peers[0].bcast == nil {
+		t.Errorf("broadcast server not added: %v", peers)
+	}
+}
+
+func TestMergePeersKeepBroadcast(t *testing.T) {
+	d := newTestNTPd(&Config{BroadcastClient: true})
+	b := d.broadcastPeer(net.ParseIP("192.0.2.1"))
+	peers, _, removed := mergePeers(d.peers(),
+		map[string][]net.IP{"a": {net.ParseIP("192.0.2.9")}}, defaultMaxPeers)
+	if len(peers) != 2 || len(removed) != 0 {
+		t.Fatalf("peers=%d removed=%d", len(peers), len(removed))
+	}
+	if peers[1] != b {
+		t.Error("broadcast peer replaced")
+	}
+}
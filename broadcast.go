@@ -0,0 +1,97 @@
+package gontpd
+
+import (
+	"context"
+	"math"
+	"net"
+	"syscall"
+	"time"
+)
+
+// broadcastPacket builds mode 5 packet from template at now, ok is false
+// if clock isn't synchronized so that bad time is never broadcast.
+func (d *NTPd) broadcastPacket(now time.Time, interval time.Duration) (p []byte, ok bool) {
+	p = make([]byte, headerSize)
+	copy(p, d.loadTemplate())
+	d.mu.RLock()
+	synced := d.synced
+	d.mu.RUnlock()
+
+	if !synced || p[liVnModePos]>>6 == notSync ||
+		p[stratumPos] == 0 || p[stratumPos] >= invalidStratum {
+		return
+	}
+	setMode(p, modeBroadcast)
+	setInt8(p, pollPos, int8(math.Round(math.Log2(interval.Seconds()))))
+	// broadcast has no request to echo
+	setUint64(p, originTimeStamp, 0)
+	setUint64(p, receiveTimeStamp, 0)
+	setUint64(p, transmitTimeStamp, toNtpTime(now))
+	ok = true
+	return
+}
+
+// dialBroadcast opens socket to addr with SO_BROADCAST, marked with dscp
+func dialBroadcast(addr string, dscp uint8) (conn *net.UDPConn, err error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return
+	}
+	network := "udp6"
+	if raddr.IP.To4() != nil {
+		network = "udp4"
+	}
+	dialer := net.Dialer{
+		Control: func(network, _ string, c syscall.RawConn) (err error) {
+			var operr error
+			err = c.Control(func(fd uintptr) {
+				if network == "udp4" {
+					operr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+				}
+				if operr == nil && dscp != 0 {
+					operr = setDSCP(int(fd), network, dscp)
+				}
+			})
+			if err == nil {
+				err = operr
+			}
+			return
+		},
+	}
+	c, err := dialer.Dial(network, raddr.String())
+	if err != nil {
+		return
+	}
+	conn = c.(*net.UDPConn)
+	return
+}
+
+// broadcastLoop sends broadcast packet to BroadcastAddr every
+// BroadcastInterval, it runs regardless of the unicast server.
+func (d *NTPd) broadcastLoop(ctx context.Context) {
+	cfg := d.config()
+	conn, err := dialBroadcast(cfg.BroadcastAddr, cfg.DSCP)
+	if err != nil {
+		logger().Errorf("broadcast: %s", err)
+		return
+	}
+	defer conn.Close()
+	logger().Infof("broadcast to %s every %s", cfg.BroadcastAddr, cfg.BroadcastInterval)
+
+	for sleepContext(ctx, cfg.BroadcastInterval) == nil {
+		p, ok := d.broadcastPacket(time.Now(), cfg.BroadcastInterval)
+		if !ok {
+			if debug {
+				logger().Debugf("broadcast: clock unsynchronized, skipped")
+			}
+			continue
+		}
+		if _, err = conn.Write(p); err != nil {
+			logger().Warnf("broadcast: %s", err)
+			continue
+		}
+		if d.stat != nil {
+			d.stat.broadcastCounter.Inc()
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package gontpd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBroadcastPacket(t *testing.T) {
+	d := newTestNTPd(&Config{})
+	now := time.Now()
+	if _, ok := d.broadcastPacket(now, 64*time.Second); ok {
+		t.Error("broadcast before sync")
+	}
+
+	d.setLocalTemplate(2, loclRefer, now)
+	d.synced = true
+	p, ok := d.broadcastPacket(now, 64*time.Second)
+	if !ok {
+		t.Fatal("no broadcast after sync")
+	}
+	if m := getMode(p); m != modeBroadcast {
+		t.Errorf("mode=%d", m)
+	}
+	if poll := int8(p[pollPos]); poll != 6 {
+		t.Errorf("poll=%d", poll)
+	}
+	if p[stratumPos] != 2 {
+		t.Errorf("stratum=%d", p[stratumPos])
+	}
+	for _, pos := range []int{originTimeStamp, receiveTimeStamp} {
+		if ts := p[pos : pos+8]; string(ts) != string(make([]byte, 8)) {
+			t.Errorf("timestamp at %d is set: %x", pos, ts)
+		}
+	}
+
+	d.modifyTemplate(func(t []byte) { setLi(t, notSync) })
+	if _, ok = d.broadcastPacket(now, 64*time.Second); ok {
+		t.Error("broadcast unsynchronized template")
+	}
+}
+
+func TestBroadcastLoop(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	d := newTestNTPd(&Config{BroadcastAddr: conn.LocalAddr().String(),
+		BroadcastInterval: 10 * time.Millisecond})
+	d.setLocalTemplate(1, loclRefer, time.Now())
+	d.synced = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.broadcastLoop(ctx)
+
+	p := make([]byte, maxPacketSize)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFromUDP(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != headerSize || getMode(p) != modeBroadcast {
+		t.Errorf("got %d bytes mode %d", n, getMode(p))
+	}
+}
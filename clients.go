@@ -0,0 +1,111 @@
+package gontpd
+
+import (
+	"context"
+	"hash/maphash"
+	"math"
+	"math/bits"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// HyperLogLog of client addresses, 2^hllBits registers take 16KB per
+// generation whatever the number of (spoofed) sources, standard error
+// is about 1.04/sqrt(2^hllBits) = 1.6%.
+const (
+	hllBits      = 12
+	hllRegisters = 1 << hllBits
+
+	// clientWindow is how long a generation of clients is counted, the
+	// estimate covers the last 1-2 windows
+	clientWindow = time.Hour
+)
+
+type hll struct {
+	reg [hllRegisters]uint32
+}
+
+// add records hash of a client, register is updated only if it grows so
+// workers rarely write the same cache line.
+func (h *hll) add(x uint64) {
+	i := x >> (64 - hllBits)
+	rank := uint32(bits.LeadingZeros64(x<<hllBits|1<<(hllBits-1))) + 1
+	for {
+		old := atomic.LoadUint32(&h.reg[i])
+		if rank <= old || atomic.CompareAndSwapUint32(&h.reg[i], old, rank) {
+			return
+		}
+	}
+}
+
+// estimate returns cardinality of union of sketches, small cardinality
+// is estimated by linear counting.
+func estimate(hs ...*hll) float64 {
+	var (
+		sum   float64
+		zeros int
+	)
+	for i := 0; i < hllRegisters; i++ {
+		var r uint32
+		for _, h := range hs {
+			if v := atomic.LoadUint32(&h.reg[i]); v > r {
+				r = v
+			}
+		}
+		if r == 0 {
+			zeros++
+		}
+		sum += math.Ldexp(1, -int(r))
+	}
+	m := float64(hllRegisters)
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return e
+}
+
+// clientCounter estimates unique clients seen in the last 1-2 windows
+// by two generations of sketch.
+type clientCounter struct {
+	seed maphash.Seed
+	// cur and prev are *hll
+	cur  atomic.Value
+	prev atomic.Value
+}
+
+func newClientCounter() *clientCounter {
+	c := &clientCounter{seed: maphash.MakeSeed()}
+	c.cur.Store(&hll{})
+	c.prev.Store(&hll{})
+	return c
+}
+
+func (c *clientCounter) add(ip net.IP) {
+	var h maphash.Hash
+	h.SetSeed(c.seed)
+	// IPv4 and IPv4-mapped IPv6 addresses are the same client
+	h.Write(ip.To16())
+	c.cur.Load().(*hll).add(h.Sum64())
+}
+
+// rotate starts a new generation, clients seen before last rotation
+// are forgotten
+func (c *clientCounter) rotate() {
+	c.prev.Store(c.cur.Load())
+	c.cur.Store(&hll{})
+}
+
+func (c *clientCounter) estimate() float64 {
+	return estimate(c.cur.Load().(*hll), c.prev.Load().(*hll))
+}
+
+func (d *NTPd) clientLoop(ctx context.Context) {
+	if d.clients == nil {
+		return
+	}
+	for sleepContext(ctx, clientWindow) == nil {
+		d.clients.rotate()
+	}
+}
@@ -0,0 +1,56 @@
+package gontpd
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"testing"
+)
+
+func testClientIP(i int) net.IP {
+	ip := make(net.IP, 16)
+	ip[0] = 0x20
+	ip[1] = 0x01
+	binary.BigEndian.PutUint32(ip[12:], uint32(i))
+	return ip
+}
+
+// estimates are within 10%, about 6 standard errors
+func TestClientCounter(t *testing.T) {
+	for _, n := range []int{0, 1, 100, 5000, 200000} {
+		c := newClientCounter()
+		for i := 0; i < n; i++ {
+			c.add(testClientIP(i))
+			// duplicates are not counted
+			c.add(testClientIP(i))
+		}
+		e := c.estimate()
+		if math.Abs(e-float64(n)) > 0.1*float64(n)+0.5 {
+			t.Errorf("%d clients estimated as %.1f", n, e)
+		}
+	}
+}
+
+func TestClientCounterMapped(t *testing.T) {
+	c := newClientCounter()
+	c.add(net.ParseIP("192.0.2.1").To4())
+	c.add(net.ParseIP("::ffff:192.0.2.1"))
+	if e := c.estimate(); math.Round(e) != 1 {
+		t.Errorf("estimate=%.1f, expect 1", e)
+	}
+}
+
+func TestClientCounterRotate(t *testing.T) {
+	c := newClientCounter()
+	for i := 0; i < 100; i++ {
+		c.add(testClientIP(i))
+	}
+	c.rotate()
+	if e := c.estimate(); math.Abs(e-100) > 10 {
+		t.Errorf("after 1 rotation estimate=%.1f, expect 100", e)
+	}
+	c.rotate()
+	if e := c.estimate(); e != 0 {
+		t.Errorf("after 2 rotations estimate=%.1f, expect 0", e)
+	}
+}
@@ -1,21 +1,26 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/mengzhuo/gontpd"
-	yaml "gopkg.in/yaml.v2"
 )
 
 var (
-	fp = flag.String("c", "gontpd.yaml", "yaml config file")
+	fp = flag.String("c", "gontpd.yaml", "yaml or toml config file")
 	ff = flag.Int("f", 16, "log flag")
 	fv = flag.Bool("v", false, "print version")
+	fo = flag.Bool("once", false, "step clock once and exit, same as oneshot in config")
 
 	fpprof = flag.String("pprof", "", "pprof listen")
 
@@ -24,6 +29,7 @@ var (
 
 func main() {
 	flag.Parse()
+	gontpd.Version = Version
 
 	if *fv {
 		fmt.Println(Version)
@@ -36,21 +42,132 @@ func main() {
 		log.SetPrefix("[GoNTPd] ")
 	}
 
+	if flag.Arg(0) == "status" {
+		if err := status(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if *fpprof != "" {
 		go http.ListenAndServe(*fpprof, nil)
 	}
 
-	p, err := ioutil.ReadFile(*fp)
+	cfg, err := gontpd.LoadConfig(*fp)
 	if err != nil {
 		log.Fatal(err)
 	}
-	cfg := &gontpd.Config{}
-	err = yaml.Unmarshal(p, cfg)
+
+	if *fo {
+		cfg.Oneshot = true
+	}
+
+	log.Printf("%+v", cfg)
+	d, err := gontpd.New(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Printf("%+v", cfg)
-	d := gontpd.New(cfg)
-	log.Fatal(d.Run())
+	if cfg.Oneshot {
+		err = d.RunOnce()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	if restartSignal != nil {
+		signal.Notify(sig, restartSignal)
+	}
+	go func() {
+		for s := range sig {
+			if s == syscall.SIGHUP {
+				reload(d)
+				continue
+			}
+			if s == restartSignal {
+				// this process stops once the new one serves
+				go func() {
+					if _, err := d.Restart(ctx); err != nil {
+						log.Print(err)
+						return
+					}
+					cancel()
+				}()
+				continue
+			}
+			log.Printf("got signal %s, shutting down", s)
+			cancel()
+			return
+		}
+	}()
+
+	err = d.Run(ctx)
+	if err != nil && err != context.Canceled {
+		log.Fatal(err)
+	}
+}
+
+// status prints peers of running gontpd found by control socket or stat
+// address of config unless given by flags.
+func status(args []string) (err error) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	socket := fs.String("s", "", "control socket of running gontpd, control_socket of config by default")
+	url := fs.String("u", "", "stats URL of running gontpd, i.e. http://localhost:7370/stats")
+	fs.Parse(args)
+
+	if *socket == "" && *url == "" {
+		cfg, cerr := gontpd.LoadConfig(*fp)
+		if cerr != nil {
+			return fmt.Errorf("no -s or -u given: %s", cerr)
+		}
+		switch {
+		case cfg.ControlSocket != "":
+			*socket = cfg.ControlSocket
+		case cfg.StatAddr != "":
+			*url = "http://" + cfg.StatAddr + "/stats"
+		default:
+			return errors.New("no control_socket or stat_addr in config, use -s or -u")
+		}
+	}
+
+	var s gontpd.Stats
+	if *socket != "" {
+		var reply gontpd.ControlReply
+		reply, err = gontpd.ControlCall(*socket, gontpd.ControlRequest{Cmd: gontpd.ControlStatus})
+		if err != nil {
+			return
+		}
+		s = *reply.Stats
+	} else {
+		var resp *http.Response
+		resp, err = http.Get(*url)
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: %s", *url, resp.Status)
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&s); err != nil {
+			return
+		}
+	}
+	return s.WritePeers(os.Stdout)
+}
+
+func reload(d *gontpd.NTPd) {
+	log.Printf("reloading %s", *fp)
+	cfg, err := gontpd.LoadConfig(*fp)
+	if err != nil {
+		log.Print("reload failed:", err)
+		return
+	}
+	err = d.Reload(cfg)
+	if err != nil {
+		log.Print("reload failed:", err)
+	}
 }
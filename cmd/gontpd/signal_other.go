@@ -0,0 +1,9 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os"
+
+// restartSignal is nil as sockets can't be inherited
+var restartSignal os.Signal
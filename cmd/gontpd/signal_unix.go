@@ -0,0 +1,12 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartSignal starts a new process inheriting listening sockets
+var restartSignal os.Signal = syscall.SIGUSR2
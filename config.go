@@ -1,22 +1,643 @@
 package gontpd
 
-import "time"
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"go.opentelemetry.io/otel/trace"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	defaultBatchSize = 32
+
+	defaultStepThreshold  = 128 * time.Millisecond
+	defaultPanicThreshold = 1000 * time.Second
+
+	defaultFalsetickerLimit    = 3
+	defaultFalsetickerCooldown = time.Hour
+
+	defaultMinSources    = 1
+	defaultMinCandidates = 1
+
+	defaultSamplesPerPeer = 8
+
+	defaultMaxRootDistance = time.Second
+
+	defaultOrphanGrace = 5 * time.Minute
+
+	defaultResolveInterval = time.Hour
+	defaultMaxPeers        = 32
+	defaultPoolCount       = 4
+
+	defaultPeerTimeout = 5 * time.Second
+	defaultMaxStd      = 50 * time.Millisecond
+
+	defaultBroadcastInterval = 64 * time.Second
+	defaultBroadcastListen   = ":123"
+
+	defaultMinVersion = 3
+)
 
 type Config struct {
-	MaxStd time.Duration `yaml:"max_std"`
-
-	DropCIDR  []string `yaml:"drop_cidr"`
-	PeerList  []string `yaml:"peer_list"`
-	GeoDB     string   `yaml:"geo_db"`
-	Metric    string   `yaml:"metric"`
-	Listen    string   `yaml:"listen"`
-	WorkerNum int      `yaml:"worker_num"`
-	ConnNum   int      `yaml:"conn_num"`
-	RateSize  int      `yaml:"rate_size"`
-
-	RateDrop    bool `yaml:"rate_drop"`
-	ForceUpdate bool `yaml:"force_update"`
-
-	MaxPoll uint8 `yaml:"max_poll"`
-	MinPoll uint8 `yaml:"min_poll"`
+	// MaxStd is the maximum standard deviation of offsets of the samples
+	// of a poll, peer with noisier samples isn't good for that poll and
+	// they are dropped. Default 50ms, PeerSpec.MaxStd overrides it.
+	MaxStd time.Duration `yaml:"max_std" toml:"max_std"`
+	// SamplesPerPeer is how many recent samples each peer keeps, the
+	// lowest delay one of them is selected as clock filter of RFC 5905
+	SamplesPerPeer int `yaml:"samples_per_peer" toml:"samples_per_peer"`
+	// PeerTimeout is the timeout of each query to peer
+	PeerTimeout time.Duration `yaml:"peer_timeout" toml:"peer_timeout"`
+
+	// offset smaller than StepThreshold is slewed, otherwise stepped,
+	// offset over PanicThreshold is refused unless ForceUpdate, and poll
+	// interval is doubled up to MaxPoll while it is.
+	StepThreshold  time.Duration `yaml:"step_threshold" toml:"step_threshold"`
+	PanicThreshold time.Duration `yaml:"panic_threshold" toml:"panic_threshold"`
+	// MakeStep replaces StepThreshold if Limit is set, see MakeStepSpec
+	MakeStep MakeStepSpec `yaml:"make_step" toml:"make_step"`
+	// MaxOffset is the alias of PanicThreshold, they must be the same if
+	// both are set
+	MaxOffset time.Duration `yaml:"max_offset" toml:"max_offset"`
+
+	// peer is excluded from selection for FalsetickerCooldown after being
+	// falseticker for FalsetickerLimit consecutive polls
+	FalsetickerLimit    int           `yaml:"falseticker_limit" toml:"falseticker_limit"`
+	FalsetickerCooldown time.Duration `yaml:"falseticker_cooldown" toml:"falseticker_cooldown"`
+
+	// median is selected only if at least MinCandidates samples from
+	// MinSources peers survive intersection, each peer has one
+	MinSources    int `yaml:"min_sources" toml:"min_sources"`
+	MinCandidates int `yaml:"min_candidates" toml:"min_candidates"`
+	// SelectHysteresis keeps the selected peer while it's close to the
+	// median unless a challenger scores better (root distance plus
+	// jitter) by more than it, 0 to pick the best every poll
+	SelectHysteresis time.Duration `yaml:"select_hysteresis" toml:"select_hysteresis"`
+	// reply with root distance (half of root delay plus round trip, plus
+	// root and filter dispersion) over MaxRootDistance is never selected
+	MaxRootDistance time.Duration `yaml:"max_root_distance" toml:"max_root_distance"`
+
+	// serves local clock at OrphanStratum with refid LOCL after all peers
+	// are lost for OrphanGrace, 0 disables orphan mode
+	OrphanStratum uint8         `yaml:"orphan_stratum" toml:"orphan_stratum"`
+	OrphanGrace   time.Duration `yaml:"orphan_grace" toml:"orphan_grace"`
+	// root dispersion served grows by 15 PPM since last sync while no
+	// peer is selected, clock is served as unsynchronized once it's over
+	// MaxHoldoverDispersion
+	MaxHoldoverDispersion time.Duration `yaml:"max_holdover_dispersion" toml:"max_holdover_dispersion"`
+
+	// PeerList is resolved again every ResolveInterval. MaxPeers caps
+	// peers from PeerList, Pools, AddPeer and broadcast servers together,
+	// default 32 if it's not positive, there is no unlimited.
+	ResolveInterval time.Duration `yaml:"resolve_interval" toml:"resolve_interval"`
+	MaxPeers        int           `yaml:"max_peers" toml:"max_peers"`
+
+	// LeapFile is IERS/NIST leap-seconds.list, leap seconds in it are
+	// announced instead of those of peers
+	LeapFile        string        `yaml:"leap_file" toml:"leap_file"`
+	LeapSmear       bool          `yaml:"leap_smear" toml:"leap_smear"`
+	LeapSmearWindow time.Duration `yaml:"leap_smear_window" toml:"leap_smear_window"`
+
+	// Discipline is kernel (default) to pass offset to kernel PLL, or
+	// loop to steer clock by frequency of PLL/FLL of gontpd (Linux only)
+	Discipline string `yaml:"discipline" toml:"discipline"`
+	// MaxSlewRate bounds rate of slewing in ppm, i.e. how much clock
+	// may run faster or slower than true time while correcting offset
+	MaxSlewRate float64 `yaml:"max_slew_rate" toml:"max_slew_rate"`
+
+	// HuffPuff corrects offset by excess of delay over minimum delay of
+	// HuffPuffWindow, for links congested in one direction
+	HuffPuff       bool          `yaml:"huff_puff" toml:"huff_puff"`
+	HuffPuffWindow time.Duration `yaml:"huff_puff_window" toml:"huff_puff_window"`
+
+	// Pools are resolved to Count peers each, unreachable ones are
+	// replaced by fresh addresses of the pool
+	Pools []PoolSpec `yaml:"pools" toml:"pools"`
+	// Refclocks are SHM reference clocks polled as peers, i.e. GPS by
+	// gpsd, stratum 1 is served when one of them is sys peer
+	Refclocks []RefclockSpec `yaml:"refclocks" toml:"refclocks"`
+	// PPSDevice is a PPS device (Linux only), i.e. /dev/pps0, it's used
+	// only while another peer gives the second number
+	PPSDevice string `yaml:"pps_device" toml:"pps_device"`
+
+	DropCIDR []string `yaml:"drop_cidr" toml:"drop_cidr"`
+	// DropFile is a file of one CIDR per line dropped as DropCIDR,
+	// reloaded on SIGHUP and when it's modified
+	DropFile string `yaml:"drop_file" toml:"drop_file"`
+	// AllowCIDR serves only remote address within it if not empty,
+	// DropCIDR still applies
+	AllowCIDR []string `yaml:"allow_cidr" toml:"allow_cidr"`
+	// Restrict is ordered access rules, the first rule containing remote
+	// address applies, RestrictDefault applies if none does
+	Restrict        []RestrictRule `yaml:"restrict" toml:"restrict"`
+	RestrictDefault string         `yaml:"restrict_default" toml:"restrict_default"`
+
+	// PeerList entries are hostname or address of peer, or PeerSpec
+	// with options
+	PeerList  []PeerSpec `yaml:"peer_list" toml:"peer_list"`
+	GeoDB     string     `yaml:"geo_db" toml:"geo_db"`
+	Metric    string     `yaml:"metric" toml:"metric"`
+	StatAddr  string     `yaml:"stat_addr" toml:"stat_addr"`
+	Listen    string     `yaml:"listen" toml:"listen"`
+	KeyFile   string     `yaml:"key_file" toml:"key_file"`
+	DriftFile string     `yaml:"drift_file" toml:"drift_file"`
+	WorkerNum int        `yaml:"worker_num" toml:"worker_num"`
+	RateSize  int        `yaml:"rate_size" toml:"rate_size"`
+	RateBurst int        `yaml:"rate_burst" toml:"rate_burst"`
+
+	// PushGateway is URL of Prometheus pushgateway metrics are pushed to
+	// on every sync and on exit, grouped by PushJob and PushInstance
+	PushGateway  string `yaml:"push_gateway" toml:"push_gateway"`
+	PushJob      string `yaml:"push_job" toml:"push_job"`
+	PushInstance string `yaml:"push_instance" toml:"push_instance"`
+
+	ListenWorkers int `yaml:"listen_workers" toml:"listen_workers"`
+	// BatchSize is max packets read per recvmmsg, 1 to disable batching
+	BatchSize int `yaml:"batch_size" toml:"batch_size"`
+	// ConnNum is the legacy name of ListenWorkers
+	ConnNum int `yaml:"conn_num" toml:"conn_num"`
+
+	TrustedKeys []uint32 `yaml:"trusted_keys" toml:"trusted_keys"`
+
+	ListenAddrs []string `yaml:"listen_addrs" toml:"listen_addrs"`
+
+	// BroadcastAddr receives mode 5 packets every BroadcastInterval if
+	// set, i.e. "192.168.1.255:123", independent of the unicast server
+	BroadcastAddr     string        `yaml:"broadcast_addr" toml:"broadcast_addr"`
+	BroadcastInterval time.Duration `yaml:"broadcast_interval" toml:"broadcast_interval"`
+
+	// BroadcastClient disciplines clock by broadcast and multicast
+	// packets too, each server is added as peer on first packet and used
+	// after its delay is measured by a client mode query.
+	// Packets are received by server sockets, or at BroadcastListen if
+	// server is disabled. BroadcastGroups are joined, 224.0.1.1 if empty.
+	BroadcastClient bool     `yaml:"broadcast_client" toml:"broadcast_client"`
+	BroadcastListen string   `yaml:"broadcast_listen" toml:"broadcast_listen"`
+	BroadcastGroups []string `yaml:"broadcast_groups" toml:"broadcast_groups"`
+
+	// Interleaved answers interleaved mode requests with transmit
+	// timestamp of previous response, which is taken after it's sent.
+	// InterleaveSize is number of clients remembered for it.
+	Interleaved    bool `yaml:"interleaved" toml:"interleaved"`
+	InterleaveSize int  `yaml:"interleave_size" toml:"interleave_size"`
+
+	// NTSCert and NTSKey are certificate and key of NTS-KE at NTSKEAddr,
+	// NTS is served if they are set.
+	NTSCert   string `yaml:"nts_cert" toml:"nts_cert"`
+	NTSKey    string `yaml:"nts_key" toml:"nts_key"`
+	NTSKEAddr string `yaml:"nts_ke_addr" toml:"nts_ke_addr"`
+
+	// DSCP marks responses and queries to peers, 0 to 63
+	DSCP uint8 `yaml:"dscp" toml:"dscp"`
+
+	// QuerySourceAddr are local addresses queries to peers are sent from,
+	// at most one IPv4 and one IPv6 address, peers of a family without one
+	// are queried from the system default address.
+	QuerySourceAddr []string `yaml:"query_source_addr" toml:"query_source_addr"`
+
+	// SO_RCVBUF and SO_SNDBUF of listen sockets, system default if 0
+	RecvBufBytes int `yaml:"recv_buf_bytes" toml:"recv_buf_bytes"`
+	SendBufBytes int `yaml:"send_buf_bytes" toml:"send_buf_bytes"`
+
+	RateDrop    bool `yaml:"rate_drop" toml:"rate_drop"`
+	ForceUpdate bool `yaml:"force_update" toml:"force_update"`
+	// RefuseWhenUnsync answers client requests by DENY KoD instead of
+	// time while unsynchronized, in orphan mode, or while root dispersion
+	// served is over RefuseDispersion
+	RefuseWhenUnsync bool          `yaml:"refuse_when_unsync" toml:"refuse_when_unsync"`
+	RefuseDispersion time.Duration `yaml:"refuse_dispersion" toml:"refuse_dispersion"`
+	// Oneshot steps clock once and exits, see RunOnce
+	Oneshot bool `yaml:"oneshot" toml:"oneshot"`
+	// DryRun polls peers and serves as usual, but only logs how the
+	// clock would be set instead of setting it
+	DryRun bool `yaml:"dry_run" toml:"dry_run"`
+	// ServerDisabled only disciplines local clock without listening
+	ServerDisabled bool `yaml:"server_disabled" toml:"server_disabled"`
+	// DisciplineDisabled never polls peers nor adjusts local clock,
+	// local clock is served at Stratum with RefID. Otherwise RefID
+	// replaces refid of sys peer if it's set.
+	DisciplineDisabled bool   `yaml:"discipline_disabled" toml:"discipline_disabled"`
+	Stratum            uint8  `yaml:"stratum" toml:"stratum"`
+	RefID              string `yaml:"ref_id" toml:"ref_id"`
+	// MaxStratumServed caps stratum served after sync, clock is served
+	// as unsynchronized at stratum 16 if stratum through sys peer is over
+	// it, never as a better one. 0 for no cap.
+	MaxStratumServed uint8 `yaml:"max_stratum_served" toml:"max_stratum_served"`
+	// Control answers read only mode 6 control messages (ntpq readvar)
+	Control bool `yaml:"control" toml:"control"`
+	// ControlSocket is path of unix socket taking JSON line commands,
+	// see ControlRequest
+	ControlSocket string `yaml:"control_socket" toml:"control_socket"`
+	// StaggerPoll spreads start of peer polls instead of all at once
+	StaggerPoll bool `yaml:"stagger_poll" toml:"stagger_poll"`
+	// RandomStart delays first poll of Run by random time up to MinPoll
+	RandomStart bool `yaml:"random_start" toml:"random_start"`
+	// IBurst sends a burst of queries to unreachable peer, nil is true
+	// so it's only disabled explicitly, see iburst
+	IBurst *bool `yaml:"iburst" toml:"iburst"`
+
+	// requests of version lower than MinVersion are dropped
+	MinVersion uint8 `yaml:"min_version" toml:"min_version"`
+
+	MaxPoll uint8 `yaml:"max_poll" toml:"max_poll"`
+	MinPoll uint8 `yaml:"min_poll" toml:"min_poll"`
+
+	// Syslog sends logs to local syslog daemon unless Logger is set
+	Syslog bool `yaml:"syslog" toml:"syslog"`
+	// Logger receives logs instead of standard log package
+	Logger Logger `yaml:"-" toml:"-"`
+	// OnSync is called by poll loop after every clock adjustment, it
+	// delays next poll so it shouldn't block
+	OnSync func(SyncEvent) `yaml:"-" toml:"-"`
+	// Tracer traces poll cycles (peer updates, selection and clock
+	// adjustment) by OpenTelemetry, it's set by New only
+	Tracer trace.TracerProvider `yaml:"-" toml:"-"`
+}
+
+// PeerSpec is hostname or address of peer with its options, plain
+// string in config file is a PeerSpec of Addr only.
+type PeerSpec struct {
+	Addr string `yaml:"addr" toml:"addr"`
+	// Prefer peer is sys peer whenever it survives close to the median
+	Prefer bool `yaml:"prefer" toml:"prefer"`
+	// NoSelect peer is polled and monitored but never selected
+	NoSelect bool `yaml:"noselect" toml:"noselect"`
+	// MinPoll and MaxPoll bound poll interval of peer instead of global
+	// ones if set
+	MinPoll uint8 `yaml:"min_poll" toml:"min_poll"`
+	MaxPoll uint8 `yaml:"max_poll" toml:"max_poll"`
+	// MaxStd of peer instead of global one if set
+	MaxStd time.Duration `yaml:"max_std" toml:"max_std"`
+}
+
+// Peers returns PeerSpecs of addrs without options
+func Peers(addrs ...string) (specs []PeerSpec) {
+	for _, a := range addrs {
+		specs = append(specs, PeerSpec{Addr: a})
+	}
+	return
+}
+
+// UnmarshalYAML accepts plain string as Addr
+func (s *PeerSpec) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var addr string
+	if err := unmarshal(&addr); err == nil {
+		*s = PeerSpec{Addr: addr}
+		return nil
+	}
+	type plain PeerSpec
+	return unmarshal((*plain)(s))
+}
+
+// UnmarshalTOML accepts plain string as Addr, table is decoded as
+// PeerSpec and unknown keys are treated as error.
+func (s *PeerSpec) UnmarshalTOML(data interface{}) (err error) {
+	switch v := data.(type) {
+	case string:
+		*s = PeerSpec{Addr: v}
+		return
+	case map[string]interface{}:
+		var buf bytes.Buffer
+		if err = toml.NewEncoder(&buf).Encode(v); err != nil {
+			return
+		}
+		type plain PeerSpec
+		var md toml.MetaData
+		md, err = toml.NewDecoder(&buf).Decode((*plain)(s))
+		if err == nil {
+			if keys := md.Undecoded(); len(keys) > 0 {
+				err = fmt.Errorf("unknown key %s of peer %s", keys[0], s.Addr)
+			}
+		}
+		return
+	}
+	return fmt.Errorf("invalid peer %v", data)
+}
+
+// peerAddrs returns Addr of PeerList
+func (cfg *Config) peerAddrs() (addrs []string) {
+	for _, s := range cfg.PeerList {
+		addrs = append(addrs, s.Addr)
+	}
+	return
+}
+
+// peerSpecs returns PeerList by Addr
+func (cfg *Config) peerSpecs() map[string]PeerSpec {
+	specs := make(map[string]PeerSpec, len(cfg.PeerList))
+	for _, s := range cfg.PeerList {
+		specs[s.Addr] = s
+	}
+	return specs
+}
+
+// pollBounds returns poll bounds of peer of spec, global ones unless
+// the peer has its own.
+func (cfg *Config) pollBounds(spec PeerSpec) (low, high uint8) {
+	low, high = cfg.MinPoll, cfg.MaxPoll
+	if spec.MinPoll != 0 {
+		low = spec.MinPoll
+	}
+	if spec.MaxPoll != 0 {
+		high = spec.MaxPoll
+	}
+	// bound of peer wins over global one
+	if low > high {
+		if spec.MaxPoll != 0 {
+			low = high
+		} else {
+			high = low
+		}
+	}
+	return
+}
+
+// querySource returns address of QuerySourceAddr of the same family as
+// peer, empty if there is none.
+func (cfg *Config) querySource(peer net.IP) string {
+	v4 := peer.To4() != nil
+	for _, addr := range cfg.QuerySourceAddr {
+		if ip := net.ParseIP(addr); ip != nil && (ip.To4() != nil) == v4 {
+			return addr
+		}
+	}
+	return ""
+}
+
+// iburst reports if IBurst is enabled, it's by default
+func (cfg *Config) iburst() bool {
+	return cfg.IBurst == nil || *cfg.IBurst
+}
+
+// maxStd returns MaxStd of peer of spec, global one unless the peer has
+// its own.
+func (cfg *Config) maxStd(spec PeerSpec) time.Duration {
+	if spec.MaxStd != 0 {
+		return spec.MaxStd
+	}
+	return cfg.MaxStd
+}
+
+// MakeStepSpec steps offset over Threshold only for the first Limit
+// clock updates like makestep of chrony, after that offset is always
+// slewed however large it is. Threshold is StepThreshold if 0.
+type MakeStepSpec struct {
+	Threshold time.Duration `yaml:"threshold" toml:"threshold"`
+	Limit     int           `yaml:"limit" toml:"limit"`
+}
+
+// PoolSpec is a pool hostname and number of peers picked from it
+type PoolSpec struct {
+	Hostname string `yaml:"hostname" toml:"hostname"`
+	Count    int    `yaml:"count" toml:"count"`
+}
+
+// RefclockSpec is SHM segment of Unit, RefID is served when it's sys
+// peer, GPS if empty
+type RefclockSpec struct {
+	Unit  int    `yaml:"unit" toml:"unit"`
+	RefID string `yaml:"refid" toml:"refid"`
+}
+
+// RestrictRule applies Action to requests from CIDR, Action is one of
+// allow (time and control), nocontrol (time only), noserve (time
+// queries are rejected with DENY KoD) and ignore (all dropped).
+type RestrictRule struct {
+	CIDR   string `yaml:"cidr" toml:"cidr"`
+	Action string `yaml:"action" toml:"action"`
+}
+
+// LoadConfig reads config from TOML file if path ends with .toml,
+// otherwise from YAML file. Unknown keys are treated as error.
+func LoadConfig(path string) (cfg *Config, err error) {
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	cfg = &Config{}
+	switch filepath.Ext(path) {
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.NewDecoder(bytes.NewReader(p)).Decode(cfg)
+		if err == nil {
+			if keys := md.Undecoded(); len(keys) > 0 {
+				ks := make([]string, len(keys))
+				for i, k := range keys {
+					ks[i] = k.String()
+				}
+				err = fmt.Errorf("unknown keys: %s", strings.Join(ks, ", "))
+			}
+		}
+	default:
+		err = yaml.UnmarshalStrict(p, cfg)
+	}
+	if err != nil {
+		cfg = nil
+		err = fmt.Errorf("%s: %s", path, err)
+		return
+	}
+	if err = ApplyEnv(cfg); err != nil {
+		cfg = nil
+		return
+	}
+	cfg.setDefault()
+	return
+}
+
+// ApplyEnv overrides fields of cfg by environment variables, empty ones
+// are ignored. Lists are comma separated.
+//
+//	GONTPD_PEERS         PeerList
+//	GONTPD_METRIC        Metric
+//	GONTPD_MINPOLL       MinPoll
+//	GONTPD_MAXPOLL       MaxPoll
+//	GONTPD_DROP_CIDR     DropCIDR
+//	GONTPD_FORCE_UPDATE  ForceUpdate
+func ApplyEnv(cfg *Config) (err error) {
+	if v := os.Getenv("GONTPD_PEERS"); v != "" {
+		cfg.PeerList = Peers(splitList(v)...)
+	}
+	if v := os.Getenv("GONTPD_METRIC"); v != "" {
+		cfg.Metric = v
+	}
+	if v := os.Getenv("GONTPD_MINPOLL"); v != "" {
+		if cfg.MinPoll, err = parsePollEnv("GONTPD_MINPOLL", v); err != nil {
+			return
+		}
+	}
+	if v := os.Getenv("GONTPD_MAXPOLL"); v != "" {
+		if cfg.MaxPoll, err = parsePollEnv("GONTPD_MAXPOLL", v); err != nil {
+			return
+		}
+	}
+	if v := os.Getenv("GONTPD_DROP_CIDR"); v != "" {
+		cfg.DropCIDR = splitList(v)
+	}
+	if v := os.Getenv("GONTPD_FORCE_UPDATE"); v != "" {
+		if cfg.ForceUpdate, err = strconv.ParseBool(v); err != nil {
+			err = fmt.Errorf("invalid GONTPD_FORCE_UPDATE: %q is not a bool", v)
+			return
+		}
+	}
+	return
+}
+
+// splitList splits comma separated list, blank items are dropped
+func splitList(s string) (items []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+// parsePollEnv parses poll exponent v of environment variable name
+func parsePollEnv(name, v string) (poll uint8, err error) {
+	n, err := strconv.ParseUint(v, 10, 8)
+	if err != nil {
+		err = fmt.Errorf("invalid %s: %q is not a number", name, v)
+		return
+	}
+	if n < minPoll || n > maxPoll {
+		err = fmt.Errorf("invalid %s: %d not in [%d, %d]", name, n, minPoll, maxPoll)
+		return
+	}
+	poll = uint8(n)
+	return
+}
+
+func (cfg *Config) setDefault() {
+	if cfg.MinPoll < minPoll {
+		cfg.MinPoll = minPoll
+	}
+	if cfg.MaxPoll > maxPoll || cfg.MaxPoll == 0 {
+		cfg.MaxPoll = maxPoll
+	}
+
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = defaultMinVersion
+	}
+
+	if cfg.MaxStd == 0 {
+		cfg.MaxStd = defaultMaxStd
+	}
+
+	if cfg.IBurst == nil {
+		iburst := true
+		cfg.IBurst = &iburst
+	}
+
+	if cfg.RateSize < 0 {
+		cfg.RateSize = 0
+	}
+
+	if cfg.InterleaveSize <= 0 {
+		cfg.InterleaveSize = defaultInterleaveSize
+	}
+
+	if cfg.NTSKEAddr == "" {
+		cfg.NTSKEAddr = defaultNTSKEAddr
+	}
+
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+
+	if cfg.StepThreshold <= 0 {
+		cfg.StepThreshold = defaultStepThreshold
+	}
+	if cfg.PanicThreshold <= 0 {
+		cfg.PanicThreshold = cfg.MaxOffset
+	}
+	if cfg.PanicThreshold <= 0 {
+		cfg.PanicThreshold = defaultPanicThreshold
+	}
+	if cfg.MakeStep.Threshold == 0 {
+		cfg.MakeStep.Threshold = cfg.StepThreshold
+	}
+
+	if cfg.FalsetickerLimit <= 0 {
+		cfg.FalsetickerLimit = defaultFalsetickerLimit
+	}
+	if cfg.FalsetickerCooldown <= 0 {
+		cfg.FalsetickerCooldown = defaultFalsetickerCooldown
+	}
+
+	if cfg.MinSources == 0 {
+		cfg.MinSources = defaultMinSources
+	}
+	if cfg.MinCandidates == 0 {
+		cfg.MinCandidates = defaultMinCandidates
+	}
+	if cfg.SamplesPerPeer <= 0 {
+		cfg.SamplesPerPeer = defaultSamplesPerPeer
+	}
+	if cfg.MaxRootDistance <= 0 {
+		cfg.MaxRootDistance = defaultMaxRootDistance
+	}
+
+	if cfg.OrphanStratum >= invalidStratum {
+		cfg.OrphanStratum = invalidStratum - 1
+	}
+	if cfg.OrphanGrace <= 0 {
+		cfg.OrphanGrace = defaultOrphanGrace
+	}
+	if cfg.RefuseDispersion <= 0 {
+		cfg.RefuseDispersion = defaultRefuseDispersion
+	}
+	if cfg.PushJob == "" {
+		cfg.PushJob = defaultPushJob
+	}
+	if cfg.MaxHoldoverDispersion <= 0 {
+		cfg.MaxHoldoverDispersion = defaultMaxHoldoverDispersion
+	}
+
+	if cfg.PeerTimeout <= 0 {
+		cfg.PeerTimeout = defaultPeerTimeout
+	}
+
+	if cfg.BroadcastInterval <= 0 {
+		cfg.BroadcastInterval = defaultBroadcastInterval
+	}
+	if cfg.BroadcastListen == "" {
+		cfg.BroadcastListen = defaultBroadcastListen
+	}
+
+	if cfg.ResolveInterval <= 0 {
+		cfg.ResolveInterval = defaultResolveInterval
+	}
+	if cfg.MaxPeers <= 0 {
+		cfg.MaxPeers = defaultMaxPeers
+	}
+	for i := range cfg.Pools {
+		if cfg.Pools[i].Count <= 0 {
+			cfg.Pools[i].Count = defaultPoolCount
+		}
+	}
+	for i := range cfg.Refclocks {
+		if cfg.Refclocks[i].RefID == "" {
+			cfg.Refclocks[i].RefID = defaultRefclockRefID
+		}
+	}
+
+	if cfg.LeapSmearWindow <= 0 {
+		cfg.LeapSmearWindow = defaultLeapSmearWindow
+	}
+	if cfg.MaxSlewRate <= 0 {
+		cfg.MaxSlewRate = maxFreq
+	}
+	if cfg.HuffPuffWindow <= 0 {
+		cfg.HuffPuffWindow = defaultHuffPuffWindow
+	}
 }
@@ -0,0 +1,254 @@
+package gontpd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+func writeTemp(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "gontpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	err = ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigTOMLRoundTrip(t *testing.T) {
+	cfg := &Config{
+		MaxStd:      50 * time.Millisecond,
+		DropCIDR:    []string{"10.0.0.0/8", "fc00::/7"},
+		PeerList:    Peers("time1.apple.com", "time2.apple.com"),
+		Metric:      ":7370",
+		Listen:      ":123",
+		RateSize:    8196,
+		ForceUpdate: true,
+		MaxPoll:     9,
+		MinPoll:     6,
+	}
+	cfg.setDefault()
+	var w strings.Builder
+	err := toml.NewEncoder(&w).Encode(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTemp(t, "gontpd.toml", w.String())
+	defer os.RemoveAll(filepath.Dir(path))
+
+	got, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, got) {
+		t.Errorf("expect %+v\ngot %+v", cfg, got)
+	}
+}
+
+func TestLoadConfigDefault(t *testing.T) {
+	path := writeTemp(t, "gontpd.toml", `
+peer_list = ["time1.apple.com"]
+rate_size = -1
+min_poll = 1
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MinPoll != minPoll || cfg.MaxPoll != maxPoll || cfg.RateSize != 0 ||
+		!cfg.iburst() {
+		t.Errorf("default not applied %+v", cfg)
+	}
+
+	path = writeTemp(t, "gontpd.yaml", "peer_list: [time1.apple.com]\niburst: false\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	cfg, err = LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.iburst() {
+		t.Error("iburst should be disabled")
+	}
+}
+
+func TestIBurstDefault(t *testing.T) {
+	// Config built in code bursts as well
+	cfg := &Config{PeerList: Peers("192.0.2.1")}
+	if !cfg.iburst() {
+		t.Error("iburst disabled by zero value")
+	}
+	off := false
+	d := newTestNTPd(&Config{PeerList: Peers("192.0.2.1"), IBurst: &off})
+	d.dropTable.Store(&dropTable{})
+	d.lookup = func(addrs []string) map[string][]net.IP {
+		return map[string][]net.IP{"192.0.2.1": {net.ParseIP("192.0.2.1")}}
+	}
+	if cfg := d.config(); cfg.iburst() {
+		t.Error("iburst not disabled")
+	}
+	if err := d.Reload(&Config{PeerList: Peers("192.0.2.1")}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := d.config(); cfg.IBurst == nil || !*cfg.IBurst {
+		t.Error("iburst not enabled by reload without it")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	t.Setenv("GONTPD_PEERS", "time1.apple.com, time2.apple.com,")
+	t.Setenv("GONTPD_METRIC", ":9100")
+	t.Setenv("GONTPD_MINPOLL", "6")
+	t.Setenv("GONTPD_MAXPOLL", "10")
+	t.Setenv("GONTPD_DROP_CIDR", "10.0.0.0/8,192.168.0.0/16")
+	t.Setenv("GONTPD_FORCE_UPDATE", "true")
+
+	path := writeTemp(t, "gontpd.yaml", `
+peer_list: [pool.ntp.org]
+metric: ":7370"
+max_poll: 12
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.PeerList, Peers("time1.apple.com", "time2.apple.com")) ||
+		cfg.Metric != ":9100" || cfg.MinPoll != 6 || cfg.MaxPoll != 10 ||
+		!reflect.DeepEqual(cfg.DropCIDR, []string{"10.0.0.0/8", "192.168.0.0/16"}) ||
+		!cfg.ForceUpdate {
+		t.Errorf("env not applied %+v", cfg)
+	}
+
+	for _, g := range []struct{ name, value string }{
+		{"GONTPD_MINPOLL", "six"},
+		{"GONTPD_MINPOLL", "4"},
+		{"GONTPD_MAXPOLL", "17"},
+		{"GONTPD_MAXPOLL", "-1"},
+		{"GONTPD_FORCE_UPDATE", "maybe"},
+	} {
+		t.Run(g.name+"="+g.value, func(t *testing.T) {
+			t.Setenv(g.name, g.value)
+			if err := ApplyEnv(&Config{}); err == nil || !strings.Contains(err.Error(), g.name) {
+				t.Errorf("err=%v", err)
+			}
+		})
+	}
+}
+
+func TestSetDefaultMaxOffset(t *testing.T) {
+	cfg := &Config{MaxOffset: time.Minute}
+	cfg.setDefault()
+	if cfg.PanicThreshold != time.Minute {
+		t.Errorf("panic threshold %s expect max offset", cfg.PanicThreshold)
+	}
+
+	cfg = &Config{MaxOffset: time.Minute, PanicThreshold: time.Hour}
+	cfg.setDefault()
+	if cfg.PanicThreshold != time.Hour {
+		t.Errorf("panic threshold %s should not be overridden", cfg.PanicThreshold)
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	for name, content := range map[string]string{
+		"gontpd.toml": "peer_list = [\"a\"]\npeerlist = [\"b\"]\n",
+		"gontpd.yaml": "peer_list: [a]\npeerlist: [b]\n",
+	} {
+		path := writeTemp(t, name, content)
+		_, err := LoadConfig(path)
+		os.RemoveAll(filepath.Dir(path))
+		if err == nil || !strings.Contains(err.Error(), "peerlist") {
+			t.Errorf("%s: expect unknown key error got %v", name, err)
+		}
+	}
+}
+
+func TestLoadConfigPeerSpec(t *testing.T) {
+	want := []PeerSpec{
+		{Addr: "time1.apple.com"},
+		{Addr: "192.0.2.1", Prefer: true, MinPoll: 6, MaxPoll: 8},
+		{Addr: "192.0.2.2", NoSelect: true},
+	}
+	for name, content := range map[string]string{
+		"gontpd.toml": `peer_list = [
+    "time1.apple.com",
+    {addr = "192.0.2.1", prefer = true, min_poll = 6, max_poll = 8},
+    {addr = "192.0.2.2", noselect = true},
+]
+`,
+		"gontpd.yaml": `peer_list:
+    - time1.apple.com
+    - {addr: 192.0.2.1, prefer: true, min_poll: 6, max_poll: 8}
+    - addr: 192.0.2.2
+      noselect: true
+`,
+	} {
+		path := writeTemp(t, name, content)
+		cfg, err := LoadConfig(path)
+		os.RemoveAll(filepath.Dir(path))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg.PeerList, want) {
+			t.Errorf("%s: peer list %+v", name, cfg.PeerList)
+		}
+	}
+
+	for name, content := range map[string]string{
+		"gontpd.toml": "peer_list = [{addr = \"a\", perfer = true}]\n",
+		"gontpd.yaml": "peer_list: [{addr: a, perfer: true}]\n",
+	} {
+		path := writeTemp(t, name, content)
+		_, err := LoadConfig(path)
+		os.RemoveAll(filepath.Dir(path))
+		if err == nil || !strings.Contains(err.Error(), "perfer") {
+			t.Errorf("%s: expect unknown key error got %v", name, err)
+		}
+	}
+}
+
+func TestPollBounds(t *testing.T) {
+	cfg := &Config{MinPoll: 6, MaxPoll: 10}
+	for _, g := range []struct {
+		spec      PeerSpec
+		low, high uint8
+	}{
+		{PeerSpec{}, 6, 10},
+		{PeerSpec{MinPoll: 5, MaxPoll: 7}, 5, 7},
+		{PeerSpec{MinPoll: 12}, 12, 12},
+		{PeerSpec{MaxPoll: 5}, 5, 5},
+	} {
+		low, high := cfg.pollBounds(g.spec)
+		if low != g.low || high != g.high {
+			t.Errorf("%+v: bounds [%d, %d] expect [%d, %d]", g.spec, low, high, g.low, g.high)
+		}
+	}
+}
+
+func TestLoadSampleConfig(t *testing.T) {
+	for _, path := range []string{"gontpd.toml", "gontpd.yaml",
+		"pkg/etc/gontpd/gontpd.conf.yml"} {
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if len(cfg.PeerList) == 0 {
+			t.Errorf("%s: empty peer list", path)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package gontpd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// mode 6 control message, RFC 1305 Appendix B
+const (
+	ctlHeaderSize = 12
+	// ctlMaxData is max data size of one fragment
+	ctlMaxData = 468
+
+	ctlResponse = 0x80
+	ctlError    = 0x40
+	ctlMore     = 0x20
+	ctlOpMask   = 0x1f
+
+	ctlOpReadVar = 2
+
+	ctlStatusPos = 4
+	ctlAssocPos  = 6
+	ctlOffsetPos = 8
+	ctlCountPos  = 10
+
+	// clock source of system status word
+	ctlSourceUnspec = 0
+	ctlSourceNTP    = 6
+)
+
+// control answers readvar of system variables so that `ntpq -c rv`
+// works, returns length of response or 0 if request is refused.
+// Only single fragment request without association is accepted, other
+// operations, i.e. write and association listing, are refused to avoid
+// amplification.
+func (w *worker) control(p []byte, n int) (rn int) {
+	op := p[1]
+	if op&(ctlResponse|ctlError|ctlMore) != 0 || op&ctlOpMask != ctlOpReadVar {
+		return
+	}
+	if binary.BigEndian.Uint16(p[ctlAssocPos:]) != 0 ||
+		binary.BigEndian.Uint16(p[ctlOffsetPos:]) != 0 {
+		return
+	}
+	if int(binary.BigEndian.Uint16(p[ctlCountPos:])) > n-ctlHeaderSize {
+		return
+	}
+
+	data := w.d.systemVars(time.Now())
+	if len(data) > ctlMaxData {
+		data = data[:ctlMaxData]
+	}
+
+	tmpl := w.d.loadTemplate()
+	li := tmpl[liVnModePos] >> 6
+	source := uint16(ctlSourceUnspec)
+	if li != notSync {
+		source = ctlSourceNTP
+	}
+
+	p[1] = ctlResponse | ctlOpReadVar
+	binary.BigEndian.PutUint16(p[ctlStatusPos:], uint16(li)<<14|source<<8)
+	binary.BigEndian.PutUint16(p[ctlCountPos:], uint16(len(data)))
+	rn = ctlHeaderSize + copy(p[ctlHeaderSize:], data)
+	// data is padded to 32 bits boundary
+	for ; rn%4 != 0; rn++ {
+		p[rn] = 0
+	}
+	return
+}
+
+// systemVars formats system variables of readvar from template,
+// times are in milliseconds as ntpd.
+func (d *NTPd) systemVars(now time.Time) string {
+	tmpl := d.loadTemplate()
+	stratum := tmpl[stratumPos]
+	refID := binary.BigEndian.Uint32(tmpl[referIDPos:])
+
+	var offset, jitter time.Duration
+	d.mu.RLock()
+	if d.median != nil {
+		offset = d.median.resp.ClockOffset
+		jitter = d.median.jitter
+	}
+	d.mu.RUnlock()
+
+	vars := []string{
+		fmt.Sprintf("version=\"gontpd %s\"", Version),
+		fmt.Sprintf("leap=%02b", tmpl[liVnModePos]>>6),
+		fmt.Sprintf("stratum=%d", stratum),
+		fmt.Sprintf("precision=%d", int8(tmpl[clockPrecisionPos])),
+		fmt.Sprintf("rootdelay=%.3f", ntpShortMillis(tmpl[rootDelayPos:])),
+		fmt.Sprintf("rootdisp=%.3f", ntpShortMillis(tmpl[rootDispersionPos:])),
+		"refid=" + servedRefID(stratum, refID, d.config().RefID),
+		fmt.Sprintf("reftime=%s", formatNtpTime(binary.BigEndian.Uint64(tmpl[referenceTimeStamp:]))),
+		fmt.Sprintf("clock=%s", formatNtpTime(toNtpTime(now))),
+		fmt.Sprintf("poll=%d", int8(tmpl[pollPos])),
+		fmt.Sprintf("offset=%.6f", float64(offset)/float64(time.Millisecond)),
+		fmt.Sprintf("sys_jitter=%.6f", float64(jitter)/float64(time.Millisecond)),
+	}
+	return strings.Join(vars, ",\r\n") + "\r\n"
+}
+
+// ntpShortMillis decodes NTP short format in p to milliseconds
+func ntpShortMillis(p []byte) float64 {
+	return float64(binary.BigEndian.Uint32(p)) * 1000 / (1 << 16)
+}
+
+// formatNtpTime formats NTP timestamp in hex as ntpq
+func formatNtpTime(t uint64) string {
+	return fmt.Sprintf("%08x.%08x", t>>32, uint32(t))
+}
+
+// servedRefID formats refid of template as configured if it's replaced
+// by RefID, so that a code is never shown as address
+func servedRefID(stratum uint8, id uint32, configured string) string {
+	if c, err := parseRefID(configured); err == nil && c == id {
+		return configured
+	}
+	return formatRefID(stratum, id)
+}
+
+// formatRefID shows refid of stratum 0 (KoD) and 1 as ASCII, otherwise
+// as IPv4 address.
+func formatRefID(stratum uint8, id uint32) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, id)
+	if stratum > 1 && stratum < invalidStratum {
+		return net.IP(b).String()
+	}
+	return strings.TrimRight(string(b), "\x00")
+}
@@ -0,0 +1,90 @@
+package gontpd
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+func newTestControl(op uint8, assoc uint16) []byte {
+	req := make([]byte, ctlHeaderSize)
+	setVersion(req, 2)
+	setMode(req, modeControlMessage)
+	req[1] = op
+	binary.BigEndian.PutUint16(req[2:], 7)
+	binary.BigEndian.PutUint16(req[ctlAssocPos:], assoc)
+	return req
+}
+
+func TestControlReadVar(t *testing.T) {
+	ms := time.Millisecond
+	p := newTestPeer("192.0.2.1", 0, 0)
+	p.refId = makeSendRefId(p.addr)
+	d := newTestNTPd(&Config{Control: true}, p)
+	d.dropTable.Store(&dropTable{})
+	op := newOffsetPeer(p, &ntp.Response{ClockOffset: ms, RTT: 2 * ms,
+		RootDelay: 10 * ms, Stratum: 1})
+	d.setTemplate(op)
+	d.median = op
+	w := &worker{lru: newLRU(0), d: d}
+	raddr := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 123}
+
+	buf := make([]byte, maxPacketSize)
+	copy(buf, newTestControl(ctlOpReadVar, 0))
+	n, stamp := w.handle(buf, ctlHeaderSize, raddr, time.Now())
+	if n == 0 || stamp || n%4 != 0 {
+		t.Fatalf("n=%d stamp=%v", n, stamp)
+	}
+	if buf[1] != ctlResponse|ctlOpReadVar || getMode(buf) != modeControlMessage {
+		t.Errorf("header %x", buf[:2])
+	}
+	if seq := binary.BigEndian.Uint16(buf[2:]); seq != 7 {
+		t.Errorf("sequence=%d", seq)
+	}
+	count := int(binary.BigEndian.Uint16(buf[ctlCountPos:]))
+	if count > n-ctlHeaderSize {
+		t.Fatalf("count=%d n=%d", count, n)
+	}
+	data := string(buf[ctlHeaderSize : ctlHeaderSize+count])
+	for _, v := range []string{"stratum=2", "refid=192.0.2.1",
+		"rootdelay=11.99", "offset=1.000000", "leap=00"} {
+		if !strings.Contains(data, v) {
+			t.Errorf("%s not in %q", v, data)
+		}
+	}
+}
+
+func TestControlRefused(t *testing.T) {
+	d := newTestNTPd(&Config{Control: true})
+	d.dropTable.Store(&dropTable{})
+	w := &worker{lru: newLRU(0), d: d}
+	raddr := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 123}
+
+	for _, c := range []struct {
+		name string
+		req  []byte
+	}{
+		{"write", newTestControl(3, 0)},
+		{"read status", newTestControl(1, 0)},
+		{"peer vars", newTestControl(ctlOpReadVar, 1)},
+		{"response", newTestControl(ctlResponse|ctlOpReadVar, 0)},
+		{"short", newTestControl(ctlOpReadVar, 0)[:ctlHeaderSize-1]},
+	} {
+		buf := make([]byte, maxPacketSize)
+		copy(buf, c.req)
+		if n, _ := w.handle(buf, len(c.req), raddr, time.Now()); n != 0 {
+			t.Errorf("%s: got %d bytes response", c.name, n)
+		}
+	}
+
+	d.cfg.Control = false
+	buf := make([]byte, maxPacketSize)
+	copy(buf, newTestControl(ctlOpReadVar, 0))
+	if n, _ := w.handle(buf, ctlHeaderSize, raddr, time.Now()); n != 0 {
+		t.Errorf("got %d bytes response while disabled", n)
+	}
+}
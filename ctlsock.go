@@ -0,0 +1,220 @@
+package gontpd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// commands of control socket
+const (
+	ControlStatus  = "status"
+	ControlPoll    = "poll"
+	ControlResolve = "resolve"
+	ControlAdd     = "add"
+	ControlRemove  = "remove"
+)
+
+// controlIdle closes control connection without request for it
+const controlIdle = time.Minute
+
+// ControlRequest is a line of JSON sent to ControlSocket, Peer is the
+// address of add and remove.
+type ControlRequest struct {
+	Cmd  string `json:"cmd"`
+	Peer string `json:"peer,omitempty"`
+}
+
+// ControlReply is a line of JSON answering ControlRequest, Stats is set
+// by status and Peers is the number of peers after resolve, add and
+// remove.
+type ControlReply struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	Stats *Stats `json:"stats,omitempty"`
+	Peers int    `json:"peers,omitempty"`
+}
+
+// ControlCall sends req to control socket at path and returns its reply
+func ControlCall(path string, req ControlRequest) (reply ControlReply, err error) {
+	conn, err := net.DialTimeout("unix", path, controlIdle)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlIdle))
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return
+	}
+	if err = json.NewDecoder(conn).Decode(&reply); err != nil {
+		return
+	}
+	if !reply.OK {
+		err = errors.New(reply.Error)
+	}
+	return
+}
+
+// listenControl opens control socket at path readable and writable by
+// owner only, stale socket of last run is replaced. The socket is created
+// in a directory of mode 0700 and renamed to path after chmod, so nobody
+// else could connect before. It's left on close, see startControl.
+func listenControl(path string) (ln *net.UnixListener, err error) {
+	if fi, serr := os.Lstat(path); serr == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			err = fmt.Errorf("%s exists and is not a socket", path)
+			return
+		}
+		if err = os.Remove(path); err != nil {
+			return
+		}
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".gontpd-control")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	ln, err = net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return
+	}
+	ln.SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, 0600); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		ln.Close()
+		ln = nil
+	}
+	return
+}
+
+// startControl serves control socket at path until ctx is done, socket
+// is removed then.
+func (d *NTPd) startControl(ctx context.Context, path string) (err error) {
+	ln, err := listenControl(path)
+	if err != nil {
+		return
+	}
+	logger().Infof("Listen control: %s", path)
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		// socket belongs to new process after Restart
+		d.mu.RLock()
+		restarted := d.restarted
+		d.mu.RUnlock()
+		if !restarted {
+			os.Remove(path)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					logger().Errorf("control: %s", err)
+				}
+				return
+			}
+			go d.serveControl(ctx, conn)
+		}
+	}()
+	return
+}
+
+// serveControl answers requests of conn line by line
+func (d *NTPd) serveControl(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	s := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(controlIdle))
+		if !s.Scan() {
+			return
+		}
+		var req ControlRequest
+		reply := ControlReply{}
+		if err := json.Unmarshal(s.Bytes(), &req); err != nil {
+			reply.Error = fmt.Sprintf("invalid request: %s", err)
+		} else {
+			reply = d.runControl(ctx, req)
+		}
+		if err := enc.Encode(reply); err != nil {
+			return
+		}
+	}
+}
+
+// runControl runs command of req
+func (d *NTPd) runControl(ctx context.Context, req ControlRequest) (reply ControlReply) {
+	var err error
+	switch req.Cmd {
+	case ControlStatus:
+		s := d.Stats()
+		reply.Stats = &s
+	case ControlPoll:
+		d.pollNow()
+	case ControlResolve:
+		cfg := d.config()
+		d.refreshPeers(ctx, &cfg)
+		reply.Peers = len(d.peers())
+	case ControlAdd:
+		err = d.AddPeer(req.Peer)
+		reply.Peers = len(d.peers())
+	case ControlRemove:
+		err = d.RemovePeer(req.Peer)
+		reply.Peers = len(d.peers())
+	default:
+		err = fmt.Errorf("unknown command %q", req.Cmd)
+	}
+	if err != nil {
+		reply.Error = err.Error()
+		return
+	}
+	reply.OK = true
+	if req.Cmd != ControlStatus {
+		logger().Infof("control: %s %s", req.Cmd, req.Peer)
+	}
+	return
+}
+
+// pollNow cuts sleep of Run short, see sleepPoll
+func (d *NTPd) pollNow() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sleepPoll sleeps t until next poll of Run unless pollNow is called,
+// WATCHDOG=1 is sent every watchdog interval meanwhile.
+func (d *NTPd) sleepPoll(ctx context.Context, t time.Duration) error {
+	timer := time.NewTimer(t)
+	defer timer.Stop()
+	var tick <-chan time.Time
+	if d.watchdog > 0 {
+		ticker := time.NewTicker(d.watchdog)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		case <-d.wake:
+			return nil
+		case <-tick:
+			notify("WATCHDOG=1")
+		}
+	}
+}
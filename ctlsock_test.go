@@ -0,0 +1,131 @@
+package gontpd
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenControlMode(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gontpd.sock")
+	ln, err := listenControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if fi, err := os.Lstat(path); err != nil || fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Fatalf("socket mode %v err %v", fi.Mode(), err)
+	}
+	// temporary directory is removed
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d entries left in %s", len(entries), dir)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestControlSocket(t *testing.T) {
+	ms := time.Millisecond
+	d := newTestNTPd(&Config{PeerList: Peers("192.0.2.1")},
+		newTestPeer("192.0.2.1", 0, 5*ms))
+	d.lookup = func(addrs []string) map[string][]net.IP {
+		pool := map[string][]net.IP{}
+		for _, a := range addrs {
+			if a == "time.example.com" {
+				pool[a] = []net.IP{net.ParseIP("192.0.2.3")}
+			} else if ip := net.ParseIP(a); ip != nil {
+				pool[a] = []net.IP{ip}
+			}
+		}
+		return pool
+	}
+	d.wake = make(chan struct{}, 1)
+	d.dropTable.Store(&dropTable{})
+	path := filepath.Join(t.TempDir(), "gontpd.sock")
+	// stale socket of last run
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := d.startControl(ctx, path); err == nil {
+		t.Fatal("regular file replaced")
+	}
+	os.Remove(path)
+	if err := d.startControl(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("socket mode %v err %v", fi.Mode(), err)
+	}
+
+	reply, err := ControlCall(path, ControlRequest{Cmd: ControlStatus})
+	if err != nil || reply.Stats == nil || len(reply.Stats.Peers) != 1 {
+		t.Fatalf("status %+v err %v", reply, err)
+	}
+
+	if _, err = ControlCall(path, ControlRequest{Cmd: ControlPoll}); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.sleepPoll(ctx, time.Hour); err != nil {
+		t.Errorf("sleep not cut short: %s", err)
+	}
+
+	if reply, err = ControlCall(path, ControlRequest{Cmd: ControlAdd, Peer: "192.0.2.2"}); err != nil || reply.Peers != 2 {
+		t.Fatalf("add %+v err %v", reply, err)
+	}
+	if _, err = ControlCall(path, ControlRequest{Cmd: ControlAdd, Peer: "192.0.2.2"}); err == nil {
+		t.Error("peer added twice")
+	}
+	if reply, err = ControlCall(path, ControlRequest{Cmd: ControlRemove, Peer: "192.0.2.1"}); err != nil || reply.Peers != 1 {
+		t.Fatalf("remove %+v err %v", reply, err)
+	}
+	if _, err = ControlCall(path, ControlRequest{Cmd: ControlRemove, Peer: "192.0.2.1"}); err == nil {
+		t.Error("removed peer not found")
+	}
+	// address resolved from hostname
+	if reply, err = ControlCall(path, ControlRequest{Cmd: ControlAdd, Peer: "time.example.com"}); err != nil || reply.Peers != 2 {
+		t.Fatalf("add hostname %+v err %v", reply, err)
+	}
+	if reply, err = ControlCall(path, ControlRequest{Cmd: ControlRemove, Peer: "192.0.2.3"}); err != nil || reply.Peers != 1 {
+		t.Fatalf("remove resolved address %+v err %v", reply, err)
+	}
+
+	if _, err = ControlCall(path, ControlRequest{Cmd: "shutdown"}); err == nil ||
+		!strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("unknown command err %v", err)
+	}
+
+	// bad line is answered, connection stays usable
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for _, line := range []string{"status\n", `{"cmd":"status"}` + "\n"} {
+		conn.Write([]byte(line))
+		resp, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok := strings.HasPrefix(resp, `{"ok":true`); ok != (line != "status\n") {
+			t.Errorf("%q answered %q", line, resp)
+		}
+	}
+
+	cancel()
+	time.Sleep(10 * ms)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket left after stop: %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package gontpd
+
+import (
+	"math"
+	"time"
+)
+
+// Discipline of local clock
+const (
+	// disciplineKernel passes offset to kernel PLL by adjtimex(2), or
+	// slews it by adjtime(2)
+	disciplineKernel = "kernel"
+	// disciplineLoop steers clock only by frequency of clockLoop
+	disciplineLoop = "loop"
+)
+
+const (
+	// loopGain is time constant of loop in poll intervals, offset is
+	// corrected by 1/loopGain every poll
+	loopGain = 4
+	// fllInterval is the minimum poll interval of FLL, frequency
+	// wander beats phase noise over it (the Allan intercept)
+	fllInterval = 2048 * time.Second
+	fllGain     = 0.25
+	// maxFreq is the maximum frequency correction of kernel in ppm
+	maxFreq = 500
+)
+
+// state of clockLoop
+const (
+	// loopUnset has no sample yet
+	loopUnset uint8 = iota
+	// loopFreq measures frequency by the next sample
+	loopFreq
+	loopFLL
+	loopPLL
+)
+
+var loopStates = []string{"unset", "freq", "fll", "pll"}
+
+// clockLoop is a hybrid PLL/FLL like RFC 5905 Section A.5.5.6. Frequency
+// is integrated from offsets, phase is corrected by a frequency term
+// over the next poll, so clock is steered by frequency only and it's
+// disciplined between polls.
+type clockLoop struct {
+	// freq is the frequency correction of local oscillator in ppm
+	freq  float64
+	state uint8
+	// phase is the frequency term correcting lastOffset in ppm, since
+	// last update
+	phase      float64
+	lastOffset time.Duration
+	last       time.Time
+}
+
+// update feeds offset measured at now and returns the frequency in ppm
+// to set until the next poll after about interval, phase is corrected at
+// most maxSlew ppm.
+func (l *clockLoop) update(offset, interval time.Duration, maxSlew float64, now time.Time) (ppm float64) {
+	if interval <= 0 {
+		interval = pollTable[0]
+	}
+	tc := loopGain * interval.Seconds()
+	theta := offset.Seconds()
+
+	if l.state == loopUnset {
+		l.state = loopFreq
+	} else {
+		mu := now.Sub(l.last).Seconds()
+		if mu <= 0 {
+			mu = interval.Seconds()
+		}
+		// offset left if the frequency were right
+		expected := l.lastOffset.Seconds() - l.phase/1e6*mu
+		switch {
+		case l.state == loopFreq:
+			l.freq += (theta - expected) / mu * 1e6
+			l.state = loopPLL
+		case mu >= fllInterval.Seconds():
+			l.freq += fllGain * (theta - expected) / mu * 1e6
+			l.state = loopFLL
+		default:
+			l.freq += theta * mu / (tc * tc) * 1e6
+			l.state = loopPLL
+		}
+		l.freq = clampFreq(l.freq)
+	}
+	l.phase = theta / tc * 1e6
+	if math.Abs(l.phase) > maxSlew {
+		logger().Infof("loop: slew of %s clamped to max slew rate %.0f ppm", offset, maxSlew)
+		l.phase = math.Copysign(maxSlew, l.phase)
+	}
+	l.lastOffset = offset
+	l.last = now
+	return clampFreq(l.freq + l.phase)
+}
+
+// reset forgets phase after clock is stepped, frequency is kept
+func (l *clockLoop) reset() {
+	if l.state != loopUnset {
+		l.state = loopFreq
+	}
+	l.phase = 0
+	l.lastOffset = 0
+	l.last = time.Time{}
+}
+
+func clampFreq(ppm float64) float64 {
+	switch {
+	case ppm > maxFreq:
+		return maxFreq
+	case ppm < -maxFreq:
+		return -maxFreq
+	}
+	return ppm
+}
+
+// loopClock disciplines clock by frequency of clockLoop, offset over step
+// threshold is stepped by syncClock. Offset over panic threshold is
+// refused unless force.
+func (d *NTPd) loopClock(offset time.Duration, leap uint8, cfg *Config) (stepped bool, err error) {
+	if err = checkPanic(offset, cfg); err != nil {
+		return
+	}
+	if absDuration(offset) >= cfg.StepThreshold {
+		d.loop.reset()
+		return syncClock(offset, leap, cfg)
+	}
+	ppm := d.loop.update(offset, d.sleep, cfg.MaxSlewRate, time.Now())
+	if debug {
+		logger().Debugf("loop: offset=%s freq=%.3f ppm set %.3f ppm", offset, d.loop.freq, ppm)
+	}
+	err = setLoopFrequency(ppm, leap)
+	if d.stat != nil {
+		d.stat.setLoop(d.loop)
+	}
+	return
+}
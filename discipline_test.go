@@ -0,0 +1,85 @@
+package gontpd
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// simClock is local clock running at skew ppm plus frequency correction
+type simClock struct {
+	skew float64
+	// err is local clock minus true time
+	err time.Duration
+}
+
+func (c *simClock) run(ppm float64, d time.Duration) {
+	c.err += time.Duration((c.skew + ppm) / 1e6 * float64(d))
+}
+
+func TestClockLoopConverge(t *testing.T) {
+	for _, g := range []struct {
+		skew     float64
+		err      time.Duration
+		interval time.Duration
+		polls    int
+	}{
+		{50, 5 * time.Millisecond, 64 * time.Second, 60},
+		{-120, -20 * time.Millisecond, 64 * time.Second, 60},
+		{10, 5 * time.Millisecond, 1024 * time.Second, 100},
+		// FLL
+		{-30, time.Millisecond, 4096 * time.Second, 40},
+	} {
+		c := &simClock{skew: g.skew, err: g.err}
+		l := &clockLoop{}
+		now := time.Unix(1600000000, 0)
+		for i := 0; i < g.polls; i++ {
+			ppm := l.update(-c.err, g.interval, maxFreq, now)
+			c.run(ppm, g.interval)
+			now = now.Add(g.interval)
+		}
+		if math.Abs(l.freq+g.skew) > 0.1 || absDuration(c.err) > 50*time.Microsecond {
+			t.Errorf("skew %.1f ppm interval %s: freq %.3f ppm, error %s",
+				g.skew, g.interval, l.freq, c.err)
+		}
+		want := loopPLL
+		if g.interval >= fllInterval {
+			want = loopFLL
+		}
+		if l.state != want {
+			t.Errorf("interval %s: state %s", g.interval, loopStates[l.state])
+		}
+	}
+}
+
+func TestClockLoopReset(t *testing.T) {
+	l := &clockLoop{}
+	now := time.Unix(1600000000, 0)
+	l.update(time.Millisecond, time.Minute, maxFreq, now)
+	l.update(2*time.Millisecond, time.Minute, maxFreq, now.Add(time.Minute))
+	freq := l.freq
+	l.reset()
+	if l.state != loopFreq || l.freq != freq || l.phase != 0 {
+		t.Errorf("reset loop %+v", l)
+	}
+	if ppm := l.update(0, time.Minute, maxFreq, now.Add(2*time.Minute)); ppm != freq {
+		t.Errorf("frequency %.3f after reset, expect %.3f", ppm, freq)
+	}
+
+	l.freq = 1000
+	if ppm := l.update(0, time.Minute, maxFreq, now.Add(3*time.Minute)); ppm != maxFreq {
+		t.Errorf("frequency %.3f over max", ppm)
+	}
+}
+
+func TestClockLoopMaxSlew(t *testing.T) {
+	l := &clockLoop{}
+	now := time.Unix(1600000000, 0)
+	// 100ms over 4 minutes is 416 ppm
+	if ppm := l.update(100*time.Millisecond, time.Minute, 50, now); ppm != 50 {
+		t.Errorf("frequency %.3f ppm over max slew", ppm)
+	}
+	if ppm := l.update(-100*time.Millisecond, time.Minute, 50, now.Add(time.Minute)); l.phase != -50 {
+		t.Errorf("phase %.3f ppm over max slew, frequency %.3f", l.phase, ppm)
+	}
+}
@@ -0,0 +1,59 @@
+package gontpd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// driftInterval is the minimum interval between drift file writes
+const driftInterval = time.Hour
+
+// readDriftFile reads frequency correction in ppm written by writeDriftFile,
+// the format is the same as ntpd's drift file. Frequency that is not a
+// number or over maxFreq is an error, the file is corrupted.
+func readDriftFile(path string) (ppm float64, err error) {
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	ppm, err = strconv.ParseFloat(strings.TrimSpace(string(p)), 64)
+	if err != nil {
+		return
+	}
+	if math.IsNaN(ppm) || math.IsInf(ppm, 0) || math.Abs(ppm) > maxFreq {
+		return 0, fmt.Errorf("%s: frequency %g ppm out of range ±%d ppm", path, ppm, maxFreq)
+	}
+	return
+}
+
+// writeDriftFile writes ppm into a temp file then renames it to path,
+// so the drift file won't be corrupted on crash.
+func writeDriftFile(path string, ppm float64) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".drift")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+
+	_, err = f.WriteString(strconv.FormatFloat(ppm, 'f', 3, 64) + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+	return os.Rename(f.Name(), path)
+}
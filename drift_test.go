@@ -0,0 +1,69 @@
+package gontpd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDriftFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gontpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gontpd.drift")
+
+	if _, err = readDriftFile(path); err == nil {
+		t.Error("read not exist drift file")
+	}
+
+	for _, ppm := range []float64{-12.345, 0, 3.2} {
+		err = writeDriftFile(path, ppm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readDriftFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != ppm {
+			t.Errorf("expect %f got %f", ppm, got)
+		}
+	}
+
+	fl, _ := ioutil.ReadDir(dir)
+	if len(fl) != 1 {
+		t.Errorf("temp file left: %v", fl)
+	}
+
+	for _, bad := range []string{"bad", "NaN", "+Inf", "-Inf", "1e9", "500.001", "-600"} {
+		ioutil.WriteFile(path, []byte(bad+"\n"), 0644)
+		if ppm, err := readDriftFile(path); err == nil {
+			t.Errorf("read bad drift file %q: %g ppm", bad, ppm)
+		}
+	}
+	for _, edge := range []float64{maxFreq, -maxFreq} {
+		if err = writeDriftFile(path, edge); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := readDriftFile(path); err != nil || got != edge {
+			t.Errorf("read drift file %g: got %g err=%v", edge, got, err)
+		}
+	}
+}
+
+func TestLoadDriftOutOfRange(t *testing.T) {
+	defer setLogger(stdLogger{})
+	setLogger(&testLogger{})
+
+	path := filepath.Join(t.TempDir(), "gontpd.drift")
+	ioutil.WriteFile(path, []byte("1e9\n"), 0644)
+	d := newTestNTPd(&Config{DriftFile: path})
+	d.loop = &clockLoop{}
+	d.loadDrift()
+	if d.loop.freq != 0 {
+		t.Errorf("loop frequency %g ppm from out of range drift file", d.loop.freq)
+	}
+}
@@ -0,0 +1,59 @@
+package gontpd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// extension field of RFC 7822, between header and MAC
+const (
+	extHeaderSize = 4
+	// minExtSize is min length of extension field followed by MAC
+	minExtSize = 16
+	// minLastExtSize is min length of the last extension field without
+	// MAC, so that it can't be taken as MAC
+	minLastExtSize = 28
+)
+
+// extField is an extension field of packet at off, body is the value
+// with padding and refers to the packet.
+type extField struct {
+	typ  uint16
+	off  int
+	body []byte
+}
+
+// extensions walks extension fields of packet p, returns them with
+// offset of MAC, which is len(p) if p has no MAC.
+// Rest of packet which is as long as MAC is MAC, RFC 7822 Section 7.5.
+func extensions(p []byte) (exts []extField, mac int, err error) {
+	mac = len(p)
+	for off := headerSize; off < len(p); {
+		rem := len(p) - off
+		if isMACSize(rem) {
+			mac = off
+			return
+		}
+		if rem < minExtSize {
+			err = errors.New("short extension field")
+			return
+		}
+		typ := binary.BigEndian.Uint16(p[off:])
+		length := int(binary.BigEndian.Uint16(p[off+2:]))
+		switch {
+		case length < minExtSize || length%4 != 0:
+			err = fmt.Errorf("extension field %#04x has invalid length %d", typ, length)
+		case length > rem:
+			err = fmt.Errorf("extension field %#04x overflows packet", typ)
+		case length == rem && length < minLastExtSize:
+			err = fmt.Errorf("last extension field %#04x is shorter than %d", typ, minLastExtSize)
+		}
+		if err != nil {
+			return
+		}
+		exts = append(exts, extField{typ: typ, off: off, body: p[off+extHeaderSize : off+length]})
+		off += length
+	}
+	return
+}
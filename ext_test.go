@@ -0,0 +1,122 @@
+package gontpd
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// appendExt appends extension field typ with body padded to length
+func appendExt(p []byte, typ uint16, length int) []byte {
+	f := make([]byte, length)
+	binary.BigEndian.PutUint16(f, typ)
+	binary.BigEndian.PutUint16(f[2:], uint16(length))
+	for i := extHeaderSize; i < length; i++ {
+		f[i] = byte(i)
+	}
+	return append(p, f...)
+}
+
+// signExt appends MAC of k over header and extensions of p
+func signExt(p []byte, k *symKey) []byte {
+	n := len(p)
+	p = append(p, 0, 0, 0, 0)
+	setUint32(p, n, k.id)
+	return k.digest(p, p[:n])
+}
+
+func TestExtensions(t *testing.T) {
+	kt, err := parseKeys(strings.NewReader(testKeys), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := newTestRequest
+	zero := appendExt(req(), 0x0104, 32)
+	binary.BigEndian.PutUint16(zero[headerSize+2:], 0)
+
+	for _, c := range []struct {
+		name string
+		p    []byte
+		typs []uint16
+		mac  int
+		ok   bool
+	}{
+		{"none", req(), nil, headerSize, true},
+		{"one", appendExt(req(), 0x0104, 32), []uint16{0x0104}, 80, true},
+		{"two", appendExt(appendExt(req(), 0x0104, 16), 0x0204, 28), []uint16{0x0104, 0x0204}, 92, true},
+		{"MAC only", signExt(req(), kt[3]), nil, headerSize, true},
+		{"with MAC", signExt(appendExt(req(), 0x0104, 16), kt[1]), []uint16{0x0104}, 64, true},
+		{"short", append(req(), 0, 0, 0, 0), nil, 0, false},
+		{"short field", appendExt(req(), 0x0104, 12)[:60], nil, 0, false},
+		{"invalid length", appendExt(req(), 0x0104, 30), nil, 0, false},
+		{"overflow", appendExt(req(), 0x0104, 32)[:76], nil, 0, false},
+		{"short last", appendExt(req(), 0x0104, 16), nil, 0, false},
+		{"zero length", zero, nil, 0, false},
+	} {
+		exts, mac, err := extensions(c.p)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: err=%v", c.name, err)
+			continue
+		}
+		if !c.ok {
+			continue
+		}
+		if mac != c.mac || len(exts) != len(c.typs) {
+			t.Errorf("%s: mac=%d exts=%d", c.name, mac, len(exts))
+			continue
+		}
+		for i, e := range exts {
+			if e.typ != c.typs[i] || e.body[0] != extHeaderSize {
+				t.Errorf("%s: field %d type=%#04x body=%v", c.name, i, e.typ, e.body[:4])
+			}
+		}
+	}
+}
+
+func TestHandleExtensions(t *testing.T) {
+	kt, err := parseKeys(strings.NewReader(testKeys), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newTestNTPd(&Config{})
+	d.dropTable.Store(&dropTable{})
+	d.keys = kt
+	w := &worker{lru: newLRU(0), d: d}
+	raddr := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 123}
+
+	for _, c := range []struct {
+		name   string
+		req    []byte
+		rn     int
+		signed bool
+	}{
+		{"extension", appendExt(newTestRequest(), 0xf000, 28), headerSize, false},
+		{"extension and MAC", signExt(appendExt(newTestRequest(), 0xf000, 16), kt[1]),
+			headerSize + keyIDSize + kt[1].size, true},
+		{"malformed extension", appendExt(newTestRequest(), 0xf000, 20)[:60], 0, false},
+		{"bad MAC", append(appendExt(newTestRequest(), 0xf000, 16), make([]byte, 20)...), 0, false},
+	} {
+		p := make([]byte, maxPacketSize)
+		n := copy(p, c.req)
+		xmt := binary.BigEndian.Uint64(p[transmitTimeStamp:])
+		rn, _ := w.handle(p, n, raddr, time.Now())
+		if rn != c.rn {
+			t.Errorf("%s: got %d bytes response, want %d", c.name, rn, c.rn)
+			continue
+		}
+		if rn == 0 {
+			continue
+		}
+		if got := binary.BigEndian.Uint64(p[originTimeStamp:]); got != xmt {
+			t.Errorf("%s: origin=%x, want %x", c.name, got, xmt)
+		}
+		if getMode(p) != modeServer {
+			t.Errorf("%s: mode=%d", c.name, getMode(p))
+		}
+		if c.signed && kt.verify(p[:rn]) == nil {
+			t.Errorf("%s: response not signed", c.name)
+		}
+	}
+}
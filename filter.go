@@ -0,0 +1,126 @@
+package gontpd
+
+import (
+	"sort"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+// maxDisp is the maximum dispersion, sample aged over it is useless,
+// RFC 5905 Section 7.2
+const maxDisp = 16 * time.Second
+
+// filterParams are parameters of clock filter of peer
+type filterParams struct {
+	// size is number of stages, SamplesPerPeer
+	size int
+	// precision of local clock in log2 seconds
+	precision int8
+}
+
+func (d *NTPd) filterParams(cfg *Config) filterParams {
+	return filterParams{size: cfg.SamplesPerPeer, precision: d.precision}
+}
+
+// filterSample is a stage of clock filter, offset and delay of reply,
+// dispersion of it when it's taken at epoch.
+type filterSample struct {
+	resp  *ntp.Response
+	disp  time.Duration
+	epoch time.Time
+}
+
+// newFilterSample returns sample of resp taken at now, its dispersion is
+// precision of peer and local clock plus frequency tolerance over round
+// trip, RFC 5905 Section 8.
+func newFilterSample(resp *ntp.Response, now time.Time, precision int8) filterSample {
+	return filterSample{
+		resp:  resp,
+		disp:  resp.Precision + log2Duration(precision) + time.Duration(phi*float64(resp.RTT)),
+		epoch: now,
+	}
+}
+
+// aged is dispersion of sample grown by frequency tolerance since epoch
+func (s filterSample) aged(now time.Time) time.Duration {
+	return s.disp + time.Duration(phi*float64(now.Sub(s.epoch)))
+}
+
+// addSamples shifts replies taken at now into clock filter of peer, at
+// most size samples are kept.
+func (p *peer) addSamples(replies []*ntp.Response, now time.Time, fp filterParams) {
+	for _, r := range replies {
+		p.samples = append(p.samples, newFilterSample(r, now, fp.precision))
+	}
+	if n := len(p.samples); n > fp.size {
+		p.samples = append([]filterSample(nil), p.samples[n-fp.size:]...)
+	}
+}
+
+// clearFilter drops all samples of peer, they are useless after clock
+// is stepped.
+func (p *peer) clearFilter() {
+	p.samples = nil
+	p.sample = nil
+	p.epoch = time.Time{}
+	if buf := p.pushed(); buf != nil {
+		buf.clear()
+	}
+}
+
+// filter is the clock filter of RFC 5905 Section 10. Samples are sorted
+// by round trip, the first one is the estimate of peer and the candidate
+// of selection. Filter dispersion is sum of aged dispersion of the i-th
+// sample weighted by 2^-(i+1), samples aged over maxDisp are skipped as
+// well as empty stages, so peer is selectable after its first poll.
+// Jitter is the RMS of offset differences to the first one, at least
+// precision of local clock.
+// fresh is set only if the estimate is newer than the last one, a sample
+// is never used twice.
+func (p *peer) filter(now time.Time, fp filterParams) {
+	sorted := make([]filterSample, 0, len(p.samples))
+	// newest first, so the latest one wins ties
+	for i := len(p.samples) - 1; i >= 0; i-- {
+		if s := p.samples[i]; s.aged(now) < maxDisp {
+			sorted = append(sorted, s)
+		}
+	}
+	if len(sorted) == 0 {
+		p.fresh = false
+		return
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].resp.RTT < sorted[j].resp.RTT
+	})
+
+	best := sorted[0]
+	var disp time.Duration
+	offsets := make([]time.Duration, len(sorted))
+	for i := len(sorted) - 1; i >= 0; i-- {
+		disp = (disp + sorted[i].aged(now)) / 2
+		offsets[i] = sorted[i].resp.ClockOffset
+	}
+	p.sample = best.resp
+	p.offset = best.resp.ClockOffset
+	p.delay = best.resp.RTT
+	p.disp = best.resp.RootDispersion
+	p.rootDelay = best.resp.RootDelay
+	p.stratum = best.resp.Stratum
+	p.filterDisp = disp
+	p.jitter = jitter(offsets, best.resp.ClockOffset)
+	if prec := log2Duration(fp.precision); p.jitter < prec {
+		p.jitter = prec
+	}
+	p.fresh = best.epoch.After(p.epoch)
+	if p.fresh {
+		p.epoch = best.epoch
+	}
+}
+
+// clearFilters drops samples of all peers after clock is stepped
+func (d *NTPd) clearFilters() {
+	for _, p := range d.peers() {
+		p.clearFilter()
+	}
+}
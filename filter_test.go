@@ -0,0 +1,139 @@
+package gontpd
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+func TestNewFilterSample(t *testing.T) {
+	now := time.Now()
+	resp := &ntp.Response{Precision: time.Millisecond, RTT: 100 * time.Millisecond}
+	s := newFilterSample(resp, now, -10)
+	// peer and local precision, plus PHI over round trip
+	if want := time.Millisecond + log2Duration(-10) + 1500*time.Nanosecond; s.disp != want {
+		t.Errorf("disp=%s, want %s", s.disp, want)
+	}
+	// PHI over age
+	if d := s.aged(now.Add(1000 * time.Second)); d != s.disp+15*time.Millisecond {
+		t.Errorf("aged=%s, want %s", d, s.disp+15*time.Millisecond)
+	}
+}
+
+// worked example of RFC 5905 Section 10: samples sorted by delay, their
+// dispersions weighted by 2^-(i+1) and jitter as the RMS of offset
+// differences to the first one.
+func TestFilterRFC5905(t *testing.T) {
+	ms := time.Millisecond
+	now := time.Now()
+	fp := filterParams{size: 8, precision: -30}
+	sample := func(offset, delay, disp time.Duration) filterSample {
+		return filterSample{resp: &ntp.Response{ClockOffset: offset,
+			RTT: delay, Stratum: 2}, disp: disp, epoch: now}
+	}
+	p := newPeer("192.0.2.1", net.ParseIP("192.0.2.1"))
+	p.samples = []filterSample{
+		sample(3*ms, 30*ms, 8*ms),
+		sample(ms, 10*ms, 4*ms),
+		sample(2*ms, 20*ms, 16*ms),
+	}
+	p.filter(now, fp)
+
+	if p.offset != ms || p.delay != 10*ms || p.sample != p.samples[1].resp {
+		t.Errorf("offset=%s delay=%s, want 1ms 10ms", p.offset, p.delay)
+	}
+	// 4ms/2 + 16ms/4 + 8ms/8
+	if p.filterDisp != 7*ms {
+		t.Errorf("filter dispersion=%s, want 7ms", p.filterDisp)
+	}
+	// sqrt((0 + 1ms^2 + 2ms^2) / 2)
+	if want := time.Duration(math.Sqrt(2.5) * float64(ms)); p.jitter != want {
+		t.Errorf("jitter=%s, want %s", p.jitter, want)
+	}
+	if !p.fresh {
+		t.Error("first sample is not fresh")
+	}
+
+	// jitter is at least precision of local clock
+	p.filter(now, filterParams{size: 8, precision: -5})
+	if p.jitter != log2Duration(-5) {
+		t.Errorf("jitter=%s, want precision %s", p.jitter, log2Duration(-5))
+	}
+}
+
+func TestFilterAging(t *testing.T) {
+	ms := time.Millisecond
+	now := time.Now()
+	fp := filterParams{size: 8, precision: -30}
+	p := newPeer("192.0.2.1", net.ParseIP("192.0.2.1"))
+	// the lowest delay one is too old to be used
+	p.samples = []filterSample{
+		{resp: &ntp.Response{ClockOffset: 5 * ms, RTT: ms}, disp: ms,
+			epoch: now.Add(-2e6 * time.Second)},
+		{resp: &ntp.Response{ClockOffset: ms, RTT: 10 * ms}, disp: ms,
+			epoch: now.Add(-1000 * time.Second)},
+	}
+	p.filter(now, fp)
+	if p.offset != ms {
+		t.Errorf("offset=%s, sample over max dispersion is used", p.offset)
+	}
+	// dispersion is aged by PHI for 1000s
+	if p.filterDisp != 8*ms {
+		t.Errorf("filter dispersion=%s, want 8ms", p.filterDisp)
+	}
+
+	p.samples = p.samples[:1]
+	p.filter(now, fp)
+	if p.fresh {
+		t.Error("fresh without usable sample")
+	}
+}
+
+func TestFilterEpoch(t *testing.T) {
+	ms := time.Millisecond
+	now := time.Now()
+	fp := filterParams{size: 8, precision: -30}
+	p := newPeer("192.0.2.1", net.ParseIP("192.0.2.1"))
+
+	p.addSamples([]*ntp.Response{{ClockOffset: ms, RTT: 10 * ms}}, now, fp)
+	p.filter(now, fp)
+	if !p.fresh {
+		t.Fatal("first sample is not fresh")
+	}
+
+	// a sample is never used twice
+	now = now.Add(time.Minute)
+	p.addSamples([]*ntp.Response{{ClockOffset: 2 * ms, RTT: 20 * ms}}, now, fp)
+	p.filter(now, fp)
+	if p.fresh || p.offset != ms {
+		t.Errorf("fresh=%v offset=%s, want old sample not fresh", p.fresh, p.offset)
+	}
+
+	now = now.Add(time.Minute)
+	p.addSamples([]*ntp.Response{{ClockOffset: 3 * ms, RTT: 5 * ms}}, now, fp)
+	p.filter(now, fp)
+	if !p.fresh || p.offset != 3*ms {
+		t.Errorf("fresh=%v offset=%s, want new sample fresh", p.fresh, p.offset)
+	}
+}
+
+func TestClearFilter(t *testing.T) {
+	now := time.Now()
+	p := newPeer("SHM(0)", refclockAddr(0))
+	p.refclock = &refclock{name: "SHM(0)"}
+	p.refclock.add(&ntp.Response{Time: now})
+	p.addSamples([]*ntp.Response{{Time: now}}, now, testFilter)
+	p.filter(now, testFilter)
+
+	d := newTestNTPd(&Config{}, p)
+	d.clearFilters()
+	if len(p.samples) != 0 || p.sample != nil || !p.epoch.IsZero() {
+		t.Errorf("samples=%d sample=%v epoch=%s", len(p.samples), p.sample, p.epoch)
+	}
+	if samples, fresh := p.refclock.take(); len(samples) != 0 || fresh {
+		t.Errorf("pushed samples=%d fresh=%v", len(samples), fresh)
+	}
+}
@@ -0,0 +1,70 @@
+package gontpd
+
+import "time"
+
+// defaultMaxHoldoverDispersion keeps serving in holdover for about 18
+// hours at phi after a sync with small dispersion
+const defaultMaxHoldoverDispersion = time.Second
+
+// holdover states, clock is served as unsynchronized in holdoverUnsync
+const (
+	holdoverNone uint8 = iota
+	holdoverActive
+	holdoverUnsync
+)
+
+var holdoverStates = []string{"synced", "holdover", "unsync"}
+
+// checkHoldover grows root dispersion served since last sync by phi while
+// no peer could be selected, clock is served as unsynchronized once it's
+// over MaxHoldoverDispersion. Nothing is done before first sync or in
+// orphan mode.
+func (d *NTPd) checkHoldover(cfg *Config, now time.Time) {
+	if d.orphan || d.lastSync.IsZero() {
+		return
+	}
+	if d.holdover == holdoverNone {
+		d.mu.RLock()
+		d.holdoverBase = d.disp
+		d.mu.RUnlock()
+		logger().Warnf("no peer selected, enter holdover since %s",
+			d.lastSync.Format(time.RFC3339))
+	}
+
+	disp := d.holdoverBase + time.Duration(phi*float64(now.Sub(d.lastSync)))
+	state := holdoverActive
+	if disp > cfg.MaxHoldoverDispersion {
+		state = holdoverUnsync
+		if d.holdover != holdoverUnsync {
+			logger().Warnf("holdover dispersion %s over %s, serve as unsynchronized",
+				disp, cfg.MaxHoldoverDispersion)
+		}
+	}
+	d.holdover = state
+
+	d.mu.Lock()
+	d.disp = disp
+	d.mu.Unlock()
+	d.modifyTemplate(func(t []byte) {
+		setUint32(t, rootDispersionPos, toNtpShortTime(disp))
+		if state == holdoverUnsync {
+			setLi(t, notSync)
+		}
+	})
+	if d.stat != nil {
+		d.stat.dispGauge.Set(disp.Seconds())
+		d.stat.setHoldover(state)
+	}
+}
+
+// leaveHoldover is called on sync, template is set by the new sample
+func (d *NTPd) leaveHoldover() {
+	if d.holdover == holdoverNone {
+		return
+	}
+	logger().Infof("peers back, leave holdover")
+	d.holdover = holdoverNone
+	if d.stat != nil {
+		d.stat.setHoldover(holdoverNone)
+	}
+}
@@ -0,0 +1,55 @@
+package gontpd
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestCheckHoldover(t *testing.T) {
+	ms := time.Millisecond
+	d := newTestNTPd(&Config{},
+		newTestPeer("192.0.2.1", 0, 5*ms),
+		newTestPeer("192.0.2.2", ms, 5*ms),
+		newTestPeer("192.0.2.3", 2*ms, 5*ms))
+	cfg := d.config()
+	now := time.Now()
+
+	d.checkHoldover(&cfg, now)
+	if d.holdover != holdoverNone {
+		t.Fatal("holdover before first sync")
+	}
+
+	op := d.find()
+	d.setTemplate(op)
+	d.updateState(op)
+	base := d.disp
+	d.lastSync = now.Add(-time.Hour)
+	d.checkHoldover(&cfg, now)
+	want := base + time.Duration(phi*float64(time.Hour))
+	served := fromNtpShortTime(binary.BigEndian.Uint32(d.loadTemplate()[rootDispersionPos:]))
+	if d.holdover != holdoverActive || d.disp != want ||
+		served-want > ms || want-served > ms {
+		t.Fatalf("holdover=%d disp=%s served=%s, want %s", d.holdover, d.disp, served, want)
+	}
+	if li := d.loadTemplate()[liVnModePos] >> 6; li == notSync {
+		t.Error("unsynchronized in holdover")
+	}
+
+	// growth is from dispersion of last sync, not from the grown one
+	d.lastSync = now.Add(-20 * time.Hour)
+	d.checkHoldover(&cfg, now)
+	if want := base + time.Duration(phi*float64(20*time.Hour)); d.disp != want {
+		t.Errorf("disp=%s, want %s", d.disp, want)
+	}
+	if d.holdover != holdoverUnsync || d.loadTemplate()[liVnModePos]>>6 != notSync {
+		t.Fatalf("holdover=%d template=%x", d.holdover, d.loadTemplate())
+	}
+
+	d.setTemplate(op)
+	d.updateState(op)
+	if d.holdover != holdoverNone || d.disp != base ||
+		d.loadTemplate()[liVnModePos]>>6 == notSync {
+		t.Errorf("not resumed holdover=%d disp=%s", d.holdover, d.disp)
+	}
+}
@@ -0,0 +1,86 @@
+package gontpd
+
+import (
+	"time"
+)
+
+const (
+	// huffPuffBin is the span of each minimum delay of huff-n'-puff
+	// filter, 15 minutes as ntpd
+	huffPuffBin = 15 * time.Minute
+
+	defaultHuffPuffWindow = 2 * time.Hour
+)
+
+// huffPuff corrects offset biased by congestion on one direction of the
+// link like huffpuff of ntpd. Extra delay is
+// assumed to be all on one way, so offset is moved toward zero by half
+// of its delay over the minimum delay of window.
+type huffPuff struct {
+	// bins are minimum delay of each huffPuffBin of window, 0 if none
+	bins  []time.Duration
+	pos   int
+	start time.Time
+}
+
+func newHuffPuff(window time.Duration, now time.Time) *huffPuff {
+	n := int(window / huffPuffBin)
+	if n < 1 {
+		n = 1
+	}
+	return &huffPuff{bins: make([]time.Duration, n), start: now}
+}
+
+// minDelay returns minimum delay of window
+func (h *huffPuff) minDelay() (min time.Duration) {
+	for _, b := range h.bins {
+		if b > 0 && (min == 0 || b < min) {
+			min = b
+		}
+	}
+	return
+}
+
+// correct records delay at now and returns offset corrected by it
+func (h *huffPuff) correct(offset, delay time.Duration, now time.Time) time.Duration {
+	// window is restarted after clock step or long suspend
+	if now.Before(h.start) || now.Sub(h.start) >= time.Duration(len(h.bins))*huffPuffBin {
+		for i := range h.bins {
+			h.bins[i] = 0
+		}
+		h.start = now
+	}
+	for now.Sub(h.start) >= huffPuffBin {
+		h.pos = (h.pos + 1) % len(h.bins)
+		h.bins[h.pos] = 0
+		h.start = h.start.Add(huffPuffBin)
+	}
+	if b := h.bins[h.pos]; b == 0 || delay < b {
+		h.bins[h.pos] = delay
+	}
+
+	excess := (delay - h.minDelay()) / 2
+	if offset > 0 {
+		return offset - excess
+	}
+	return offset + excess
+}
+
+// applyHuffPuff returns offset of op corrected by huff-n'-puff filter if
+// HuffPuff
+func (d *NTPd) applyHuffPuff(op *offsetPeer, cfg *Config, now time.Time) time.Duration {
+	offset := op.resp.ClockOffset
+	if !cfg.HuffPuff {
+		d.huffpuff = nil
+		return offset
+	}
+	if d.huffpuff == nil {
+		d.huffpuff = newHuffPuff(cfg.HuffPuffWindow, now)
+	}
+	corrected := d.huffpuff.correct(offset, op.resp.RTT, now)
+	if debug && corrected != offset {
+		logger().Debugf("huffpuff: offset %s corrected to %s, delay %s min %s",
+			offset, corrected, op.resp.RTT, d.huffpuff.minDelay())
+	}
+	return corrected
+}
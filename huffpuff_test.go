@@ -0,0 +1,48 @@
+package gontpd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHuffPuff(t *testing.T) {
+	ms := time.Millisecond
+	now := time.Unix(1600000000, 0)
+	h := newHuffPuff(time.Hour, now)
+	if len(h.bins) != 4 {
+		t.Fatalf("%d bins", len(h.bins))
+	}
+
+	// true offset is 2ms and base delay 10ms, extra delay e on uplink
+	// biases offset by e/2
+	for i, e := range []time.Duration{0, 0, 40 * ms, 20 * ms, 0, 60 * ms} {
+		offset, delay := 2*ms+e/2, 10*ms+e
+		got := h.correct(offset, delay, now.Add(time.Duration(i)*time.Minute))
+		if got != 2*ms {
+			t.Errorf("sample %d extra delay %s: offset %s corrected to %s",
+				i, e, offset, got)
+		}
+	}
+
+	// extra delay on downlink biases offset the other way
+	if got := h.correct(-2*ms-20*ms, 50*ms, now.Add(10*time.Minute)); got != -2*ms {
+		t.Errorf("downlink offset corrected to %s", got)
+	}
+
+	// minimum delay expires with its bin
+	if got := h.correct(2*ms, 30*ms, now.Add(50*time.Minute)); got != -8*ms {
+		t.Errorf("offset corrected to %s before minimum delay expired", got)
+	}
+	if got := h.correct(2*ms, 30*ms, now.Add(70*time.Minute)); got != 2*ms {
+		t.Errorf("offset corrected to %s after minimum delay expired", got)
+	}
+	if min := h.minDelay(); min != 30*ms {
+		t.Errorf("min delay %s", min)
+	}
+
+	// window restarts after suspend
+	h.correct(0, 100*ms, now.Add(5*time.Hour))
+	if min := h.minDelay(); min != 100*ms {
+		t.Errorf("min delay %s after suspend", min)
+	}
+}
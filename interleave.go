@@ -0,0 +1,96 @@
+package gontpd
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultInterleaveSize is number of clients remembered for interleaved
+// mode
+const defaultInterleaveSize = 8192
+
+// ilState is receive and transmit timestamps of last response to a
+// client in NTP format, tx is taken after the response is sent.
+type ilState struct {
+	rx, tx uint64
+}
+
+// ilCache remembers last response of clients for interleaved mode. It's
+// shared by workers since requests of a client may be read by any worker
+// of the socket. Clients are kept in two generations, the old one is
+// dropped once the current one is full, so that recent clients are
+// always kept without a list.
+type ilCache struct {
+	mu       sync.Mutex
+	max      int
+	cur, old map[string]ilState
+}
+
+func newILCache(size int) *ilCache {
+	max := size / 2
+	if max < 1 {
+		max = 1
+	}
+	return &ilCache{
+		max: max,
+		cur: make(map[string]ilState),
+		old: make(map[string]ilState),
+	}
+}
+
+func (c *ilCache) get(ip net.IP) (s ilState, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok = c.cur[string(ip)]; ok {
+		return
+	}
+	s, ok = c.old[string(ip)]
+	return
+}
+
+func (c *ilCache) set(ip net.IP, s ilState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.cur[string(ip)]; !ok && len(c.cur) >= c.max {
+		c.old, c.cur = c.cur, make(map[string]ilState, c.max)
+	}
+	c.cur[string(ip)] = s
+}
+
+// interleave turns basic response p into interleaved one if request
+// proves the client has the last response, that is origin timestamp of
+// request is the receive timestamp of last response. Interleaved
+// response carries transmit timestamp of last response, which is taken
+// after it's sent, and receive timestamp of request as origin for
+// client to match them, draft-ietf-ntp-interleaved-modes.
+// org, rx and tx are timestamps of request.
+func (w *worker) interleave(p []byte, ip net.IP, org, rx, tx uint64) bool {
+	c := w.d.interleaves
+	if c == nil || org == 0 || org == tx {
+		return false
+	}
+	last, ok := c.get(ip)
+	if !ok || last.rx != org {
+		return false
+	}
+	setUint64(p, originTimeStamp, rx)
+	setUint64(p, transmitTimeStamp, last.tx)
+	return true
+}
+
+// sent remembers response p to ip for interleaved mode, it's called
+// right after p is sent at now.
+func (w *worker) sent(p []byte, ip net.IP, now time.Time) {
+	c := w.d.interleaves
+	if c == nil || len(p) < headerSize || getMode(p) != modeServer ||
+		p[stratumPos] == 0 {
+		// KoD is never followed by interleaved request
+		return
+	}
+	c.set(ip, ilState{
+		rx: binary.BigEndian.Uint64(p[receiveTimeStamp:]),
+		tx: toNtpTime(now),
+	})
+}
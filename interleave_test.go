@@ -0,0 +1,139 @@
+package gontpd
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestILCache(t *testing.T) {
+	c := newILCache(4)
+	ip := func(i byte) net.IP { return net.IP{192, 0, 2, i} }
+	for i := byte(1); i <= 5; i++ {
+		c.set(ip(i), ilState{rx: uint64(i)})
+	}
+	// 1 and 2 are dropped with old generation
+	for i, want := range []bool{false, false, true, true, true} {
+		if _, ok := c.get(ip(byte(i + 1))); ok != want {
+			t.Errorf("%s: cached=%v, want %v", ip(byte(i+1)), ok, want)
+		}
+	}
+	// update of current generation never drops it
+	c.set(ip(5), ilState{rx: 50})
+	if s, ok := c.get(ip(3)); !ok || s.rx != 3 {
+		t.Errorf("got %v %v", s, ok)
+	}
+	if s, _ := c.get(ip(5)); s.rx != 50 {
+		t.Errorf("got %v", s)
+	}
+}
+
+func TestHandleInterleaved(t *testing.T) {
+	d := newTestNTPd(&Config{Interleaved: true})
+	d.dropTable.Store(&dropTable{})
+	d.interleaves = newILCache(16)
+	w := &worker{lru: newLRU(0), d: d, stat: &workerStat{
+		Req:      prometheus.NewCounter(prometheus.CounterOpts{Name: "req"}),
+		Response: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "response"}, []string{"mode"}),
+	}}
+	raddr := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 123}
+	u64 := func(p []byte, pos int) uint64 { return binary.BigEndian.Uint64(p[pos:]) }
+
+	// basic request starts interleaving
+	p := make([]byte, maxPacketSize)
+	copy(p, newTestRequest())
+	xmt1 := u64(p, transmitTimeStamp)
+	n, stamp := w.handle(p, headerSize, raddr, time.Now())
+	if n != headerSize || !stamp || u64(p, originTimeStamp) != xmt1 {
+		t.Fatalf("basic response n=%d stamp=%v", n, stamp)
+	}
+	stampTransmit(p)
+	sentAt := time.Now()
+	w.sent(p[:n], raddr.IP, sentAt)
+	rx1 := u64(p, receiveTimeStamp)
+
+	// client echoes receive timestamp of last response as origin and
+	// puts its own receive timestamp of it in receive
+	clientRx := toNtpTime(time.Now())
+	p = make([]byte, maxPacketSize)
+	copy(p, newTestRequest())
+	setUint64(p, originTimeStamp, rx1)
+	setUint64(p, receiveTimeStamp, clientRx)
+	n, stamp = w.handle(p, headerSize, raddr, time.Now())
+	if n != headerSize || stamp {
+		t.Fatalf("interleaved response n=%d stamp=%v", n, stamp)
+	}
+	if got := u64(p, originTimeStamp); got != clientRx {
+		t.Errorf("origin=%x, want %x", got, clientRx)
+	}
+	if got := u64(p, transmitTimeStamp); got != toNtpTime(sentAt) {
+		t.Errorf("transmit=%x, want %x", got, toNtpTime(sentAt))
+	}
+	if u64(p, receiveTimeStamp) <= rx1 {
+		t.Error("receive timestamp of last request")
+	}
+
+	// stale origin
+	p = make([]byte, maxPacketSize)
+	copy(p, newTestRequest())
+	setUint64(p, originTimeStamp, rx1-1)
+	if _, stamp = w.handle(p, headerSize, raddr, time.Now()); !stamp {
+		t.Error("interleaved response to stale origin")
+	}
+	// unknown client
+	p = make([]byte, maxPacketSize)
+	copy(p, newTestRequest())
+	setUint64(p, originTimeStamp, rx1)
+	if _, stamp = w.handle(p, headerSize, &net.UDPAddr{IP: net.IP{192, 0, 2, 9}}, time.Now()); !stamp {
+		t.Error("interleaved response to unknown client")
+	}
+
+	if got := testutil.ToFloat64(w.stat.Response.WithLabelValues("interleaved")); got != 1 {
+		t.Errorf("%v interleaved responses, want 1", got)
+	}
+	if got := testutil.ToFloat64(w.stat.Response.WithLabelValues("basic")); got != 3 {
+		t.Errorf("%v basic responses, want 3", got)
+	}
+}
+
+func TestServeInterleaved(t *testing.T) {
+	for _, batch := range []int{1, 8} {
+		d := newTestServer(t, &Config{Interleaved: true, BatchSize: batch})
+		conn, err := net.DialUDP("udp", nil, d.conns[0].LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := func(req []byte) []byte {
+			resp := make([]byte, maxPacketSize)
+			conn.SetDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Write(req); err != nil {
+				t.Fatal(err)
+			}
+			n, err := conn.Read(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return resp[:n]
+		}
+
+		req := newTestRequest()
+		resp := query(req)
+		xmt1 := binary.BigEndian.Uint64(resp[transmitTimeStamp:])
+		req = newTestRequest()
+		copy(req[originTimeStamp:], resp[receiveTimeStamp:receiveTimeStamp+8])
+		resp = query(req)
+		if got := binary.BigEndian.Uint64(resp[transmitTimeStamp:]); got < xmt1 {
+			t.Errorf("batch %d: transmit of last response %x is before it's stamped %x",
+				batch, got, xmt1)
+		}
+		if binary.BigEndian.Uint64(resp[originTimeStamp:]) == binary.BigEndian.Uint64(req[transmitTimeStamp:]) {
+			t.Errorf("batch %d: basic response", batch)
+		}
+		conn.Close()
+		d.shutdown()
+	}
+}
@@ -0,0 +1,264 @@
+package gontpd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// leapAnnounce is how long before a leap second in leap file the leap
+// indicator is served
+const leapAnnounce = time.Minute
+
+// leapEntry is a line of leap-seconds.list, TAI-UTC is offset since at
+type leapEntry struct {
+	at     time.Time
+	offset int
+}
+
+// leapTable is the content of an IERS/NIST leap-seconds.list
+type leapTable struct {
+	entries []leapEntry
+	updated time.Time
+	expire  time.Time
+}
+
+func ntpSeconds(s string) (t time.Time, err error) {
+	sec, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return
+	}
+	t = ntpEpoch.Add(time.Duration(sec) * time.Second)
+	return
+}
+
+// parseLeapFile reads leap-seconds.list from r and verifies its hash,
+// the SHA1 of update time, expiration time and data lines without
+// whitespace and comments.
+func parseLeapFile(r io.Reader) (t *leapTable, err error) {
+	t = &leapTable{}
+	var (
+		hashed bytes.Buffer
+		sum    []byte
+	)
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		var fields []string
+		switch {
+		case strings.HasPrefix(line, "#$"):
+			fields = strings.Fields(line[2:])
+			if len(fields) > 0 {
+				t.updated, err = ntpSeconds(fields[0])
+			}
+		case strings.HasPrefix(line, "#@"):
+			fields = strings.Fields(line[2:])
+			if len(fields) > 0 {
+				t.expire, err = ntpSeconds(fields[0])
+			}
+		case strings.HasPrefix(line, "#h"):
+			sum, err = parseLeapHash(line[2:])
+		case strings.HasPrefix(line, "#"):
+		default:
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			fields = strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			if len(fields) != 2 {
+				err = errors.New("expect time and offset")
+				break
+			}
+			var e leapEntry
+			e.at, err = ntpSeconds(fields[0])
+			if err == nil {
+				e.offset, err = strconv.Atoi(fields[1])
+			}
+			if err == nil && len(t.entries) > 0 && !e.at.After(t.entries[len(t.entries)-1].at) {
+				err = errors.New("time is not increasing")
+			}
+			t.entries = append(t.entries, e)
+		}
+		if err != nil {
+			err = fmt.Errorf("line %d: %s", n, err)
+			return
+		}
+		for _, f := range fields {
+			hashed.WriteString(f)
+		}
+	}
+	if err = s.Err(); err != nil {
+		return
+	}
+
+	if t.expire.IsZero() {
+		err = errors.New("no expiration time")
+		return
+	}
+	if sum == nil {
+		err = errors.New("no hash")
+		return
+	}
+	if h := sha1.Sum(hashed.Bytes()); !bytes.Equal(h[:], sum) {
+		err = fmt.Errorf("hash mismatch, got %x", h)
+		return
+	}
+	return
+}
+
+// parseLeapHash parses 5 hex words of SHA1, leading zeros of word may
+// be omitted
+func parseLeapHash(s string) (sum []byte, err error) {
+	words := strings.Fields(s)
+	if len(words) != sha1.Size/4 {
+		err = fmt.Errorf("invalid hash %q", s)
+		return
+	}
+	sum = make([]byte, sha1.Size)
+	for i, w := range words {
+		var v uint64
+		v, err = strconv.ParseUint(w, 16, 32)
+		if err != nil {
+			return
+		}
+		binary.BigEndian.PutUint32(sum[i*4:], uint32(v))
+	}
+	return
+}
+
+func loadLeapFile(path string) (t *leapTable, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	t, err = parseLeapFile(f)
+	if err != nil {
+		return
+	}
+	if now := time.Now(); t.expired(now) {
+		logger().Warnf("leap file %s expired at %s, fetch a new one",
+			path, t.expire.Format(time.RFC3339))
+	}
+	return
+}
+
+func (t *leapTable) expired(now time.Time) bool {
+	return !now.Before(t.expire)
+}
+
+// next returns the first leap second after now and whether it is
+// inserted or deleted
+func (t *leapTable) next(now time.Time) (at time.Time, li uint8, ok bool) {
+	for i := 1; i < len(t.entries); i++ {
+		e := t.entries[i]
+		if !e.at.After(now) {
+			continue
+		}
+		li = leapIns
+		if e.offset < t.entries[i-1].offset {
+			li = leapDel
+		}
+		return e.at, li, true
+	}
+	return
+}
+
+// indicator returns leap indicator at now, it's set when next leap
+// second is within before.
+func (t *leapTable) indicator(now time.Time, before time.Duration) uint8 {
+	at, li, ok := t.next(now)
+	if !ok || at.Sub(now) > before {
+		return noLeap
+	}
+	return li
+}
+
+func (d *NTPd) leapTable() *leapTable {
+	t, _ := d.leaps.Load().(*leapTable)
+	return t
+}
+
+// clockLeap returns leap indicator passed to kernel with offset,
+// kernel handles leap second at the end of UTC day so leap second
+// in leap file is scheduled on that day. Without leap file leap of
+// sys peer is used.
+func (d *NTPd) clockLeap(peerLeap uint8, now time.Time) uint8 {
+	t := d.leapTable()
+	if t == nil {
+		return peerLeap
+	}
+	return t.indicator(now, nextLeap(now).Sub(now))
+}
+
+// serveLeap returns leap indicator served to clients, leap second in
+// leap file is announced leapAnnounce before it happens.
+func (d *NTPd) serveLeap(peerLeap uint8, now time.Time) uint8 {
+	if d.config().LeapSmear {
+		// smeared time never has leap second
+		return noLeap
+	}
+	t := d.leapTable()
+	if t == nil {
+		return peerLeap
+	}
+	return t.indicator(now, leapAnnounce)
+}
+
+// untilLeap is seconds to next leap second in leap file, -1 if none
+func (d *NTPd) untilLeap() float64 {
+	t := d.leapTable()
+	if t == nil {
+		return -1
+	}
+	now := time.Now()
+	at, _, ok := t.next(now)
+	if !ok {
+		return -1
+	}
+	return at.Sub(now).Seconds()
+}
+
+// leapLoop updates leap indicator of template when leap second in leap
+// file is announced and passed, since template is only set every poll.
+func (d *NTPd) leapLoop(ctx context.Context) {
+	for {
+		wait := time.Hour
+		now := time.Now()
+		if t := d.leapTable(); t != nil {
+			if at, _, ok := t.next(now); ok {
+				w := at.Add(-leapAnnounce).Sub(now)
+				if w <= 0 {
+					w = at.Sub(now)
+				}
+				if w < wait {
+					wait = w
+				}
+			}
+		}
+		if sleepContext(ctx, wait) != nil {
+			return
+		}
+		if d.leapTable() == nil {
+			continue
+		}
+		li := d.serveLeap(noLeap, time.Now())
+		d.mu.RLock()
+		synced := d.synced
+		d.mu.RUnlock()
+		if synced {
+			d.modifyTemplate(func(t []byte) { setLi(t, li) })
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package gontpd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testLeapFile = `#	leap-seconds.list excerpt
+#$	 3676924800
+#@	3928521600
+#
+2272060800	10	# 1 Jan 1972
+2287785600	11	# 1 Jul 1972
+3692217600	37	# 1 Jan 2017
+#
+#h	b11624ae 51254890 0e740a58 e6679018 6c36b341
+`
+
+func TestParseLeapFile(t *testing.T) {
+	lt, err := parseLeapFile(strings.NewReader(testLeapFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lt.entries) != 3 {
+		t.Fatalf("got %d entries", len(lt.entries))
+	}
+	if want := time.Date(2024, 6, 28, 0, 0, 0, 0, time.UTC); !lt.expire.Equal(want) {
+		t.Errorf("expire=%s, want %s", lt.expire, want)
+	}
+	if !lt.expired(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("not expired")
+	}
+
+	for _, c := range []string{
+		strings.Replace(testLeapFile, "37", "36", 1),
+		strings.Replace(testLeapFile, "#@", "# ", 1),
+		strings.Replace(testLeapFile, "#h", "# ", 1),
+		strings.Replace(testLeapFile, "2287785600", "2272060800", 1),
+	} {
+		if _, err = parseLeapFile(strings.NewReader(c)); err == nil {
+			t.Errorf("no error on %q", c)
+		}
+	}
+}
+
+func TestParseLeapHash(t *testing.T) {
+	sum, err := parseLeapHash(" 1 0 ffffffff 0 a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum[3] != 1 || sum[8] != 0xff || sum[19] != 0xa {
+		t.Errorf("got %x", sum)
+	}
+	if _, err = parseLeapHash("1 2 3"); err == nil {
+		t.Error("short hash accepted")
+	}
+}
+
+func TestLeapIndicator(t *testing.T) {
+	lt, err := parseLeapFile(strings.NewReader(testLeapFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newTestNTPd(&Config{})
+	d.leaps.Store(lt)
+
+	leap := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		now          time.Time
+		clock, serve uint8
+	}{
+		{leap.Add(-48 * time.Hour), noLeap, noLeap},
+		{leap.Add(-12 * time.Hour), leapIns, noLeap},
+		{leap.Add(-30 * time.Second), leapIns, leapIns},
+		{leap, noLeap, noLeap},
+	} {
+		if li := d.clockLeap(leapDel, c.now); li != c.clock {
+			t.Errorf("%s: clock leap=%d, want %d", c.now, li, c.clock)
+		}
+		if li := d.serveLeap(leapDel, c.now); li != c.serve {
+			t.Errorf("%s: serve leap=%d, want %d", c.now, li, c.serve)
+		}
+	}
+
+	del := &leapTable{entries: []leapEntry{{leap, 37}, {leap.AddDate(0, 6, 0), 36}}}
+	if _, li, ok := del.next(leap); !ok || li != leapDel {
+		t.Errorf("li=%d ok=%v, want deletion", li, ok)
+	}
+
+	// without leap file leap of peer is used unless smeared
+	d = newTestNTPd(&Config{})
+	if li := d.serveLeap(leapIns, leap); li != leapIns {
+		t.Errorf("serve leap=%d without leap file", li)
+	}
+	d = newTestNTPd(&Config{LeapSmear: true})
+	d.leaps.Store(lt)
+	if li := d.serveLeap(leapIns, leap.Add(-time.Second)); li != noLeap {
+		t.Errorf("serve leap=%d with smear", li)
+	}
+}
@@ -1 +1,51 @@
 package gontpd
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// Logger receives logs of gontpd by level, see Config.Logger.
+// Debug logs are only emitted when built with debug tag.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// stdLogger writes to standard log package without level
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, v ...interface{}) {
+	if debug {
+		log.Printf(format, v...)
+	}
+}
+
+func (stdLogger) Infof(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+func (stdLogger) Warnf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+func (stdLogger) Errorf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// currentLogger holds Logger of the package, set by New
+var currentLogger atomic.Value
+
+func init() {
+	setLogger(stdLogger{})
+}
+
+func setLogger(l Logger) {
+	currentLogger.Store(&l)
+}
+
+func logger() Logger {
+	return *currentLogger.Load().(*Logger)
+}
@@ -0,0 +1,42 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package gontpd
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+// syslogLogger writes to local syslog daemon
+type syslogLogger struct {
+	w *syslog.Writer
+}
+
+// NewSyslogLogger returns Logger writes to local syslog daemon as
+// daemon facility with tag.
+func NewSyslogLogger(tag string) (Logger, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogLogger{w}, nil
+}
+
+func (s *syslogLogger) Debugf(format string, v ...interface{}) {
+	if debug {
+		s.w.Debug(fmt.Sprintf(format, v...))
+	}
+}
+
+func (s *syslogLogger) Infof(format string, v ...interface{}) {
+	s.w.Info(fmt.Sprintf(format, v...))
+}
+
+func (s *syslogLogger) Warnf(format string, v ...interface{}) {
+	s.w.Warning(fmt.Sprintf(format, v...))
+}
+
+func (s *syslogLogger) Errorf(format string, v ...interface{}) {
+	s.w.Err(fmt.Sprintf(format, v...))
+}
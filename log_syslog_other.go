@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package gontpd
+
+import "errors"
+
+// NewSyslogLogger is not supported on this system
+func NewSyslogLogger(tag string) (Logger, error) {
+	return nil, errors.New("syslog is not supported")
+}
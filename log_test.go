@@ -0,0 +1,58 @@
+package gontpd
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testLogger struct {
+	logs []string
+}
+
+func (l *testLogger) logf(level, format string, v ...interface{}) {
+	l.logs = append(l.logs, level+" "+fmt.Sprintf(format, v...))
+}
+
+func (l *testLogger) Debugf(format string, v ...interface{}) { l.logf("debug", format, v...) }
+func (l *testLogger) Infof(format string, v ...interface{})  { l.logf("info", format, v...) }
+func (l *testLogger) Warnf(format string, v ...interface{})  { l.logf("warn", format, v...) }
+func (l *testLogger) Errorf(format string, v ...interface{}) { l.logf("error", format, v...) }
+
+func TestConfigLogger(t *testing.T) {
+	defer setLogger(stdLogger{})
+	l := &testLogger{}
+	_, err := New(&Config{PeerList: Peers("127.0.0.1"), Logger: l})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.logs) == 0 || !strings.HasPrefix(l.logs[0], "info clock precision") {
+		t.Errorf("got logs %q", l.logs)
+	}
+
+	p := newPeer("192.0.2.1", nil)
+	p.reach, p.good = 1, true
+	p.classify(false, time.Now(), 1, time.Minute)
+	if last := l.logs[len(l.logs)-1]; !strings.HasPrefix(last, "warn peer:") {
+		t.Errorf("got %q for falseticker", last)
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	old := log.Writer()
+	log.SetOutput(&buf)
+	defer log.SetOutput(old)
+
+	stdLogger{}.Infof("info %d", 1)
+	stdLogger{}.Debugf("debug %d", 2)
+	if !strings.Contains(buf.String(), "info 1") {
+		t.Errorf("got %q", buf.String())
+	}
+	if strings.Contains(buf.String(), "debug 2") != debug {
+		t.Errorf("got %q with debug=%v", buf.String(), debug)
+	}
+}
@@ -12,7 +12,7 @@ mkdir -p .buildtmp/usr/bin
 
 $MAKEGOBIN build \
     -o .buildtmp/usr/bin/gontpd \
-    -ldflags "-X main.Version=$VERSION" \
+    -ldflags "-X main.Version=$VERSION -X github.com/mengzhuo/gontpd.Version=$VERSION" \
     cmd/gontpd/main.go
 
 fpm -s dir -C '.buildtmp/' -t deb -n gontpd -v $VERSION --verbose --url https://gontpd.org\
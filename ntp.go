@@ -2,6 +2,9 @@ package gontpd
 
 import (
 	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
 	"time"
 )
 
@@ -26,14 +29,24 @@ var (
 const (
 	nanoPerSec = 1e9
 
+	headerSize = 48
+	// maxPacketSize is large enough for MAC and extension fields
+	maxPacketSize = 1024
+
 	// INIT
 	initRefer = 0x494e4954
 
+	// LOCL | local clock, used in orphan mode
+	loclRefer = 0x4c4f434c
+
 	// ACST | The association belongs to a unicast server.
 	acstKoD = 0x41435354
 
 	// RATE | Rate exceeded
 	rateKoD = 0x52415445
+
+	// DENY | Access denied by remote server
+	denyKoD = 0x44454e59
 )
 
 const (
@@ -76,6 +89,19 @@ func toNtpTime(t time.Time) uint64 {
 	return uint64(sec<<32 | frac)
 }
 
+func fromNtpTime(t uint64) time.Time {
+	sec := t >> 32
+	nsec := (t & 0xffffffff) * nanoPerSec >> 32
+	return ntpEpoch.Add(time.Duration(sec)*time.Second + time.Duration(nsec))
+}
+
+// kissCode returns ASCII form of KoD code, i.e. RATE
+func kissCode(code uint32) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], code)
+	return string(b[:])
+}
+
 func setLi(m []byte, li uint8) {
 	m[0] = (m[0] & 0x3f) | li<<6
 }
@@ -88,6 +114,10 @@ func getMode(m []byte) uint8 {
 	return m[0] &^ 0xf8
 }
 
+func getVersion(m []byte) uint8 {
+	return (m[0] >> 3) & 0x7
+}
+
 func setVersion(m []byte, v uint8) {
 	m[0] = (m[0] & 0xc7) | v<<3
 }
@@ -109,48 +139,200 @@ func setUint32(m []byte, index int, value uint32) {
 	binary.BigEndian.PutUint32(m[index:], value)
 }
 
+// toNtpShortTime encodes t in NTP short format (16.16 fixed point
+// seconds), saturated to the range of the format.
 func toNtpShortTime(t time.Duration) uint32 {
+	if t <= 0 {
+		return 0
+	}
+	if t >= 1<<16*nanoPerSec {
+		return math.MaxUint32
+	}
 	sec := t / nanoPerSec
 	frac := (t - sec*nanoPerSec) << 16 / nanoPerSec
 	return uint32(sec<<16 | frac)
 }
 
+func fromNtpShortTime(t uint32) time.Duration {
+	return time.Duration(uint64(t) * nanoPerSec >> 16)
+}
+
 func newTemplate() (t []byte) {
 	t = make([]byte, 48)
-	setLi(t, noLeap)
+	// unsynchronized until first sync
+	setLi(t, notSync)
 	setVersion(t, 4)
 	setMode(t, modeServer)
 	setUint32(t, referIDPos, initRefer)
 	setInt8(t, pollPos, minPoll)
-	setUint8(t, stratumPos, 0xff)
+	setUint8(t, stratumPos, invalidStratum)
 	setUint64(t, referenceTimeStamp, toNtpTime(time.Now()))
 	return
 }
 
+// loadTemplate returns template of responses, it must not be modified
+// since workers may be reading it.
+func (d *NTPd) loadTemplate() []byte {
+	t, _ := d.template.Load().([]byte)
+	return t
+}
+
+// modifyTemplate applies fn to a copy of template then swaps it in, so
+// workers always read a consistent one while it's updated.
+func (d *NTPd) modifyTemplate(fn func(t []byte)) {
+	d.templateMu.Lock()
+	defer d.templateMu.Unlock()
+	t := make([]byte, headerSize)
+	copy(t, d.loadTemplate())
+	fn(t)
+	d.template.Store(t)
+}
+
 func (d *NTPd) setTemplate(op *offsetPeer) {
 
-	setLi(d.template, uint8(op.resp.Leap))
-	setMode(d.template, modeServer)
+	li := d.serveLeap(uint8(op.resp.Leap), time.Now())
+	cfg := d.config()
+	stratum, refID := servedStratum(op.resp.Stratum, cfg.MaxStratumServed), op.peer.refId
+	if stratum == invalidStratum {
+		li = notSync
+	}
+	if id, err := parseRefID(cfg.RefID); err == nil {
+		refID = id
+	}
+	ref := op.resp.Time
+	if d.smear != nil {
+		ref = ref.Add(d.smear.correction(ref))
+	}
+	delay, disp := rootDelay(op), rootDispersion(op, d.precision)
+	d.mu.Lock()
+	d.delay, d.disp = delay, disp
+	d.mu.Unlock()
+	d.modifyTemplate(func(t []byte) {
+		setLi(t, li)
+		setMode(t, modeServer)
 
-	setUint8(d.template, stratumPos, op.resp.Stratum+1)
-	setInt8(d.template, clockPrecisionPos, systemPrecision())
+		setUint8(t, stratumPos, stratum)
+		setInt8(t, clockPrecisionPos, d.precision)
 
-	d.delay = op.resp.RootDelay + op.resp.RTT/2
-	setUint32(d.template, rootDelayPos, toNtpShortTime(d.delay))
+		setUint32(t, rootDelayPos, toNtpShortTime(delay))
+		setUint32(t, rootDispersionPos, toNtpShortTime(disp))
+		setUint64(t, referenceTimeStamp, toNtpTime(ref))
+		setUint32(t, referIDPos, refID)
 
-	d.disp = op.resp.RootDelay/2 + op.resp.RootDispersion
-	setUint32(d.template, rootDispersionPos,
-		toNtpShortTime(d.disp))
-	setUint64(d.template, referenceTimeStamp, toNtpTime(op.resp.Time))
-	setUint32(d.template, referIDPos, op.peer.refId)
+		setInt8(t, pollPos, int8(op.peer.trustLevel))
+	})
+}
 
-	setInt8(d.template, pollPos, int8(op.peer.trustLevel))
+// servedStratum is stratum served through sys peer of peerStratum, it's
+// always one greater than peerStratum so distance from the root is never
+// under-reported, clients are told it's unsynchronized (16) instead if
+// it's over max or 15.
+func servedStratum(peerStratum, max uint8) uint8 {
+	if peerStratum >= invalidStratum-1 {
+		return invalidStratum
+	}
+	if max > 0 && peerStratum+1 > max {
+		return invalidStratum
+	}
+	return peerStratum + 1
+}
+
+// phi is the frequency tolerance of clock, 15 PPM
+const phi = 15e-6
+
+// rootDelay is the round trip delay to the stratum 1 source through sys
+// peer op, RFC 5905 Section 11.2.3.
+func rootDelay(op *offsetPeer) time.Duration {
+	return op.resp.RootDelay + op.resp.RTT
+}
+
+// rootDispersion is the dispersion to the stratum 1 source through sys
+// peer op plus ours: the dispersion of sample (precision of peer and
+// local clock and frequency tolerance over round trip), jitter and the
+// offset to be corrected, RFC 5905 Section 11.2.3.
+func rootDispersion(op *offsetPeer, precision int8) time.Duration {
+	epsilon := op.resp.Precision + log2Duration(precision) +
+		time.Duration(phi*float64(op.resp.RTT))
+	return op.resp.RootDispersion + epsilon + op.jitter +
+		absDuration(op.resp.ClockOffset)
+}
+
+// precisionSamples is number of clock reads to measure precision
+const precisionSamples = 1000
+
+// measurePrecision returns precision of local clock in log2 seconds,
+// that is the minimum non-zero difference of consecutive clock reads,
+// rounded up.
+func measurePrecision() int8 {
+	res := int64(math.MaxInt64)
+	last := time.Now().UnixNano()
+	for i := 0; i < precisionSamples; i++ {
+		now := time.Now().UnixNano()
+		if delta := now - last; delta > 0 && delta < res {
+			res = delta
+		}
+		last = now
+	}
+	if res == math.MaxInt64 {
+		// clock never ticked, precision is worse than the whole run
+		res = int64(time.Millisecond)
+	}
+	return int8(math.Ceil(math.Log2(float64(res) / float64(time.Second))))
+}
+
+// log2Duration converts precision in log2 seconds to duration
+func log2Duration(p int8) time.Duration {
+	return time.Duration(math.Ldexp(float64(time.Second), int(p)))
+}
+
+// setLocalTemplate serves local clock at stratum with refID, used in
+// orphan mode and when discipline is disabled.
+func (d *NTPd) setLocalTemplate(stratum uint8, refID uint32, now time.Time) {
+	li := d.serveLeap(noLeap, now)
+	disp := log2Duration(d.precision)
+	d.mu.Lock()
+	d.delay, d.disp = 0, disp
+	d.mu.Unlock()
+	d.modifyTemplate(func(t []byte) {
+		setLi(t, li)
+		setUint8(t, stratumPos, stratum)
+		setInt8(t, clockPrecisionPos, d.precision)
+		setUint32(t, referIDPos, refID)
+		setUint32(t, rootDelayPos, 0)
+		setUint32(t, rootDispersionPos, toNtpShortTime(disp))
+		setUint64(t, referenceTimeStamp, toNtpTime(now))
+	})
+}
+
+// parseRefID accepts IPv4 address or 1-4 ASCII characters,
+// i.e. "GPS", "PTP".
+func parseRefID(s string) (id uint32, err error) {
+	if ip := net.ParseIP(s).To4(); ip != nil {
+		id = binary.BigEndian.Uint32(ip)
+		return
+	}
+	if len(s) == 0 || len(s) > 4 {
+		err = fmt.Errorf("%q should be IPv4 address or 1-4 characters", s)
+		return
+	}
+	var b [4]byte
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			err = fmt.Errorf("%q has non printable character", s)
+			return
+		}
+		b[i] = s[i]
+	}
+	id = binary.BigEndian.Uint32(b[:])
+	return
 }
 
+// stddev is the population standard deviation of offsets pl around their
+// mean, offsets on both sides of zero are not folded.
 func stddev(pl []time.Duration) time.Duration {
 	var sum time.Duration
 	for _, p := range pl {
-		sum += absDuration(p)
+		sum += p
 	}
 	avg := sum / time.Duration(len(pl))
 	sum = 0
@@ -1,14 +1,71 @@
 package gontpd
 
 import (
+	"encoding/binary"
+	"net"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/beevik/ntp"
 )
 
 func TestToNtpShortTime(t *testing.T) {
-	a := toNtpShortTime(time.Second)
-	if a != 65536 {
-		t.Fatal(a)
+	for _, c := range []struct {
+		d time.Duration
+		v uint32
+	}{
+		{time.Second, 0x00010000},
+		{500 * time.Millisecond, 0x00008000},
+		{1500 * time.Millisecond, 0x00018000},
+		{15625 * time.Microsecond, 0x00000400},
+		{-time.Second, 0},
+		{1 << 16 * time.Second, 0xffffffff},
+	} {
+		if v := toNtpShortTime(c.d); v != c.v {
+			t.Errorf("%s: got %#08x, want %#08x", c.d, v, c.v)
+		}
+	}
+}
+
+func TestMeasurePrecision(t *testing.T) {
+	p := measurePrecision()
+	// 1ns to 1ms
+	if p < -30 || p > -10 {
+		t.Errorf("precision=%d", p)
+	}
+}
+
+func TestRootDelayDispersion(t *testing.T) {
+	ms := time.Millisecond
+	p := newTestPeer("192.0.2.1", 0, 0)
+	p.jitter = ms
+	op := newOffsetPeer(p, &ntp.Response{
+		ClockOffset:    -2 * ms,
+		RTT:            20 * ms,
+		RootDelay:      250 * ms,
+		RootDispersion: 125 * ms,
+		Precision:      log2Duration(-10),
+		Stratum:        1,
+	})
+
+	d := newTestNTPd(&Config{})
+	d.setTemplate(op)
+	if want := 270 * ms; d.delay != want {
+		t.Errorf("delay=%s, want %s", d.delay, want)
+	}
+	// 125ms root dispersion + 2ms offset + 1ms jitter
+	// + precision of both + 15PPM * 20ms
+	want := 128*ms + log2Duration(-10) + log2Duration(d.precision) + 300
+	if d.disp != want {
+		t.Errorf("disp=%s, want %s", d.disp, want)
+	}
+
+	if v := binary.BigEndian.Uint32(d.loadTemplate()[rootDelayPos:]); v != toNtpShortTime(270*ms) {
+		t.Errorf("root delay=%#08x", v)
+	}
+	if v := binary.BigEndian.Uint32(d.loadTemplate()[rootDispersionPos:]); v != toNtpShortTime(want) {
+		t.Errorf("root dispersion=%#08x", v)
 	}
 }
 
@@ -42,6 +99,8 @@ func TestStddev(t *testing.T) {
 	}{
 		{time.Millisecond,
 			[]time.Duration{49 * time.Millisecond, 50 * time.Millisecond, 51 * time.Millisecond}},
+		{time.Millisecond,
+			[]time.Duration{-time.Millisecond, time.Millisecond}},
 	}
 	for _, p := range gold {
 		got := stddev(p.v)
@@ -50,3 +109,175 @@ func TestStddev(t *testing.T) {
 		}
 	}
 }
+
+func TestTemplateUnsynced(t *testing.T) {
+	d := newTestNTPd(&Config{},
+		newTestPeer("192.0.2.1", 0, time.Millisecond),
+		newTestPeer("192.0.2.2", 0, time.Millisecond),
+		newTestPeer("192.0.2.3", 0, time.Millisecond))
+	if li := d.loadTemplate()[liVnModePos] >> 6; li != notSync {
+		t.Errorf("li=%d before sync", li)
+	}
+	if s := d.loadTemplate()[stratumPos]; s != invalidStratum {
+		t.Errorf("stratum=%d before sync", s)
+	}
+
+	op := d.find()
+	d.setTemplate(op)
+	d.updateState(op)
+	if li := d.loadTemplate()[liVnModePos] >> 6; li != noLeap {
+		t.Errorf("li=%d after sync", li)
+	}
+	if s := d.loadTemplate()[stratumPos]; s != 3 {
+		t.Errorf("stratum=%d after sync", s)
+	}
+	if !d.Stats().Synced {
+		t.Error("not synced")
+	}
+}
+
+func TestParseRefID(t *testing.T) {
+	gold := []struct {
+		s  string
+		id uint32
+		ok bool
+	}{
+		{"GPS", 0x47505300, true},
+		{"LOCL", loclRefer, true},
+		{"192.0.2.1", 0xc0000201, true},
+		{"", 0, false},
+		{"TOOLONG", 0, false},
+		{"\x00", 0, false},
+		{"2001:db8::1", 0, false},
+	}
+	for _, g := range gold {
+		id, err := parseRefID(g.s)
+		if (err == nil) != g.ok || id != g.id {
+			t.Errorf("parseRefID(%q)=%x, %v expect %x ok=%v", g.s, id, err, g.id, g.ok)
+		}
+	}
+}
+
+// TestTemplateSwap serves while template is updated, responses must be
+// built from one version of template. Run with -race.
+func TestTemplateSwap(t *testing.T) {
+	newOp := func(addr string, stratum uint8) *offsetPeer {
+		p := newTestPeer(addr, 0, time.Millisecond)
+		p.refId = binary.BigEndian.Uint32(net.ParseIP(addr).To4())
+		return newOffsetPeer(p, &ntp.Response{Stratum: stratum,
+			RTT: time.Millisecond, Time: time.Now()})
+	}
+	ops := []*offsetPeer{newOp("192.0.2.1", 1), newOp("192.0.2.2", 3)}
+	d := newTestNTPd(&Config{})
+	d.dropTable.Store(&dropTable{})
+	d.setTemplate(ops[0])
+	w := &worker{lru: newLRU(0), d: d}
+	raddr := &net.UDPAddr{IP: net.IP{198, 51, 100, 1}, Port: 123}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			d.setTemplate(ops[i%2])
+		}
+	}()
+
+	p := make([]byte, maxPacketSize)
+	for served := 0; ; served++ {
+		select {
+		case <-done:
+			if served == 0 {
+				t.Fatal("nothing served")
+			}
+			return
+		default:
+		}
+		copy(p, newTestRequest())
+		if n, _ := w.handle(p, headerSize, raddr, time.Now()); n != headerSize {
+			t.Fatalf("response length %d", n)
+		}
+		stratum := p[stratumPos]
+		refID := binary.BigEndian.Uint32(p[referIDPos:])
+		if (stratum == 2 && refID != ops[0].peer.refId) ||
+			(stratum == 4 && refID != ops[1].peer.refId) {
+			t.Fatalf("torn template stratum=%d refid=%x", stratum, refID)
+		}
+	}
+}
+
+func TestServedStratum(t *testing.T) {
+	for _, c := range []struct {
+		peer, max, want uint8
+	}{
+		{0, 0, 1},
+		{1, 0, 2},
+		{3, 2, invalidStratum},
+		{1, 2, 2},
+		{14, 0, 15},
+		{15, 2, invalidStratum},
+		{255, 0, invalidStratum},
+	} {
+		if got := servedStratum(c.peer, c.max); got != c.want {
+			t.Errorf("servedStratum(%d, %d)=%d, want %d", c.peer, c.max, got, c.want)
+		}
+	}
+}
+
+func TestSetTemplateStratum(t *testing.T) {
+	d := newTestNTPd(&Config{})
+	p := newTestPeer("192.0.2.1", 0, time.Millisecond)
+	// refclock is stratum 0, network peers are 1 to 15
+	for peerStratum := 0; peerStratum <= 255; peerStratum++ {
+		op := &offsetPeer{peer: p, resp: &ntp.Response{Stratum: uint8(peerStratum)}}
+		d.setTemplate(op)
+		tmpl := d.loadTemplate()
+		served, li := tmpl[stratumPos], tmpl[liVnModePos]>>6
+		if peerStratum >= invalidStratum-1 {
+			if served != invalidStratum || li != notSync {
+				t.Errorf("peer stratum %d: served %d li %d, want unsynchronized",
+					peerStratum, served, li)
+			}
+			continue
+		}
+		if int(served) != peerStratum+1 || li == notSync {
+			t.Errorf("peer stratum %d: served %d li %d", peerStratum, served, li)
+		}
+	}
+}
+
+func TestSetTemplateOverride(t *testing.T) {
+	ms := time.Millisecond
+	d := newTestNTPd(&Config{RefID: "GPS", MaxStratumServed: 3},
+		newTestPeer("192.0.2.1", 0, 5*ms),
+		newTestPeer("192.0.2.2", ms, 5*ms),
+		newTestPeer("192.0.2.3", 2*ms, 5*ms))
+	op := d.find()
+	d.setTemplate(op)
+	d.updateState(op)
+
+	tmpl := d.loadTemplate()
+	if tmpl[stratumPos] != 3 || binary.BigEndian.Uint32(tmpl[referIDPos:]) != 0x47505300 {
+		t.Errorf("stratum=%d refid=%x", tmpl[stratumPos], tmpl[referIDPos:referIDPos+4])
+	}
+	if vars := d.systemVars(time.Now()); !strings.Contains(vars, "refid=GPS,") ||
+		!strings.Contains(vars, "stratum=3,") {
+		t.Errorf("readvar %q", vars)
+	}
+	if s := d.Stats(); s.Stratum != 3 || s.RefID != "GPS" {
+		t.Errorf("stats stratum=%d refid=%s", s.Stratum, s.RefID)
+	}
+
+	// refid of peer is served without override
+	d.cfg.RefID = ""
+	d.setTemplate(op)
+	if s := d.Stats(); s.RefID != formatRefID(3, op.peer.refId) {
+		t.Errorf("refid=%s", s.RefID)
+	}
+
+	// better stratum than reality is never served
+	d.cfg.MaxStratumServed = 2
+	d.setTemplate(op)
+	if tmpl := d.loadTemplate(); tmpl[stratumPos] != invalidStratum || tmpl[liVnModePos]>>6 != notSync {
+		t.Errorf("over cap: stratum=%d li=%d", tmpl[stratumPos], tmpl[liVnModePos]>>6)
+	}
+}
@@ -1,242 +1,1518 @@
 package gontpd
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"math"
+	"math/rand"
 	"net"
-	"sort"
+	"os"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/beevik/ntp"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var errNoMedian = errors.New("no median found")
 
 type NTPd struct {
-	template []byte
+	// template holds []byte of response header, it's replaced instead
+	// of modified, see modifyTemplate
+	template   atomic.Value
+	templateMu sync.Mutex
 
 	cfg *Config
 
-	peerList  []*peer
-	stat      *ntpStat
-	dropTable *dropTable
+	// mu guards peerList, median, synced, healthy, lastSync, updates,
+	// steps, delay, disp, published stats of peers and reloadable fields
+	// of cfg.
+	// Workers never take it, what they read is swapped atomically.
+	// Samples of peer are only written by goroutine polling it, poll
+	// loop publishes them for others, see publishPeers. sleep, failures,
+	// selected, orphan, holdover, driftSaved and watchdog are owned by
+	// goroutine of Run.
+	mu       sync.RWMutex
+	peerList []*peer
+	median   *offsetPeer
 
-	sleep time.Duration
-	delay time.Duration
-	disp  time.Duration
+	stat *ntpStat
+	// dropTable holds *dropTable, swapped on reload
+	dropTable atomic.Value
+	// allowTable holds *dropTable of AllowCIDR, swapped on reload
+	allowTable atomic.Value
+	// restricts holds *restrictTable, swapped on reload
+	restricts atomic.Value
+	keys      keyTable
+	// interleaves is last responses of clients if Interleaved
+	interleaves *ilCache
+	// clients estimates unique clients if metrics are exported
+	clients *clientCounter
+	// tracer is set if Config.Tracer is set
+	tracer trace.Tracer
+	// nts is set if NTS is served
+	nts *ntsServer
+	// leaps holds *leapTable of LeapFile, swapped on reload
+	leaps atomic.Value
+
+	// conns are listening sockets and connAddrs their listen address,
+	// written by goroutine of Run and guarded by mu for Restart.
+	// restarted is set once Restart succeeds.
+	conns     []*net.UDPConn
+	connAddrs []string
+	restarted bool
+	workers   sync.WaitGroup
+
+	// precision of local clock in log2 seconds, measured once by New
+	precision int8
+
+	sleep      time.Duration
+	delay      time.Duration
+	disp       time.Duration
+	driftSaved time.Time
+	smear      *leapSmear
+	huffpuff   *huffPuff
+	// loop is set if Discipline is loop
+	loop *clockLoop
+
+	// synced is set after first sync, healthy is set if last poll
+	// synced clock, lastSync is time of last successful sync, orphan is set if serving local clock after all
+	// peers lost
+	synced   bool
+	healthy  bool
+	lastSync time.Time
+	orphan   bool
+	// holdover is state of serving after peers lost, holdoverBase is
+	// root dispersion of last sync
+	holdover     uint8
+	holdoverBase time.Duration
+	// updates is clock adjustments since start, steps is those stepped
+	updates int
+	steps   int
+
+	// failures is consecutive polls without median
+	failures int
+	// selected is peer selected by last find, see noteSelected
+	selected *peer
+	// wake cuts sleep of Run short, see pollNow
+	wake chan struct{}
+	// watchdog is interval of WATCHDOG=1 to systemd, see sdWatchdog
+	watchdog time.Duration
+	// selfAddrs are our addresses found by init, peers of them are
+	// excluded from selection, see selfReason
+	selfAddrs []net.IP
+	// demoted holds unreachable pool addresses until expiry, guarded by mu
+	demoted map[string]time.Time
+	// unresolved is hosts failed to resolve last time and srvTTL is
+	// the minimum TTL of SRV records, guarded by mu
+	unresolved []string
+	srvTTL     time.Duration
+	// dropFileMod is modification time of loaded DropFile, guarded by mu
+	dropFileMod time.Time
+	// lookup resolves peer addresses, replaced in tests
+	lookup func(addrs []string) map[string][]net.IP
+	// random returns a random number in [0, n), replaced by seeded
+	// source in tests
+	random func(n int64) int64
 }
 
-func New(cfg *Config) (d *NTPd) {
+func New(cfg *Config) (d *NTPd, err error) {
+	switch {
+	case cfg.Logger != nil:
+		setLogger(cfg.Logger)
+	case cfg.Syslog:
+		var l Logger
+		l, err = NewSyslogLogger("gontpd")
+		if err != nil {
+			err = fmt.Errorf("invalid Syslog: %s", err)
+			return
+		}
+		setLogger(l)
+	default:
+		setLogger(stdLogger{})
+	}
 
-	if cfg.MinPoll < minPoll {
-		cfg.MinPoll = minPoll
+	if err = cfg.Validate(); err != nil {
+		return
 	}
-	if cfg.MaxPoll > maxPoll {
-		cfg.MaxPoll = maxPoll
+	if cfg.Discipline == disciplineLoop {
+		if _, ferr := getFrequency(); ferr == errNoFrequency {
+			err = fmt.Errorf("invalid Discipline: %s", ferr)
+			return
+		}
 	}
 
-	if cfg.RateSize < 0 {
-		cfg.RateSize = 0
+	cfg.setDefault()
+
+	dt, dropFileMod, err := loadDropTable(cfg)
+	if err != nil {
+		return
 	}
 
-	dt, err := newDropTable(cfg.DropCIDR)
+	at, err := newDropTable(cfg.AllowCIDR)
 	if err != nil {
+		err = fmt.Errorf("invalid AllowCIDR: %s", err)
 		return
 	}
 
+	rt, err := newRestrictTable(cfg.Restrict, cfg.RestrictDefault)
+	if err != nil {
+		err = fmt.Errorf("invalid Restrict: %s", err)
+		return
+	}
+
+	var kt keyTable
+	if cfg.KeyFile != "" {
+		kt, err = loadKeyFile(cfg.KeyFile, cfg.TrustedKeys)
+		if err != nil {
+			err = fmt.Errorf("invalid KeyFile: %s", err)
+			return
+		}
+	}
+
+	var lt *leapTable
+	if cfg.LeapFile != "" {
+		lt, err = loadLeapFile(cfg.LeapFile)
+		if err != nil {
+			err = fmt.Errorf("invalid LeapFile: %s", err)
+			return
+		}
+	}
+
+	if cfg.BroadcastAddr != "" {
+		if _, err = net.ResolveUDPAddr("udp", cfg.BroadcastAddr); err != nil {
+			err = fmt.Errorf("invalid BroadcastAddr: %s", err)
+			return
+		}
+	}
+
+	var nts *ntsServer
+	if cfg.NTSCert != "" || cfg.NTSKey != "" {
+		if cfg.ServerDisabled {
+			err = errors.New("invalid NTSCert: server is disabled")
+			return
+		}
+		nts, err = newNTSServer(cfg.NTSCert, cfg.NTSKey)
+		if err != nil {
+			err = fmt.Errorf("invalid NTSCert: %s", err)
+			return
+		}
+	}
+
 	d = &NTPd{cfg: cfg,
-		template:  newTemplate(),
-		dropTable: dt,
+		keys:        kt,
+		precision:   measurePrecision(),
+		dropFileMod: dropFileMod,
+		nts:         nts,
+		wake:        make(chan struct{}, 1),
+	}
+	t := newTemplate()
+	setInt8(t, clockPrecisionPos, d.precision)
+	d.template.Store(t)
+	logger().Infof("clock precision 2^%d s", d.precision)
+	d.dropTable.Store(dt)
+	d.allowTable.Store(at)
+	d.restricts.Store(rt)
+	d.leaps.Store(lt)
+	if cfg.Interleaved {
+		d.interleaves = newILCache(cfg.InterleaveSize)
+	}
+	if cfg.Discipline == disciplineLoop {
+		d.loop = &clockLoop{}
+	}
+	if cfg.Tracer != nil {
+		d.tracer = cfg.Tracer.Tracer(tracerName)
 	}
-	if cfg.Metric != "" {
+	if cfg.Metric != "" || cfg.PushGateway != "" {
 		d.stat = newNTPStat(cfg.Metric)
+		d.stat.setLeapFunc(d.untilLeap)
+		d.stat.setBanFunc(func() float64 {
+			return float64(d.drops().bans.len())
+		})
+		d.clients = newClientCounter()
+		d.stat.setClientFunc(d.clients.estimate)
 	}
-	return d
+	if cfg.StatAddr != "" {
+		d.serveStats(cfg.StatAddr)
+	}
+	return
 }
 
-func (d *NTPd) Run() (err error) {
+// Run syncs the system clock with peers and serves NTP requests until
+// ctx is cancelled, then it stops the listener and returns ctx.Err().
+// No request is served if ServerDisabled, peers are never polled and
+// local clock is served if DisciplineDisabled.
+// Nothing is started if config is invalid, see Config.Validate.
+func (d *NTPd) Run(ctx context.Context) (err error) {
+	cfg := d.config()
+	if err = cfg.Validate(); err != nil {
+		return
+	}
+	d.watchdog = sdWatchdog()
+	if cfg.DisciplineDisabled {
+		return d.serveLocal(ctx)
+	}
 
-	err = d.init()
+	err = d.init(ctx)
 	if err != nil {
 		return
 	}
+	d.loadDrift()
+	d.startRefclocks(ctx)
+	defer d.pushMetrics()
+	if cfg.ControlSocket != "" {
+		if err = d.startControl(ctx, cfg.ControlSocket); err != nil {
+			err = fmt.Errorf("listen ControlSocket: %s", err)
+			return
+		}
+	}
 
-	d.poll()
-	median := d.find()
-	if median == nil {
-		err = errNoMedian
+	listened := false
+	if cfg.BroadcastClient {
+		// broadcast servers are only known by their packets, so they
+		// are received before first sync
+		listened, err = d.startBroadcastClient(ctx, &cfg)
+		if err != nil {
+			return
+		}
+		if listened {
+			defer d.shutdown()
+		}
+	}
+
+	if delay := d.startDelay(&cfg); delay > 0 {
+		logger().Infof("first poll in %s", delay)
+		if err = sleepContext(ctx, delay); err != nil {
+			return
+		}
+	}
+	median, err := d.firstMedian(ctx, &cfg)
+	if err != nil {
 		return
 	}
-	err = syncClock(median.resp.ClockOffset, 0,
-		d.cfg.ForceUpdate)
+	// offset over panic threshold is retried after backoff, the source
+	// may be rogue for a while
+	for {
+		err = d.syncTo(ctx, median, median.resp.ClockOffset, 0, &cfg)
+		if err != errPanicOffset {
+			break
+		}
+		d.setHealthy(false)
+		d.rejectBackoff(&cfg)
+		logger().Warnf("first sync: offset %s of peer:%s rejected, retry in %s",
+			median.resp.ClockOffset, median.peer.addr, d.sleep)
+		if err = d.sleepPoll(ctx, d.sleep); err != nil {
+			return
+		}
+		if median, err = d.firstMedian(ctx, &cfg); err != nil {
+			return
+		}
+	}
 	if err != nil {
-		log.Println("sync err:", err, " offset:", median.resp.ClockOffset)
+		logger().Errorf("sync err: %s offset: %s", err, median.resp.ClockOffset)
 		return
 	}
+	median.peer.fresh = false
 	d.setTemplate(median)
 	d.updateState(median)
 
-	go d.listen()
+	if !cfg.ServerDisabled && !listened {
+		err = d.listen()
+		if err != nil {
+			return
+		}
+		defer d.shutdown()
+	}
+	if d.nts != nil && !cfg.ServerDisabled {
+		if err = d.startNTS(ctx); err != nil {
+			err = fmt.Errorf("listen NTS-KE: %s", err)
+			return
+		}
+	}
+	defer d.saveDrift()
+	go d.resolveLoop(ctx)
+	go d.leapLoop(ctx)
+	go d.banLoop(ctx)
+	go d.clientLoop(ctx)
+	go d.dropFileLoop(ctx)
+	if cfg.BroadcastAddr != "" {
+		go d.broadcastLoop(ctx)
+	}
+	// clock is synchronized and served
+	notify("READY=1")
 
 	for {
-		time.Sleep(d.sleep)
-		d.poll()
-		median = d.find()
+		notify("WATCHDOG=1")
+		if d.stat != nil {
+			d.stat.nextPollGauge.Set(unixSeconds(time.Now().Add(d.sleep)))
+		}
+		err = d.sleepPoll(ctx, d.sleep)
+		if err != nil {
+			return
+		}
+		cfg = d.config()
+		cycle, span := d.startSpan(ctx, "poll")
+		reached := d.poll(cycle)
+		if err = ctx.Err(); err != nil {
+			span.End()
+			return
+		}
+		d.replacePool(cycle, &cfg)
+		median = d.traceFind(cycle)
 		if median == nil {
-			log.Println(errNoMedian)
-			d.sleep = time.Second * 10
+			logger().Warnf("%s", errNoMedian)
+			d.setHealthy(false)
+			d.checkOrphan(&cfg, time.Now())
+			d.checkHoldover(&cfg, time.Now())
+			d.backoff(cycle, &cfg)
+			span.End()
+			continue
+		}
+		d.failures = 0
+		// a sample is never used twice, RFC 5905 Section 10
+		if !median.peer.fresh {
+			if debug {
+				logger().Debugf("peer:%s sample is already used", median.peer.addr)
+			}
+			span.End()
 			continue
 		}
 
-		err = syncClock(median.resp.ClockOffset,
-			uint8(median.resp.Leap), d.cfg.ForceUpdate)
+		offset := d.applyHuffPuff(median, &cfg, time.Now())
+		leap := d.clockLeap(uint8(median.resp.Leap), time.Now())
+		if cfg.LeapSmear {
+			offset = d.applySmear(offset, leap, time.Now())
+			leap = noLeap
+		}
+
+		err = d.syncTo(cycle, median, offset, leap, &cfg)
+		if err == errPanicOffset {
+			d.setHealthy(false)
+			d.rejectBackoff(&cfg)
+			logger().Warnf("offset %s of peer:%s rejected, retry in %s",
+				offset, median.peer.addr, d.sleep)
+			span.End()
+			continue
+		}
 		if err != nil {
+			span.End()
 			return
 		}
+		median.peer.fresh = false
 
 		d.setTemplate(median)
 		d.updateState(median)
+		if time.Since(d.driftSaved) > driftInterval {
+			d.saveDrift()
+		}
 
-		if absDuration(median.resp.ClockOffset) < time.Millisecond*20 {
+		if absDuration(offset) < time.Millisecond*20 {
+			specs := cfg.peerSpecs()
+			low, high := cfg.pollBounds(specs[median.peer.origin])
 			poll := median.peer.trustLevel
-			if poll > d.cfg.MaxPoll {
-				poll = d.cfg.MaxPoll
+			if poll > high {
+				poll = high
 			}
-			if poll < d.cfg.MinPoll {
-				poll = d.cfg.MinPoll
+			if poll < low {
+				poll = low
 			}
 
-			for _, p := range d.peerList {
-				if p.good && p.trustLevel < d.cfg.MaxPoll {
+			for _, p := range d.peers() {
+				s := specs[p.origin]
+				if _, high := cfg.pollBounds(s); p.good && p.trustLevel < high {
 					p.trustLevel += 1
 				}
+				// peer with its own MaxPoll is polled at least that often
+				if p.enable && s.MaxPoll != 0 && poll > s.MaxPoll {
+					poll = s.MaxPoll
+				}
 			}
 
 			d.sleep = pollTable[poll-minPoll]
+			if reached {
+				d.sleep = pollTable[0]
+			}
 		} else {
 			d.sleep = pollTable[0]
-			for i := 0; i < len(d.peerList); i++ {
-				d.peerList[i].trustLevel = 1
+			for _, p := range d.peers() {
+				p.trustLevel = 1
 			}
 		}
+		d.publishPeers()
 		if d.stat != nil {
 			d.stat.pollGauge.Set(d.sleep.Seconds())
 		}
+		d.pushMetrics()
+		span.End()
+	}
+}
+
+// startBroadcastClient receives broadcast packets by server sockets, or
+// by its own socket if server is disabled. listened is set if server is
+// started.
+func (d *NTPd) startBroadcastClient(ctx context.Context, cfg *Config) (listened bool, err error) {
+	if !cfg.ServerDisabled {
+		err = d.listen()
+		listened = err == nil
+		return
+	}
+	conn, err := d.listenBroadcast(cfg.BroadcastListen, broadcastGroups(cfg))
+	if err != nil {
+		err = fmt.Errorf("broadcast client: %s", err)
+		return
+	}
+	go d.broadcastClientLoop(ctx, conn)
+	return
+}
+
+// RunOnce polls peers and steps the clock to the selected offset once
+// like ntpdate, no request is served. It returns error if no offset
+// could be selected.
+func (d *NTPd) RunOnce() (err error) {
+	ctx := context.Background()
+	err = d.init(ctx)
+	if err != nil {
+		return
+	}
+	defer d.pushMetrics()
+	d.poll(ctx)
+	median := d.traceFind(ctx)
+	if median == nil {
+		err = errNoMedian
+		return
+	}
+
+	cfg := d.config()
+	// step whatever the offset is
+	cfg.StepThreshold = time.Nanosecond
+	offset := median.resp.ClockOffset
+	err = d.syncTo(ctx, median, offset, 0, &cfg)
+	if err != nil {
+		return
+	}
+	logger().Infof("clock adjusted by %s from %s", offset, median.peer.addr)
+	return
+}
+
+// serveLocal serves local clock at Stratum with RefID until ctx is done,
+// clock is disciplined by someone else.
+func (d *NTPd) serveLocal(ctx context.Context) (err error) {
+	cfg := d.config()
+	refID, err := parseRefID(cfg.RefID)
+	if err != nil {
+		return
+	}
+	d.setLocalTemplate(cfg.Stratum, refID, time.Now())
+	d.mu.Lock()
+	d.synced = true
+	d.mu.Unlock()
+	d.setHealthy(true)
+
+	err = d.listen()
+	if err != nil {
+		return
+	}
+	defer d.shutdown()
+	if d.nts != nil {
+		if err = d.startNTS(ctx); err != nil {
+			err = fmt.Errorf("listen NTS-KE: %s", err)
+			return
+		}
+	}
+	logger().Infof("serve local clock at stratum %d refid %s", cfg.Stratum, cfg.RefID)
+	go d.leapLoop(ctx)
+	go d.banLoop(ctx)
+	go d.clientLoop(ctx)
+	go d.dropFileLoop(ctx)
+	if cfg.BroadcastAddr != "" {
+		go d.broadcastLoop(ctx)
+	}
+	notify("READY=1")
+
+	for {
+		notify("WATCHDOG=1")
+		err = d.sleepPoll(ctx, pollTable[0])
+		if err != nil {
+			return
+		}
+		d.modifyTemplate(func(t []byte) {
+			setUint64(t, referenceTimeStamp, toNtpTime(time.Now()))
+		})
+	}
+}
+
+// firstMedian polls peers for the median of the first sync, errNoMedian
+// is returned if there is none. Broadcast servers and refclocks are
+// polled until their samples are pushed.
+func (d *NTPd) firstMedian(ctx context.Context, cfg *Config) (median *offsetPeer, err error) {
+	d.poll(ctx)
+	// poll is given up on cancel, the clock is never set after it
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	median = d.traceFind(ctx)
+	for median == nil && (cfg.BroadcastClient || len(cfg.Refclocks) > 0) {
+		if err = sleepContext(ctx, pollTable[0]); err != nil {
+			return
+		}
+		d.poll(ctx)
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		median = d.traceFind(ctx)
+	}
+	if median == nil {
+		err = errNoMedian
+	}
+	return
+}
+
+// rejectBackoff doubles sleep up to MaxPoll after offset of median is
+// rejected by panic threshold, the source is not polled quickly again.
+func (d *NTPd) rejectBackoff(cfg *Config) {
+	ceil := pollTable[cfg.MaxPoll-minPoll]
+	d.sleep *= 2
+	if d.sleep < pollTable[1] {
+		d.sleep = pollTable[1]
+	}
+	if d.sleep > ceil {
+		d.sleep = ceil
+	}
+}
+
+// minBackoff is the first sleep after no median found
+const minBackoff = 10 * time.Second
+
+// backoff doubles sleep from minBackoff up to MaxPoll while no median
+// could be found, peers are resolved again in case addresses changed.
+func (d *NTPd) backoff(ctx context.Context, cfg *Config) {
+	d.failures++
+	ceil := pollTable[cfg.MaxPoll-minPoll]
+	d.sleep = minBackoff
+	for i := 1; i < d.failures && d.sleep < ceil; i++ {
+		d.sleep *= 2
+	}
+	if d.sleep > ceil {
+		d.sleep = ceil
+	}
+	logger().Warnf("no median for %d polls, retry in %s", d.failures, d.sleep)
+	d.refreshPeers(ctx, cfg)
+}
+
+// resolveLoop refreshes peers every ResolveInterval until ctx is done,
+// so pool hostnames follow their rotating addresses. SRV names are
+// refreshed once their records expire, and hosts failed to resolve are
+// retried every resolveRetryInterval.
+func (d *NTPd) resolveLoop(ctx context.Context) {
+	for {
+		interval := d.resolveInterval(d.config().ResolveInterval)
+		if sleepContext(ctx, interval) != nil {
+			return
+		}
+		cfg := d.config()
+		d.refreshPeers(ctx, &cfg)
+	}
+}
+
+// unresolvedHosts returns number of hosts failed to resolve last time
+func (d *NTPd) unresolvedHosts() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.unresolved)
+}
+
+// resolveInterval returns how long until peers are resolved again,
+// interval is shortened by TTL of SRV records and unresolved hosts.
+func (d *NTPd) resolveInterval(interval time.Duration) time.Duration {
+	d.mu.RLock()
+	ttl, unresolved := d.srvTTL, len(d.unresolved)
+	d.mu.RUnlock()
+	if ttl > 0 && ttl < interval {
+		interval = ttl
+		if interval < minSRVTTL {
+			interval = minSRVTTL
+		}
+	}
+	if unresolved > 0 && interval > resolveRetryInterval {
+		interval = resolveRetryInterval
+		logger().Infof("resolve: %d hosts unresolved, retry in %s", unresolved, interval)
+	}
+	return interval
+}
+
+// refreshPeers resolves PeerList again, peers with unchanged address
+// keep their state. Current peers are kept if nothing resolved.
+func (d *NTPd) refreshPeers(ctx context.Context, cfg *Config) {
+	pool := d.resolveAll(ctx, cfg)
+
+	d.mu.Lock()
+	peers, added, removed := mergePeers(d.peerList, pool, cfg.MaxPeers)
+	if len(peers) == 0 {
+		d.mu.Unlock()
+		logger().Warnf("refresh: no available peer, tried: %v", cfg.peerAddrs())
+		return
+	}
+	d.peerList = peers
+	d.mu.Unlock()
+
+	d.logPeers("refresh", added, removed)
+}
+
+func (d *NTPd) logPeers(prefix string, added, removed []*peer) {
+	for _, p := range added {
+		logger().Infof("%s: add peer %s->%s", prefix, p.origin, p.addr)
+	}
+	for _, p := range removed {
+		logger().Infof("%s: remove peer %s->%s", prefix, p.origin, p.addr)
+		if d.stat != nil {
+			d.stat.deletePeer(p)
+		}
+	}
+}
+
+// sleepContext pauses for duration t or until ctx is done.
+func sleepContext(ctx context.Context, t time.Duration) error {
+	timer := time.NewTimer(t)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// syncTo adjusts clock by offset selected from op, then OnSync is called
+// if it succeeds.
+func (d *NTPd) syncTo(ctx context.Context, op *offsetPeer, offset time.Duration, leap uint8, cfg *Config) (err error) {
+	stepped, err := d.traceAdjust(ctx, offset, leap, cfg)
+	if err != nil || cfg.OnSync == nil {
+		return
+	}
+	d.mu.RLock()
+	peer := medianStats(op)
+	d.mu.RUnlock()
+	cfg.OnSync(SyncEvent{
+		Time:    time.Now(),
+		Offset:  offset,
+		Stepped: stepped,
+		Leap:    leap,
+		DryRun:  cfg.DryRun,
+		Peer:    peer,
+	})
+	return
+}
+
+// adjust syncs clock to offset and counts steps, slews and offsets
+// rejected by panic threshold
+func (d *NTPd) adjust(offset time.Duration, leap uint8, cfg *Config) (stepped bool, err error) {
+	sync := syncClock
+	switch {
+	case cfg.DryRun:
+		sync = dryRunClock
+	case d.loop != nil:
+		sync = d.loopClock
+	}
+	stepped, err = sync(offset, leap, d.stepConfig(cfg))
+	if stepped && err == nil && !cfg.DryRun {
+		d.clearFilters()
+		if offset < 0 {
+			// time read by applications goes back
+			logger().Warnf("clock stepped backward by %s", -offset)
+		}
+	}
+	if err == nil {
+		d.mu.Lock()
+		d.updates++
+		if stepped {
+			d.steps++
+		}
+		if d.updates == cfg.MakeStep.Limit {
+			logger().Infof("makestep: %d updates, offset is only slewed from now on", d.updates)
+		}
+		d.mu.Unlock()
+	}
+	if d.stat == nil {
+		return
+	}
+	if err == errPanicOffset {
+		d.stat.rejectCounter.Inc()
+	}
+	if err != nil {
+		return
+	}
+	if stepped {
+		d.stat.stepCounter.Inc()
+		direction := "forward"
+		if offset < 0 {
+			direction = "backward"
+		}
+		d.stat.stepDirCounter.WithLabelValues(direction).Inc()
+		d.stat.lastStepGauge.Set(offset.Seconds())
+	} else {
+		d.stat.slewCounter.Inc()
+	}
+	return
+}
+
+// stepConfig returns cfg with step threshold of MakeStep, offset is never
+// stepped after MakeStep.Limit updates. updates is only written by the
+// caller so it's read without lock.
+func (d *NTPd) stepConfig(cfg *Config) *Config {
+	if cfg.MakeStep.Limit == 0 {
+		return cfg
+	}
+	c := *cfg
+	if d.updates < cfg.MakeStep.Limit {
+		c.StepThreshold = cfg.MakeStep.Threshold
+	} else {
+		c.StepThreshold = math.MaxInt64
+	}
+	return &c
+}
+
+// loadDrift primes kernel frequency with the drift file
+func (d *NTPd) loadDrift() {
+	path := d.config().DriftFile
+	if path == "" {
+		return
+	}
+	ppm, err := readDriftFile(path)
+	if err != nil {
+		logger().Warnf("read drift file failed: %s", err)
+		return
+	}
+	if d.config().DryRun {
+		logger().Infof("dry run: would load frequency %.3f ppm from %s", ppm, path)
+		return
+	}
+	err = setFrequency(ppm)
+	if err != nil {
+		logger().Errorf("set frequency failed: %s", err)
+		return
+	}
+	if d.loop != nil {
+		d.loop.freq = ppm
+	}
+	logger().Infof("frequency %.3f ppm loaded from %s", ppm, path)
+}
+
+func (d *NTPd) saveDrift() {
+	path := d.config().DriftFile
+	ppm, err := getFrequency()
+	if err == errNoFrequency {
+		return
+	}
+	// kernel frequency of loop includes phase correction
+	if d.loop != nil && d.loop.state != loopUnset {
+		ppm = d.loop.freq
+	}
+	if err != nil {
+		logger().Errorf("get frequency failed: %s", err)
+		return
+	}
+	if d.stat != nil {
+		d.stat.driftGauge.Set(ppm)
+	}
+	if path == "" {
+		return
+	}
+	d.driftSaved = time.Now()
+	err = writeDriftFile(path, ppm)
+	if err != nil {
+		logger().Errorf("write drift file failed: %s", err)
 	}
 }
 
 func (d *NTPd) updateState(op *offsetPeer) {
+	d.mu.Lock()
+	d.median = op
+	d.synced = true
+	d.lastSync = time.Now()
+	delay, disp := d.delay, d.disp
+	d.mu.Unlock()
+	d.setHealthy(true)
+
+	if d.orphan {
+		logger().Infof("peers back, leave orphan mode")
+		d.orphan = false
+	}
+	d.leaveHoldover()
+
 	if d.stat != nil {
-		d.stat.delayGauge.Set(d.delay.Seconds())
+		d.stat.delayGauge.Set(delay.Seconds())
 		d.stat.offsetGauge.Set(op.resp.ClockOffset.Seconds())
-		d.stat.dispGauge.Set(d.disp.Seconds())
+		d.stat.dispGauge.Set(disp.Seconds())
+		d.stat.orphanGauge.Set(0)
 	}
 }
 
-func (d *NTPd) init() (err error) {
-	pool := map[string][]net.IP{}
-	for _, addr := range d.cfg.PeerList {
-		ips, err := net.LookupIP(addr)
-		if err != nil {
-			log.Print(err)
-			continue
+func (d *NTPd) setHealthy(ok bool) {
+	d.mu.Lock()
+	d.healthy = ok
+	d.mu.Unlock()
+	if d.stat != nil {
+		v := 0.0
+		if d.Ready() {
+			v = 1
 		}
-		pool[addr] = ips
+		d.stat.syncGauge.Set(v)
 	}
+}
 
-	for origin, ips := range pool {
-		for _, ip := range ips {
-			p := newPeer(origin, ip)
-			if p == nil {
-				log.Printf("peer:%s->%s init failed", origin, ip.String())
-			}
-			d.peerList = append(d.peerList, p)
+// Ready reports if clock has been disciplined and last poll found an
+// offset within PanicThreshold.
+func (d *NTPd) Ready() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.synced && d.healthy
+}
+
+// checkOrphan enters orphan mode if no sync for OrphanGrace
+func (d *NTPd) checkOrphan(cfg *Config, now time.Time) {
+	if d.orphan || cfg.OrphanStratum == 0 || now.Sub(d.lastSync) < cfg.OrphanGrace {
+		return
+	}
+	logger().Infof("no sync since %s, enter orphan mode at stratum %d",
+		d.lastSync.Format(time.RFC3339), cfg.OrphanStratum)
+	d.orphan = true
+	d.setLocalTemplate(cfg.OrphanStratum, loclRefer, now)
+	if d.stat != nil {
+		d.stat.orphanGauge.Set(1)
+	}
+}
+
+func (d *NTPd) init(ctx context.Context) (err error) {
+	cfg := d.config()
+	peers, _, _ := mergePeers(nil, d.resolveAll(ctx, &cfg), cfg.MaxPeers)
+	refclocks, err := openRefclocks(cfg.Refclocks)
+	if err != nil {
+		err = fmt.Errorf("open refclock %s", err)
+		return
+	}
+	peers = append(peers, refclocks...)
+	if cfg.PPSDevice != "" {
+		var p *peer
+		p, err = openPPSPeer(cfg.PPSDevice, d.precision)
+		if err != nil {
+			err = fmt.Errorf("open PPS %s: %s", cfg.PPSDevice, err)
+			return
 		}
+		peers = append(peers, p)
 	}
 
-	if len(d.peerList) == 0 {
-		err = fmt.Errorf("no available peer, tried: %v", d.cfg.PeerList)
+	d.mu.Lock()
+	d.peerList = peers
+	d.mu.Unlock()
+	d.selfAddrs = localAddrs(d.listenAddrs())
+
+	if len(peers) == 0 && !cfg.BroadcastClient {
+		err = fmt.Errorf("no available peer, tried: %v", cfg.peerAddrs())
 	}
 
 	d.sleep = pollTable[0]
-	log.Printf("init with %d peers", len(d.peerList))
+	logger().Infof("init with %d peers", len(peers))
 
 	return
 }
 
-func (d *NTPd) poll() {
-	var wg sync.WaitGroup
-	for _, p := range d.peerList {
-		if p.enable {
-			wg.Add(1)
-			go p.update(&wg, d.cfg.MaxStd)
+// config returns a copy of current config
+func (d *NTPd) config() Config {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return *d.cfg
+}
+
+// peers returns a snapshot of peerList
+func (d *NTPd) peers() []*peer {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.peerList
+}
+
+// publishPeers copies state of peers for other goroutines, it's called
+// by poll loop when no peer is being polled.
+func (d *NTPd) publishPeers() {
+	peers := d.peers()
+	cfg := d.config()
+	specs := cfg.peerSpecs()
+	stats := make([]PeerStats, len(peers))
+	for i, p := range peers {
+		stats[i] = newPeerStats(p)
+		stats[i].Poll = p.pollInterval(cfg.pollBounds(specs[p.origin]))
+	}
+	d.mu.Lock()
+	for i, p := range peers {
+		p.stats = stats[i]
+	}
+	d.mu.Unlock()
+}
+
+func (d *NTPd) drops() *dropTable {
+	return d.dropTable.Load().(*dropTable)
+}
+
+// allowed reports whether ip is within AllowCIDR, every address is
+// allowed if it's empty
+func (d *NTPd) allowed(ip net.IP) bool {
+	t, _ := d.allowTable.Load().(*dropTable)
+	return t == nil || len(t.CIDR) == 0 || t.contains(ip)
+}
+
+// loadDropTable builds drop table of DropCIDR and DropFile, mod is
+// modification time of DropFile.
+func loadDropTable(cfg *Config) (dt *dropTable, mod time.Time, err error) {
+	cidr := cfg.DropCIDR
+	if cfg.DropFile != "" {
+		var file []string
+		file, mod, err = loadDropFile(cfg.DropFile)
+		if err != nil {
+			err = fmt.Errorf("invalid DropFile: %s", err)
+			return
 		}
+		cidr = removeNested(append(append([]string{}, cfg.DropCIDR...), file...))
 	}
-	wg.Wait()
+	dt, err = newDropTable(cidr)
+	if err != nil {
+		err = fmt.Errorf("invalid DropCIDR: %s", err)
+	}
+	return
+}
 
-	goodCount := 0
-	for _, p := range d.peerList {
-		if p.good {
-			goodCount += 1
+// dropFileCheck is how often DropFile is checked for modification
+const dropFileCheck = time.Minute
+
+// dropFileLoop reloads drop table once DropFile is modified, so that
+// external feed can update it without SIGHUP.
+func (d *NTPd) dropFileLoop(ctx context.Context) {
+	for sleepContext(ctx, dropFileCheck) == nil {
+		d.checkDropFile()
+	}
+}
+
+func (d *NTPd) checkDropFile() {
+	cfg := d.config()
+	if cfg.DropFile == "" {
+		return
+	}
+	fi, err := os.Stat(cfg.DropFile)
+	if err != nil {
+		logger().Warnf("drop file: %s", err)
+		return
+	}
+	d.mu.RLock()
+	mod := d.dropFileMod
+	d.mu.RUnlock()
+	if fi.ModTime().Equal(mod) {
+		return
+	}
+
+	dt, mod, err := loadDropTable(&cfg)
+	if err != nil {
+		logger().Errorf("reload drop file: %s", err)
+		return
+	}
+	d.mu.Lock()
+	d.dropFileMod = mod
+	d.mu.Unlock()
+	dt.bans = d.drops().bans
+	d.dropTable.Store(dt)
+	logger().Infof("drop file %s reloaded, %d CIDR", cfg.DropFile, len(dt.CIDR))
+}
+
+// BanFor drops requests from ip for dur, see dropTable.BanFor
+func (d *NTPd) BanFor(ip net.IP, dur time.Duration) {
+	d.drops().BanFor(ip, dur)
+}
+
+// banReapInterval is how often expired bans are removed
+const banReapInterval = time.Minute
+
+func (d *NTPd) banLoop(ctx context.Context) {
+	for sleepContext(ctx, banReapInterval) == nil {
+		for _, ip := range d.drops().bans.reap(time.Now()) {
+			logger().Infof("ban of %s lifted", ip)
+		}
+	}
+}
+
+func (d *NTPd) restrictTable() *restrictTable {
+	t, _ := d.restricts.Load().(*restrictTable)
+	return t
+}
+
+// lookup of a host is given up after resolveTimeout and retried
+// resolveRetries times, sleep between attempts doubles from
+// resolveBackoff.
+const (
+	resolveTimeout = 5 * time.Second
+	resolveRetries = 2
+	// resolveRetryInterval is how often hosts failed all attempts are
+	// resolved again
+	resolveRetryInterval = time.Minute
+)
+
+var (
+	resolveBackoff = time.Second
+
+	// lookupIP resolves host, replaced in tests
+	lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		return net.DefaultResolver.LookupIP(ctx, "ip", host)
+	}
+)
+
+// resolve resolves addrs, ttl is the minimum TTL of SRV records among
+// them, 0 if there's none.
+func (d *NTPd) resolve(ctx context.Context, addrs []string) (pool map[string][]net.IP, ttl time.Duration) {
+	if d.lookup != nil {
+		return d.lookup(addrs), 0
+	}
+	return resolvePeers(ctx, addrs)
+}
+
+// resolvePeers resolves addrs, SRV names to addresses of their targets.
+// Hosts failed all attempts are missing in pool.
+func resolvePeers(ctx context.Context, addrs []string) (pool map[string][]net.IP, ttl time.Duration) {
+	pool = map[string][]net.IP{}
+	for _, addr := range addrs {
+		var ips []net.IP
+		if isSRV(addr) {
+			var t time.Duration
+			ips, t = resolveSRV(ctx, addr)
+			if t > 0 && (ttl == 0 || t < ttl) {
+				ttl = t
+			}
+		} else {
+			ips = resolveHost(ctx, addr)
+		}
+		if len(ips) > 0 {
+			pool[addr] = ips
 		}
 	}
-	if goodCount < 3 {
-		log.Print("not enough good peers, but continue")
+	return
+}
+
+// resolveHost looks up host with retries until ctx is done
+func resolveHost(ctx context.Context, host string) (ips []net.IP) {
+	backoff := resolveBackoff
+	for i := 0; i <= resolveRetries; i++ {
+		if i > 0 {
+			if sleepContext(ctx, backoff) != nil {
+				return
+			}
+			backoff *= 2
+		}
+		lctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+		var err error
+		ips, err = lookupIP(lctx, host)
+		cancel()
+		if err == nil && len(ips) > 0 {
+			return
+		}
+		if err == nil {
+			err = errors.New("no address")
+		}
+		logger().Warnf("resolve %s failed, attempt %d of %d: %s",
+			host, i+1, resolveRetries+1, err)
 	}
+	return
 }
 
-type offsetPeer struct {
-	peer *peer
-	resp *ntp.Response
+// mergePeers builds new peer list from pool, peers with same address
+// in old are kept with their state. New peers are added until there are
+// maxPeers peers.
+func mergePeers(old []*peer, pool map[string][]net.IP, maxPeers int) (peers, added, removed []*peer) {
+	oldMap := map[string]*peer{}
+	for _, p := range old {
+		oldMap[p.addr.String()] = p
+	}
+
+	type fresh struct {
+		origin string
+		ip     net.IP
+	}
+	var fl []fresh
+	for origin, ips := range pool {
+		for _, ip := range ips {
+			key := ip.String()
+			p, ok := oldMap[key]
+			// same address may be resolved from different origins,
+			// nil marks address already in peers
+			oldMap[key] = nil
+			if ok {
+				if p != nil {
+					peers = append(peers, p)
+				}
+				continue
+			}
+			fl = append(fl, fresh{origin, ip})
+		}
+	}
+
+	for _, f := range fl {
+		if len(peers) >= maxPeers {
+			logger().Warnf("peer:%s->%s skipped, max %d peers", f.origin, f.ip, maxPeers)
+			continue
+		}
+		p := newPeer(f.origin, f.ip)
+		if p == nil {
+			logger().Warnf("peer:%s->%s init failed", f.origin, f.ip.String())
+			continue
+		}
+		peers = append(peers, p)
+		added = append(added, p)
+	}
+
+	for _, p := range oldMap {
+		if p == nil {
+			continue
+		}
+		// broadcast servers are found by listening, refclocks are
+		// not resolved
+		if p.pushed() != nil {
+			peers = append(peers, p)
+			continue
+		}
+		removed = append(removed, p)
+	}
+	return
 }
 
-func (d *NTPd) find() (op *offsetPeer) {
+// AddPeer resolves addr and adds its addresses as peers while running,
+// addr is kept in PeerList so DNS refresh won't remove them.
+func (d *NTPd) AddPeer(addr string) (err error) {
+	pool, _ := d.resolve(context.Background(), []string{addr})
+	ips := pool[addr]
+	if len(ips) == 0 {
+		err = fmt.Errorf("add peer %s: no address resolved", addr)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, a := range d.cfg.PeerList {
+		if a.Addr == addr {
+			err = fmt.Errorf("add peer %s: already exists", addr)
+			return
+		}
+	}
 
-	tmp := []*offsetPeer{}
+	exists := map[string]bool{}
 	for _, p := range d.peerList {
-		if !p.good {
+		exists[p.addr.String()] = true
+	}
+	// peerList is copied since snapshots may be in use
+	peers := append([]*peer{}, d.peerList...)
+	for _, ip := range ips {
+		if exists[ip.String()] {
+			continue
+		}
+		if len(peers) >= d.cfg.MaxPeers {
+			logger().Warnf("peer:%s->%s skipped, max %d peers", addr, ip, d.cfg.MaxPeers)
+			break
+		}
+		p := newPeer(addr, ip)
+		if p == nil {
 			continue
 		}
+		peers = append(peers, p)
+	}
+	d.peerList = peers
+	d.cfg.PeerList = append(d.cfg.PeerList[:len(d.cfg.PeerList):len(d.cfg.PeerList)], PeerSpec{Addr: addr})
+	return
+}
 
-		for _, resp := range p.reply {
-			if resp.Stratum >= invalidStratum {
-				continue
-			}
-			tmp = append(tmp, &offsetPeer{p, resp})
+// RemovePeer removes peers resolved from addr or with address addr,
+// addresses resolved from other hostnames of PeerList may come back on
+// next DNS refresh.
+func (d *NTPd) RemovePeer(addr string) (err error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		addr = ip.String()
+	}
+
+	d.mu.Lock()
+	var list []PeerSpec
+	for _, a := range d.cfg.PeerList {
+		if a.Addr != addr {
+			list = append(list, a)
 		}
 	}
+	var peers, removed []*peer
+	for _, p := range d.peerList {
+		if p.origin == addr || p.addr.String() == addr {
+			removed = append(removed, p)
+			continue
+		}
+		peers = append(peers, p)
+	}
+	if len(removed) == 0 && len(list) == len(d.cfg.PeerList) {
+		d.mu.Unlock()
+		err = fmt.Errorf("remove peer %s: not found", addr)
+		return
+	}
+	d.peerList = peers
+	d.cfg.PeerList = list
+	d.mu.Unlock()
+
+	d.logPeers("remove", nil, removed)
+	return
+}
+
+// Reload applies PeerList, Pools, DropCIDR, DropFile, AllowCIDR, Restrict, MaxStd, ForceUpdate, IBurst, poll
+// bounds, step thresholds, orphan and resolve settings of cfg without
+// restarting the listener.
+// Other changes only take effect after restart.
+func (d *NTPd) Reload(cfg *Config) (err error) {
+	if err = cfg.Validate(); err != nil {
+		return
+	}
+	cfg.setDefault()
+
+	dt, dropFileMod, err := loadDropTable(cfg)
+	if err != nil {
+		return
+	}
 
-	if len(tmp) == 0 {
+	at, err := newDropTable(cfg.AllowCIDR)
+	if err != nil {
+		err = fmt.Errorf("invalid AllowCIDR: %s", err)
+		return
+	}
+
+	rt, err := newRestrictTable(cfg.Restrict, cfg.RestrictDefault)
+	if err != nil {
+		err = fmt.Errorf("invalid Restrict: %s", err)
 		return
 	}
-	sort.Sort(byOffset(tmp))
-	if debug {
-		for _, p := range tmp {
-			fmt.Printf("%s:%s,", p.peer.addr, p.resp.ClockOffset)
+
+	var lt *leapTable
+	if cfg.LeapFile != "" {
+		lt, err = loadLeapFile(cfg.LeapFile)
+		if err != nil {
+			err = fmt.Errorf("invalid LeapFile: %s", err)
+			return
 		}
-		fmt.Print("\n")
 	}
 
-	if len(tmp) < goodFilter {
+	pool := d.resolveAll(context.Background(), cfg)
+
+	d.mu.Lock()
+	peers, added, removed := mergePeers(d.peerList, pool, cfg.MaxPeers)
+	if len(peers) == 0 {
+		d.mu.Unlock()
+		err = fmt.Errorf("no available peer, tried: %v", cfg.peerAddrs())
 		return
 	}
+	d.peerList = peers
+	old := *d.cfg
+	d.cfg.PeerList = cfg.PeerList
+	d.cfg.Pools = cfg.Pools
+	d.cfg.DropCIDR = cfg.DropCIDR
+	d.cfg.DropFile = cfg.DropFile
+	d.dropFileMod = dropFileMod
+	d.cfg.AllowCIDR = cfg.AllowCIDR
+	d.cfg.Restrict = cfg.Restrict
+	d.cfg.RestrictDefault = cfg.RestrictDefault
+	d.cfg.MaxStd = cfg.MaxStd
+	d.cfg.ForceUpdate = cfg.ForceUpdate
+	d.cfg.IBurst = cfg.IBurst
+	d.cfg.MaxPoll = cfg.MaxPoll
+	d.cfg.MinPoll = cfg.MinPoll
+	d.cfg.StepThreshold = cfg.StepThreshold
+	d.cfg.PanicThreshold = cfg.PanicThreshold
+	d.cfg.OrphanStratum = cfg.OrphanStratum
+	d.cfg.OrphanGrace = cfg.OrphanGrace
+	d.cfg.ResolveInterval = cfg.ResolveInterval
+	d.cfg.MaxPeers = cfg.MaxPeers
+	d.cfg.LeapFile = cfg.LeapFile
+	d.mu.Unlock()
 
-	op = tmp[len(tmp)/2]
+	// temporary bans survive reload
+	dt.bans = d.drops().bans
+	d.dropTable.Store(dt)
+	d.allowTable.Store(at)
+	d.restricts.Store(rt)
+	d.leaps.Store(lt)
+
+	d.logPeers("reload", added, removed)
+	if !reflect.DeepEqual(old.DropCIDR, cfg.DropCIDR) {
+		logger().Infof("reload: drop_cidr %v -> %v", old.DropCIDR, cfg.DropCIDR)
+	}
+	if !reflect.DeepEqual(old.AllowCIDR, cfg.AllowCIDR) {
+		logger().Infof("reload: allow_cidr %v -> %v", old.AllowCIDR, cfg.AllowCIDR)
+	}
+	if !reflect.DeepEqual(old.Restrict, cfg.Restrict) || old.RestrictDefault != cfg.RestrictDefault {
+		logger().Infof("reload: restrict %v default %q -> %v default %q",
+			old.Restrict, old.RestrictDefault, cfg.Restrict, cfg.RestrictDefault)
+	}
+	if old.MaxStd != cfg.MaxStd {
+		logger().Infof("reload: max_std %s -> %s", old.MaxStd, cfg.MaxStd)
+	}
+	if old.ForceUpdate != cfg.ForceUpdate {
+		logger().Infof("reload: force_update %v -> %v", old.ForceUpdate, cfg.ForceUpdate)
+	}
+	if old.MinPoll != cfg.MinPoll || old.MaxPoll != cfg.MaxPoll {
+		logger().Infof("reload: poll [%d, %d] -> [%d, %d]",
+			old.MinPoll, old.MaxPoll, cfg.MinPoll, cfg.MaxPoll)
+	}
+	if old.StepThreshold != cfg.StepThreshold || old.PanicThreshold != cfg.PanicThreshold {
+		logger().Infof("reload: step/panic threshold %s/%s -> %s/%s",
+			old.StepThreshold, old.PanicThreshold,
+			cfg.StepThreshold, cfg.PanicThreshold)
+	}
+	if lt != nil {
+		logger().Infof("reload: leap file %s expires at %s", cfg.LeapFile,
+			lt.expire.Format(time.RFC3339))
+	}
+	logger().Infof("reload with %d peers", len(peers))
 	return
 }
 
-type byOffset []*offsetPeer
+// staggerStep spaces start of peer polls if StaggerPoll
+const staggerStep = 100 * time.Millisecond
+
+// randDuration returns a random duration in [0, t)
+func (d *NTPd) randDuration(t time.Duration) time.Duration {
+	if t <= 0 {
+		return 0
+	}
+	if d.random != nil {
+		return time.Duration(d.random(int64(t)))
+	}
+	return time.Duration(rand.Int63n(int64(t)))
+}
+
+// staggerDelay returns start delay of i-th peer, peers start one
+// staggerStep after another plus a random jitter within the step.
+func (d *NTPd) staggerDelay(i int) time.Duration {
+	return time.Duration(i)*staggerStep + d.randDuration(staggerStep)
+}
+
+// startDelay returns delay before first poll, it's random in [0, MinPoll)
+// if RandomStart so daemons started at once don't query peers together.
+func (d *NTPd) startDelay(cfg *Config) time.Duration {
+	if !cfg.RandomStart {
+		return 0
+	}
+	poll := cfg.MinPoll
+	if poll > cfg.MaxPoll {
+		poll = cfg.MaxPoll
+	}
+	return d.randDuration(pollTable[poll-minPoll])
+}
 
-func (b byOffset) Len() int {
-	return len(b)
+// queryOptions returns options of queries to peer, they are sent from
+// address of QuerySourceAddr of its family.
+func (d *NTPd) queryOptions(cfg *Config, peer net.IP) ntp.QueryOptions {
+	opt := ntp.QueryOptions{Timeout: cfg.PeerTimeout, LocalAddress: cfg.querySource(peer)}
+	if cfg.DSCP != 0 {
+		opt.Dialer = dscpDialer(cfg.DSCP)
+	}
+	return opt
 }
 
-func (b byOffset) Less(i, j int) bool {
-	return b[i].resp.ClockOffset < b[j].resp.ClockOffset
+// minPeerStratum is the best stratum of reachable peers, except those of
+// ourselves, invalidStratum if there is none.
+func minPeerStratum(peers []*peer) uint8 {
+	min := uint8(invalidStratum)
+	for _, p := range peers {
+		if !p.enable || p.reach == 0 || p.state == stateSelf || p.stratum == 0 {
+			continue
+		}
+		if p.stratum < min {
+			min = p.stratum
+		}
+	}
+	return min
 }
 
-func (b byOffset) Swap(i, j int) {
-	b[i], b[j] = b[j], b[i]
+// poll updates all enabled peers, it reports if any peer just became
+// reachable.
+func (d *NTPd) poll(ctx context.Context) (reached bool) {
+	var wg sync.WaitGroup
+	peers := d.peers()
+	cfg := d.config()
+	specs := cfg.peerSpecs()
+	fp := d.filterParams(&cfg)
+	polled := make([]bool, len(peers))
+	reach := make([]uint8, len(peers))
+	now := time.Now()
+	n := 0
+	for i, p := range peers {
+		reach[i] = p.reach
+		if !p.enable {
+			continue
+		}
+		// peer with its own MinPoll waits for it even if others are polled
+		if s := specs[p.origin]; s.MinPoll != 0 && !p.lastPoll.IsZero() &&
+			now.Sub(p.lastPoll) < pollTable[s.MinPoll-minPoll] {
+			continue
+		}
+		// peer failing to reply is backed off up to its MaxPoll, it's
+		// polled in burst once reach is cleared
+		if wait := p.backoff(cfg.pollBounds(specs[p.origin])); now.Sub(p.lastPoll) < wait {
+			if debug {
+				logger().Debugf("peer:%s backed off %s after %d failures",
+					p.addr, wait, p.failures)
+			}
+			continue
+		}
+		polled[i] = true
+		p.lastPoll = now
+		var delay time.Duration
+		b := p.pushed()
+		if b == nil && cfg.StaggerPoll {
+			delay = d.staggerDelay(n)
+			n++
+		}
+		// burst on first contact or after being unreachable
+		burst := cfg.iburst() && p.reach == 0
+		maxstd := cfg.maxStd(specs[p.origin])
+		opt := d.queryOptions(&cfg, p.addr)
+		wg.Add(1)
+		go func(p *peer, b *sampleBuf, delay time.Duration) {
+			defer wg.Done()
+			if sleepContext(ctx, delay) != nil {
+				return
+			}
+			pctx, span := d.startSpan(ctx, "peer")
+			defer endPeerSpan(span, p)
+			if b != nil {
+				p.updateSamples(pctx, maxstd, fp, b)
+				return
+			}
+			p.update(pctx, maxstd, fp, opt, burst)
+		}(p, b, delay)
+	}
+	wg.Wait()
+
+	for i, p := range peers {
+		if reach[i] == 0 && p.reach != 0 {
+			logger().Infof("peer:%s->%s becomes reachable", p.origin, p.addr)
+			// sample new peer quickly
+			p.trustLevel = minPoll
+			reached = true
+		}
+		if d.stat != nil {
+			d.stat.setPeer(p, polled[i])
+		}
+	}
+	if d.stat != nil {
+		d.stat.minStratumGauge.Set(float64(minPeerStratum(peers)))
+		d.stat.lastPollGauge.Set(unixSeconds(time.Now()))
+	}
+
+	goodCount := 0
+	for _, p := range peers {
+		if p.good {
+			goodCount += 1
+		}
+	}
+	if goodCount < cfg.MinSources {
+		logger().Warnf("not enough good peers: %d of min %d", goodCount, cfg.MinSources)
+	}
+	return
 }
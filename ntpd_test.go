@@ -0,0 +1,805 @@
+package gontpd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/beevik/ntp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNewInvalidConfig(t *testing.T) {
+	gold := []struct {
+		cfg   *Config
+		field string
+	}{
+		{&Config{}, "PeerList"},
+		{&Config{PeerList: Peers("time1.apple.com"),
+			DropCIDR: []string{"10.0.0.0/33"}}, "DropCIDR"},
+		{&Config{PeerList: Peers("time1.apple.com"),
+			DropCIDR: []string{"10.0.0.0/8", "bad"}}, "DropCIDR"},
+		{&Config{DisciplineDisabled: true, RefID: "PTP"}, "Stratum"},
+		{&Config{DisciplineDisabled: true, Stratum: 16, RefID: "PTP"}, "Stratum"},
+		{&Config{DisciplineDisabled: true, Stratum: 2}, "RefID"},
+		{&Config{DisciplineDisabled: true, Stratum: 2, RefID: "TOOLONG"}, "RefID"},
+		{&Config{DisciplineDisabled: true, ServerDisabled: true,
+			Stratum: 2, RefID: "PTP"}, "DisciplineDisabled"},
+		{&Config{DisciplineDisabled: true, Oneshot: true,
+			Stratum: 2, RefID: "PTP"}, "Oneshot"},
+		{&Config{PeerList: []PeerSpec{{}}}, "PeerList"},
+		{&Config{PeerList: Peers("time1.apple.com"), Discipline: "fll"}, "Discipline"},
+		{&Config{PeerList: Peers("time1.apple.com"), MaxSlewRate: 1000}, "MaxSlewRate"},
+		{&Config{PeerList: []PeerSpec{{Addr: "a", MinPoll: 1}}}, "PeerList"},
+		{&Config{PeerList: []PeerSpec{{Addr: "a", MinPoll: 8, MaxPoll: 6}}}, "PeerList"},
+		{&Config{PeerList: Peers("time1.apple.com"), MinSources: -1}, "MinSources"},
+		{&Config{PeerList: Peers("time1.apple.com"), MinCandidates: -1}, "MinCandidates"},
+	}
+
+	for _, g := range gold {
+		d, err := New(g.cfg)
+		if err == nil || d != nil {
+			t.Errorf("cfg=%+v expect error got d=%v", g.cfg, d)
+			continue
+		}
+		if !strings.Contains(err.Error(), g.field) {
+			t.Errorf("error %q should name field %s", err, g.field)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	d, err := New(&Config{PeerList: Peers("time1.apple.com"),
+		DropCIDR: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil {
+		t.Fatal("nil NTPd")
+	}
+}
+
+func TestNewDisciplineDisabled(t *testing.T) {
+	d, err := New(&Config{DisciplineDisabled: true, Stratum: 2, RefID: "PTP"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil {
+		t.Fatal("nil NTPd")
+	}
+}
+
+func TestSleepContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if err := sleepContext(ctx, time.Hour); err != context.Canceled {
+		t.Errorf("expect %s got %v", context.Canceled, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("sleep not interrupted")
+	}
+	if err := sleepContext(context.Background(), time.Millisecond); err != nil {
+		t.Error(err)
+	}
+}
+
+// waitListen waits for Run of d to listen, that is the first poll synced
+// the clock, it returns the first listen address.
+func waitListen(t *testing.T, d *NTPd) (addr string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); addr == ""; {
+		if time.Now().After(deadline) {
+			t.Fatal("not listened after first poll")
+		}
+		d.mu.RLock()
+		if len(d.conns) > 0 {
+			addr = d.conns[0].LocalAddr().String()
+		}
+		d.mu.RUnlock()
+		time.Sleep(time.Millisecond)
+	}
+	return
+}
+
+// TestRunCancelPoll cancels Run while a peer query hangs, it must return
+// at once and stop the listener.
+func TestRunCancelPoll(t *testing.T) {
+	oldInterval, oldQuery := queryInterval, ntpQuery
+	queryInterval = time.Millisecond
+	defer func() { queryInterval, ntpQuery = oldInterval, oldQuery }()
+
+	var slow int32
+	polling := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+	ntpQuery = func(string, ntp.QueryOptions) (*ntp.Response, error) {
+		if atomic.LoadInt32(&slow) == 1 {
+			select {
+			case polling <- struct{}{}:
+			default:
+			}
+			<-release
+			return nil, errors.New("released")
+		}
+		return &ntp.Response{Stratum: 2, RTT: time.Millisecond, Time: time.Now()}, nil
+	}
+
+	d, err := New(&Config{PeerList: Peers("192.0.2.1"), DryRun: true,
+		ListenAddrs: []string{"127.0.0.1:0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- d.Run(ctx) }()
+
+	addr := waitListen(t, d)
+	atomic.StoreInt32(&slow, 1)
+	d.pollNow()
+	select {
+	case <-polling:
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer not polled")
+	}
+
+	cancel()
+	select {
+	case err = <-done:
+		if err != context.Canceled {
+			t.Errorf("run err=%v, want %s", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("run blocked by poll after cancel")
+	}
+	d.mu.RLock()
+	n := len(d.conns)
+	d.mu.RUnlock()
+	if n != 0 {
+		t.Errorf("%d sockets left open", n)
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatalf("listen address not released: %s", err)
+	}
+	conn.Close()
+}
+
+// TestRunRejectOffset polls a source over MaxOffset before and after the
+// first sync, its offset is rejected and it's polled later than usual.
+func TestRunRejectOffset(t *testing.T) {
+	oldInterval, oldQuery := queryInterval, ntpQuery
+	queryInterval = time.Millisecond
+	defer func() { queryInterval, ntpQuery = oldInterval, oldQuery }()
+
+	// the first sync is rejected too
+	offset := int64(time.Hour)
+	ntpQuery = func(string, ntp.QueryOptions) (*ntp.Response, error) {
+		return &ntp.Response{Stratum: 2, RTT: time.Millisecond, Time: time.Now(),
+			ClockOffset: time.Duration(atomic.LoadInt64(&offset))}, nil
+	}
+
+	d, err := New(&Config{PeerList: Peers("192.0.2.1"), DryRun: true,
+		MaxOffset: time.Second, ListenAddrs: []string{"127.0.0.1:0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.stat = newNTPStat("")
+	d.clients = newClientCounter()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- d.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(d.stat.rejectCounter) < 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("first offset not rejected")
+		}
+	}
+	select {
+	case err = <-done:
+		t.Fatalf("run returned on rejected first offset: %v", err)
+	default:
+	}
+	atomic.StoreInt64(&offset, 0)
+	d.pollNow()
+	waitListen(t, d)
+
+	atomic.StoreInt64(&offset, int64(time.Hour))
+	d.pollNow()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("offset not rejected")
+		}
+		if testutil.ToFloat64(d.stat.rejectCounter) < 2 {
+			continue
+		}
+		// next poll is set once Run sleeps again
+		next := time.Unix(0, int64(testutil.ToFloat64(d.stat.nextPollGauge)*1e9))
+		if next.Sub(time.Now()) > pollTable[0] {
+			break
+		}
+	}
+	if s := d.Stats(); s.Updates != 1 || s.Steps != 0 {
+		t.Errorf("%d updates %d steps after rejected offset, want 1 and 0", s.Updates, s.Steps)
+	}
+	if n := testutil.ToFloat64(d.stat.stepCounter); n != 0 {
+		t.Errorf("clock stepped %v times", n)
+	}
+}
+
+func TestReload(t *testing.T) {
+	d, err := New(&Config{PeerList: Peers("127.0.0.1", "127.0.0.2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	kept := d.peers()[1]
+	if kept.addr.String() != "127.0.0.2" {
+		kept = d.peers()[0]
+	}
+	kept.trustLevel = 9
+	d.BanFor(net.IP{192, 0, 2, 9}, time.Hour)
+
+	err = d.Reload(&Config{
+		PeerList: Peers("127.0.0.2", "127.0.0.3", "127.0.0.3"),
+		DropCIDR: []string{"10.0.0.0/8"},
+		MinPoll:  6, MaxPoll: 8,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]*peer{}
+	for _, p := range d.peers() {
+		got[p.addr.String()] = p
+	}
+	if len(got) != 2 || len(d.peers()) != 2 {
+		t.Fatalf("unexpected peers %v", got)
+	}
+	if got["127.0.0.2"] != kept || kept.trustLevel != 9 {
+		t.Error("unchanged peer state lost")
+	}
+	if got["127.0.0.3"] == nil {
+		t.Error("new peer not added")
+	}
+	if !d.drops().contains(net.IP{10, 1, 1, 1}) {
+		t.Error("drop table not reloaded")
+	}
+	if !d.drops().contains(net.IP{192, 0, 2, 9}) {
+		t.Error("ban lost on reload")
+	}
+	if cfg := d.config(); cfg.MinPoll != 6 || cfg.MaxPoll != 8 {
+		t.Errorf("poll bounds not reloaded %d %d", cfg.MinPoll, cfg.MaxPoll)
+	}
+
+	if err = d.Reload(&Config{PeerList: Peers("127.0.0.1"),
+		DropCIDR: []string{"bad"}}); err == nil {
+		t.Error("bad drop cidr reloaded")
+	}
+	if len(d.peers()) != 2 {
+		t.Error("failed reload changed peers")
+	}
+}
+
+func TestCheckOrphan(t *testing.T) {
+	ms := time.Millisecond
+	d := newTestNTPd(&Config{OrphanStratum: 10},
+		newTestPeer("192.0.2.1", 0, 5*ms),
+		newTestPeer("192.0.2.2", ms, 5*ms),
+		newTestPeer("192.0.2.3", 2*ms, 5*ms))
+	cfg := d.config()
+	now := time.Now()
+
+	d.lastSync = now.Add(-time.Minute)
+	d.checkOrphan(&cfg, now)
+	if d.orphan {
+		t.Fatal("orphan within grace")
+	}
+
+	d.lastSync = now.Add(-cfg.OrphanGrace)
+	d.checkOrphan(&cfg, now)
+	if !d.orphan || d.loadTemplate()[stratumPos] != 10 ||
+		binary.BigEndian.Uint32(d.loadTemplate()[referIDPos:]) != loclRefer {
+		t.Fatalf("orphan=%v template=%x", d.orphan, d.loadTemplate())
+	}
+
+	op := d.find()
+	d.setTemplate(op)
+	d.updateState(op)
+	if d.orphan || d.loadTemplate()[stratumPos] != 3 {
+		t.Errorf("not resumed orphan=%v stratum=%d", d.orphan, d.loadTemplate()[stratumPos])
+	}
+
+	cfg.OrphanStratum = 0
+	d.lastSync = time.Time{}
+	d.checkOrphan(&cfg, now)
+	if d.orphan {
+		t.Error("orphan mode disabled")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	old := newTestPeer("192.0.2.1", 0, 0)
+	old.origin = "pool.example"
+	d := newTestNTPd(&Config{MaxPoll: 8, PeerList: Peers("pool.example")}, old)
+	d.lookup = func(addrs []string) map[string][]net.IP {
+		return map[string][]net.IP{
+			"pool.example": {net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")},
+		}
+	}
+	cfg := d.config()
+
+	gold := []time.Duration{10, 20, 40, 80, 160, 256, 256}
+	for i, g := range gold {
+		d.backoff(context.Background(), &cfg)
+		if d.sleep != g*time.Second {
+			t.Errorf("failure %d: sleep=%s expect %ds", i+1, d.sleep, g)
+		}
+	}
+
+	peers := d.peers()
+	if len(peers) != 2 {
+		t.Fatalf("peers not refreshed %v", peers)
+	}
+	for _, p := range peers {
+		if p.addr.String() == "192.0.2.1" && p != old {
+			t.Error("state of unchanged peer lost")
+		}
+	}
+
+	// nothing resolved keeps current peers
+	d.lookup = func([]string) map[string][]net.IP { return nil }
+	d.backoff(context.Background(), &cfg)
+	if len(d.peers()) != 2 {
+		t.Error("peers dropped")
+	}
+}
+
+func TestResolveHost(t *testing.T) {
+	oldLookup, oldBackoff := lookupIP, resolveBackoff
+	defer func() { lookupIP, resolveBackoff = oldLookup, oldBackoff }()
+	resolveBackoff = time.Millisecond
+
+	ip := net.ParseIP("192.0.2.1")
+	for _, g := range []struct {
+		fails, calls int
+		ok           bool
+	}{
+		{0, 1, true},
+		{2, 3, true},
+		{3, 3, false},
+	} {
+		calls := 0
+		lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+			if _, ok := ctx.Deadline(); !ok {
+				t.Error("lookup without timeout")
+			}
+			calls++
+			if calls <= g.fails {
+				return nil, errors.New("temporary failure")
+			}
+			return []net.IP{ip}, nil
+		}
+		ips := resolveHost(context.Background(), "a.example")
+		if calls != g.calls || (len(ips) == 1) != g.ok {
+			t.Errorf("fails=%d: calls=%d ips=%v", g.fails, calls, ips)
+		}
+	}
+
+	// no retry after ctx is done
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	lookupIP = func(context.Context, string) ([]net.IP, error) {
+		calls++
+		cancel()
+		return nil, errors.New("temporary failure")
+	}
+	if ips := resolveHost(ctx, "a.example"); ips != nil || calls != 1 {
+		t.Errorf("calls=%d ips=%v after cancel", calls, ips)
+	}
+}
+
+func TestRefreshUnresolved(t *testing.T) {
+	a := newTestPeer("192.0.2.1", 0, 0)
+	a.origin = "a.example"
+	d := newTestNTPd(&Config{PeerList: Peers("a.example", "b.example")}, a)
+	d.lookup = func([]string) map[string][]net.IP {
+		return map[string][]net.IP{"b.example": {net.ParseIP("192.0.2.2")}}
+	}
+	cfg := d.config()
+	d.refreshPeers(context.Background(), &cfg)
+
+	// peer of a.example is kept until it resolves again
+	peers := d.peers()
+	if len(peers) != 2 || peers[0] != a && peers[1] != a {
+		t.Fatalf("peers=%v, want a.example kept", peers)
+	}
+	if n := d.unresolvedHosts(); n != 1 {
+		t.Errorf("unresolved=%d, want 1", n)
+	}
+
+	d.lookup = func([]string) map[string][]net.IP {
+		return map[string][]net.IP{
+			"a.example": {net.ParseIP("192.0.2.3")},
+			"b.example": {net.ParseIP("192.0.2.2")},
+		}
+	}
+	d.refreshPeers(context.Background(), &cfg)
+	for _, p := range d.peers() {
+		if p == a {
+			t.Error("old address of a.example not replaced")
+		}
+	}
+	if n := d.unresolvedHosts(); n != 0 {
+		t.Errorf("unresolved=%d, want 0", n)
+	}
+}
+
+func TestMergePeersMax(t *testing.T) {
+	old := []*peer{newTestPeer("192.0.2.1", 0, 0), newTestPeer("192.0.2.2", 0, 0)}
+	pool := map[string][]net.IP{
+		"a.example": {net.ParseIP("192.0.2.3"), net.ParseIP("192.0.2.1")},
+		"b.example": {net.ParseIP("192.0.2.4"), net.ParseIP("192.0.2.5")},
+	}
+
+	peers, added, removed := mergePeers(old, pool, 3)
+	if len(peers) != 3 || len(added) != 2 {
+		t.Fatalf("peers=%d added=%d expect 3 and 2", len(peers), len(added))
+	}
+	if peers[0] != old[0] {
+		t.Error("existing peer should be kept first")
+	}
+	if len(removed) != 1 || removed[0] != old[1] {
+		t.Errorf("removed %v", removed)
+	}
+
+	peers, _, _ = mergePeers(nil, pool, defaultMaxPeers)
+	if len(peers) != 4 {
+		t.Errorf("under default max got %d peers", len(peers))
+	}
+}
+
+func TestPoolReplace(t *testing.T) {
+	ips := []net.IP{}
+	for i := 1; i <= 5; i++ {
+		ips = append(ips, net.IP{192, 0, 2, byte(i)})
+	}
+	d := newTestNTPd(&Config{Pools: []PoolSpec{{Hostname: "pool.example", Count: 3}}})
+	d.lookup = func(addrs []string) map[string][]net.IP {
+		pool := map[string][]net.IP{}
+		for _, a := range addrs {
+			if a == "pool.example" {
+				pool[a] = ips
+			}
+		}
+		return pool
+	}
+	if err := d.init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	peers := d.peers()
+	if len(peers) != 3 {
+		t.Fatalf("expect 3 peers got %d", len(peers))
+	}
+
+	cfg := d.config()
+	dead := peers[0]
+	dead.polls = reachBits
+	alive := peers[1]
+	alive.polls, alive.reach = reachBits, 1
+	d.replacePool(context.Background(), &cfg)
+
+	peers = d.peers()
+	if len(peers) != 3 {
+		t.Fatalf("expect 3 peers after replace got %d", len(peers))
+	}
+	kept := false
+	for _, p := range peers {
+		if p.addr.Equal(dead.addr) {
+			t.Errorf("unreachable %s not replaced", dead.addr)
+		}
+		if p == alive {
+			kept = true
+		}
+	}
+	if !kept {
+		t.Error("state of reachable peer lost")
+	}
+}
+
+func TestAddRemovePeer(t *testing.T) {
+	d := newTestNTPd(&Config{PeerList: Peers("192.0.2.1")},
+		newTestPeer("192.0.2.1", 0, 0))
+	d.peerList[0].origin = "192.0.2.1"
+	d.lookup = func(addrs []string) map[string][]net.IP {
+		pool := map[string][]net.IP{}
+		for _, a := range addrs {
+			switch a {
+			case "a.example":
+				pool[a] = []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}
+			case "b.example":
+				pool[a] = []net.IP{net.ParseIP("192.0.2.3")}
+			}
+		}
+		return pool
+	}
+
+	if err := d.AddPeer("missing.example"); err == nil {
+		t.Error("unresolved peer added")
+	}
+	for _, addr := range []string{"a.example", "b.example"} {
+		if err := d.AddPeer(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.AddPeer("a.example"); err == nil {
+		t.Error("duplicated peer added")
+	}
+	if n := len(d.peers()); n != 3 {
+		t.Fatalf("expect 3 peers got %d", n)
+	}
+
+	snapshot := d.peers()
+	if err := d.RemovePeer("a.example"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RemovePeer("192.0.2.3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RemovePeer("c.example"); err == nil {
+		t.Error("remove unknown peer")
+	}
+	peers := d.peers()
+	if len(peers) != 1 || peers[0].addr.String() != "192.0.2.1" {
+		t.Errorf("peers after remove %v", peers)
+	}
+	if len(snapshot) != 3 || snapshot[2].addr.String() != "192.0.2.3" {
+		t.Error("snapshot modified")
+	}
+	if cfg := d.config(); len(cfg.PeerList) != 2 || cfg.PeerList[1].Addr != "b.example" {
+		t.Errorf("peer list %v", cfg.PeerList)
+	}
+}
+
+func TestStaggerDelay(t *testing.T) {
+	n := newTestNTPd(&Config{})
+	for i := 0; i < 10; i++ {
+		d := n.staggerDelay(i)
+		low := time.Duration(i) * staggerStep
+		if d < low || d >= low+staggerStep {
+			t.Errorf("delay of peer %d %s not in [%s, %s)", i, d, low, low+staggerStep)
+		}
+	}
+}
+
+func TestStartDelay(t *testing.T) {
+	d := newTestNTPd(&Config{MinPoll: 6})
+	if delay := d.startDelay(d.cfg); delay != 0 {
+		t.Errorf("delay %s without RandomStart", delay)
+	}
+
+	d.cfg.RandomStart = true
+	d.random = rand.New(rand.NewSource(1)).Int63n
+	var first []time.Duration
+	for i := 0; i < 10; i++ {
+		delay := d.startDelay(d.cfg)
+		if delay < 0 || delay >= pollTable[1] {
+			t.Errorf("delay %s not in [0, %s)", delay, pollTable[1])
+		}
+		first = append(first, delay)
+	}
+	// the same seed gives the same delays
+	d.random = rand.New(rand.NewSource(1)).Int63n
+	for i, want := range first {
+		if delay := d.startDelay(d.cfg); delay != want {
+			t.Errorf("delay %d = %s, want %s", i, delay, want)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	defer setLogger(stdLogger{})
+	l := &testLogger{}
+	setLogger(l)
+
+	cfg := &Config{DryRun: true}
+	d := newTestNTPd(cfg)
+	for _, c := range []struct {
+		offset time.Duration
+		log    string
+		err    error
+	}{
+		{time.Millisecond, "info dry run: would slew clock by 1ms", nil},
+		{-time.Second, "info dry run: would step clock by -1s", nil},
+		{-2 * cfg.PanicThreshold, "warn offset", errPanicOffset},
+	} {
+		if _, err := d.adjust(c.offset, noLeap, cfg); err != c.err {
+			t.Errorf("%s: got error %v, want %v", c.offset, err, c.err)
+		}
+		if last := l.logs[len(l.logs)-1]; !strings.HasPrefix(last, c.log) {
+			t.Errorf("%s: got log %q", c.offset, last)
+		}
+	}
+}
+
+func TestMinPeerStratum(t *testing.T) {
+	newStratumPeer := func(stratum, reach uint8, state string) *peer {
+		p := newTestPeer("192.0.2.1", 0, time.Millisecond)
+		p.stratum, p.reach, p.state = stratum, reach, state
+		return p
+	}
+	for _, g := range []struct {
+		peers []*peer
+		min   uint8
+	}{
+		{nil, invalidStratum},
+		{[]*peer{newStratumPeer(3, 1, stateSurvivor), newStratumPeer(2, 0, stateUnreachable)}, 3},
+		{[]*peer{newStratumPeer(3, 1, stateSurvivor), newStratumPeer(1, 1, stateFalseticker)}, 1},
+		{[]*peer{newStratumPeer(3, 1, stateSurvivor), newStratumPeer(1, 1, stateSelf), newStratumPeer(0, 1, "")}, 3},
+	} {
+		if min := minPeerStratum(g.peers); min != g.min {
+			t.Errorf("%d peers: min stratum %d, want %d", len(g.peers), min, g.min)
+		}
+	}
+}
+
+func TestPollPeerMinPoll(t *testing.T) {
+	old := queryInterval
+	queryInterval = time.Millisecond
+	defer func() { queryInterval = old }()
+
+	var peers []*peer
+	for _, addr := range []string{"192.0.2.1", "192.0.2.2"} {
+		p := newPeer(addr, net.ParseIP(addr))
+		p.query = func(string, ntp.QueryOptions) (*ntp.Response, error) {
+			return &ntp.Response{Stratum: 2, RTT: time.Millisecond, Time: time.Now()}, nil
+		}
+		peers = append(peers, p)
+	}
+	d := newTestNTPd(&Config{PeerList: []PeerSpec{
+		{Addr: "192.0.2.1"}, {Addr: "192.0.2.2", MinPoll: 6}}}, peers...)
+	for i := 0; i < 3; i++ {
+		d.poll(context.Background())
+	}
+	if peers[0].polls != 3 || peers[1].polls != 1 {
+		t.Errorf("polls %d and %d, expect 3 and 1", peers[0].polls, peers[1].polls)
+	}
+}
+
+func TestLastPollTimestamp(t *testing.T) {
+	old := queryInterval
+	queryInterval = time.Millisecond
+	defer func() { queryInterval = old }()
+
+	p := newPeer("192.0.2.1", net.ParseIP("192.0.2.1"))
+	p.query = func(string, ntp.QueryOptions) (*ntp.Response, error) {
+		return &ntp.Response{Stratum: 2, RTT: time.Millisecond, Time: time.Now()}, nil
+	}
+	d := newTestNTPd(&Config{PeerList: Peers("192.0.2.1")}, p)
+	d.stat = newNTPStat("")
+	start := unixSeconds(time.Now())
+	d.poll(context.Background())
+	if last := testutil.ToFloat64(d.stat.lastPollGauge); last < start || last > unixSeconds(time.Now()) {
+		t.Errorf("last poll at %f, poll started at %f", last, start)
+	}
+}
+
+func TestMakeStep(t *testing.T) {
+	defer setLogger(stdLogger{})
+	setLogger(&testLogger{})
+
+	cfg := &Config{DryRun: true, MakeStep: MakeStepSpec{Threshold: time.Second, Limit: 2}}
+	d := newTestNTPd(cfg)
+	for i, c := range []struct {
+		offset  time.Duration
+		stepped bool
+	}{
+		{500 * time.Millisecond, false},
+		{-2 * time.Second, true},
+		// over limit
+		{-2 * time.Second, false},
+		{100 * time.Second, false},
+	} {
+		stepped, err := d.adjust(c.offset, noLeap, cfg)
+		if err != nil || stepped != c.stepped {
+			t.Errorf("update %d offset %s: stepped=%v err=%v", i, c.offset, stepped, err)
+		}
+	}
+	if s := d.Stats(); s.Updates != 4 || s.Steps != 1 {
+		t.Errorf("%d updates %d steps", s.Updates, s.Steps)
+	}
+}
+
+func TestStepDirection(t *testing.T) {
+	defer setLogger(stdLogger{})
+	setLogger(&testLogger{})
+
+	cfg := &Config{DryRun: true}
+	d := newTestNTPd(cfg)
+	d.stat = &ntpStat{
+		stepCounter:    prometheus.NewCounter(prometheus.CounterOpts{Name: "step"}),
+		slewCounter:    prometheus.NewCounter(prometheus.CounterOpts{Name: "slew"}),
+		stepDirCounter: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "dir"}, []string{"direction"}),
+		lastStepGauge:  prometheus.NewGauge(prometheus.GaugeOpts{Name: "last"}),
+	}
+	for _, offset := range []time.Duration{time.Second, -2 * time.Second, time.Millisecond, -3 * time.Second} {
+		if _, err := d.adjust(offset, noLeap, cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for dir, want := range map[string]float64{"forward": 1, "backward": 2} {
+		if got := testutil.ToFloat64(d.stat.stepDirCounter.WithLabelValues(dir)); got != want {
+			t.Errorf("%v %s steps, want %v", got, dir, want)
+		}
+	}
+	if got := testutil.ToFloat64(d.stat.lastStepGauge); got != -3 {
+		t.Errorf("last step %v, want -3", got)
+	}
+}
+
+// TestPollConcurrent polls while stats, control and clients read the
+// state, run with -race.
+func TestPollConcurrent(t *testing.T) {
+	old := queryInterval
+	queryInterval = time.Millisecond
+	defer func() { queryInterval = old }()
+
+	var peers []*peer
+	for i, addr := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		p := newPeer(addr, net.ParseIP(addr))
+		offset := time.Duration(i) * time.Millisecond
+		p.query = func(string, ntp.QueryOptions) (*ntp.Response, error) {
+			return &ntp.Response{Stratum: 2, ClockOffset: offset,
+				RTT: time.Millisecond, Time: time.Now()}, nil
+		}
+		peers = append(peers, p)
+	}
+	d := newTestNTPd(&Config{}, peers...)
+	d.dropTable.Store(&dropTable{})
+	w := &worker{lru: newLRU(0), d: d}
+	raddr := &net.UDPAddr{IP: net.IP{198, 51, 100, 1}, Port: 123}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			d.poll(context.Background())
+			if op := d.find(); op != nil {
+				d.setTemplate(op)
+				d.updateState(op)
+			}
+			d.publishPeers()
+		}
+	}()
+
+	p := make([]byte, maxPacketSize)
+	for {
+		select {
+		case <-done:
+			if s := d.Stats(); !s.Synced || s.Median == nil || len(s.Peers) != 3 {
+				t.Errorf("stats %+v", s)
+			}
+			return
+		default:
+		}
+		d.Stats()
+		d.Ready()
+		d.systemVars(time.Now())
+		copy(p, newTestRequest())
+		w.handle(p, headerSize, raddr, time.Now())
+	}
+}
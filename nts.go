@@ -0,0 +1,533 @@
+package gontpd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Network Time Security, RFC 8915
+const (
+	defaultNTSKEAddr = ":4460"
+
+	ntsALPN          = "ntske/1"
+	ntsExporterLabel = "EXPORTER-network-time-security"
+
+	// NTS-KE record types, critical bit is the top bit of type
+	ntsKEEnd       = 0
+	ntsKENextProto = 1
+	ntsKEError     = 2
+	ntsKEWarning   = 3
+	ntsKEAEAD      = 4
+	ntsKECookie    = 5
+	ntsKECritical  = 0x8000
+
+	// NTS-KE error codes
+	ntsKEUnrecognized = 0
+	ntsKEBadRequest   = 1
+
+	ntsProtoNTPv4 = 0
+	// ntsAEADSIV256 is AEAD_AES_SIV_CMAC_256
+	ntsAEADSIV256 = 15
+
+	// extension field types of NTS
+	extUniqueID          = 0x0104
+	extCookie            = 0x0204
+	extCookiePlaceholder = 0x0304
+	extAuthenticator     = 0x0404
+
+	// ntsCookies is number of cookies issued by NTS-KE
+	ntsCookies   = 8
+	ntsNonceSize = 16
+	// minUniqueIDSize is min length of unique identifier of request
+	minUniqueIDSize = 32
+
+	// ntsKETimeout is the deadline of a whole NTS-KE session
+	ntsKETimeout = 10 * time.Second
+	// maxKERequest is max size of records of NTS-KE request
+	maxKERequest = 1024
+
+	// ntsKeyRotation is interval of new cookie key, cookies of the
+	// previous key are accepted until next rotation
+	ntsKeyRotation = 24 * time.Hour
+)
+
+// cookieSize is length of cookie: key id, nonce and sealed keys
+const cookieSize = 4 + ntsNonceSize + 16 + 2*sivKeySize
+
+// cookieKey seals cookies, id is carried by cookie to find the key
+type cookieKey struct {
+	id   uint32
+	aead *siv
+}
+
+func newCookieKey() (k *cookieKey, err error) {
+	var b [4 + sivKeySize]byte
+	if _, err = rand.Read(b[:]); err != nil {
+		return
+	}
+	k = &cookieKey{id: binary.BigEndian.Uint32(b[:])}
+	k.aead, err = newSIV(b[4:])
+	return
+}
+
+// ntsServer holds certificate of NTS-KE and keys of cookies, cookies
+// are stateless so keys[0] seals new cookies, keys[1] is the previous
+// one.
+type ntsServer struct {
+	cert tls.Certificate
+
+	mu   sync.RWMutex
+	keys []*cookieKey
+
+	// ln is the NTS-KE listener once started
+	ln net.Listener
+}
+
+func newNTSServer(certFile, keyFile string) (s *ntsServer, err error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return
+	}
+	s = &ntsServer{cert: cert}
+	err = s.rotate()
+	return
+}
+
+// rotate adds a new cookie key, the one before previous is dropped
+func (s *ntsServer) rotate() (err error) {
+	k, err := newCookieKey()
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.keys = append([]*cookieKey{k}, s.keys...)
+	if len(s.keys) > 2 {
+		s.keys = s.keys[:2]
+	}
+	s.mu.Unlock()
+	return
+}
+
+// cookie seals keys of client into a new cookie
+func (s *ntsServer) cookie(dst, c2s, s2c []byte) ([]byte, error) {
+	s.mu.RLock()
+	k := s.keys[0]
+	s.mu.RUnlock()
+
+	n := len(dst)
+	dst = append(dst, make([]byte, 4+ntsNonceSize)...)
+	binary.BigEndian.PutUint32(dst[n:], k.id)
+	nonce := dst[n+4:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	var keys [2 * sivKeySize]byte
+	copy(keys[:], c2s)
+	copy(keys[sivKeySize:], s2c)
+	return k.aead.seal(dst, keys[:], nonce), nil
+}
+
+// openCookie returns keys of client sealed in cookie
+func (s *ntsServer) openCookie(cookie []byte) (c2s, s2c []byte, err error) {
+	if len(cookie) != cookieSize {
+		err = errors.New("invalid cookie length")
+		return
+	}
+	id := binary.BigEndian.Uint32(cookie)
+	var k *cookieKey
+	s.mu.RLock()
+	for _, ck := range s.keys {
+		if ck.id == id {
+			k = ck
+		}
+	}
+	s.mu.RUnlock()
+	if k == nil {
+		err = errors.New("unknown cookie key")
+		return
+	}
+	keys, err := k.aead.open(nil, cookie[4+ntsNonceSize:], cookie[4:4+ntsNonceSize])
+	if err != nil {
+		return
+	}
+	c2s, s2c = keys[:sivKeySize], keys[sivKeySize:]
+	return
+}
+
+// keRecord is a record of NTS-KE
+type keRecord struct {
+	typ  uint16
+	body []byte
+}
+
+func (r keRecord) critical() bool {
+	return r.typ&ntsKECritical != 0
+}
+
+func (r keRecord) kind() uint16 {
+	return r.typ &^ ntsKECritical
+}
+
+// readKERecords reads records until End of Message
+func readKERecords(r io.Reader) (recs []keRecord, err error) {
+	var hdr [4]byte
+	size := 0
+	for {
+		if _, err = io.ReadFull(r, hdr[:]); err != nil {
+			return
+		}
+		rec := keRecord{typ: binary.BigEndian.Uint16(hdr[:])}
+		n := int(binary.BigEndian.Uint16(hdr[2:]))
+		if size += len(hdr) + n; size > maxKERequest {
+			err = fmt.Errorf("request is over %d bytes", maxKERequest)
+			return
+		}
+		rec.body = make([]byte, n)
+		if _, err = io.ReadFull(r, rec.body); err != nil {
+			return
+		}
+		recs = append(recs, rec)
+		if rec.kind() == ntsKEEnd {
+			return
+		}
+	}
+}
+
+func appendKERecord(p []byte, typ uint16, body []byte) []byte {
+	p = append(p, byte(typ>>8), byte(typ), byte(len(body)>>8), byte(len(body)))
+	return append(p, body...)
+}
+
+// uint16s returns body of record as list of uint16, i.e. protocols
+func uint16s(body []byte) (vs []uint16, ok bool) {
+	if len(body)%2 != 0 {
+		return
+	}
+	for i := 0; i < len(body); i += 2 {
+		vs = append(vs, binary.BigEndian.Uint16(body[i:]))
+	}
+	return vs, true
+}
+
+func hasUint16(vs []uint16, v uint16) bool {
+	for _, x := range vs {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate checks NTS-KE request, returns error code if request is
+// refused. ok reports whether NTPv4 and AES-SIV are supported by client,
+// otherwise empty lists are responded and no cookie is issued.
+func negotiate(recs []keRecord) (ok bool, code uint16, err error) {
+	var protos, aeads []uint16
+	var hasProto, hasAEAD bool
+	for _, r := range recs {
+		valid := true
+		switch r.kind() {
+		case ntsKEEnd:
+		case ntsKENextProto:
+			protos, valid = uint16s(r.body)
+			valid = valid && !hasProto
+			hasProto = true
+		case ntsKEAEAD:
+			aeads, valid = uint16s(r.body)
+			valid = valid && !hasAEAD
+			hasAEAD = true
+		case ntsKEError, ntsKEWarning:
+			valid = false
+		default:
+			if r.critical() {
+				code, err = ntsKEUnrecognized, fmt.Errorf("unrecognized critical record %d", r.kind())
+				return
+			}
+		}
+		if !valid {
+			code, err = ntsKEBadRequest, fmt.Errorf("bad request: record %d", r.kind())
+			return
+		}
+	}
+	if !hasProto {
+		code, err = ntsKEBadRequest, errors.New("bad request: no next protocol")
+		return
+	}
+	ok = hasUint16(protos, ntsProtoNTPv4) && hasAEAD && hasUint16(aeads, ntsAEADSIV256)
+	return
+}
+
+// exportKeys derives keys of client to server and server to client
+func exportKeys(cs tls.ConnectionState) (c2s, s2c []byte, err error) {
+	context := []byte{0, ntsProtoNTPv4, 0, ntsAEADSIV256, 0}
+	c2s, err = cs.ExportKeyingMaterial(ntsExporterLabel, context, sivKeySize)
+	if err != nil {
+		return
+	}
+	context[4] = 1
+	s2c, err = cs.ExportKeyingMaterial(ntsExporterLabel, context, sivKeySize)
+	return
+}
+
+// serveNTSKE answers one NTS-KE session on conn
+func (d *NTPd) serveNTSKE(conn *tls.Conn) (err error) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ntsKETimeout))
+	if err = conn.Handshake(); err != nil {
+		return
+	}
+	cs := conn.ConnectionState()
+	if cs.NegotiatedProtocol != ntsALPN {
+		err = fmt.Errorf("bad request: ALPN %q", cs.NegotiatedProtocol)
+		return
+	}
+	recs, err := readKERecords(conn)
+	if err != nil {
+		return
+	}
+
+	var resp []byte
+	ok, code, err := negotiate(recs)
+	switch {
+	case err != nil:
+		var b [2]byte
+		binary.BigEndian.PutUint16(b[:], code)
+		resp = appendKERecord(resp, ntsKECritical|ntsKEError, b[:])
+	case !ok:
+		resp = appendKERecord(resp, ntsKECritical|ntsKENextProto, nil)
+		resp = appendKERecord(resp, ntsKEAEAD, nil)
+	default:
+		resp = appendKERecord(resp, ntsKECritical|ntsKENextProto, []byte{0, ntsProtoNTPv4})
+		resp = appendKERecord(resp, ntsKEAEAD, []byte{0, ntsAEADSIV256})
+		var c2s, s2c, cookie []byte
+		c2s, s2c, err = exportKeys(cs)
+		if err != nil {
+			return
+		}
+		for i := 0; i < ntsCookies; i++ {
+			cookie, err = d.nts.cookie(cookie[:0], c2s, s2c)
+			if err != nil {
+				return
+			}
+			resp = appendKERecord(resp, ntsKECookie, cookie)
+		}
+	}
+	resp = appendKERecord(resp, ntsKECritical|ntsKEEnd, nil)
+	if _, werr := conn.Write(resp); werr != nil && err == nil {
+		err = werr
+	}
+	return
+}
+
+// startNTS listens NTS-KE at NTSKEAddr and rotates cookie keys until ctx
+// is done.
+func (d *NTPd) startNTS(ctx context.Context) (err error) {
+	s := d.nts
+	ln, err := tls.Listen("tcp", d.cfg.NTSKEAddr, &tls.Config{
+		Certificates: []tls.Certificate{s.cert},
+		NextProtos:   []string{ntsALPN},
+		MinVersion:   tls.VersionTLS13,
+	})
+	if err != nil {
+		return
+	}
+	s.ln = ln
+	logger().Infof("NTS-KE listen %s", ln.Addr())
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	go d.ntsKELoop(ctx, ln)
+	go d.ntsKeyLoop(ctx)
+	return
+}
+
+func (d *NTPd) ntsKELoop(ctx context.Context, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				logger().Errorf("NTS-KE: %s", err)
+			}
+			return
+		}
+		go func() {
+			err := d.serveNTSKE(conn.(*tls.Conn))
+			result := "ok"
+			if err != nil {
+				result = "error"
+				if debug {
+					logger().Debugf("NTS-KE: %s: %s", conn.RemoteAddr(), err)
+				}
+			}
+			if d.stat != nil {
+				d.stat.ntsKECounter.WithLabelValues(result).Inc()
+			}
+		}()
+	}
+}
+
+func (d *NTPd) ntsKeyLoop(ctx context.Context) {
+	for {
+		if sleepContext(ctx, ntsKeyRotation) != nil {
+			return
+		}
+		if err := d.nts.rotate(); err != nil {
+			logger().Errorf("NTS: rotate cookie key: %s", err)
+		}
+	}
+}
+
+// hasNTS reports whether request carries NTS extension fields
+func hasNTS(exts []extField) bool {
+	for _, e := range exts {
+		if e.typ == extCookie || e.typ == extAuthenticator {
+			return true
+		}
+	}
+	return false
+}
+
+// ntsRequest is NTS extension fields of request
+type ntsRequest struct {
+	uid          []byte
+	cookie       []byte
+	placeholders int
+	auth         extField
+}
+
+func parseNTSRequest(exts []extField) (r ntsRequest, err error) {
+	var hasAuth bool
+	for _, e := range exts {
+		if hasAuth {
+			// fields after authenticator are not authenticated
+			break
+		}
+		switch e.typ {
+		case extUniqueID:
+			r.uid = e.body
+		case extCookie:
+			if r.cookie != nil {
+				err = errors.New("more than one cookie")
+				return
+			}
+			r.cookie = e.body
+		case extCookiePlaceholder:
+			r.placeholders++
+		case extAuthenticator:
+			r.auth, hasAuth = e, true
+		}
+	}
+	switch {
+	case len(r.uid) < minUniqueIDSize:
+		err = errors.New("no unique identifier")
+	case r.cookie == nil:
+		err = errors.New("no cookie")
+	case !hasAuth:
+		err = errors.New("no authenticator")
+	}
+	return
+}
+
+// parseAuthenticator returns nonce and ciphertext of authenticator body
+func parseAuthenticator(body []byte) (nonce, ciphertext []byte, err error) {
+	if len(body) < 4 {
+		err = errors.New("short authenticator")
+		return
+	}
+	nl := int(binary.BigEndian.Uint16(body))
+	cl := int(binary.BigEndian.Uint16(body[2:]))
+	np := (nl + 3) &^ 3
+	if nl < ntsNonceSize || 4+np+cl > len(body) {
+		err = errors.New("invalid authenticator length")
+		return
+	}
+	nonce, ciphertext = body[4:4+nl], body[4+np:4+np+cl]
+	return
+}
+
+func appendExtField(p []byte, typ uint16, body []byte) []byte {
+	length := extHeaderSize + (len(body)+3)&^3
+	p = append(p, byte(typ>>8), byte(typ), byte(length>>8), byte(length))
+	p = append(p, body...)
+	for i := len(body); i%4 != 0; i++ {
+		p = append(p, 0)
+	}
+	return p
+}
+
+// serveNTS builds authenticated response in place of NTS request p
+// with length n, a new cookie is sent for the one used and each
+// placeholder as long as response is not larger than request.
+// Interleaved mode is not offered to NTS clients.
+func (w *worker) serveNTS(p []byte, n int, exts []extField, receiveTime time.Time) (rn int, err error) {
+	req, err := parseNTSRequest(exts)
+	if err != nil {
+		return
+	}
+	c2s, s2c, err := w.d.nts.openCookie(req.cookie)
+	if err != nil {
+		return
+	}
+	nonce, ciphertext, err := parseAuthenticator(req.auth.body)
+	if err != nil {
+		return
+	}
+	aead, err := newSIV(c2s)
+	if err != nil {
+		return
+	}
+	if _, err = aead.open(nil, ciphertext, p[:req.auth.off], nonce); err != nil {
+		return
+	}
+
+	// request is overwritten by response so it's built aside
+	resp := w.ntsBuf[:0]
+	resp = append(resp, w.d.loadTemplate()[:originTimeStamp]...)
+	resp = append(resp, p[transmitTimeStamp:transmitTimeStamp+8]...)
+	resp = append(resp, make([]byte, 16)...)
+	setUint64(resp, receiveTimeStamp, toNtpTime(receiveTime))
+	resp = appendExtField(resp, extUniqueID, req.uid)
+
+	// authenticator holds nonce lengths, nonce and SIV besides cookies
+	overhead := extHeaderSize + 4 + ntsNonceSize + 16
+	cookies := 1 + req.placeholders
+	for cookies > 1 && len(resp)+overhead+cookies*(extHeaderSize+cookieSize) > n {
+		cookies--
+	}
+	var plain, cookie []byte
+	for i := 0; i < cookies; i++ {
+		cookie, err = w.d.nts.cookie(cookie[:0], c2s, s2c)
+		if err != nil {
+			return
+		}
+		plain = appendExtField(plain, extCookie, cookie)
+	}
+
+	aead, err = newSIV(s2c)
+	if err != nil {
+		return
+	}
+	stampTransmit(resp)
+	auth := len(resp)
+	length := overhead + len(plain)
+	resp = append(resp, byte(extAuthenticator>>8), byte(extAuthenticator&0xff),
+		byte(length>>8), byte(length), 0, ntsNonceSize, byte((16+len(plain))>>8), byte(16+len(plain)))
+	nonceAt := len(resp)
+	resp = append(resp, make([]byte, ntsNonceSize)...)
+	if _, err = rand.Read(resp[nonceAt:]); err != nil {
+		return
+	}
+	resp = aead.seal(resp, plain, resp[:auth], resp[nonceAt:])
+	w.ntsBuf = resp
+	rn = copy(p, resp)
+	return
+}
@@ -0,0 +1,330 @@
+package gontpd
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// writeTestCert writes self-signed certificate and key of localhost
+func writeTestCert(t *testing.T) (cert, key string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert = writeTemp(t, "cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	key = writeTemp(t, "key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})))
+	return
+}
+
+func newTestNTS(t *testing.T) *ntsServer {
+	cert, key := writeTestCert(t)
+	s, err := newNTSServer(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestNTSCookie(t *testing.T) {
+	s := newTestNTS(t)
+	c2s, s2c := bytes.Repeat([]byte{1}, sivKeySize), bytes.Repeat([]byte{2}, sivKeySize)
+	cookie, err := s.cookie(nil, c2s, s2c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cookie) != cookieSize {
+		t.Fatalf("cookie length %d, want %d", len(cookie), cookieSize)
+	}
+	check := func(name string, cookie []byte, ok bool) {
+		gc, gs, err := s.openCookie(cookie)
+		if (err == nil) != ok {
+			t.Errorf("%s: err=%v", name, err)
+			return
+		}
+		if ok && (!bytes.Equal(gc, c2s) || !bytes.Equal(gs, s2c)) {
+			t.Errorf("%s: got keys %x %x", name, gc, gs)
+		}
+	}
+	check("new", cookie, true)
+
+	tampered := append([]byte{}, cookie...)
+	tampered[cookieSize-1] ^= 1
+	check("tampered", tampered, false)
+	check("short", cookie[:cookieSize-4], false)
+
+	// cookie of previous key is valid until next rotation
+	s.rotate()
+	check("previous key", cookie, true)
+	s.rotate()
+	check("expired key", cookie, false)
+}
+
+func TestNegotiate(t *testing.T) {
+	rec := func(typ uint16, body ...byte) keRecord { return keRecord{typ: typ, body: body} }
+	proto := rec(ntsKECritical|ntsKENextProto, 0, ntsProtoNTPv4)
+	aead := rec(ntsKEAEAD, 0, 1, 0, ntsAEADSIV256)
+	end := rec(ntsKECritical | ntsKEEnd)
+	for _, c := range []struct {
+		name string
+		recs []keRecord
+		ok   bool
+		code int
+	}{
+		{"ok", []keRecord{proto, aead, end}, true, -1},
+		{"unknown proto", []keRecord{rec(ntsKECritical|ntsKENextProto, 0x80, 0), aead, end}, false, -1},
+		{"unknown aead", []keRecord{proto, rec(ntsKEAEAD, 0, 1), end}, false, -1},
+		{"no aead", []keRecord{proto, end}, false, -1},
+		{"no proto", []keRecord{aead, end}, false, ntsKEBadRequest},
+		{"odd proto", []keRecord{rec(ntsKENextProto, 0), aead, end}, false, ntsKEBadRequest},
+		{"two proto", []keRecord{proto, proto, aead, end}, false, ntsKEBadRequest},
+		{"error record", []keRecord{proto, aead, rec(ntsKEError, 0, 0), end}, false, ntsKEBadRequest},
+		{"unknown record", []keRecord{proto, aead, rec(0x4000), end}, true, -1},
+		{"unknown critical", []keRecord{proto, aead, rec(ntsKECritical | 0x4000), end}, false, ntsKEUnrecognized},
+	} {
+		ok, code, err := negotiate(c.recs)
+		if ok != c.ok || (err != nil) != (c.code >= 0) || (err != nil && int(code) != c.code) {
+			t.Errorf("%s: ok=%v code=%d err=%v", c.name, ok, code, err)
+		}
+	}
+}
+
+// ntsKE runs NTS-KE with server at addr, returns keys and cookies
+func ntsKE(t *testing.T, addr string) (c2s, s2c []byte, cookies [][]byte) {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{ntsALPN},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var req []byte
+	req = appendKERecord(req, ntsKECritical|ntsKENextProto, []byte{0, ntsProtoNTPv4})
+	req = appendKERecord(req, ntsKEAEAD, []byte{0, ntsAEADSIV256})
+	req = appendKERecord(req, ntsKECritical|ntsKEEnd, nil)
+	if _, err = conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := readKERecords(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range recs {
+		switch r.kind() {
+		case ntsKECookie:
+			cookies = append(cookies, r.body)
+		case ntsKEError:
+			t.Fatalf("NTS-KE error %v", r.body)
+		}
+	}
+	c2s, s2c, err = exportKeys(conn.ConnectionState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// newNTSPacket builds NTS request with uid and cookie authenticated
+// by c2s, placeholders are added for more cookies.
+func newNTSPacket(c2s, uid, cookie []byte, placeholders int) []byte {
+	p := newTestRequest()
+	p = appendExtField(p, extUniqueID, uid)
+	p = appendExtField(p, extCookie, cookie)
+	for i := 0; i < placeholders; i++ {
+		p = appendExtField(p, extCookiePlaceholder, make([]byte, len(cookie)))
+	}
+	aead, _ := newSIV(c2s)
+	nonce := bytes.Repeat([]byte{7}, ntsNonceSize)
+	ct := aead.seal(nil, nil, p, nonce)
+	body := []byte{0, ntsNonceSize, 0, byte(len(ct))}
+	body = append(append(body, nonce...), ct...)
+	return appendExtField(p, extAuthenticator, body)
+}
+
+// openNTSResponse verifies response p by s2c, returns cookies in it
+func openNTSResponse(t *testing.T, s2c, uid, p []byte) (cookies [][]byte) {
+	exts, mac, err := extensions(p)
+	if err != nil || mac != len(p) {
+		t.Fatalf("response extensions: mac=%d %v", mac, err)
+	}
+	var gotUID bool
+	for _, e := range exts {
+		switch e.typ {
+		case extUniqueID:
+			gotUID = bytes.Equal(e.body, uid)
+		case extAuthenticator:
+			nonce, ct, err := parseAuthenticator(e.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			aead, _ := newSIV(s2c)
+			plain, err := aead.open(nil, ct, p[:e.off], nonce)
+			if err != nil {
+				t.Fatalf("response not authenticated: %s", err)
+			}
+			inner, _, err := extensions(append(make([]byte, headerSize), plain...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range inner {
+				if c.typ == extCookie {
+					cookies = append(cookies, c.body)
+				}
+			}
+		}
+	}
+	if !gotUID {
+		t.Error("unique identifier not echoed")
+	}
+	return
+}
+
+func TestServeNTS(t *testing.T) {
+	cert, key := writeTestCert(t)
+	d := newTestServer(t, &Config{NTSCert: cert, NTSKey: key, NTSKEAddr: "127.0.0.1:0"})
+	defer d.shutdown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := d.startNTS(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	c2s, s2c, cookies := ntsKE(t, d.nts.ln.Addr().String())
+	if len(cookies) != ntsCookies {
+		t.Fatalf("got %d cookies", len(cookies))
+	}
+
+	conn, err := net.DialUDP("udp", nil, d.conns[0].LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	uid := bytes.Repeat([]byte{0xab}, minUniqueIDSize)
+	req := newNTSPacket(c2s, uid, cookies[0], 2)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, maxPacketSize)
+	n, err := conn.Read(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = resp[:n]
+	if n > len(req) {
+		t.Errorf("response %d bytes is larger than request %d", n, len(req))
+	}
+	if !bytes.Equal(resp[originTimeStamp:originTimeStamp+8], req[transmitTimeStamp:transmitTimeStamp+8]) {
+		t.Error("origin timestamp mismatch")
+	}
+	if got := openNTSResponse(t, s2c, uid, resp); len(got) != 3 {
+		t.Errorf("got %d cookies, want 3", len(got))
+	}
+}
+
+func TestHandleNTSDrop(t *testing.T) {
+	d := newTestNTPd(&Config{})
+	d.dropTable.Store(&dropTable{})
+	d.nts = newTestNTS(t)
+	w := &worker{lru: newLRU(0), d: d, stat: &workerStat{
+		Req:     prometheus.NewCounter(prometheus.CounterOpts{Name: "req"}),
+		NTS:     prometheus.NewCounter(prometheus.CounterOpts{Name: "nts"}),
+		NTSDrop: prometheus.NewCounter(prometheus.CounterOpts{Name: "nts_drop"}),
+	}}
+	raddr := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 123}
+
+	c2s, s2c := bytes.Repeat([]byte{1}, sivKeySize), bytes.Repeat([]byte{2}, sivKeySize)
+	cookie, _ := d.nts.cookie(nil, c2s, s2c)
+	uid := bytes.Repeat([]byte{0xab}, minUniqueIDSize)
+	good := newNTSPacket(c2s, uid, cookie, 0)
+	tampered := append([]byte{}, good...)
+	tampered[transmitTimeStamp] ^= 1
+	noUID := newTestRequest()
+	noUID = appendExtField(noUID, extCookie, cookie)
+	noUID = appendExtField(noUID, extAuthenticator, good[len(good)-40+extHeaderSize:])
+	badCookie := append([]byte{}, cookie...)
+	badCookie[0] ^= 1
+
+	for _, c := range []struct {
+		name string
+		req  []byte
+		ok   bool
+	}{
+		{"good", good, true},
+		{"tampered header", tampered, false},
+		{"wrong key", newNTSPacket(s2c, uid, cookie, 0), false},
+		{"unknown cookie", newNTSPacket(c2s, uid, badCookie, 0), false},
+		{"no unique identifier", noUID, false},
+		{"short unique identifier", newNTSPacket(c2s, uid[:16], cookie, 0), false},
+	} {
+		p := make([]byte, maxPacketSize)
+		n := copy(p, c.req)
+		rn, stamp := w.handle(p, n, raddr, time.Now())
+		if (rn != 0) != c.ok || stamp {
+			t.Errorf("%s: got %d bytes response stamp=%v", c.name, rn, stamp)
+			continue
+		}
+		if c.ok {
+			openNTSResponse(t, s2c, uid, p[:rn])
+			if ts := binary.BigEndian.Uint64(p[transmitTimeStamp:]); ts == 0 {
+				t.Errorf("%s: no transmit timestamp", c.name)
+			}
+		}
+	}
+	if got := testutil.ToFloat64(w.stat.NTS); got != 1 {
+		t.Errorf("%v NTS responses, want 1", got)
+	}
+	if got := testutil.ToFloat64(w.stat.NTSDrop); got != 5 {
+		t.Errorf("%v NTS drops, want 5", got)
+	}
+}
+
+func TestNewNTS(t *testing.T) {
+	cert, key := writeTestCert(t)
+	for _, c := range []struct {
+		name string
+		cfg  Config
+		ok   bool
+	}{
+		{"ok", Config{NTSCert: cert, NTSKey: key}, true},
+		{"no key", Config{NTSCert: cert}, false},
+		{"key as cert", Config{NTSCert: key, NTSKey: key}, false},
+		{"server disabled", Config{NTSCert: cert, NTSKey: key, ServerDisabled: true}, false},
+	} {
+		c.cfg.PeerList = Peers("127.0.0.1")
+		_, err := New(&c.cfg)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: err=%v", c.name, err)
+		}
+	}
+}
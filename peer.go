@@ -1,10 +1,12 @@
 package gontpd
 
 import (
+	"context"
 	"crypto/md5"
-	"log"
+	"encoding/binary"
+	"fmt"
+	"math"
 	"net"
-	"sync"
 	"time"
 
 	"github.com/beevik/ntp"
@@ -12,6 +14,7 @@ import (
 
 const (
 	replyNum       = 4
+	iburstNum      = 6
 	goodFilter     = replyNum - 1
 	invalidStratum = 16
 	maxPoll        = 16
@@ -19,21 +22,105 @@ const (
 )
 
 type peer struct {
-	origin     string
-	addr       net.IP
-	reply      [replyNum]*ntp.Response
+	origin string
+	addr   net.IP
+	// samples are stages of clock filter, the last SamplesPerPeer valid
+	// replies of good polls, oldest first. sample is the one with
+	// minimum round trip chosen by filter, taken at epoch, and fresh is
+	// set if it's not used before.
+	samples []filterSample
+	sample  *ntp.Response
+	epoch   time.Time
+	fresh   bool
+	// estimate of peer by its sample, disp is root dispersion and
+	// filterDisp is dispersion of clock filter
 	offset     time.Duration
 	delay      time.Duration
-	err        time.Duration
+	disp       time.Duration
+	filterDisp time.Duration
+	rootDelay  time.Duration
+	jitter     time.Duration
 	refId      uint32
 	stratum    uint8
 	trustLevel uint8
-	good       bool
-	enable     bool
+	// reach is shifted left every poll, bit 0 is set if poll is good
+	reach  uint8
+	polls  int
+	good   bool
+	enable bool
+	// noisy is set if samples of the last poll are dropped by MaxStd
+	noisy bool
+	// lastPoll is start of the last poll cycle that updated peer
+	lastPoll time.Time
+	// failures is consecutive polls without any reply, peer is backed
+	// off by them
+	failures int
+
+	// query is ntpQuery if nil, replaced in tests
+	query queryFunc
+	// bcast is set if peer is a broadcast server, its samples are
+	// received instead of polled
+	bcast *bcastState
+	// refclock is set if peer is a reference clock, its samples are
+	// read from it
+	refclock *refclock
+
+	// falseCount is consecutive polls that peer is falseticker,
+	// peer is excluded from selection until falseUntil
+	falseCount int
+	falseUntil time.Time
+	state      string
+
+	// stats is state published by poll loop, guarded by mu of NTPd
+	stats PeerStats
+}
+
+const (
+	stateSurvivor    = "survivor"
+	stateFalseticker = "falseticker"
+	stateUnreachable = "unreachable"
+	// stateNoSelect is reachable peer never selected by NoSelect
+	stateNoSelect = "noselect"
+	// stateSelf is peer excluded as ourselves or synchronized to us
+	stateSelf = "self"
+)
+
+var peerStates = []string{stateSurvivor, stateFalseticker, stateUnreachable, stateNoSelect, stateSelf}
+
+// banned reports if peer is excluded from selection as falseticker
+func (p *peer) banned(now time.Time) bool {
+	return now.Before(p.falseUntil)
+}
+
+// classify updates state of peer after selection, peer is banned for
+// cooldown after being falseticker for limit consecutive polls.
+func (p *peer) classify(survived bool, now time.Time, limit int, cooldown time.Duration) {
+	switch {
+	case p.reach == 0:
+		p.state = stateUnreachable
+	case !p.good:
+		// no sample of this poll, keep previous state
+	case p.banned(now):
+		p.state = stateFalseticker
+	case survived:
+		if p.falseCount >= limit {
+			logger().Infof("peer:%s recovered from falseticker", p.addr)
+		}
+		p.falseCount = 0
+		p.state = stateSurvivor
+	default:
+		p.falseCount++
+		p.state = stateFalseticker
+		if p.falseCount >= limit {
+			p.falseUntil = now.Add(cooldown)
+			logger().Warnf("peer:%s is falseticker for %d polls, excluded until %s",
+				p.addr, p.falseCount, p.falseUntil.Format(time.RFC3339))
+		}
+	}
 }
 
 func newPeer(origin string, addr net.IP) (p *peer) {
-	log.Printf("new peer:%s->%s", origin, addr.String())
+	logger().Infof("new peer:%s->%s", origin, addr.String())
 	p = &peer{
 		origin:     origin,
 		addr:       addr,
@@ -41,18 +128,95 @@ func newPeer(origin string, addr net.IP) (p *peer) {
 		enable:     true,
 	}
 	p.refId = makeSendRefId(addr)
+	p.stats = newPeerStats(p)
 	return
 }
 
-func (p *peer) update(wg *sync.WaitGroup, maxstd time.Duration) {
-	defer wg.Done()
-	p.good = false
-	ts := 2 * time.Second
+// shiftReach records result of a poll in reach register
+func (p *peer) shiftReach(good bool) {
+	p.reach <<= 1
+	if good {
+		p.reach |= 1
+	}
+}
+
+// queryInterval is the minimum headway between queries to a peer,
+// it's a variable for tests.
+var queryInterval = 2 * time.Second
+
+// queryFunc queries NTP server at addr
+type queryFunc func(addr string, opt ntp.QueryOptions) (*ntp.Response, error)
+
+// ntpQuery queries peers without their own query, it's a variable for tests.
+var ntpQuery queryFunc = ntp.QueryWithOptions
+
+// queryContext queries peer until ctx is done even if query hangs,
+// panic in query is returned as error.
+func (p *peer) queryContext(ctx context.Context, opt ntp.QueryOptions) (*ntp.Response, error) {
+	query := p.query
+	if query == nil {
+		query = ntpQuery
+	}
+
+	type result struct {
+		resp *ntp.Response
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				ch <- result{nil, fmt.Errorf("query panic: %v", r)}
+			}
+		}()
+		resp, err := query(p.addr.String(), opt)
+		ch <- result{resp, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.resp, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// update polls peer for replyNum samples, or iburstNum samples if burst
+// is set, replies of good poll are shifted into clock filter.
+// Each query is given up after opt.Timeout, and the poll is given up
+// once ctx is done.
+func (p *peer) update(ctx context.Context, maxstd time.Duration, fp filterParams, opt ntp.QueryOptions, burst bool) {
+	p.good, p.noisy = false, false
+	defer func() { p.shiftReach(p.good) }()
+	defer func() {
+		if r := recover(); r != nil {
+			logger().Errorf("peer:%s update panic: %v", p.addr, r)
+			p.good = false
+		}
+	}()
+	p.polls++
+	// queries are spaced by minimum headway even in burst,
+	// and backoff on RATE KoD
+	ts := queryInterval
 	goodList := []time.Duration{}
 
-	for i := 0; i < replyNum; i++ {
-		time.Sleep(ts)
-		resp, err := ntp.Query(p.addr.String())
+	num := replyNum
+	if burst {
+		num = iburstNum
+		logger().Infof("peer:%s burst %d samples", p.addr, num)
+	}
+	replies := make([]*ntp.Response, 0, num)
+
+	for i := 0; i < num; i++ {
+		if sleepContext(ctx, ts) != nil {
+			return
+		}
+		qctx, cancel := context.WithTimeout(ctx, opt.Timeout)
+		resp, err := p.queryContext(qctx, opt)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
 		if resp != nil && resp.Stratum == 0 {
 			switch resp.KissCode {
 			case "RATE":
@@ -64,11 +228,10 @@ func (p *peer) update(wg *sync.WaitGroup, maxstd time.Duration) {
 		}
 
 		if err != nil {
-			log.Printf("%s update failed %s", p.addr.String(), err)
-			p.reply[i] = &ntp.Response{Stratum: invalidStratum}
+			logger().Warnf("%s update failed %s", p.addr.String(), err)
 			if nerr, ok := err.(net.Error); ok {
 				if !nerr.Temporary() {
-					log.Printf("%s can't be reach, disabled", p.addr.String())
+					logger().Warnf("%s can't be reach, disabled", p.addr.String())
 					p.enable = false
 					return
 				}
@@ -77,41 +240,93 @@ func (p *peer) update(wg *sync.WaitGroup, maxstd time.Duration) {
 		}
 
 		goodList = append(goodList, resp.ClockOffset)
-		p.reply[i] = resp
+		replies = append(replies, resp)
+	}
+	if len(replies) == 0 {
+		p.failures++
+	} else {
+		p.failures = 0
 	}
 
 	if len(goodList) < goodFilter {
-		log.Printf("peer:%s has not enough good response", p.addr.String())
+		logger().Warnf("peer:%s has not enough good response", p.addr.String())
 		p.good = false
 		return
 	}
 
 	if sd := stddev(goodList); maxstd < sd {
-		log.Printf("peer:%s stddev out of range:%s", p.addr.String(), sd)
-		p.good = false
+		logger().Warnf("peer:%s stddev out of range:%s", p.addr.String(), sd)
+		p.good, p.noisy = false, true
 		return
 	}
 
 	p.good = true
+	now := time.Now()
+	p.addSamples(replies, now, fp)
+	p.filter(now, fp)
 
 	if debug {
-		log.Printf("%s is good=%v", p.addr, p.good)
+		logger().Debugf("%s is good=%v", p.addr, p.good)
 	}
 
 }
 
-func makeSendRefId(ip net.IP) (id uint32) {
+// backoff is how long peer is left alone after its last poll as it
+// failed to reply, doubling from poll interval of low up to high. Zero is
+// returned if the last poll got any reply.
+func (p *peer) backoff(low, high uint8) time.Duration {
+	if p.failures == 0 {
+		return 0
+	}
+	exp := int(low) + p.failures
+	if exp > int(high) {
+		exp = int(high)
+	}
+	return pollTable[exp-minPoll]
+}
 
-	if len(ip) > 10 && ip[11] == 255 {
-		// ipv4
-		id = uint32(ip[12])<<24 + uint32(ip[13])<<16 + uint32(ip[14])<<
-			8 + uint32(ip[15])
-	} else {
-		h := md5.New()
-		hr := h.Sum(ip)
-		// 255.b2.b3.b4 for ipv6 hash
-		// https://support.ntp.org/bin/view/Dev/UpdatingTheRefidFormat
-		id = uint32(255)<<24 + uint32(hr[1])<<16 + uint32(hr[2])<<8 + uint32(hr[3])
+// pollInterval is poll interval of peer by its trust level within low and
+// high, or its backoff while it's failing to reply.
+func (p *peer) pollInterval(low, high uint8) time.Duration {
+	if p.failures > 0 {
+		return p.backoff(low, high)
 	}
-	return
+	level := p.trustLevel
+	if level < low {
+		level = low
+	}
+	if level > high {
+		level = high
+	}
+	return pollTable[level-minPoll]
+}
+
+// rootDist is root distance of peer by last poll, the same as rootDist of
+// its sample as candidate.
+func (p *peer) rootDist() time.Duration {
+	return (p.rootDelay+p.delay)/2 + p.disp + p.filterDisp
+}
+
+// jitter is the RMS of differences between offsets and offset of the
+// best sample ref, RFC 5905 Section 10.
+func jitter(offsets []time.Duration, ref time.Duration) time.Duration {
+	if len(offsets) < 2 {
+		return 0
+	}
+	var sum float64
+	for _, o := range offsets {
+		diff := float64(o - ref)
+		sum += diff * diff
+	}
+	return time.Duration(math.Sqrt(sum / float64(len(offsets)-1)))
+}
+
+// makeSendRefId follows RFC 5905, refid is the IPv4 address of peer
+// or the first four octets of the MD5 hash of the IPv6 address.
+func makeSendRefId(ip net.IP) (id uint32) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return binary.BigEndian.Uint32(ip4)
+	}
+	hr := md5.Sum(ip.To16())
+	return binary.BigEndian.Uint32(hr[:4])
 }
@@ -0,0 +1,309 @@
+package gontpd
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+func TestMakeSendRefId(t *testing.T) {
+	if id := makeSendRefId(net.ParseIP("192.0.2.1")); id != 0xc0000201 {
+		t.Errorf("ipv4 refid=%x", id)
+	}
+	if id := makeSendRefId(net.IP{192, 0, 2, 1}); id != 0xc0000201 {
+		t.Errorf("4 bytes ipv4 refid=%x", id)
+	}
+
+	ip := net.ParseIP("2001:db8::1")
+	sum := md5.Sum(ip)
+	if id := makeSendRefId(ip); id != binary.BigEndian.Uint32(sum[:]) {
+		t.Errorf("ipv6 refid=%x expect md5 %x", id, sum[:4])
+	}
+}
+
+func TestShiftReach(t *testing.T) {
+	p := &peer{}
+	for i, good := range []bool{true, false, true, true} {
+		p.shiftReach(good)
+		if i == 0 && p.reach != 0x1 {
+			t.Errorf("reach=%x after first good poll", p.reach)
+		}
+	}
+	if p.reach != 0xb {
+		t.Errorf("reach=%x expect b", p.reach)
+	}
+	for i := 0; i < 8; i++ {
+		p.shiftReach(false)
+	}
+	if p.reach != 0 {
+		t.Errorf("reach=%x should be unreachable after 8 bad polls", p.reach)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	ms := time.Millisecond
+	gold := []struct {
+		offsets []time.Duration
+		ref     time.Duration
+		jitter  time.Duration
+	}{
+		{nil, 0, 0},
+		{[]time.Duration{ms}, ms, 0},
+		{[]time.Duration{ms, ms, ms}, ms, 0},
+		{[]time.Duration{0, 2 * ms, 2 * ms}, 0, 2 * ms},
+		{[]time.Duration{0, 3 * ms, -3 * ms}, 0, 3 * ms},
+	}
+	for _, g := range gold {
+		if j := jitter(g.offsets, g.ref); j != g.jitter {
+			t.Errorf("jitter(%v, %s)=%s expect %s", g.offsets, g.ref, j, g.jitter)
+		}
+	}
+}
+
+func TestUpdateTimeoutAndPanic(t *testing.T) {
+	old := queryInterval
+	queryInterval = time.Millisecond
+	defer func() { queryInterval = old }()
+
+	hang := make(chan struct{})
+	defer close(hang)
+
+	gold := []struct {
+		name  string
+		query queryFunc
+		good  bool
+	}{
+		{"hang", func(string, ntp.QueryOptions) (*ntp.Response, error) {
+			<-hang
+			return nil, nil
+		}, false},
+		{"panic", func(string, ntp.QueryOptions) (*ntp.Response, error) {
+			panic("boom")
+		}, false},
+		{"good", func(string, ntp.QueryOptions) (*ntp.Response, error) {
+			return &ntp.Response{Stratum: 2, ClockOffset: time.Millisecond}, nil
+		}, true},
+	}
+
+	for _, g := range gold {
+		p := newPeer("192.0.2.1", net.ParseIP("192.0.2.1"))
+		p.query = g.query
+		done := make(chan struct{})
+		go func() {
+			p.update(context.Background(), time.Second, testFilter, ntp.QueryOptions{Timeout: 10 * time.Millisecond}, false)
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: update blocked", g.name)
+		}
+		if p.good != g.good || (p.reach&1 == 1) != g.good {
+			t.Errorf("%s: good=%v reach=%x", g.name, p.good, p.reach)
+		}
+	}
+}
+
+// testFilter is clock filter of default size on a microsecond clock
+var testFilter = filterParams{size: defaultSamplesPerPeer, precision: -20}
+
+func TestPeerFilter(t *testing.T) {
+	old := queryInterval
+	queryInterval = time.Millisecond
+	defer func() { queryInterval = old }()
+
+	ms := time.Millisecond
+	// round trip of the 6th reply is the lowest
+	rtts := []time.Duration{30, 20, 25, 40, 35, 5, 30, 20, 40, 40, 40, 40}
+	n := 0
+	p := newPeer("192.0.2.1", net.ParseIP("192.0.2.1"))
+	p.query = func(string, ntp.QueryOptions) (*ntp.Response, error) {
+		resp := &ntp.Response{Stratum: 2, RTT: rtts[n] * ms,
+			ClockOffset: time.Duration(n) * ms}
+		n++
+		return resp, nil
+	}
+
+	opt := ntp.QueryOptions{Timeout: 10 * ms}
+	fp := filterParams{size: 6, precision: -20}
+	p.update(context.Background(), time.Second, fp, opt, false)
+	if p.offset != ms || p.delay != 20*ms {
+		t.Errorf("offset=%s delay=%s, want 1ms 20ms", p.offset, p.delay)
+	}
+	p.update(context.Background(), time.Second, fp, opt, false)
+	if len(p.samples) != 6 {
+		t.Fatalf("got %d samples, want 6", len(p.samples))
+	}
+	if p.offset != 5*ms || p.delay != 5*ms {
+		t.Errorf("offset=%s delay=%s, want 5ms 5ms", p.offset, p.delay)
+	}
+	if op := newOffsetPeer(p, p.sample); op.resp.ClockOffset != 5*ms {
+		t.Errorf("candidate offset=%s, want 5ms", op.resp.ClockOffset)
+	}
+
+	// lowest one is shifted out of window
+	p.update(context.Background(), time.Second, fp, opt, false)
+	if p.offset != 7*ms || p.delay != 20*ms {
+		t.Errorf("offset=%s delay=%s, want 7ms 20ms", p.offset, p.delay)
+	}
+}
+
+func TestPeerMaxStd(t *testing.T) {
+	old := queryInterval
+	queryInterval = time.Millisecond
+	defer func() { queryInterval = old }()
+
+	ms := time.Millisecond
+	// offsets alternate around 5ms by spread
+	newSpreadPeer := func(addr string, spread time.Duration) *peer {
+		n := 0
+		p := newPeer(addr, net.ParseIP(addr))
+		p.query = func(string, ntp.QueryOptions) (*ntp.Response, error) {
+			off := 5*ms + spread
+			if n%2 == 1 {
+				off = 5*ms - spread
+			}
+			n++
+			return &ntp.Response{Stratum: 2, RTT: ms, ClockOffset: off, Time: time.Now()}, nil
+		}
+		return p
+	}
+	opt := ntp.QueryOptions{Timeout: 10 * ms}
+	for _, g := range []struct {
+		spread time.Duration
+		good   bool
+	}{
+		{ms, true},
+		{10 * ms, true},
+		{20 * ms, false},
+	} {
+		p := newSpreadPeer("192.0.2.1", g.spread)
+		p.update(context.Background(), 10*ms, testFilter, opt, false)
+		if p.good != g.good || p.noisy == g.good {
+			t.Errorf("spread %s: good=%v noisy=%v", g.spread, p.good, p.noisy)
+		}
+		if g.good != (len(p.samples) > 0) {
+			t.Errorf("spread %s: %d samples", g.spread, len(p.samples))
+		}
+	}
+
+	// max_std of peer overrides global one
+	noisy, clean := newSpreadPeer("192.0.2.1", 20*ms), newSpreadPeer("192.0.2.2", 20*ms)
+	d := newTestNTPd(&Config{MaxStd: 10 * ms, PeerList: []PeerSpec{
+		{Addr: "192.0.2.1"}, {Addr: "192.0.2.2", MaxStd: 30 * ms}}}, noisy, clean)
+	d.poll(context.Background())
+	if noisy.good || !clean.good {
+		t.Errorf("good=%v and %v, want false and true", noisy.good, clean.good)
+	}
+}
+
+func TestQuerySource(t *testing.T) {
+	cfg := &Config{QuerySourceAddr: []string{"2001:db8::1", "127.0.0.2"}}
+	for _, g := range []struct {
+		peer, source string
+	}{
+		{"192.0.2.1", "127.0.0.2"},
+		{"2001:db8::2", "2001:db8::1"},
+	} {
+		if s := cfg.querySource(net.ParseIP(g.peer)); s != g.source {
+			t.Errorf("source of %s is %q, want %q", g.peer, s, g.source)
+		}
+	}
+	if s := (&Config{}).querySource(net.ParseIP("192.0.2.1")); s != "" {
+		t.Errorf("source %q without QuerySourceAddr", s)
+	}
+
+	// query egresses from the source address, 127.0.0.2 is only
+	// assigned on Linux
+	if err := validateQuerySource([]string{"127.0.0.2"}); err != nil {
+		t.Skip(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	from := make(chan net.Addr, 1)
+	go func() {
+		buf := make([]byte, 128)
+		_, addr, err := conn.ReadFrom(buf)
+		if err == nil {
+			from <- addr
+		}
+	}()
+	cfg.PeerTimeout = 100 * time.Millisecond
+	d := newTestNTPd(cfg)
+	opt := d.queryOptions(cfg, net.ParseIP("127.0.0.1"))
+	ntp.QueryWithOptions(conn.LocalAddr().String(), opt)
+	select {
+	case addr := <-from:
+		if ip := addr.(*net.UDPAddr).IP; !ip.Equal(net.ParseIP("127.0.0.2")) {
+			t.Errorf("query from %s, want 127.0.0.2", ip)
+		}
+	case <-time.After(time.Second):
+		t.Error("no query")
+	}
+}
+
+func TestPeerBackoff(t *testing.T) {
+	old := queryInterval
+	queryInterval = time.Millisecond
+	defer func() { queryInterval = old }()
+
+	p := newPeer("192.0.2.1", net.ParseIP("192.0.2.1"))
+	for _, g := range []struct {
+		failures  int
+		low, high uint8
+		wait      time.Duration
+	}{
+		{0, minPoll, maxPoll, 0},
+		{1, minPoll, maxPoll, 64 * time.Second},
+		{3, 6, maxPoll, 512 * time.Second},
+		{20, minPoll, 10, 1024 * time.Second},
+	} {
+		p.failures = g.failures
+		if wait := p.backoff(g.low, g.high); wait != g.wait {
+			t.Errorf("failures=%d [%d, %d] backoff=%s, want %s",
+				g.failures, g.low, g.high, wait, g.wait)
+		}
+	}
+
+	fail := true
+	p = newPeer("192.0.2.1", net.ParseIP("192.0.2.1"))
+	p.query = func(string, ntp.QueryOptions) (*ntp.Response, error) {
+		if fail {
+			return nil, errors.New("timeout")
+		}
+		return &ntp.Response{Stratum: 2}, nil
+	}
+	d := newTestNTPd(&Config{PeerList: Peers("192.0.2.1")}, p)
+	d.poll(context.Background())
+	if p.failures != 1 || p.polls != 1 {
+		t.Fatalf("failures=%d polls=%d", p.failures, p.polls)
+	}
+	// dead peer isn't polled again until backoff
+	d.poll(context.Background())
+	if p.polls != 1 {
+		t.Errorf("polled while backed off, polls=%d", p.polls)
+	}
+	p.lastPoll = p.lastPoll.Add(-64 * time.Second)
+	d.poll(context.Background())
+	if p.polls != 2 || p.failures != 2 {
+		t.Errorf("polls=%d failures=%d after backoff", p.polls, p.failures)
+	}
+
+	// reply resets backoff
+	fail = false
+	p.lastPoll = p.lastPoll.Add(-128 * time.Second)
+	d.poll(context.Background())
+	if p.failures != 0 || !p.good {
+		t.Errorf("failures=%d good=%v after reply", p.failures, p.good)
+	}
+}
@@ -0,0 +1,110 @@
+package gontpd
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// pool peer is replaced after it's unreachable for reachBits polls
+const reachBits = 8
+
+// resolveAll resolves PeerList and picks addresses of Pools. Current
+// peers of hosts failed to resolve are kept, those hosts are retried by
+// resolveLoop.
+func (d *NTPd) resolveAll(ctx context.Context, cfg *Config) map[string][]net.IP {
+	hosts := cfg.peerAddrs()
+	pool, ttl := d.resolve(ctx, hosts)
+	if pool == nil {
+		pool = map[string][]net.IP{}
+	}
+	for _, ps := range cfg.Pools {
+		hosts = append(hosts, ps.Hostname)
+		ips, _ := d.resolve(ctx, []string{ps.Hostname})
+		pool[ps.Hostname] = ips[ps.Hostname]
+	}
+	var unresolved []string
+	for _, host := range hosts {
+		if len(pool[host]) == 0 {
+			unresolved = append(unresolved, host)
+		}
+	}
+
+	now := time.Now()
+	inUse := map[string]bool{}
+	current := map[string][]net.IP{}
+	d.mu.Lock()
+	d.unresolved, d.srvTTL = unresolved, ttl
+	for _, p := range d.peerList {
+		inUse[p.addr.String()] = true
+		current[p.origin] = append(current[p.origin], p.addr)
+	}
+	for addr, until := range d.demoted {
+		if now.After(until) {
+			delete(d.demoted, addr)
+		}
+	}
+	demoted := make(map[string]bool, len(d.demoted))
+	for addr := range d.demoted {
+		demoted[addr] = true
+	}
+	d.mu.Unlock()
+
+	for _, ps := range cfg.Pools {
+		pool[ps.Hostname] = pickPool(pool[ps.Hostname], ps.Count, inUse, demoted)
+	}
+	for _, host := range unresolved {
+		if ips := current[host]; len(ips) > 0 {
+			logger().Warnf("resolve: %s failed, keep %d current peers", host, len(ips))
+			pool[host] = ips
+		}
+	}
+	return pool
+}
+
+// pickPool chooses count addresses from ips, addresses in use are
+// preferred to keep their state and demoted ones are skipped.
+func pickPool(ips []net.IP, count int, inUse, demoted map[string]bool) (picked []net.IP) {
+	for _, preferred := range []bool{true, false} {
+		for _, ip := range ips {
+			if len(picked) >= count {
+				return
+			}
+			key := ip.String()
+			if inUse[key] == preferred && !demoted[key] {
+				picked = append(picked, ip)
+			}
+		}
+	}
+	return
+}
+
+// replacePool demotes pool peers unreachable for reachBits polls and
+// picks fresh addresses from their pools.
+func (d *NTPd) replacePool(ctx context.Context, cfg *Config) {
+	hosts := map[string]bool{}
+	for _, ps := range cfg.Pools {
+		hosts[ps.Hostname] = true
+	}
+
+	until := time.Now().Add(cfg.ResolveInterval)
+	n := 0
+	d.mu.Lock()
+	for _, p := range d.peerList {
+		if !hosts[p.origin] || p.reach != 0 || p.polls < reachBits {
+			continue
+		}
+		logger().Warnf("pool:%s peer %s unreachable, demoted until %s",
+			p.origin, p.addr, until.Format(time.RFC3339))
+		if d.demoted == nil {
+			d.demoted = map[string]time.Time{}
+		}
+		d.demoted[p.addr.String()] = until
+		n++
+	}
+	d.mu.Unlock()
+
+	if n > 0 {
+		d.refreshPeers(ctx, cfg)
+	}
+}
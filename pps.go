@@ -0,0 +1,72 @@
+package gontpd
+
+import (
+	"net"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+const (
+	ppsRefID = "PPS"
+	// ppsMaxOffset is max distance between PPS and another peer to
+	// take the second number from it
+	ppsMaxOffset = 400 * time.Millisecond
+	// ppsTimeout is how long to wait for a pulse
+	ppsTimeout = 2 * time.Second
+)
+
+// ppsAddr is the pseudo address of PPS peer as ntpd
+var ppsAddr = net.IPv4(127, 127, 22, 0).To4()
+
+// ppsSample returns sample of pulse captured at local time t, pulse is
+// the start of a second so offset is the distance to the nearest one.
+func ppsSample(t time.Time, precision int8) *ntp.Response {
+	sec := t.Round(time.Second)
+	return &ntp.Response{
+		Time:           t,
+		ClockOffset:    sec.Sub(t),
+		Precision:      log2Duration(precision),
+		ReferenceTime:  sec,
+		RootDispersion: log2Duration(precision),
+	}
+}
+
+// openPPSPeer opens PPS device as peer, the samples are read by the
+// refclock loop.
+func openPPSPeer(device string, precision int8) (p *peer, err error) {
+	refID, _ := parseRefID(ppsRefID)
+	rc := &refclock{name: "PPS(" + device + ")", pps: true}
+	fetch, closer, err := openPPS(device)
+	if err != nil {
+		return
+	}
+	rc.close = closer
+	rc.read = func() (resp *ntp.Response, err error) {
+		t, ok, err := fetch(ppsTimeout)
+		if ok {
+			resp = ppsSample(t, precision)
+		}
+		return
+	}
+	p = newPeer(rc.name, ppsAddr)
+	p.refId = refID
+	p.refclock = rc
+	return
+}
+
+// ppsLocked reports whether PPS peer p is numbered by another good peer,
+// that is the offset of p is within ppsMaxOffset of the peer. PPS alone
+// only knows where a second starts.
+func ppsLocked(p *peer, peers []*peer) bool {
+	for _, q := range peers {
+		if q == p || q.reach == 0 || !q.enable || !q.good ||
+			(q.refclock != nil && q.refclock.pps) {
+			continue
+		}
+		if absDuration(q.offset-p.offset) < ppsMaxOffset {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package gontpd
+
+import (
+	"errors"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// RFC 2783 PPS API of Linux, linux/pps.h
+const ppsCaptureAssert = 0x01
+
+// ioctl numbers take size of pointer as argument size
+var (
+	ppsGetParams = ioc(2, 0xa1)
+	ppsSetParams = ioc(1, 0xa2)
+	ppsFetch     = ioc(3, 0xa4)
+)
+
+func ioc(dir, nr uintptr) uintptr {
+	return dir<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'p'<<8 | nr
+}
+
+type ppsKtime struct {
+	sec   int64
+	nsec  int32
+	flags uint32
+}
+
+type ppsKinfo struct {
+	assertSequence uint32
+	clearSequence  uint32
+	assertTu       ppsKtime
+	clearTu        ppsKtime
+	currentMode    int32
+}
+
+type ppsFdata struct {
+	info    ppsKinfo
+	timeout ppsKtime
+}
+
+type ppsKparams struct {
+	apiVersion  int32
+	mode        int32
+	assertOffTu ppsKtime
+	clearOffTu  ppsKtime
+}
+
+func ppsIoctl(fd int, req uintptr, arg unsafe.Pointer) (err error) {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+	if errno != 0 {
+		err = errno
+	}
+	return
+}
+
+// openPPS opens PPS device and enables capture of assert edge, fetch
+// waits up to timeout for next pulse and returns its timestamp.
+func openPPS(device string) (fetch func(timeout time.Duration) (time.Time, bool, error), close func() error, err error) {
+	fd, err := unix.Open(device, unix.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	var params ppsKparams
+	if err = ppsIoctl(fd, ppsGetParams, unsafe.Pointer(&params)); err != nil {
+		unix.Close(fd)
+		return
+	}
+	if params.mode&ppsCaptureAssert == 0 {
+		params.mode |= ppsCaptureAssert
+		if err = ppsIoctl(fd, ppsSetParams, unsafe.Pointer(&params)); err != nil {
+			unix.Close(fd)
+			return
+		}
+	}
+
+	var last uint32
+	fetch = func(timeout time.Duration) (t time.Time, ok bool, err error) {
+		var data ppsFdata
+		data.timeout.sec = int64(timeout / time.Second)
+		data.timeout.nsec = int32(timeout % time.Second)
+		err = ppsIoctl(fd, ppsFetch, unsafe.Pointer(&data))
+		if err == unix.ETIMEDOUT {
+			err = errors.New("no pulse")
+		}
+		if err != nil {
+			return
+		}
+		seq := data.info.assertSequence
+		if seq == last {
+			return
+		}
+		last = seq
+		t = time.Unix(data.info.assertTu.sec, int64(data.info.assertTu.nsec))
+		ok = true
+		return
+	}
+	close = func() error { return unix.Close(fd) }
+	return
+}
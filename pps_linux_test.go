@@ -0,0 +1,38 @@
+package gontpd
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestPPSIoctl(t *testing.T) {
+	if unsafe.Sizeof(uintptr(0)) != 8 {
+		t.Skip("ioctl numbers of 64 bits only")
+	}
+	for _, c := range []struct {
+		name   string
+		got    uintptr
+		expect uintptr
+	}{
+		{"getparams", ppsGetParams, 0x800870a1},
+		{"setparams", ppsSetParams, 0x400870a2},
+		{"fetch", ppsFetch, 0xc00870a4},
+	} {
+		if c.got != c.expect {
+			t.Errorf("%s: %#x, expect %#x", c.name, c.got, c.expect)
+		}
+	}
+}
+
+func TestPPSLayout(t *testing.T) {
+	// sizes of linux/pps.h on 64 bits
+	if unsafe.Sizeof(uintptr(0)) != 8 {
+		t.Skip("layout of 64 bits only")
+	}
+	if s := unsafe.Sizeof(ppsFdata{}); s != 64 {
+		t.Errorf("pps_fdata size=%d, expect 64", s)
+	}
+	if s := unsafe.Sizeof(ppsKparams{}); s != 40 {
+		t.Errorf("pps_kparams size=%d, expect 40", s)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package gontpd
+
+import (
+	"errors"
+	"time"
+)
+
+func openPPS(device string) (fetch func(timeout time.Duration) (time.Time, bool, error), close func() error, err error) {
+	err = errors.New("PPS is not supported on this platform")
+	return
+}
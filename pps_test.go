@@ -0,0 +1,73 @@
+package gontpd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPPSSample(t *testing.T) {
+	ms := time.Millisecond
+	sec := time.Unix(1600000000, 0)
+	for _, c := range []struct {
+		t      time.Time
+		offset time.Duration
+	}{
+		{sec, 0},
+		{sec.Add(3 * ms), -3 * ms},
+		{sec.Add(-2 * ms), 2 * ms},
+		{sec.Add(700 * ms), 300 * ms},
+	} {
+		resp := ppsSample(c.t, -20)
+		if resp.ClockOffset != c.offset {
+			t.Errorf("%s: offset=%s, expect %s", c.t, resp.ClockOffset, c.offset)
+		}
+	}
+}
+
+func newTestPPSPeer(offset time.Duration) *peer {
+	p := newTestPeer("127.127.22.0", offset, time.Microsecond)
+	p.offset = offset
+	p.refclock = &refclock{name: "PPS(/dev/pps0)", pps: true}
+	return p
+}
+
+func TestPPSLocked(t *testing.T) {
+	ms := time.Millisecond
+	pps := newTestPPSPeer(ms)
+	coarse := newTestPeer("192.0.2.1", 5*ms, 10*ms)
+	coarse.offset = 5 * ms
+	far := newTestPeer("192.0.2.2", 500*ms, 10*ms)
+	far.offset = 500 * ms
+
+	for _, c := range []struct {
+		name   string
+		peers  []*peer
+		locked bool
+	}{
+		{"alone", []*peer{pps}, false},
+		{"coarse", []*peer{pps, coarse}, true},
+		{"far", []*peer{pps, far}, false},
+		{"other pps", []*peer{pps, newTestPPSPeer(ms)}, false},
+	} {
+		if got := ppsLocked(pps, c.peers); got != c.locked {
+			t.Errorf("%s: locked=%v, expect %v", c.name, got, c.locked)
+		}
+	}
+}
+
+func TestFindPPS(t *testing.T) {
+	ms := time.Millisecond
+	pps := newTestPPSPeer(0)
+	d := newTestNTPd(&Config{}, pps)
+	if op := d.find(); op != nil {
+		t.Fatalf("unlocked PPS selected %v", op)
+	}
+
+	coarse := newTestPeer("192.0.2.1", 20*ms, 50*ms)
+	coarse.offset = 20 * ms
+	d = newTestNTPd(&Config{}, pps, coarse)
+	op := d.find()
+	if op == nil || op.peer != pps {
+		t.Fatalf("expect PPS selected, got %v", op)
+	}
+}
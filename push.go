@@ -0,0 +1,49 @@
+package gontpd
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const defaultPushJob = "gontpd"
+
+// pushTimeout bounds a push, it's done by goroutine of Run between polls
+const pushTimeout = 10 * time.Second
+
+// pushInstance returns instance label of pushed metrics, hostname is
+// used unless PushInstance is set
+func pushInstance(cfg *Config) string {
+	if cfg.PushInstance != "" {
+		return cfg.PushInstance
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "localhost"
+	}
+	return host
+}
+
+// pushMetrics replaces metrics of job and instance on PushGateway with
+// the current ones. A failed push is only logged, metrics are pushed
+// again on next sync.
+func (d *NTPd) pushMetrics() {
+	cfg := d.config()
+	if d.stat == nil || cfg.PushGateway == "" {
+		return
+	}
+	err := push.New(cfg.PushGateway, cfg.PushJob).
+		Client(&http.Client{Timeout: pushTimeout}).
+		Gatherer(d.stat.reg).
+		Grouping("instance", pushInstance(&cfg)).
+		Push()
+	if err != nil {
+		logger().Warnf("push metrics to %s failed: %s", cfg.PushGateway, err)
+		return
+	}
+	if debug {
+		logger().Debugf("metrics pushed to %s", cfg.PushGateway)
+	}
+}
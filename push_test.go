@@ -0,0 +1,35 @@
+package gontpd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPushMetrics(t *testing.T) {
+	var method, path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+	}))
+	defer srv.Close()
+
+	d := newTestNTPd(&Config{PushGateway: srv.URL, PushInstance: "ntp1"})
+	d.stat = newNTPStat("")
+	d.pushMetrics()
+	if method != http.MethodPut || path != "/metrics/job/gontpd/instance/ntp1" {
+		t.Errorf("pushed %s %s", method, path)
+	}
+
+	// failure is only logged
+	srv.Close()
+	d.pushMetrics()
+}
+
+func TestPushInstance(t *testing.T) {
+	if got := pushInstance(&Config{PushInstance: "ntp1"}); got != "ntp1" {
+		t.Errorf("instance=%s", got)
+	}
+	if got := pushInstance(&Config{}); got == "" {
+		t.Error("empty default instance")
+	}
+}
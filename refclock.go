@@ -0,0 +1,171 @@
+package gontpd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+// SHM reference clock of ntpd, it's written by gpsd and others
+const (
+	// shmKey is the key of unit 0, "NTP0"
+	shmKey = 0x4e545030
+
+	maxRefclockUnit      = 255
+	defaultRefclockRefID = "GPS"
+
+	// refclockInterval is how often segment is read
+	refclockInterval = time.Second
+)
+
+var errRefclockUnsync = errors.New("refclock is not synchronized")
+
+// shmTime is struct shmTime of ntpd refclock_shm.c, time_t is C long,
+// which has the size of Go int on supported platforms.
+type shmTime struct {
+	mode                 int32
+	count                int32
+	clockTimeStampSec    int
+	clockTimeStampUSec   int32
+	receiveTimeStampSec  int
+	receiveTimeStampUSec int32
+	leap                 int32
+	precision            int32
+	nsamples             int32
+	valid                int32
+	clockTimeStampNSec   uint32
+	receiveTimeStampNSec uint32
+	dummy                [8]int32
+}
+
+// shmStamp is time of seconds, microseconds and nanoseconds, nsec is
+// used only if it agrees with usec since old writers leave it unset.
+func shmStamp(sec int, usec int32, nsec uint32) time.Time {
+	if int32(nsec/1000) != usec {
+		nsec = uint32(usec) * 1000
+	}
+	return time.Unix(int64(sec), int64(nsec))
+}
+
+// readSHM returns new sample in t or nil if there is none, valid is
+// cleared after read so each sample is read once.
+// Writer of mode 1 increases count before and after writing, sample is
+// discarded if count changes during read.
+func readSHM(t *shmTime) (resp *ntp.Response, err error) {
+	if atomic.LoadInt32(&t.valid) == 0 {
+		return
+	}
+	count := atomic.LoadInt32(&t.count)
+	mode := t.mode
+	clock := shmStamp(t.clockTimeStampSec, t.clockTimeStampUSec, t.clockTimeStampNSec)
+	receive := shmStamp(t.receiveTimeStampSec, t.receiveTimeStampUSec, t.receiveTimeStampNSec)
+	leap, precision := uint8(t.leap), int8(t.precision)
+	clash := atomic.LoadInt32(&t.count) != count
+	atomic.StoreInt32(&t.valid, 0)
+
+	switch {
+	case mode != 0 && mode != 1:
+		err = fmt.Errorf("unsupported mode %d", mode)
+	case mode == 1 && clash:
+		err = errors.New("sample is written while reading")
+	case leap == notSync:
+		err = errRefclockUnsync
+	}
+	if err != nil {
+		return
+	}
+	resp = &ntp.Response{
+		Time:           receive,
+		ClockOffset:    clock.Sub(receive),
+		Precision:      log2Duration(precision),
+		ReferenceTime:  clock,
+		RootDispersion: log2Duration(precision),
+		Leap:           ntp.LeapIndicator(leap),
+	}
+	return
+}
+
+// refclock is a SHM segment or PPS device, its samples are read every
+// refclockInterval and taken by poll.
+type refclock struct {
+	sampleBuf
+	name string
+	// read returns new sample or nil if there is none, it may block
+	// until the next one
+	read  func() (*ntp.Response, error)
+	close func() error
+	// pps is set if samples are offsets within second of PPS
+	pps bool
+}
+
+// refclockAddr is the pseudo address of SHM unit as ntpd, it's used as
+// address of refclock peer.
+func refclockAddr(unit int) net.IP {
+	return net.IPv4(127, 127, 28, byte(unit)).To4()
+}
+
+// openRefclocks attaches SHM segments of specs as peers
+func openRefclocks(specs []RefclockSpec) (peers []*peer, err error) {
+	for _, s := range specs {
+		var refID uint32
+		refID, err = parseRefID(s.RefID)
+		if err != nil {
+			return
+		}
+		rc := &refclock{name: fmt.Sprintf("SHM(%d)", s.Unit)}
+		var shm *shmTime
+		shm, rc.close, err = openSHM(s.Unit)
+		if err != nil {
+			err = fmt.Errorf("%s: %s", rc.name, err)
+			return
+		}
+		rc.read = func() (*ntp.Response, error) { return readSHM(shm) }
+		p := newPeer(rc.name, refclockAddr(s.Unit))
+		p.refId = refID
+		p.refclock = rc
+		peers = append(peers, p)
+	}
+	return
+}
+
+// refclockLoop reads samples of rc until ctx is done
+func (d *NTPd) refclockLoop(ctx context.Context, rc *refclock) {
+	defer rc.close()
+	t := time.NewTicker(refclockInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		resp, err := rc.read()
+		if err != nil {
+			if debug {
+				logger().Debugf("%s: %s", rc.name, err)
+			}
+			continue
+		}
+		if resp == nil {
+			continue
+		}
+		rc.add(resp)
+		if rc.pps && d.stat != nil {
+			d.stat.ppsCounter.Inc()
+		}
+	}
+}
+
+// startRefclocks reads refclocks in peers until ctx is done
+func (d *NTPd) startRefclocks(ctx context.Context) {
+	for _, p := range d.peers() {
+		if p.refclock != nil {
+			go d.refclockLoop(ctx, p.refclock)
+		}
+	}
+}
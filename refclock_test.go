@@ -0,0 +1,147 @@
+package gontpd
+
+import (
+	"context"
+	"encoding/binary"
+	"strconv"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestShmTimeLayout(t *testing.T) {
+	// sizeof(struct shmTime) of ntpd
+	size := uintptr(80)
+	if strconv.IntSize == 64 {
+		size = 96
+	}
+	if got := unsafe.Sizeof(shmTime{}); got != size {
+		t.Errorf("shmTime is %d bytes, want %d", got, size)
+	}
+	if got := unsafe.Offsetof(shmTime{}.valid); strconv.IntSize == 64 && got != 48 {
+		t.Errorf("valid at %d, want 48", got)
+	}
+}
+
+// writeSHM writes sample as gpsd, clock is ahead of receive by offset
+func writeSHM(t *shmTime, receive time.Time, offset time.Duration, leap int32) {
+	clock := receive.Add(offset)
+	t.count++
+	t.clockTimeStampSec = int(clock.Unix())
+	t.clockTimeStampUSec = int32(clock.Nanosecond() / 1000)
+	t.clockTimeStampNSec = uint32(clock.Nanosecond())
+	t.receiveTimeStampSec = int(receive.Unix())
+	t.receiveTimeStampUSec = int32(receive.Nanosecond() / 1000)
+	t.receiveTimeStampNSec = uint32(receive.Nanosecond())
+	t.leap = leap
+	t.precision = -20
+	t.count++
+	t.valid = 1
+}
+
+func TestReadSHM(t *testing.T) {
+	now := time.Unix(1600000000, 123456789)
+	ms := time.Millisecond
+	for _, c := range []struct {
+		name   string
+		set    func(*shmTime)
+		offset time.Duration
+		ok     bool
+		err    bool
+	}{
+		{"invalid", func(s *shmTime) { writeSHM(s, now, ms, 0); s.valid = 0 }, 0, false, false},
+		{"mode 0", func(s *shmTime) { writeSHM(s, now, ms, 0) }, ms, true, false},
+		{"mode 1", func(s *shmTime) { writeSHM(s, now, -ms, 0); s.mode = 1 }, -ms, true, false},
+		{"usec only", func(s *shmTime) {
+			writeSHM(s, now, ms, 0)
+			s.clockTimeStampNSec, s.receiveTimeStampNSec = 0, 0
+		}, ms, true, false},
+		{"unsynchronized", func(s *shmTime) { writeSHM(s, now, ms, int32(notSync)) }, 0, false, true},
+		{"unknown mode", func(s *shmTime) { writeSHM(s, now, ms, 0); s.mode = 2 }, 0, false, true},
+	} {
+		s := &shmTime{}
+		c.set(s)
+		resp, err := readSHM(s)
+		if (err != nil) != c.err || (resp != nil) != c.ok {
+			t.Errorf("%s: resp=%v err=%v", c.name, resp, err)
+			continue
+		}
+		if s.valid != 0 {
+			t.Errorf("%s: valid is not cleared", c.name)
+		}
+		if resp == nil {
+			continue
+		}
+		if diff := absDuration(resp.ClockOffset - c.offset); diff > time.Microsecond {
+			t.Errorf("%s: offset=%s, want %s", c.name, resp.ClockOffset, c.offset)
+		}
+		if resp.Stratum != 0 || resp.Precision != log2Duration(-20) {
+			t.Errorf("%s: stratum=%d precision=%s", c.name, resp.Stratum, resp.Precision)
+		}
+		// read once
+		if resp, _ = readSHM(s); resp != nil {
+			t.Errorf("%s: sample read twice", c.name)
+		}
+	}
+}
+
+func TestRefclockPeer(t *testing.T) {
+	gps, _ := parseRefID("GPS")
+	p := newPeer("SHM(0)", refclockAddr(0))
+	p.refId = gps
+	p.refclock = &refclock{name: "SHM(0)"}
+	d := newTestNTPd(&Config{}, p)
+
+	shm := &shmTime{}
+	now := time.Now()
+	for i := 0; i < replyNum; i++ {
+		writeSHM(shm, now.Add(time.Duration(i)*time.Second), 3*time.Millisecond, 0)
+		resp, err := readSHM(shm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.refclock.add(resp)
+	}
+
+	p.updateSamples(context.Background(), 50*time.Millisecond, testFilter, p.pushed())
+	if !p.good {
+		t.Fatal("refclock is not good")
+	}
+	op := d.find()
+	if op == nil || op.peer != p {
+		t.Fatalf("refclock not selected: %v", op)
+	}
+	d.setTemplate(op)
+	if s := d.loadTemplate()[stratumPos]; s != 1 {
+		t.Errorf("serve stratum %d, want 1", s)
+	}
+	if id := binary.BigEndian.Uint32(d.loadTemplate()[referIDPos:]); id != gps {
+		t.Errorf("refid %s, want GPS", kissCode(id))
+	}
+
+	// refclock is kept on DNS refresh
+	peers, _, removed := mergePeers(d.peers(), nil, defaultMaxPeers)
+	if len(peers) != 1 || len(removed) != 0 {
+		t.Errorf("peers=%d removed=%d", len(peers), len(removed))
+	}
+}
+
+func TestValidateRefclocks(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		rcs  []RefclockSpec
+		ok   bool
+	}{
+		{"only refclock", []RefclockSpec{{Unit: 0}}, true},
+		{"refid", []RefclockSpec{{Unit: 0, RefID: "PPS"}, {Unit: 1}}, true},
+		{"duplicated unit", []RefclockSpec{{Unit: 2}, {Unit: 2}}, false},
+		{"negative unit", []RefclockSpec{{Unit: -1}}, false},
+		{"large unit", []RefclockSpec{{Unit: 256}}, false},
+		{"bad refid", []RefclockSpec{{Unit: 0, RefID: "TOOLONG"}}, false},
+	} {
+		errs := validatePeers(&Config{Refclocks: c.rcs})
+		if (len(errs) == 0) != c.ok {
+			t.Errorf("%s: errs=%v", c.name, errs)
+		}
+	}
+}
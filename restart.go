@@ -0,0 +1,164 @@
+package gontpd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// environment of process started by Restart, listenFDsEnv is listen
+// address of each inherited socket from fd 3, readyFDEnv is the fd
+// ready is written to once they are served.
+const (
+	listenFDsEnv = "GONTPD_LISTEN_FDS"
+	readyFDEnv   = "GONTPD_READY_FD"
+)
+
+// listenFDStart is fd of the first inherited socket, the first one of
+// ExtraFiles, replaced in tests
+var listenFDStart = 3
+
+// restartTimeout is how long Restart waits for the new process to serve,
+// it syncs clock before that
+const restartTimeout = 10 * time.Minute
+
+// Restart starts a new process of the same executable and arguments which
+// inherits listening sockets, and returns once it serves on them. Both
+// processes answer requests meanwhile, d is left serving so the caller
+// stops Run of d after that, in-flight requests are answered by
+// shutdown. The new process is killed if it fails to serve before ctx
+// is done or restartTimeout. NTS-KE listener isn't inherited.
+func (d *NTPd) Restart(ctx context.Context) (pid int, err error) {
+	d.mu.RLock()
+	conns, addrs := d.conns, d.connAddrs
+	d.mu.RUnlock()
+	if len(conns) == 0 {
+		err = errors.New("restart: no listening socket")
+		return
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, conn := range conns {
+		var f *os.File
+		if f, err = conn.File(); err != nil {
+			err = fmt.Errorf("restart: %s", err)
+			return
+		}
+		files = append(files, f)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		listenFDsEnv+"="+strings.Join(addrs, ","),
+		readyFDEnv+"="+strconv.Itoa(listenFDStart+len(conns)),
+		// watchdog is taken over with MAINPID
+		"WATCHDOG_PID=")
+	if err = cmd.Start(); err != nil {
+		err = fmt.Errorf("restart: %s", err)
+		return
+	}
+	pid = cmd.Process.Pid
+	// EOF is read once the new process exits without being ready
+	w.Close()
+	files = files[:len(files)-1]
+	logger().Infof("restart: started pid %d with %d sockets", pid, len(conns))
+
+	ready := make(chan error, 1)
+	go func() {
+		_, rerr := bufio.NewReader(r).ReadString('\n')
+		ready <- rerr
+	}()
+	timer := time.NewTimer(restartTimeout)
+	defer timer.Stop()
+	select {
+	case err = <-ready:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+		err = errors.New("timeout")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		err = fmt.Errorf("restart: pid %d not serving: %s", pid, err)
+		return
+	}
+	d.mu.Lock()
+	d.restarted = true
+	d.mu.Unlock()
+	notify(fmt.Sprintf("MAINPID=%d", pid))
+	// the new process is reparented once we exit
+	go cmd.Wait()
+	logger().Infof("restart: pid %d is serving", pid)
+	return
+}
+
+// inheritedConns takes sockets passed by Restart of the old process by
+// listen address, nil if there is none.
+func inheritedConns() (conns map[string][]*net.UDPConn) {
+	list := os.Getenv(listenFDsEnv)
+	if list == "" {
+		return
+	}
+	os.Unsetenv(listenFDsEnv)
+	conns = map[string][]*net.UDPConn{}
+	for i, addr := range strings.Split(list, ",") {
+		f := os.NewFile(uintptr(listenFDStart+i), addr)
+		pc, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			logger().Errorf("restart: inherit %s: %s", addr, err)
+			continue
+		}
+		conn, ok := pc.(*net.UDPConn)
+		if !ok {
+			pc.Close()
+			continue
+		}
+		conns[addr] = append(conns[addr], conn)
+	}
+	return
+}
+
+// notifyRestarted tells the old process that inherited sockets are
+// served, nothing is done if it's not started by Restart.
+func notifyRestarted() {
+	s := os.Getenv(readyFDEnv)
+	if s == "" {
+		return
+	}
+	os.Unsetenv(readyFDEnv)
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	if _, err = f.WriteString("ready\n"); err != nil {
+		logger().Errorf("restart: notify: %s", err)
+	}
+	f.Close()
+}
@@ -0,0 +1,99 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package gontpd
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// dupFD duplicates fd of c, it's left to the function under test to close
+// without double close by finalizer of an os.File.
+func dupFD(t *testing.T, c syscall.Conn) (fd int) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Control(func(s uintptr) {
+		fd, err = syscall.Dup(int(s))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestInheritedConns(t *testing.T) {
+	old, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	// fd is owned by inheritedConns like fd 3 of a new process
+	fd := dupFD(t, old)
+
+	oldStart := listenFDStart
+	defer func() { listenFDStart = oldStart }()
+	listenFDStart = fd
+	os.Setenv(listenFDsEnv, "127.0.0.1:0")
+	conns := inheritedConns()
+	if os.Getenv(listenFDsEnv) != "" {
+		t.Error("env left for next restart")
+	}
+	if len(conns["127.0.0.1:0"]) != 1 {
+		t.Fatalf("conns=%v", conns)
+	}
+	conn := conns["127.0.0.1:0"][0]
+	defer conn.Close()
+	if conn.LocalAddr().String() != old.LocalAddr().String() {
+		t.Fatalf("inherited %s, want %s", conn.LocalAddr(), old.LocalAddr())
+	}
+
+	// old process stops reading, inherited socket still receives
+	old.Close()
+	c, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 8)
+	if n, _, err := conn.ReadFrom(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Errorf("read %q err %v", buf[:n], err)
+	}
+
+	if inheritedConns() != nil {
+		t.Error("sockets inherited twice")
+	}
+}
+
+func TestNotifyRestarted(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	fd := dupFD(t, w)
+	w.Close()
+	os.Setenv(readyFDEnv, strconv.Itoa(fd))
+	notifyRestarted()
+	if s, err := bufio.NewReader(r).ReadString('\n'); err != nil || s != "ready\n" {
+		t.Errorf("read %q err %v", s, err)
+	}
+	// not started by Restart
+	notifyRestarted()
+}
+
+func TestRestartWithoutListener(t *testing.T) {
+	d := newTestNTPd(&Config{})
+	if _, err := d.Restart(t.Context()); err == nil {
+		t.Error("restart without socket")
+	}
+}
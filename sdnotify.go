@@ -0,0 +1,49 @@
+package gontpd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends state to service manager by sd_notify protocol of
+// systemd, nothing is done unless NOTIFY_SOCKET is set.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// abstract socket
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notify sends state by sdNotify, errors are only logged
+func notify(state string) {
+	if err := sdNotify(state); err != nil {
+		logger().Warnf("sd_notify %s: %s", state, err)
+	}
+}
+
+// sdWatchdog returns how often WATCHDOG=1 is sent, half of WatchdogSec of
+// the service, zero if watchdog is disabled or belongs to another process
+// (i.e. the old one of Restart).
+func sdWatchdog() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
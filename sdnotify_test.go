@@ -0,0 +1,83 @@
+package gontpd
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listenNotify listens NOTIFY_SOCKET of the test
+func listenNotify(t *testing.T) *net.UnixConn {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("without NOTIFY_SOCKET: %s", err)
+	}
+
+	conn := listenNotify(t)
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	if s := readNotify(t, conn); s != "READY=1" {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestSdWatchdog(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	for _, g := range []struct {
+		usec, pid string
+		interval  time.Duration
+	}{
+		{"", "", 0},
+		{"bad", "", 0},
+		{"20000000", "", 10 * time.Second},
+		{"20000000", pid, 10 * time.Second},
+		{"20000000", "1", 0},
+	} {
+		t.Setenv("WATCHDOG_USEC", g.usec)
+		t.Setenv("WATCHDOG_PID", g.pid)
+		if i := sdWatchdog(); i != g.interval {
+			t.Errorf("usec %q pid %q: interval %s, want %s", g.usec, g.pid, i, g.interval)
+		}
+	}
+}
+
+func TestSleepPollWatchdog(t *testing.T) {
+	conn := listenNotify(t)
+	d := newTestNTPd(&Config{})
+	d.watchdog = 10 * time.Millisecond
+	if err := d.sleepPoll(context.Background(), 55*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if s := readNotify(t, conn); s != "WATCHDOG=1" {
+			t.Errorf("got %q", s)
+		}
+	}
+}
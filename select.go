@@ -0,0 +1,312 @@
+package gontpd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+type offsetPeer struct {
+	peer *peer
+	resp *ntp.Response
+
+	// rootDelay and rootDisp are accumulated to the stratum 1 source
+	// through this peer, rootDist is the half width of correctness
+	// interval [offset - rootDist, offset + rootDist]
+	rootDelay time.Duration
+	rootDisp  time.Duration
+	rootDist  time.Duration
+	// jitter of peer by last poll
+	jitter time.Duration
+	// prefer is set if peer is Prefer of PeerList
+	prefer bool
+}
+
+func newOffsetPeer(p *peer, resp *ntp.Response) *offsetPeer {
+	op := &offsetPeer{peer: p, resp: resp}
+	op.rootDelay = resp.RootDelay + resp.RTT
+	op.rootDisp = resp.RootDispersion + p.filterDisp
+	op.rootDist = op.rootDelay/2 + op.rootDisp
+	op.jitter = p.jitter
+	return op
+}
+
+func (d *NTPd) find() (op *offsetPeer) {
+
+	cfg := d.config()
+	specs := cfg.peerSpecs()
+	now := time.Now()
+	peers := d.peers()
+	tmp := []*offsetPeer{}
+	self := map[*peer]bool{}
+	for _, p := range peers {
+		if p.reach == 0 || !p.enable || p.banned(now) || specs[p.origin].NoSelect {
+			continue
+		}
+		if reason := d.selfReason(p); reason != "" {
+			if p.state != stateSelf {
+				logger().Warnf("peer:%s excluded from selection, %s", p.addr, reason)
+			}
+			self[p] = true
+			continue
+		}
+		if p.refclock != nil && p.refclock.pps && !ppsLocked(p, peers) {
+			continue
+		}
+
+		// sample of clock filter is the only candidate of peer
+		if resp := p.sample; resp != nil && resp.Stratum < invalidStratum {
+			c := newOffsetPeer(p, resp)
+			// distance threshold of RFC 5905 Section 11.2.1
+			if c.rootDist > cfg.MaxRootDistance {
+				if debug {
+					logger().Debugf("peer:%s root distance %s over %s",
+						p.addr, c.rootDist, cfg.MaxRootDistance)
+				}
+				continue
+			}
+			c.prefer = specs[p.origin].Prefer
+			tmp = append(tmp, c)
+		}
+	}
+	op, survivors := selectMedian(tmp, cfg.MinCandidates, cfg.MinSources)
+	op = keepSelected(op, survivors, d.selected, cfg.SelectHysteresis)
+	if op != nil {
+		d.noteSelected(op.peer)
+	}
+	// offset of prefer peer is used as is
+	if op != nil && !op.prefer {
+		op = combine(op, survivors)
+	}
+
+	survived := map[*peer]bool{}
+	for _, c := range survivors {
+		survived[c.peer] = true
+	}
+	for _, p := range peers {
+		switch {
+		case specs[p.origin].NoSelect && p.reach != 0:
+			p.state = stateNoSelect
+		case self[p]:
+			p.state = stateSelf
+		default:
+			p.classify(survived[p], now, cfg.FalsetickerLimit, cfg.FalsetickerCooldown)
+		}
+		if d.stat != nil {
+			d.stat.setPeerState(p)
+		}
+	}
+	d.publishPeers()
+	return
+}
+
+// selectMedian discards falsetickers by intersection algorithm
+// then picks one of survivors around the median.
+// The best sample of each good peer is a candidate, so every peer has
+// equal votes.
+// No median is picked unless minCandidates candidates of minSources peers
+// survive.
+func selectMedian(tmp []*offsetPeer, minCandidates, minSources int) (op *offsetPeer, survivors []*offsetPeer) {
+	if len(tmp) == 0 {
+		return
+	}
+	sort.Sort(byOffset(tmp))
+	if debug {
+		var sb strings.Builder
+		for _, p := range tmp {
+			fmt.Fprintf(&sb, "%s:%s±%s,", p.peer.addr, p.resp.ClockOffset, p.rootDist)
+		}
+		logger().Debugf("%s", sb.String())
+	}
+
+	low, high, ok := intersect(tmp)
+	if !ok {
+		return
+	}
+
+	for _, c := range tmp {
+		if c.resp.ClockOffset+c.rootDist < low ||
+			c.resp.ClockOffset-c.rootDist > high {
+			continue
+		}
+		survivors = append(survivors, c)
+	}
+
+	if len(survivors) < minCandidates {
+		return
+	}
+	sources := map[*peer]bool{}
+	for _, c := range survivors {
+		sources[c.peer] = true
+	}
+	if len(sources) < minSources {
+		if debug {
+			logger().Debugf("%d sources survived, min %d", len(sources), minSources)
+		}
+		return
+	}
+
+	op = pickSurvivor(survivors)
+	return
+}
+
+// pickSurvivor starts from the median of survivors sorted by offset and
+// prefers candidate with lower root distance plus jitter among those
+// close to the median, i.e. within root distance of the median.
+// Candidate of prefer peer close to the median always wins.
+func pickSurvivor(survivors []*offsetPeer) (op *offsetPeer) {
+	median := survivors[len(survivors)/2]
+	op = median
+	for _, c := range survivors {
+		if absDuration(c.resp.ClockOffset-median.resp.ClockOffset) > median.rootDist {
+			continue
+		}
+		switch {
+		case c.prefer && !op.prefer:
+			op = c
+		case c.prefer == op.prefer && c.score() < op.score():
+			op = c
+		}
+	}
+	return
+}
+
+// keepSelected returns candidate of current instead of op if it's close
+// to the median as pickSurvivor and op doesn't score better by more than
+// hysteresis. Prefer peer still wins.
+func keepSelected(op *offsetPeer, survivors []*offsetPeer, current *peer, hysteresis time.Duration) *offsetPeer {
+	if hysteresis <= 0 || op == nil || current == nil || op.peer == current || op.prefer {
+		return op
+	}
+	median := survivors[len(survivors)/2]
+	for _, c := range survivors {
+		if c.peer != current ||
+			absDuration(c.resp.ClockOffset-median.resp.ClockOffset) > median.rootDist {
+			continue
+		}
+		if c.score() <= op.score()+hysteresis {
+			return c
+		}
+	}
+	return op
+}
+
+// noteSelected records p as the selected peer, change from the last one
+// is logged and counted as it's offset jitter to clock.
+func (d *NTPd) noteSelected(p *peer) {
+	old := d.selected
+	d.selected = p
+	if old == nil || old == p {
+		return
+	}
+	logger().Infof("selected peer changed from %s to %s", old.addr, p.addr)
+	if d.stat != nil {
+		d.stat.selectCounter.Inc()
+	}
+}
+
+func (op *offsetPeer) score() time.Duration {
+	return op.rootDist + op.jitter
+}
+
+// minDist avoids infinite weight of candidate in combine
+const minDist = time.Millisecond
+
+// combine averages offset, delay and dispersion of survivors weighted
+// by 1/rootDist as RFC 5905 Section 11.2.3, the result keeps other
+// fields (peer, stratum, leap, refid...) of sys.
+func combine(sys *offsetPeer, survivors []*offsetPeer) *offsetPeer {
+	var sum, offset, rtt, delay, disp float64
+	for _, c := range survivors {
+		dist := c.rootDist
+		if dist < minDist {
+			dist = minDist
+		}
+		w := 1 / float64(dist)
+		sum += w
+		offset += w * float64(c.resp.ClockOffset)
+		rtt += w * float64(c.resp.RTT)
+		delay += w * float64(c.resp.RootDelay)
+		disp += w * float64(c.resp.RootDispersion)
+	}
+	if sum == 0 {
+		return sys
+	}
+
+	resp := *sys.resp
+	resp.ClockOffset = time.Duration(offset / sum)
+	resp.RTT = time.Duration(rtt / sum)
+	resp.RootDelay = time.Duration(delay / sum)
+	resp.RootDispersion = time.Duration(disp / sum)
+	return newOffsetPeer(sys.peer, &resp)
+}
+
+type endpoint struct {
+	val time.Duration
+	// -1 for the lower endpoint, 1 for the upper one
+	typ int
+}
+
+// intersect finds interval [low, high] where correctness intervals of
+// at least n-f candidates intersect with the fewest falsetickers f,
+// according to Marzullo's algorithm in RFC 5905 Section 11.2.1.
+// More than half of candidates must agree.
+func intersect(cands []*offsetPeer) (low, high time.Duration, ok bool) {
+	n := len(cands)
+	el := make([]endpoint, 0, 2*n)
+	for _, c := range cands {
+		el = append(el,
+			endpoint{c.resp.ClockOffset - c.rootDist, -1},
+			endpoint{c.resp.ClockOffset + c.rootDist, 1})
+	}
+	sort.Slice(el, func(i, j int) bool {
+		if el[i].val == el[j].val {
+			return el[i].typ < el[j].typ
+		}
+		return el[i].val < el[j].val
+	})
+
+	// allow f falsetickers
+	for f := 0; 2*f < n; f++ {
+		count, found := 0, false
+		for _, e := range el {
+			count -= e.typ
+			if count >= n-f {
+				low, found = e.val, true
+				break
+			}
+		}
+
+		count = 0
+		for i := len(el) - 1; i >= 0; i-- {
+			count += el[i].typ
+			if count >= n-f {
+				high = el[i].val
+				break
+			}
+		}
+
+		if found && low <= high {
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+type byOffset []*offsetPeer
+
+func (b byOffset) Len() int {
+	return len(b)
+}
+
+func (b byOffset) Less(i, j int) bool {
+	return b[i].resp.ClockOffset < b[j].resp.ClockOffset
+}
+
+func (b byOffset) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
@@ -0,0 +1,339 @@
+package gontpd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/beevik/ntp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestCandidate(addr string, offset, dist time.Duration) *offsetPeer {
+	p := &peer{addr: net.ParseIP(addr)}
+	return &offsetPeer{
+		peer:     p,
+		resp:     &ntp.Response{ClockOffset: offset, Stratum: 2},
+		rootDist: dist,
+	}
+}
+
+func TestSelectMedianFalseticker(t *testing.T) {
+	ms := time.Millisecond
+	cands := []*offsetPeer{
+		newTestCandidate("192.0.2.1", -20*ms, 5*ms),
+		newTestCandidate("192.0.2.2", -18*ms, 5*ms),
+		newTestCandidate("192.0.2.3", 30*ms, 60*ms),
+		// falseticker with tight interval sits in the middle
+		newTestCandidate("192.0.2.4", 10*ms, 1*ms),
+	}
+
+	// plain median picks the falseticker
+	sorted := append([]*offsetPeer{}, cands...)
+	sort.Sort(byOffset(sorted))
+	if sorted[len(sorted)/2].peer.addr.String() != "192.0.2.4" {
+		t.Fatal("bad test case, median is not the falseticker")
+	}
+
+	low, high, ok := intersect(cands)
+	if !ok || low != -23*ms || high != -15*ms {
+		t.Errorf("intersection=[%s, %s] ok=%v", low, high, ok)
+	}
+
+	op, _ := selectMedian(cands, goodFilter, 1)
+	if op == nil {
+		t.Fatal("no median")
+	}
+	if op.peer.addr.String() == "192.0.2.4" {
+		t.Error("falseticker selected")
+	}
+	if op.peer.addr.String() != "192.0.2.2" {
+		t.Errorf("expect 192.0.2.2 got %s", op.peer.addr)
+	}
+}
+
+func TestIntersectNoMajority(t *testing.T) {
+	ms := time.Millisecond
+	cands := []*offsetPeer{
+		newTestCandidate("192.0.2.1", -100*ms, ms),
+		newTestCandidate("192.0.2.2", 0, ms),
+		newTestCandidate("192.0.2.3", 100*ms, ms),
+	}
+	if _, _, ok := intersect(cands); ok {
+		t.Error("disjoint intervals intersected")
+	}
+	if op, _ := selectMedian(cands, goodFilter, 1); op != nil {
+		t.Errorf("median found %s", op.peer.addr)
+	}
+}
+
+func TestFindMinSources(t *testing.T) {
+	ms := time.Millisecond
+	gold := []struct {
+		minSources, minCandidates int
+		peers                     int
+		found                     bool
+	}{
+		{0, 0, 1, true},
+		{2, 0, 1, false},
+		{2, 0, 2, true},
+		{3, 0, 3, true},
+		{0, 2, 1, false},
+		{0, 2, 2, true},
+		{0, 3, 2, false},
+	}
+	for _, g := range gold {
+		var peers []*peer
+		for i := 0; i < g.peers; i++ {
+			peers = append(peers, newTestPeer(fmt.Sprintf("192.0.2.%d", i+1), ms, 5*ms))
+		}
+		d := newTestNTPd(&Config{MinSources: g.minSources,
+			MinCandidates: g.minCandidates}, peers...)
+		if op := d.find(); (op != nil) != g.found {
+			t.Errorf("min_sources=%d min_candidates=%d peers=%d found=%v",
+				g.minSources, g.minCandidates, g.peers, op != nil)
+		}
+	}
+}
+
+func TestFindMaxRootDistance(t *testing.T) {
+	ms := time.Millisecond
+	far := newTestPeer("192.0.2.4", 0, 2*time.Second)
+	// the closest one to stratum 1 wins unless it's too far
+	d := newTestNTPd(&Config{}, newTestPeer("192.0.2.1", ms, 700*ms), far)
+	op := d.find()
+	if op == nil || op.peer == far {
+		t.Fatalf("peer over max root distance selected %v", op)
+	}
+
+	d = newTestNTPd(&Config{MaxRootDistance: 500 * ms},
+		newTestPeer("192.0.2.1", ms, 700*ms), far)
+	if op := d.find(); op != nil {
+		t.Errorf("peer %s over max root distance selected", op.peer.addr)
+	}
+
+	far.delay, far.rootDelay, far.disp, far.filterDisp = 10*ms, 30*ms, 2*time.Second, 5*ms
+	if dist := far.rootDist(); dist != 2*time.Second+25*ms {
+		t.Errorf("root distance %s", dist)
+	}
+}
+
+func TestFindNoSelect(t *testing.T) {
+	ms := time.Millisecond
+	mon := newTestPeer("192.0.2.4", 0, ms)
+	d := newTestNTPd(&Config{PeerList: []PeerSpec{{Addr: "mon", NoSelect: true}}},
+		newTestPeer("192.0.2.1", ms, 5*ms),
+		newTestPeer("192.0.2.2", 2*ms, 5*ms),
+		newTestPeer("192.0.2.3", 3*ms, 5*ms),
+		mon)
+	mon.origin = "mon"
+	for i := 0; i < 5; i++ {
+		op := d.find()
+		if op == nil {
+			t.Fatal("no median")
+		}
+		if op.peer == mon {
+			t.Fatal("noselect peer selected")
+		}
+	}
+	if mon.state != stateNoSelect || mon.banned(time.Now()) {
+		t.Errorf("noselect peer state %s", mon.state)
+	}
+}
+
+func TestFindPrefer(t *testing.T) {
+	ms := time.Millisecond
+	for _, g := range []struct {
+		offset time.Duration
+		chosen bool
+	}{
+		// worse score but close to the median
+		{3 * ms, true},
+		// falseticker
+		{100 * ms, false},
+	} {
+		pref := newTestPeer("192.0.2.4", g.offset, 8*ms)
+		pref.origin = "pref"
+		d := newTestNTPd(&Config{PeerList: []PeerSpec{{Addr: "pref", Prefer: true}}},
+			newTestPeer("192.0.2.1", ms, 5*ms),
+			newTestPeer("192.0.2.2", 2*ms, 5*ms),
+			newTestPeer("192.0.2.3", 2*ms, 5*ms),
+			pref)
+		op := d.find()
+		if op == nil {
+			t.Fatal("no median")
+		}
+		if (op.peer == pref) != g.chosen {
+			t.Errorf("offset %s: prefer peer chosen=%v", g.offset, op.peer == pref)
+		}
+		if g.chosen && op.resp.ClockOffset != g.offset {
+			t.Errorf("offset of prefer peer %s is combined to %s", g.offset, op.resp.ClockOffset)
+		}
+	}
+}
+
+func newTestPeer(addr string, offset, dist time.Duration) *peer {
+	p := &peer{addr: net.ParseIP(addr), good: true, enable: true,
+		reach: 1, trustLevel: minPoll}
+	p.addSamples([]*ntp.Response{{ClockOffset: offset,
+		RootDispersion: dist, Stratum: 2}}, time.Now(), testFilter)
+	p.filter(time.Now(), testFilter)
+	p.stats = newPeerStats(p)
+	return p
+}
+
+func newTestNTPd(cfg *Config, peers ...*peer) *NTPd {
+	cfg.setDefault()
+	d := &NTPd{cfg: cfg, peerList: peers, precision: measurePrecision()}
+	d.template.Store(newTemplate())
+	return d
+}
+
+func TestFindFalsetickerBan(t *testing.T) {
+	ms := time.Millisecond
+	bad := newTestPeer("192.0.2.4", 100*ms, ms)
+	d := newTestNTPd(&Config{FalsetickerLimit: 2},
+		newTestPeer("192.0.2.1", 0, 5*ms),
+		newTestPeer("192.0.2.2", ms, 5*ms),
+		newTestPeer("192.0.2.3", 2*ms, 5*ms),
+		bad)
+
+	for i := 0; i < 2; i++ {
+		op := d.find()
+		if op == nil || op.peer == bad {
+			t.Fatalf("poll %d: bad selection %v", i, op)
+		}
+		if bad.state != stateFalseticker || bad.falseCount != i+1 {
+			t.Errorf("poll %d: state=%s count=%d", i, bad.state, bad.falseCount)
+		}
+	}
+	if !bad.banned(time.Now()) {
+		t.Fatal("falseticker not banned")
+	}
+	for _, p := range d.peers() {
+		if p != bad && p.state != stateSurvivor {
+			t.Errorf("%s state=%s", p.addr, p.state)
+		}
+	}
+
+	// agrees again after cooldown
+	bad.falseUntil = time.Now().Add(-time.Second)
+	for _, s := range bad.samples {
+		s.resp.ClockOffset = ms
+	}
+	d.find()
+	if bad.state != stateSurvivor || bad.falseCount != 0 {
+		t.Errorf("not recovered state=%s count=%d", bad.state, bad.falseCount)
+	}
+
+	// missing one poll keeps peer in selection
+	d.peerList[0].good = false
+	d.peerList[0].reach = 0x2
+	d.find()
+	if d.peerList[0].state != stateSurvivor {
+		t.Errorf("state=%s", d.peerList[0].state)
+	}
+
+	d.peerList[0].reach = 0
+	d.find()
+	if d.peerList[0].state != stateUnreachable {
+		t.Errorf("state=%s", d.peerList[0].state)
+	}
+}
+
+func TestFindPrefersLowJitter(t *testing.T) {
+	ms := time.Millisecond
+	stable := newTestPeer("192.0.2.1", ms, 5*ms)
+	stable.jitter = ms
+	noisy := newTestPeer("192.0.2.2", 2*ms, 5*ms)
+	noisy.jitter = 20 * ms
+	d := newTestNTPd(&Config{}, stable, noisy)
+
+	op := d.find()
+	if op == nil {
+		t.Fatal("no median")
+	}
+	if op.peer != stable {
+		t.Errorf("expect %s got %s", stable.addr, op.peer.addr)
+	}
+
+	// far from median is not preferred even with lower distance
+	cands := []*offsetPeer{
+		newTestCandidate("192.0.2.1", -10*ms, ms),
+		newTestCandidate("192.0.2.2", 0, 5*ms),
+		newTestCandidate("192.0.2.3", 2*ms, 5*ms),
+	}
+	if op = pickSurvivor(cands); op != cands[1] {
+		t.Errorf("expect median got %s", op.peer.addr)
+	}
+}
+
+func TestKeepSelected(t *testing.T) {
+	ms := time.Millisecond
+	cands := []*offsetPeer{
+		newTestCandidate("192.0.2.1", 0, 4*ms),
+		newTestCandidate("192.0.2.2", ms, 5*ms),
+		newTestCandidate("192.0.2.3", 2*ms, 7*ms),
+	}
+	best := pickSurvivor(cands)
+	if best != cands[0] {
+		t.Fatalf("best %s", best.peer.addr)
+	}
+	current := cands[1].peer
+
+	if op := keepSelected(best, cands, current, 0); op != best {
+		t.Error("kept without hysteresis")
+	}
+	if op := keepSelected(best, cands, current, 2*ms); op != cands[1] {
+		t.Errorf("challenger within hysteresis won: %s", op.peer.addr)
+	}
+	if op := keepSelected(best, cands, cands[2].peer, 2*ms); op != best {
+		t.Errorf("challenger better by more than hysteresis lost: %s", op.peer.addr)
+	}
+	best.prefer = true
+	if op := keepSelected(best, cands, current, time.Second); op != best {
+		t.Error("prefer peer lost")
+	}
+}
+
+func TestNoteSelected(t *testing.T) {
+	d := newTestNTPd(&Config{})
+	d.stat = &ntpStat{selectCounter: prometheus.NewCounter(prometheus.CounterOpts{Name: "select"})}
+	a, b := &peer{addr: net.ParseIP("192.0.2.1")}, &peer{addr: net.ParseIP("192.0.2.2")}
+	for _, p := range []*peer{a, a, b, b, a} {
+		d.noteSelected(p)
+	}
+	if got := testutil.ToFloat64(d.stat.selectCounter); got != 2 {
+		t.Errorf("%v changes, want 2", got)
+	}
+	if d.selected != a {
+		t.Errorf("selected %s", d.selected.addr)
+	}
+}
+
+func TestCombine(t *testing.T) {
+	ms := time.Millisecond
+	a := newTestCandidate("192.0.2.1", 0, ms)
+	a.resp.RootDispersion = ms
+	b := newTestCandidate("192.0.2.2", 3*ms, 2*ms)
+	b.resp.RootDispersion = 4 * ms
+	b.resp.Leap = 1
+
+	op := combine(a, []*offsetPeer{a, b})
+	// weights are 2:1
+	if op.resp.ClockOffset != ms {
+		t.Errorf("offset=%s expect 1ms", op.resp.ClockOffset)
+	}
+	if op.resp.RootDispersion != 2*ms {
+		t.Errorf("dispersion=%s expect 2ms", op.resp.RootDispersion)
+	}
+	if op.peer != a.peer || op.resp.Stratum != a.resp.Stratum || op.resp.Leap != 0 {
+		t.Errorf("combined result should keep system peer %+v", op.resp)
+	}
+	if a.resp.ClockOffset != 0 {
+		t.Error("candidate modified")
+	}
+}
@@ -0,0 +1,63 @@
+package gontpd
+
+import "net"
+
+// interfaceAddrs returns addresses of local interfaces, replaced in tests
+var interfaceAddrs = net.InterfaceAddrs
+
+// localAddrs returns addresses we serve at, every interface address for
+// unspecified host of listen addresses.
+func localAddrs(listen []string) (ips []net.IP) {
+	wildcard := false
+	for _, addr := range listen {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || ip.IsUnspecified() {
+			wildcard = true
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	if !wildcard {
+		return
+	}
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		logger().Warnf("list interface addresses failed: %s", err)
+		return
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			ips = append(ips, n.IP)
+		}
+	}
+	return
+}
+
+// selfReason reports why peer p is ourselves or synchronized to us, it's
+// empty if it's not. Peer at one of our addresses is ourselves, and peer
+// of refid of our address is synchronized to us, e.g. two instances
+// listing each other, RFC 5905 Section 13. Samples of it would be fed
+// back to our clock.
+func (d *NTPd) selfReason(p *peer) string {
+	if p.refclock != nil {
+		return ""
+	}
+	for _, ip := range d.selfAddrs {
+		if p.addr.Equal(ip) {
+			return "address " + ip.String() + " is ours"
+		}
+	}
+	if p.sample == nil || p.sample.Stratum < 2 {
+		return ""
+	}
+	for _, ip := range d.selfAddrs {
+		if p.sample.ReferenceID == makeSendRefId(ip) {
+			return "refid is our address " + ip.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,61 @@
+package gontpd
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLocalAddrs(t *testing.T) {
+	old := interfaceAddrs
+	defer func() { interfaceAddrs = old }()
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+			&net.IPNet{IP: net.ParseIP("192.0.2.10"), Mask: net.CIDRMask(24, 32)},
+		}, nil
+	}
+
+	ips := localAddrs([]string{"198.51.100.1:123"})
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("198.51.100.1")) {
+		t.Errorf("ips=%v", ips)
+	}
+	ips = localAddrs([]string{"198.51.100.1:123", ":123"})
+	if len(ips) != 3 || !ips[2].Equal(net.ParseIP("192.0.2.10")) {
+		t.Errorf("wildcard ips=%v", ips)
+	}
+}
+
+func TestFindExcludesSelf(t *testing.T) {
+	ms := time.Millisecond
+	ours := newTestPeer("192.0.2.10", 0, 5*ms)
+	// synchronized to us, as another instance listing us
+	loop := newTestPeer("192.0.2.4", 0, 5*ms)
+	loop.sample.ReferenceID = makeSendRefId(net.ParseIP("192.0.2.10"))
+	d := newTestNTPd(&Config{},
+		newTestPeer("192.0.2.1", 0, 5*ms),
+		newTestPeer("192.0.2.2", ms, 5*ms),
+		newTestPeer("192.0.2.3", 2*ms, 5*ms),
+		ours, loop)
+	d.selfAddrs = []net.IP{net.ParseIP("192.0.2.10")}
+
+	op := d.find()
+	if op == nil {
+		t.Fatal("no median")
+	}
+	if op.peer == ours || op.peer == loop {
+		t.Errorf("selected self %s", op.peer.addr)
+	}
+	for _, p := range []*peer{ours, loop} {
+		if p.state != stateSelf {
+			t.Errorf("peer:%s state=%s", p.addr, p.state)
+		}
+	}
+
+	// stratum 1 refid is a code instead of address
+	loop.sample.Stratum = 1
+	d.find()
+	if loop.state == stateSelf {
+		t.Error("stratum 1 peer excluded by refid")
+	}
+}
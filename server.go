@@ -2,9 +2,12 @@ package gontpd
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
-	"log"
 	"net"
+	"runtime"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -13,39 +16,138 @@ import (
 )
 
 // minimum headway time is 2 seconds, https://www.eecis.udel.edu/~mills/ntp/html/rate.html
-const limit = 2
+const limit = 2 * time.Second
 
-func (d *NTPd) listen() {
+func (d *NTPd) listen() (err error) {
 
 	var geodb *geoip.GeoIP
 	if d.cfg.GeoDB != "" {
 		var err error
 		geodb, err = geoip.Open(d.cfg.GeoDB)
 		if err != nil {
-			log.Println(err)
+			logger().Errorf("open geo db: %s", err)
 		}
 	}
 
-	for j := 0; j < d.cfg.ConnNum; j++ {
-		conn, err := d.makeConn()
-		if err != nil {
-			log.Fatal(err)
+	// sockets of old process are served instead of new ones, see Restart
+	inherited := inheritedConns()
+	// failed address is skipped as long as any address is listened
+	var failed []string
+	for _, addr := range d.listenAddrs() {
+		lerr := d.listenAddr(addr, geodb, inherited[addr])
+		delete(inherited, addr)
+		if lerr != nil {
+			logger().Errorf("listen %s failed: %s", addr, lerr)
+			failed = append(failed, lerr.Error())
+		}
+	}
+	for addr, conns := range inherited {
+		logger().Warnf("restart: %s is no longer listened", addr)
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	if len(d.conns) == 0 {
+		d.shutdown()
+		err = fmt.Errorf("no address listened: %s", strings.Join(failed, "; "))
+		return
+	}
+	notifyRestarted()
+	return
+}
+
+func (d *NTPd) listenAddrs() []string {
+	if len(d.cfg.ListenAddrs) > 0 {
+		return d.cfg.ListenAddrs
+	}
+	return []string{d.cfg.Listen}
+}
+
+// listenAddr opens ListenWorkers sockets at addr, inherited sockets of
+// the old process are used first.
+func (d *NTPd) listenAddr(addr string, geodb *geoip.GeoIP, inherited []*net.UDPConn) (err error) {
+	network := listenNetwork(addr)
+	configured := addr
+	for j := 0; j < d.listenWorkers(); j++ {
+		var conn *net.UDPConn
+		if j < len(inherited) {
+			conn = inherited[j]
+			logger().Infof("restart: inherited socket at %s", conn.LocalAddr())
+		} else {
+			conn, err = d.makeConn(network, addr)
+			if err != nil {
+				break
+			}
 		}
-		for i := 0; i < d.cfg.WorkerNum; i++ {
-			id := fmt.Sprintf("%d:%d", j, i)
+		// the rest of sockets must share the port of the first one
+		// even if listen address is ":0"
+		addr = conn.LocalAddr().String()
+		if j == 0 && j >= len(inherited) && d.cfg.BroadcastClient {
+			// every socket of the port receives multicast of groups,
+			// inherited one has joined already
+			joinGroups(conn, broadcastGroups(d.cfg))
+		}
+		d.mu.Lock()
+		d.conns = append(d.conns, conn)
+		d.connAddrs = append(d.connAddrs, configured)
+		d.mu.Unlock()
+		for i := 0; i < d.workerNum(); i++ {
+			id := fmt.Sprintf("%d:%d", len(d.conns)-1, i)
 			var ws *workerStat
-			if d.cfg.Metric != "" {
-				ws = newWorkerStat(id)
+			if d.stat != nil {
+				ws = newWorkerStat(d.stat.reg, id)
 			}
 
 			w := worker{
-				id, newLRU(d.cfg.RateSize),
-				conn, ws, d,
-				geodb,
+				id: id, lru: newLRU(d.cfg.RateSize),
+				conn: conn, stat: ws, d: d,
+				geoDB: geodb,
 			}
+			d.workers.Add(1)
 			go w.Work()
 		}
 	}
+	for j := d.listenWorkers(); j < len(inherited); j++ {
+		inherited[j].Close()
+	}
+	return
+}
+
+// listenWorkers returns how many SO_REUSEPORT sockets should be opened,
+// ConnNum is the legacy name of ListenWorkers.
+func (d *NTPd) listenWorkers() int {
+	n := d.cfg.ListenWorkers
+	if d.cfg.ConnNum > n {
+		n = d.cfg.ConnNum
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+func (d *NTPd) workerNum() int {
+	if d.cfg.WorkerNum < 1 {
+		return 1
+	}
+	return d.cfg.WorkerNum
+}
+
+// shutdown stops workers from reading new packets, waits for in-flight
+// requests to be answered and closes all connections.
+func (d *NTPd) shutdown() {
+	now := time.Now()
+	for _, conn := range d.conns {
+		conn.SetReadDeadline(now)
+	}
+	d.workers.Wait()
+	for _, conn := range d.conns {
+		conn.Close()
+	}
+	d.mu.Lock()
+	d.conns, d.connAddrs = nil, nil
+	d.mu.Unlock()
+	logger().Infof("listener stopped")
 }
 
 type worker struct {
@@ -55,13 +157,45 @@ type worker struct {
 	stat  *workerStat
 	d     *NTPd
 	geoDB *geoip.GeoIP
+
+	// hwTimestamp is set if last packet is timestamped by NIC
+	hwTimestamp bool
+	// drops is the last drop counter of socket
+	drops uint32
+	// ntsBuf builds NTS response
+	ntsBuf []byte
 }
 
-func (d *NTPd) makeConn() (conn *net.UDPConn, err error) {
+// listenNetwork chooses udp4 or udp6 for a literal IP address so
+// "0.0.0.0:123" and "[::]:123" can be listened at the same time,
+// other addresses (i.e. ":123") fallback to dual stack udp.
+func listenNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "udp"
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "udp"
+	case ip.To4() != nil:
+		return "udp4"
+	default:
+		return "udp6"
+	}
+}
 
-	var operr error
+func (d *NTPd) makeConn(network, addr string) (conn *net.UDPConn, err error) {
 
-	cfgFn := func(network, address string, conn syscall.RawConn) (err error) {
+	var (
+		operr error
+		mode  string
+	)
+
+	cfgFn := func(network, _ string, conn syscall.RawConn) (err error) {
 
 		fn := func(fd uintptr) {
 			operr = syscall.SetsockoptInt(int(fd),
@@ -70,13 +204,47 @@ func (d *NTPd) makeConn() (conn *net.UDPConn, err error) {
 			if operr != nil {
 				return
 			}
+			if network == "udp6" {
+				operr = syscall.SetsockoptInt(int(fd),
+					syscall.IPPROTO_IPV6,
+					syscall.IPV6_V6ONLY, 1)
+				if operr != nil {
+					return
+				}
+			}
+			if d.cfg.DSCP != 0 {
+				operr = setDSCP(int(fd), network, d.cfg.DSCP)
+				if operr != nil {
+					return
+				}
+			}
+			mode = enableRxTimestamp(int(fd))
+			if err := enableRxDrops(int(fd)); err != nil {
+				logger().Warnf("socket drop counter is not available: %s", err)
+			}
+			if d.cfg.RecvBufBytes > 0 {
+				n, err := setRecvBuf(int(fd), d.cfg.RecvBufBytes)
+				if err != nil {
+					operr = fmt.Errorf("set receive buffer: %s", err)
+					return
+				}
+				logger().Infof("%s receive buffer %d bytes, applied %d", addr, d.cfg.RecvBufBytes, n)
+			}
+			if d.cfg.SendBufBytes > 0 {
+				n, err := setSendBuf(int(fd), d.cfg.SendBufBytes)
+				if err != nil {
+					operr = fmt.Errorf("set send buffer: %s", err)
+					return
+				}
+				logger().Infof("%s send buffer %d bytes, applied %d", addr, d.cfg.SendBufBytes, n)
+			}
 			/*
 				TODO
 				rerr := syscall.SetsockoptInt(int(fd),
 					syscall.SOL_SOCKET,
 					unix.SO_ATTACH_REUSEPORT_EBPF, 1)
 				if rerr != nil {
-					log.Println("set attach reuseport failed:", rerr, "but continue...")
+					logger().Warnf("set attach reuseport failed: %s, but continue...", rerr)
 				}
 			*/
 		}
@@ -89,123 +257,549 @@ func (d *NTPd) makeConn() (conn *net.UDPConn, err error) {
 		return
 	}
 	lc := net.ListenConfig{Control: cfgFn}
-	lp, err := lc.ListenPacket(context.Background(), "udp", d.cfg.Listen)
+	lp, err := lc.ListenPacket(context.Background(), network, addr)
 	if err != nil {
 		return
 	}
 	conn = lp.(*net.UDPConn)
+	if debug {
+		logger().Debugf("listen %s with %s rx timestamp", conn.LocalAddr(), mode)
+	}
+	return
+}
+
+// maxDSCP is the max value of 6 bits DSCP
+const maxDSCP = 63
+
+// setDSCP marks packets sent by fd with dscp in TOS (IPv4) or traffic
+// class (IPv6), IPv4 traffic of dual stack socket is marked as well.
+func setDSCP(fd int, network string, dscp uint8) (err error) {
+	tos := int(dscp) << 2
+	if network == "udp4" {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	}
+	err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+	if err != nil {
+		return
+	}
+	// fails on IPv6 only socket of some systems
+	syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
 	return
 }
 
+// dscpDialer dials UDP socket marked with dscp for peer queries
+func dscpDialer(dscp uint8) func(localAddress, remoteAddress string) (net.Conn, error) {
+	return func(localAddress, remoteAddress string) (net.Conn, error) {
+		dialer := net.Dialer{
+			Control: func(network, _ string, conn syscall.RawConn) (err error) {
+				var operr error
+				err = conn.Control(func(fd uintptr) {
+					operr = setDSCP(int(fd), network, dscp)
+				})
+				if err == nil {
+					err = operr
+				}
+				return
+			},
+		}
+		if localAddress != "" {
+			laddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(localAddress, "0"))
+			if err != nil {
+				return nil, err
+			}
+			dialer.LocalAddr = laddr
+		}
+		return dialer.Dial("udp", remoteAddress)
+	}
+}
+
+// backoff of restarting worker after panic
+const (
+	minRestartBackoff = 100 * time.Millisecond
+	maxRestartBackoff = 10 * time.Second
+)
+
 func (w *worker) Work() {
+	logger().Infof("worker %s started", w.id)
+	defer w.d.workers.Done()
+	w.supervise(w.serve)
+}
+
+func (w *worker) serve() {
+	if w.d.cfg.BatchSize > 1 && batchSupported {
+		w.workBatch()
+		return
+	}
+	w.workSingle()
+}
+
+// supervise runs serve until it returns, i.e. the socket is closed.
+// serve is restarted with backoff if it panics, so the server never
+// stops serving silently while polling goes on. Backoff is reset once
+// serve runs longer than maxRestartBackoff.
+func (w *worker) supervise(serve func()) {
+	backoff := minRestartBackoff
+	for {
+		start := time.Now()
+		if !w.recoverPanic(serve) {
+			return
+		}
+		if w.stat != nil {
+			w.stat.Restart.Inc()
+		}
+		if time.Since(start) > maxRestartBackoff {
+			backoff = minRestartBackoff
+		}
+		logger().Errorf("worker %s restart in %s", w.id, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+}
+
+// recoverPanic runs fn and reports whether it panicked
+func (w *worker) recoverPanic(fn func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger().Errorf("worker %s panic: %v\n%s", w.id, r, stack())
+			panicked = true
+		}
+	}()
+	fn()
+	return
+}
+
+func stack() []byte {
+	buf := make([]byte, 4096)
+	return buf[:runtime.Stack(buf, false)]
+}
+
+// bufPool holds packet buffers, a buffer is owned by one worker until
+// the worker exits, so it's never shared between workers.
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, maxPacketSize)
+		return &b
+	},
+}
+
+// workSingle reads and answers one packet per syscall
+func (w *worker) workSingle() {
 	var (
 		receiveTime time.Time
 		remoteAddr  *net.UDPAddr
 
-		err      error
-		lastUnix int64
-		n        int
-		ok       bool
+		err   error
+		n     int
+		oobn  int
+		stamp bool
 	)
-	p := make([]byte, 48)
-	oob := make([]byte, 1)
-
-	log.Printf("worker %s started", w.id)
+	bp := bufPool.Get().(*[]byte)
+	defer bufPool.Put(bp)
+	p := *bp
+	oob := make([]byte, oobSize)
 
 	for {
-		n, _, _, remoteAddr, err = w.conn.ReadMsgUDP(p, oob)
+		n, oobn, _, remoteAddr, err = w.conn.ReadMsgUDP(p, oob)
 		if err != nil {
 			return
 		}
 
-		receiveTime = time.Now()
-		if n < 48 {
+		receiveTime = w.receiveTime(oob[:oobn])
+		n, stamp = w.handleSafe(p, n, remoteAddr, receiveTime)
+		if n == 0 {
+			continue
+		}
+		if stamp {
+			stampTransmit(p)
+		}
+		_, err = w.conn.WriteToUDP(p[:n], remoteAddr)
+		if err != nil {
 			if debug {
-				log.Printf("worker: %s get small packet %d",
-					remoteAddr.String(), n)
-			}
-			if w.stat != nil {
-				w.stat.Malform.Inc()
+				logger().Errorf("worker: %s write failed. %s", remoteAddr.String(), err)
 			}
 			continue
 		}
+		now := time.Now()
+		w.responded(receiveTime, now)
+		w.sent(p[:n], remoteAddr.IP, now)
+	}
+}
 
-		if w.d.dropTable.contains(remoteAddr.IP) {
-			if debug {
-				log.Printf("worker: %s drop packet %d",
-					remoteAddr.String(), n)
+// responded counts response sent at now and records its latency to
+// request received at rt, it's negative if clock is stepped meanwhile.
+func (w *worker) responded(rt, now time.Time) {
+	if s := w.d.stat; s != nil {
+		s.responseCounter.Inc()
+	}
+	if w.stat == nil || w.stat.Latency == nil {
+		return
+	}
+	if d := now.Sub(rt); d >= 0 {
+		w.stat.Latency.Observe(d.Seconds())
+	}
+}
+
+// rxInfo is ancillary data of received packet
+type rxInfo struct {
+	// time is kernel timestamp if ok, hw is set if it's taken by NIC
+	time time.Time
+	hw   bool
+	ok   bool
+	// drops is packets dropped by socket so far if hasDrops
+	drops    uint32
+	hasDrops bool
+}
+
+// receiveTime returns kernel timestamp of packet in oob if available
+func (w *worker) receiveTime(oob []byte) time.Time {
+	rx := parseRx(oob)
+	if rx.hw != w.hwTimestamp {
+		w.hwTimestamp = rx.hw
+		if w.stat != nil {
+			v := 0.0
+			if rx.hw {
+				v = 1
 			}
+			w.stat.HWTimestamp.Set(v)
+		}
+	}
+	if rx.hasDrops && rx.drops != w.drops {
+		w.drops = rx.drops
+		if w.stat != nil {
+			w.stat.SocketDrops.Set(float64(rx.drops))
+		}
+	}
+	if !rx.ok {
+		return time.Now()
+	}
+	return rx.time
+}
+
+// handleSafe is handle which drops the request if it panics, so that one
+// bad packet can't take down the worker.
+func (w *worker) handleSafe(p []byte, n int, remoteAddr *net.UDPAddr, receiveTime time.Time) (rn int, stamp bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger().Errorf("worker %s: %s packet %d panic: %v\n%s",
+				w.id, remoteAddr, n, r, stack())
 			if w.stat != nil {
-				w.stat.ACL.Inc()
+				w.stat.Panic.Inc()
 			}
-			continue
+			rn, stamp = 0, false
 		}
+	}()
+	return w.handle(p, n, remoteAddr, receiveTime)
+}
 
-		// BCE
-		_ = p[47]
+// handle builds response in place of request p with length n,
+// returns length of response or 0 if nothing should be sent.
+// Transmit timestamp should be set by caller right before sending if
+// stamp is true, signed response is stamped before signing.
+func (w *worker) handle(p []byte, n int, remoteAddr *net.UDPAddr, receiveTime time.Time) (rn int, stamp bool) {
+	if w.d.cfg.BroadcastClient && n >= headerSize && n <= len(p) &&
+		getMode(p) == modeBroadcast {
+		w.d.receiveBroadcast(p[:n], remoteAddr.IP, receiveTime)
+		return
+	}
 
-		if w.d.cfg.RateSize > 0 {
+	if kind := malformed(p, n); kind != "" {
+		if debug {
+			logger().Debugf("worker: %s get malformed packet %d: %s",
+				remoteAddr.String(), n, kind)
+		}
+		if w.stat != nil {
+			w.stat.Malform.Inc()
+			w.stat.Malformed.WithLabelValues(kind).Inc()
+		}
+		return
+	}
 
-			lastUnix, ok = w.lru.Get(remoteAddr.IP)
+	if rule := w.d.drops().match(remoteAddr.IP); rule != "" {
+		if debug {
+			logger().Debugf("worker: %s drop packet %d by %s",
+				remoteAddr.String(), n, rule)
+		}
+		if w.stat != nil {
+			w.stat.ACL.Inc()
+			w.stat.DropCIDR.WithLabelValues(rule).Inc()
+		}
+		return
+	}
 
-			if ok && receiveTime.Unix()-lastUnix < limit {
+	if !w.d.allowed(remoteAddr.IP) {
+		if debug {
+			logger().Debugf("worker: %s drop packet %d not allowed",
+				remoteAddr.String(), n)
+		}
+		if w.stat != nil {
+			w.stat.ACL.Inc()
+		}
+		return
+	}
 
-				if !w.d.cfg.RateDrop {
-					w.sendError(p, remoteAddr, rateKoD)
-				}
-				if w.stat != nil {
-					w.stat.Rate.Inc()
-				}
-				continue
-			}
+	action := restrictAllow
+	if rt := w.d.restrictTable(); rt.enabled() {
+		rule := rt.match(remoteAddr.IP)
+		action = rule.action
+		if w.stat != nil {
+			w.stat.Restrict.WithLabelValues(rule.cidr, rule.name).Inc()
+		}
+	}
+	if action == restrictIgnore {
+		if debug {
+			logger().Debugf("worker: %s ignore packet %d",
+				remoteAddr.String(), n)
+		}
+		if w.stat != nil {
+			w.stat.ACL.Inc()
+		}
+		return
+	}
+
+	// BCE
+	_ = p[47]
+
+	if w.d.cfg.RateSize > 0 && !w.allow(remoteAddr.IP, receiveTime) {
+		if w.stat != nil {
+			w.stat.Rate.Inc()
+		}
+		if w.d.cfg.RateDrop || n < headerSize {
+			return
+		}
+		rn = w.kod(p, rateKoD)
+		return
+	}
+
+	// GetMode
 
-			w.lru.Add(remoteAddr.IP, receiveTime.Unix())
+	mode := getMode(p)
+	// ntpq sends control message in version 2
+	if mode != modeControlMessage && getVersion(p) < w.d.cfg.MinVersion {
+		if debug {
+			logger().Debugf("worker: %s drop version %d request",
+				remoteAddr.String(), getVersion(p))
 		}
+		if w.stat != nil {
+			w.stat.Version.Inc()
+		}
+		return
+	}
 
-		// GetMode
+	// dropped, ignored and rate limited requests are neither served nor
+	// counted as clients
+	if s := w.d.stat; s != nil {
+		s.requestCounter.Inc()
+	}
+	if c := w.d.clients; c != nil {
+		c.add(remoteAddr.IP)
+	}
 
-		switch p[liVnModePos] &^ 0xf8 {
-		case modeSymmetricActive:
-			w.sendError(p, remoteAddr, acstKoD)
-		case modeReserved:
-			fallthrough
-		case modeClient:
-			copy(p[0:originTimeStamp], w.d.template)
-			copy(p[originTimeStamp:originTimeStamp+8],
-				p[transmitTimeStamp:transmitTimeStamp+8])
-			setUint64(p, receiveTimeStamp, toNtpTime(receiveTime))
-			setUint64(p, transmitTimeStamp, toNtpTime(time.Now()))
-			_, err = w.conn.WriteToUDP(p, remoteAddr)
-			if err != nil && debug {
-				log.Printf("worker: %s write failed. %s", remoteAddr.String(), err)
+	switch mode {
+	case modeClient:
+		if action == restrictNoServe {
+			rn = w.kod(p, denyKoD)
+			return
+		}
+		exts, mac, _ := extensions(p[:n])
+		if w.d.cfg.RefuseWhenUnsync && untrusted(w.d.loadTemplate(), w.d.cfg) {
+			if w.stat != nil {
+				w.stat.Unsync.Inc()
+			}
+			// KoD would be unauthenticated, NTS client is left to retry
+			if w.d.nts != nil && hasNTS(exts) {
+				return
+			}
+			rn = w.kod(p, denyKoD)
+			return
+		}
+		if w.d.nts != nil && hasNTS(exts) {
+			rn, err := w.serveNTS(p, n, exts, receiveTime)
+			if err != nil {
+				if debug {
+					logger().Debugf("worker: %s NTS failed: %s", remoteAddr.String(), err)
+				}
+				if w.stat != nil {
+					w.stat.NTSDrop.Inc()
+				}
+				return 0, false
 			}
-			if w.stat == nil {
-				continue
+			if w.stat != nil {
+				w.stat.Req.Inc()
+				w.stat.NTS.Inc()
 			}
-			w.stat.Req.Inc()
-			if w.stat.GeoDB != nil {
-				w.logIP(remoteAddr)
+			return rn, false
+		}
+
+		var key *symKey
+		// other extension fields are ignored as unknown ones, RFC 7822,
+		// response carries none of them
+		if mac < n {
+			key = w.d.keys.verify(p[:n])
+			if key == nil {
+				if debug {
+					logger().Debugf("worker: %s auth failed", remoteAddr.String())
+				}
+				if w.stat != nil {
+					w.stat.Auth.Inc()
+				}
+				return
 			}
-		default:
-			if debug {
-				log.Printf("%s not support client request mode:%x",
-					remoteAddr.String(), p[liVnModePos]&^0xf8)
+		}
+
+		org := binary.BigEndian.Uint64(p[originTimeStamp:])
+		rx := binary.BigEndian.Uint64(p[receiveTimeStamp:])
+		tx := binary.BigEndian.Uint64(p[transmitTimeStamp:])
+		copy(p[0:originTimeStamp], w.d.loadTemplate())
+		setUint64(p, originTimeStamp, tx)
+		setUint64(p, receiveTimeStamp, toNtpTime(receiveTime))
+		rn, stamp = headerSize, true
+		interleaved := w.interleave(p, remoteAddr.IP, org, rx, tx)
+		if interleaved {
+			// transmit timestamp is the one of last response
+			stamp = false
+		}
+		if key != nil {
+			if stamp {
+				stampTransmit(p)
 			}
+			rn, stamp = key.sign(p), false
+		}
+		if w.stat == nil {
+			return
+		}
+		w.stat.Req.Inc()
+		if interleaved {
+			w.stat.Response.WithLabelValues("interleaved").Inc()
+		} else {
+			w.stat.Response.WithLabelValues("basic").Inc()
+		}
+		if w.stat.GeoDB != nil {
+			w.logIP(remoteAddr)
+		}
+		return
+	case modeControlMessage:
+		if action >= restrictNoControl {
 			if w.stat != nil {
-				w.stat.Unknown.Inc()
+				w.stat.ACL.Inc()
 			}
+			return
+		}
+		if w.d.cfg.Control {
+			rn = w.control(p, n)
+		}
+		if w.stat == nil {
+			return
 		}
+		if rn == 0 {
+			w.stat.Unknown.Inc()
+			return
+		}
+		w.stat.Control.Inc()
+		return
+	default:
+		if debug {
+			logger().Debugf("%s not support client request mode:%x",
+				remoteAddr.String(), p[liVnModePos]&^0xf8)
+		}
+		if w.stat != nil {
+			w.stat.Unknown.Inc()
+		}
+		return
+	}
+}
+
+// malformed returns why request p with length n is dropped without
+// response, or empty string if it's valid.
+// Request of mode other than client (also symmetric active, which was
+// answered by ACST KoD) is dropped to avoid reflection, control message
+// is checked further by control. Extension fields must be well formed.
+func malformed(p []byte, n int) string {
+	switch {
+	case n < ctlHeaderSize || n > len(p):
+		return "short"
+	case getMode(p) == modeControlMessage:
+		return ""
+	case n < headerSize:
+		return "short"
+	case n%4 != 0:
+		// MAC and extension fields are 32 bits aligned
+		return "length"
+	case getMode(p) != modeClient:
+		return "mode"
+	}
+	if n > headerSize {
+		if _, _, err := extensions(p[:n]); err != nil {
+			return "extension"
+		}
+	}
+	return ""
+}
+
+// stampTransmit sets transmit timestamp of response p, it's called right
+// before the packet is handed to kernel. Transmit timestamp is taken in
+// user space and early by the send path of kernel, usually tens of
+// microseconds. Receive timestamp is taken by kernel or NIC when
+// supported (Linux), otherwise it's late by the latency from kernel to
+// worker as well.
+func stampTransmit(p []byte) {
+	setUint64(p, transmitTimeStamp, toNtpTime(time.Now()))
+}
+
+// allow is a token bucket in form of GCRA, lru holds the theoretical
+// arrival time of next request in nanoseconds for each client.
+// A client can send RateBurst requests at once then one per limit.
+func (w *worker) allow(ip net.IP, now time.Time) bool {
+	t := now.UnixNano()
+	tat, ok := w.lru.Get(ip)
+	if !ok || tat < t {
+		tat = t
 	}
+
+	burst := w.d.cfg.RateBurst
+	if burst < 1 {
+		burst = 1
+	}
+	if tat-t > int64(limit)*int64(burst-1) {
+		return false
+	}
+	w.lru.Add(ip, tat+int64(limit))
+	return true
 }
 
-func (w *worker) sendError(p []byte, raddr *net.UDPAddr, err uint32) {
+// defaultRefuseDispersion is root dispersion over which time is refused
+// by RefuseWhenUnsync, reached after about 2 hours of holdover
+const defaultRefuseDispersion = 100 * time.Millisecond
+
+// untrusted reports if time of template t shouldn't be served: it's
+// unsynchronized, served by orphan mode, or root dispersion is over
+// RefuseDispersion. Local clock of DisciplineDisabled is trusted.
+func untrusted(t []byte, cfg *Config) bool {
+	if t[liVnModePos]>>6 == notSync || t[stratumPos] == 0 || t[stratumPos] >= invalidStratum {
+		return true
+	}
+	if cfg.DisciplineDisabled {
+		return false
+	}
+	if binary.BigEndian.Uint32(t[referIDPos:]) == loclRefer {
+		return true
+	}
+	return fromNtpShortTime(binary.BigEndian.Uint32(t[rootDispersionPos:])) > cfg.RefuseDispersion
+}
+
+// kod builds Kiss-o'-Death response in place of request p
+func (w *worker) kod(p []byte, code uint32) int {
 	// avoid spoof
-	copy(p[0:originTimeStamp], w.d.template)
+	copy(p[0:originTimeStamp], w.d.loadTemplate())
 	copy(p[originTimeStamp:originTimeStamp+8],
 		p[transmitTimeStamp:transmitTimeStamp+8])
 	setUint8(p, stratumPos, 0)
-	setUint32(p, referIDPos, err)
-	w.conn.WriteToUDP(p, raddr)
+	setUint32(p, referIDPos, code)
+	if w.stat != nil {
+		w.stat.KoD.WithLabelValues(kissCode(code)).Inc()
+	}
+	return headerSize
 }
 
 func (w *worker) logIP(raddr *net.UDPAddr) {
@@ -0,0 +1,731 @@
+package gontpd
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/beevik/ntp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestServer(tb testing.TB, cfg *Config) *NTPd {
+	if cfg.Listen == "" {
+		cfg.Listen = "127.0.0.1:0"
+	}
+	if len(cfg.PeerList) == 0 {
+		cfg.PeerList = Peers("127.0.0.1")
+	}
+	d, err := New(cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = d.listen()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return d
+}
+
+func newTestRequest() []byte {
+	req := make([]byte, 48)
+	setVersion(req, 4)
+	setMode(req, modeClient)
+	setUint64(req, transmitTimeStamp, toNtpTime(time.Now()))
+	return req
+}
+
+func TestListenWorkersSharePort(t *testing.T) {
+	d := newTestServer(t, &Config{ListenWorkers: 4})
+	defer d.shutdown()
+
+	if len(d.conns) != 4 {
+		t.Fatalf("expect 4 sockets got %d", len(d.conns))
+	}
+	addr := d.conns[0].LocalAddr().String()
+	for _, c := range d.conns[1:] {
+		if c.LocalAddr().String() != addr {
+			t.Errorf("socket bound to %s, expect %s", c.LocalAddr(), addr)
+		}
+	}
+}
+
+func benchmarkServe(b *testing.B, workers, batch, parallel int) {
+	d := newTestServer(b, &Config{ListenWorkers: workers, BatchSize: batch})
+	defer d.shutdown()
+	raddr := d.conns[0].LocalAddr().(*net.UDPAddr)
+
+	b.SetParallelism(parallel)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// each client owns a socket so kernel can hash them to
+		// different listen sockets
+		conn, err := net.DialUDP("udp", nil, raddr)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer conn.Close()
+		req := newTestRequest()
+		resp := make([]byte, 48)
+		for pb.Next() {
+			conn.SetDeadline(time.Now().Add(time.Second))
+			if _, err = conn.Write(req); err != nil {
+				b.Error(err)
+				return
+			}
+			if _, err = conn.Read(resp); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkServe1Socket(b *testing.B) {
+	benchmarkServe(b, 1, 1, 1)
+}
+
+func BenchmarkServe4Socket(b *testing.B) {
+	benchmarkServe(b, 4, 1, 4)
+}
+
+// many clients send at once so recvmmsg can read more than one packet
+func BenchmarkServeSingle(b *testing.B) {
+	benchmarkServe(b, 1, 1, 16)
+}
+
+func BenchmarkServeBatch(b *testing.B) {
+	benchmarkServe(b, 1, 32, 16)
+}
+
+func TestWorkerAllow(t *testing.T) {
+	w := &worker{lru: newLRU(10), d: &NTPd{cfg: &Config{RateBurst: 3}}}
+	ip := net.IP{1, 2, 3, 4}
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 3; i++ {
+		if !w.allow(ip, now) {
+			t.Fatalf("burst request %d rejected", i)
+		}
+	}
+	if w.allow(ip, now) {
+		t.Error("request over burst allowed")
+	}
+	if !w.allow(net.IP{1, 2, 3, 5}, now) {
+		t.Error("other client rejected")
+	}
+
+	now = now.Add(limit)
+	if !w.allow(ip, now) {
+		t.Error("request after headway rejected")
+	}
+	if w.allow(ip, now) {
+		t.Error("second request after headway allowed")
+	}
+
+	now = now.Add(10 * limit)
+	for i := 0; i < 3; i++ {
+		if !w.allow(ip, now) {
+			t.Fatalf("refilled burst request %d rejected", i)
+		}
+	}
+}
+
+func TestListenNetwork(t *testing.T) {
+	gold := map[string]string{
+		":123":            "udp",
+		"localhost:123":   "udp",
+		"0.0.0.0:123":     "udp4",
+		"[::]:123":        "udp6",
+		"[fe80::1%1]:123": "udp6",
+		"bad":             "udp",
+	}
+	for addr, network := range gold {
+		if got := listenNetwork(addr); got != network {
+			t.Errorf("%s expect %s got %s", addr, network, got)
+		}
+	}
+}
+
+func TestListenDualStack(t *testing.T) {
+	if c, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback}); err != nil {
+		t.Skip("no ipv6 support", err)
+	} else {
+		c.Close()
+	}
+
+	d := newTestServer(t, &Config{ListenAddrs: []string{"127.0.0.1:0", "[::1]:0"}})
+	defer d.shutdown()
+
+	for _, c := range d.conns {
+		conn, err := net.DialUDP("udp", nil, c.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write(newTestRequest())
+		resp := make([]byte, 48)
+		if _, err = conn.Read(resp); err != nil {
+			t.Errorf("%s: %s", c.LocalAddr(), err)
+		}
+		conn.Close()
+	}
+}
+
+func TestServeBatchPairing(t *testing.T) {
+	d := newTestServer(t, &Config{BatchSize: 8})
+	defer d.shutdown()
+	raddr := d.conns[0].LocalAddr().(*net.UDPAddr)
+
+	clients := make([]*net.UDPConn, 8)
+	for i := range clients {
+		c, err := net.DialUDP("udp", nil, raddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		clients[i] = c
+	}
+
+	// send all requests first so they are likely read in one batch
+	for i, c := range clients {
+		req := newTestRequest()
+		setUint64(req, transmitTimeStamp, uint64(i+1))
+		c.Write(req)
+	}
+
+	for i, c := range clients {
+		resp := make([]byte, 48)
+		c.SetDeadline(time.Now().Add(time.Second))
+		if _, err := c.Read(resp); err != nil {
+			t.Fatal(err)
+		}
+		if got := binary.BigEndian.Uint64(resp[originTimeStamp:]); got != uint64(i+1) {
+			t.Errorf("client %d got origin timestamp of %d", i+1, got)
+		}
+	}
+}
+
+func BenchmarkHandle(b *testing.B) {
+	d := newTestNTPd(&Config{RateSize: 1024})
+	d.dropTable.Store(&dropTable{})
+	w := &worker{lru: newLRU(1024), d: d}
+	raddr := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 123}
+	req := newTestRequest()
+	p := make([]byte, maxPacketSize)
+	now := time.Now()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(p, req)
+		raddr.IP[3] = byte(i)
+		w.handle(p, headerSize, raddr, now.Add(time.Duration(i)*limit))
+	}
+}
+
+func TestHandleStampTransmit(t *testing.T) {
+	kt, err := parseKeys(strings.NewReader("1 MD5 secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newTestNTPd(&Config{})
+	d.dropTable.Store(&dropTable{})
+	d.keys = kt
+	w := &worker{lru: newLRU(0), d: d}
+	raddr := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 123}
+
+	p := make([]byte, maxPacketSize)
+	req := newTestRequest()
+	copy(p, req)
+	n, stamp := w.handle(p, headerSize, raddr, time.Now())
+	if n != headerSize || !stamp {
+		t.Fatalf("n=%d stamp=%v", n, stamp)
+	}
+	if !bytes.Equal(p[originTimeStamp:originTimeStamp+8], req[transmitTimeStamp:]) {
+		t.Error("origin not echoed")
+	}
+	if !bytes.Equal(p[transmitTimeStamp:transmitTimeStamp+8], req[transmitTimeStamp:]) {
+		t.Error("transmit stamped in handle")
+	}
+	before := time.Now()
+	stampTransmit(p)
+	if ts := binary.BigEndian.Uint64(p[transmitTimeStamp:]); ts < toNtpTime(before) {
+		t.Errorf("transmit %x stamped before %x", ts, toNtpTime(before))
+	}
+
+	// signed response is stamped before MAC is computed
+	copy(p, req)
+	n = kt[1].sign(p)
+	n, stamp = w.handle(p, n, raddr, time.Now())
+	if stamp || n != headerSize+keyIDSize+md5.Size {
+		t.Fatalf("n=%d stamp=%v", n, stamp)
+	}
+	if kt.verify(p[:n]) == nil {
+		t.Error("bad MAC of signed response")
+	}
+}
+
+func TestHandleOriginEcho(t *testing.T) {
+	d := newTestNTPd(&Config{RateSize: 16, RateBurst: 1})
+	d.dropTable.Store(&dropTable{})
+	w := &worker{lru: newLRU(16), d: d}
+	raddr := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 123}
+	now := time.Now()
+
+	// buffer is reused by worker, the second request is answered by RATE KoD
+	p := make([]byte, maxPacketSize)
+	for i, xmt := range []uint64{0x0123456789abcdef, 0xfedcba9876543210} {
+		req := newTestRequest()
+		setUint64(req, transmitTimeStamp, xmt)
+		copy(p, req)
+		n, _ := w.handle(p, headerSize, raddr, now)
+		if n != headerSize {
+			t.Fatalf("request %d: n=%d", i, n)
+		}
+		if got := binary.BigEndian.Uint64(p[originTimeStamp:]); got != xmt {
+			t.Errorf("request %d: origin=%x, want %x", i, got, xmt)
+		}
+		if p[liVnModePos]&0x7 != modeServer {
+			t.Errorf("request %d: mode=%d", i, p[liVnModePos]&0x7)
+		}
+	}
+}
+
+func TestQueryOriginEcho(t *testing.T) {
+	d := newTestServer(t, &Config{})
+	defer d.shutdown()
+
+	// client rejects response if origin doesn't match its transmit timestamp
+	resp, err := ntp.QueryWithOptions(d.conns[0].LocalAddr().String(),
+		ntp.QueryOptions{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.RTT < 0 || resp.RTT > time.Second {
+		t.Errorf("bad round trip %s", resp.RTT)
+	}
+}
+
+func TestHandleMinVersion(t *testing.T) {
+	raddr := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 123}
+	for _, c := range []struct {
+		min, version uint8
+		answered     bool
+	}{
+		{0, 1, false},
+		{0, 2, false},
+		{0, 3, true},
+		{0, 4, true},
+		{1, 1, true},
+		{4, 3, false},
+	} {
+		d := newTestNTPd(&Config{MinVersion: c.min})
+		d.dropTable.Store(&dropTable{})
+		w := &worker{lru: newLRU(0), d: d}
+		p := make([]byte, maxPacketSize)
+		copy(p, newTestRequest())
+		setVersion(p, c.version)
+		if n, _ := w.handle(p, headerSize, raddr, time.Now()); (n != 0) != c.answered {
+			t.Errorf("min=%d version=%d: got %d bytes response", c.min, c.version, n)
+		}
+	}
+}
+
+func TestHandleMalformed(t *testing.T) {
+	d := newTestNTPd(&Config{Control: true})
+	d.dropTable.Store(&dropTable{})
+	w := &worker{lru: newLRU(0), d: d}
+	raddr := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 123}
+
+	mode := func(m uint8) []byte {
+		req := newTestRequest()
+		setMode(req, m)
+		return req
+	}
+	for _, c := range []struct {
+		name string
+		req  []byte
+		kind string
+	}{
+		{"empty", nil, "short"},
+		{"short", newTestRequest()[:47], "short"},
+		{"short control", newTestControl(ctlOpReadVar, 0)[:11], "short"},
+		{"unaligned", append(newTestRequest(), 0), "length"},
+		{"extension", appendExt(newTestRequest(), 0xf000, 16), "extension"},
+		{"reserved", mode(modeReserved), "mode"},
+		{"symmetric active", mode(modeSymmetricActive), "mode"},
+		{"server", mode(modeServer), "mode"},
+		{"broadcast", mode(modeBroadcast), "mode"},
+		{"private", mode(modeReservedPrivate), "mode"},
+		{"client", newTestRequest(), ""},
+		{"control", newTestControl(ctlOpReadVar, 0), ""},
+	} {
+		p := make([]byte, maxPacketSize)
+		copy(p, c.req)
+		if kind := malformed(p, len(c.req)); kind != c.kind {
+			t.Errorf("%s: got %q, want %q", c.name, kind, c.kind)
+		}
+		n, _ := w.handle(p, len(c.req), raddr, time.Now())
+		if (n != 0) != (c.kind == "") {
+			t.Errorf("%s: got %d bytes response", c.name, n)
+		}
+	}
+}
+
+func TestHandleRandom(t *testing.T) {
+	kt, err := parseKeys(strings.NewReader("1 MD5 secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newTestNTPd(&Config{Control: true, RateSize: 16, MinVersion: 1})
+	d.dropTable.Store(&dropTable{})
+	d.keys = kt
+	w := &worker{lru: newLRU(16), d: d}
+	raddr := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 123}
+
+	rnd := rand.New(rand.NewSource(1))
+	p := make([]byte, maxPacketSize)
+	for i := 0; i < 100000; i++ {
+		n := rnd.Intn(2 * headerSize)
+		rnd.Read(p[:n])
+		// random request with valid mode reaches further
+		if i%2 == 0 && n > 0 {
+			setMode(p, modeClient)
+		}
+		raddr.IP[3] = byte(i)
+		rn, _ := w.handle(p, n, raddr, time.Now())
+		if n < ctlHeaderSize && rn != 0 {
+			t.Fatalf("%d bytes response to %d bytes request", rn, n)
+		}
+		if rn > len(p) {
+			t.Fatalf("response %d is longer than buffer", rn)
+		}
+	}
+}
+
+func TestDSCP(t *testing.T) {
+	tos := func(c syscall.Conn, level, opt int) (v int) {
+		rc, err := c.SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc.Control(func(fd uintptr) {
+			v, err = syscall.GetsockoptInt(int(fd), level, opt)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	d := &NTPd{cfg: &Config{DSCP: 46}}
+	conn, err := d.makeConn("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if v := tos(conn, syscall.IPPROTO_IP, syscall.IP_TOS); v != 46<<2 {
+		t.Errorf("listen IP_TOS=%d", v)
+	}
+
+	if conn6, err := d.makeConn("udp6", "[::1]:0"); err == nil {
+		defer conn6.Close()
+		if v := tos(conn6, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS); v != 46<<2 {
+			t.Errorf("listen IPV6_TCLASS=%d", v)
+		}
+	}
+
+	c, err := dscpDialer(46)("", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v := tos(c.(*net.UDPConn), syscall.IPPROTO_IP, syscall.IP_TOS); v != 46<<2 {
+		t.Errorf("query IP_TOS=%d", v)
+	}
+
+	if _, err = New(&Config{DSCP: 64, PeerList: Peers("127.0.0.1")}); err == nil {
+		t.Error("DSCP 64 accepted")
+	}
+}
+
+func TestListenPartialFailure(t *testing.T) {
+	// 203.0.113.0/24 is documentation network, not local address
+	d := newTestServer(t, &Config{ListenAddrs: []string{"203.0.113.1:0", "127.0.0.1:0"}})
+	defer d.shutdown()
+	if len(d.conns) != 1 || !d.conns[0].LocalAddr().(*net.UDPAddr).IP.IsLoopback() {
+		t.Fatalf("got conns %v", d.conns)
+	}
+
+	d, err := New(&Config{ListenAddrs: []string{"203.0.113.1:0", "203.0.113.2:0"},
+		PeerList: Peers("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.listen(); err == nil || !strings.Contains(err.Error(), "203.0.113.2") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestHandlePanic(t *testing.T) {
+	// drop table is never stored, handle panics on it
+	d := newTestNTPd(&Config{})
+	w := &worker{id: "0:0", lru: newLRU(0), d: d}
+	raddr := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 123}
+
+	p := make([]byte, maxPacketSize)
+	copy(p, newTestRequest())
+	if n, stamp := w.handleSafe(p, headerSize, raddr, time.Now()); n != 0 || stamp {
+		t.Errorf("got %d bytes response on panic", n)
+	}
+}
+
+func TestSupervise(t *testing.T) {
+	w := &worker{id: "0:0"}
+	runs := 0
+	start := time.Now()
+	w.supervise(func() {
+		runs++
+		if runs < 3 {
+			panic("bad packet")
+		}
+	})
+	if runs != 3 {
+		t.Errorf("served %d times, want 3", runs)
+	}
+	if d := time.Since(start); d < 3*minRestartBackoff {
+		t.Errorf("restarted within %s, no backoff", d)
+	}
+}
+
+func TestHandleRestrict(t *testing.T) {
+	d := newTestNTPd(&Config{Control: true})
+	d.dropTable.Store(&dropTable{})
+	rt, err := newRestrictTable([]RestrictRule{
+		{"192.0.2.0/25", "allow"},
+		{"192.0.2.128/26", "nocontrol"},
+		{"192.0.2.192/27", "noserve"},
+	}, "ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.restricts.Store(rt)
+	w := &worker{lru: newLRU(0), d: d}
+
+	for _, c := range []struct {
+		ip              byte
+		client, control bool
+		kod             bool
+	}{
+		{1, true, true, false},
+		{129, true, false, false},
+		{193, true, false, true},
+		{225, false, false, false},
+	} {
+		raddr := &net.UDPAddr{IP: net.IP{192, 0, 2, c.ip}, Port: 123}
+		p := make([]byte, maxPacketSize)
+		copy(p, newTestRequest())
+		n, _ := w.handle(p, headerSize, raddr, time.Now())
+		if (n != 0) != c.client {
+			t.Errorf("%s: got %d bytes response", raddr, n)
+		}
+		if kod := n != 0 && p[stratumPos] == 0 && binary.BigEndian.Uint32(p[referIDPos:]) == denyKoD; kod != c.kod {
+			t.Errorf("%s: DENY KoD=%v", raddr, kod)
+		}
+
+		req := newTestControl(ctlOpReadVar, 0)
+		copy(p, req)
+		if n, _ = w.handle(p, len(req), raddr, time.Now()); (n != 0) != c.control {
+			t.Errorf("%s: got %d bytes control response", raddr, n)
+		}
+	}
+}
+
+func TestHandleAllowCIDR(t *testing.T) {
+	d := newTestNTPd(&Config{})
+	dt, err := newDropTable([]string{"10.1.0.0/16", "2001:db8:1::/48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at, err := newDropTable([]string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.dropTable.Store(dt)
+	d.allowTable.Store(at)
+	w := &worker{lru: newLRU(0), d: d}
+
+	for _, c := range []struct {
+		ip     string
+		served bool
+	}{
+		{"10.2.0.1", true},
+		{"10.1.0.1", false},
+		{"192.0.2.1", false},
+		{"2001:db8:2::1", true},
+		{"2001:db8:1::1", false},
+		{"2001:db9::1", false},
+	} {
+		raddr := &net.UDPAddr{IP: net.ParseIP(c.ip), Port: 123}
+		p := make([]byte, maxPacketSize)
+		copy(p, newTestRequest())
+		if n, _ := w.handle(p, headerSize, raddr, time.Now()); (n != 0) != c.served {
+			t.Errorf("%s: got %d bytes response", c.ip, n)
+		}
+	}
+
+	// empty allow list serves everyone
+	empty, _ := newDropTable(nil)
+	d.allowTable.Store(empty)
+	if !d.allowed(net.ParseIP("192.0.2.1")) {
+		t.Error("address is not allowed by empty list")
+	}
+}
+
+func TestHandleDropCIDRCounter(t *testing.T) {
+	d := newTestNTPd(&Config{})
+	dt, err := newDropTable([]string{"10.0.0.0/8", "192.168.0.0/16", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt.BanFor(net.ParseIP("203.0.113.1"), time.Hour)
+	d.dropTable.Store(dt)
+
+	// unregistered counters so that test can run repeatedly
+	w := &worker{lru: newLRU(0), d: d, stat: &workerStat{
+		Req:      prometheus.NewCounter(prometheus.CounterOpts{Name: "req"}),
+		ACL:      prometheus.NewCounter(prometheus.CounterOpts{Name: "acl"}),
+		DropCIDR: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "drop_cidr"}, []string{"cidr"}),
+		Response: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "response"}, []string{"mode"}),
+	}}
+	for _, ip := range []string{
+		"10.0.0.1", "10.1.2.3", "10.255.0.1",
+		"192.168.1.1",
+		"2001:db8::1", "2001:db8:1::1",
+		"203.0.113.1",
+		"198.51.100.1",
+	} {
+		p := make([]byte, maxPacketSize)
+		copy(p, newTestRequest())
+		w.handle(p, headerSize, &net.UDPAddr{IP: net.ParseIP(ip), Port: 123}, time.Now())
+	}
+
+	for _, c := range []struct {
+		cidr string
+		hits float64
+	}{
+		{"10.0.0.0/8", 3},
+		{"192.168.0.0/16", 1},
+		{"2001:db8::/32", 2},
+		{banRule, 1},
+	} {
+		if got := testutil.ToFloat64(w.stat.DropCIDR.WithLabelValues(c.cidr)); got != c.hits {
+			t.Errorf("%s: %v hits, want %v", c.cidr, got, c.hits)
+		}
+	}
+	if got := testutil.ToFloat64(w.stat.ACL); got != 7 {
+		t.Errorf("%v dropped, want 7", got)
+	}
+	if got := testutil.ToFloat64(w.stat.Req); got != 1 {
+		t.Errorf("%v served, want 1", got)
+	}
+}
+
+func TestHandleRefuseUnsync(t *testing.T) {
+	d := newTestNTPd(&Config{RefuseWhenUnsync: true})
+	d.dropTable.Store(&dropTable{})
+	w := &worker{lru: newLRU(0), d: d, stat: &workerStat{
+		Req:      prometheus.NewCounter(prometheus.CounterOpts{Name: "req"}),
+		Unsync:   prometheus.NewCounter(prometheus.CounterOpts{Name: "unsync"}),
+		KoD:      prometheus.NewCounterVec(prometheus.CounterOpts{Name: "kod"}, []string{"reason"}),
+		Response: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "response"}, []string{"mode"}),
+	}}
+	raddr := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 123}
+	synced := func(t []byte) {
+		setLi(t, noLeap)
+		setUint8(t, stratumPos, 2)
+		setUint32(t, referIDPos, 0xc0000201)
+		setUint32(t, rootDispersionPos, toNtpShortTime(time.Millisecond))
+	}
+
+	for _, c := range []struct {
+		name   string
+		modify func(t []byte)
+		refuse bool
+	}{
+		{"before sync", func(t []byte) {}, true},
+		{"synced", synced, false},
+		{"orphan", func(t []byte) {
+			synced(t)
+			setUint32(t, referIDPos, loclRefer)
+		}, true},
+		{"holdover", func(t []byte) {
+			synced(t)
+			setUint32(t, rootDispersionPos, toNtpShortTime(time.Second))
+		}, true},
+	} {
+		d.template.Store(newTemplate())
+		d.modifyTemplate(c.modify)
+		p := make([]byte, maxPacketSize)
+		copy(p, newTestRequest())
+		n, _ := w.handle(p, headerSize, raddr, time.Now())
+		kod := n != 0 && p[stratumPos] == 0 && binary.BigEndian.Uint32(p[referIDPos:]) == denyKoD
+		if n == 0 || kod != c.refuse {
+			t.Errorf("%s: n=%d DENY KoD=%v", c.name, n, kod)
+		}
+	}
+	if got := testutil.ToFloat64(w.stat.Unsync); got != 3 {
+		t.Errorf("%v refused, want 3", got)
+	}
+
+	// local clock is served as configured
+	d.cfg.DisciplineDisabled = true
+	d.template.Store(newTemplate())
+	d.modifyTemplate(func(t []byte) {
+		synced(t)
+		setUint32(t, referIDPos, loclRefer)
+	})
+	if untrusted(d.loadTemplate(), d.cfg) {
+		t.Error("local clock refused")
+	}
+}
+
+func TestHandleCountServed(t *testing.T) {
+	d := newTestNTPd(&Config{})
+	drops, err := newDropTable([]string{"198.51.100.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.dropTable.Store(drops)
+	d.stat = &ntpStat{requestCounter: prometheus.NewCounter(prometheus.CounterOpts{Name: "requests"})}
+	d.clients = newClientCounter()
+	w := &worker{lru: newLRU(0), d: d, stat: &workerStat{
+		Req:      prometheus.NewCounter(prometheus.CounterOpts{Name: "req"}),
+		ACL:      prometheus.NewCounter(prometheus.CounterOpts{Name: "acl"}),
+		DropCIDR: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "drop"}, []string{"cidr"}),
+		Response: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "response"}, []string{"mode"}),
+	}}
+	for i, ip := range []net.IP{{198, 51, 100, 1}, {198, 51, 100, 2}, {192, 0, 2, 1}} {
+		p := make([]byte, maxPacketSize)
+		copy(p, newTestRequest())
+		n, _ := w.handle(p, headerSize, &net.UDPAddr{IP: ip, Port: 123}, time.Now())
+		if dropped := i < 2; dropped != (n == 0) {
+			t.Errorf("%s: n=%d", ip, n)
+		}
+	}
+	if got := testutil.ToFloat64(d.stat.requestCounter); got != 1 {
+		t.Errorf("%v requests counted, want only the served one", got)
+	}
+	if e := d.clients.estimate(); e < 0.5 || e > 1.5 {
+		t.Errorf("%.1f clients estimated, want 1", e)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package gontpd
+
+import "errors"
+
+func openSHM(unit int) (t *shmTime, detach func() error, err error) {
+	err = errors.New("SHM refclock is not supported on this platform")
+	return
+}
@@ -0,0 +1,30 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package gontpd
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// openSHM attaches SHM segment of unit, it's created if writer hasn't.
+// Units 0 and 1 are only accessible by root as ntpd.
+func openSHM(unit int) (t *shmTime, detach func() error, err error) {
+	perm := 0666
+	if unit < 2 {
+		perm = 0600
+	}
+	id, err := unix.SysvShmGet(shmKey+unit, int(unsafe.Sizeof(shmTime{})), unix.IPC_CREAT|perm)
+	if err != nil {
+		return
+	}
+	b, err := unix.SysvShmAttach(id, 0, 0)
+	if err != nil {
+		return
+	}
+	t = (*shmTime)(unsafe.Pointer(&b[0]))
+	detach = func() error { return unix.SysvShmDetach(b) }
+	return
+}
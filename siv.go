@@ -0,0 +1,136 @@
+package gontpd
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+)
+
+// sivKeySize is key size of AEAD_AES_SIV_CMAC_256, half for CMAC and
+// half for CTR
+const sivKeySize = 32
+
+var errOpen = errors.New("message authentication failed")
+
+// siv is AES-SIV of RFC 5297, the only AEAD required by NTS
+type siv struct {
+	mac, ctr cipher.Block
+	k1, k2   [aes.BlockSize]byte
+}
+
+func newSIV(key []byte) (s *siv, err error) {
+	if len(key) != sivKeySize && len(key) != 2*sivKeySize {
+		err = aes.KeySizeError(len(key))
+		return
+	}
+	s = &siv{}
+	half := len(key) / 2
+	if s.mac, err = aes.NewCipher(key[:half]); err != nil {
+		return
+	}
+	if s.ctr, err = aes.NewCipher(key[half:]); err != nil {
+		return
+	}
+	// subkeys of CMAC, RFC 4493
+	s.mac.Encrypt(s.k1[:], s.k1[:])
+	dbl(&s.k1)
+	s.k2 = s.k1
+	dbl(&s.k2)
+	return
+}
+
+// dbl is multiplication by x in GF(2^128)
+func dbl(b *[aes.BlockSize]byte) {
+	carry := b[0] >> 7
+	for i := 0; i < aes.BlockSize-1; i++ {
+		b[i] = b[i]<<1 | b[i+1]>>7
+	}
+	b[aes.BlockSize-1] = b[aes.BlockSize-1]<<1 ^ 0x87*carry
+}
+
+func xorBlock(dst *[aes.BlockSize]byte, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
+
+// cmac of RFC 4493
+func (s *siv) cmac(msg []byte) (sum [aes.BlockSize]byte) {
+	for len(msg) > aes.BlockSize {
+		xorBlock(&sum, msg[:aes.BlockSize])
+		s.mac.Encrypt(sum[:], sum[:])
+		msg = msg[aes.BlockSize:]
+	}
+	if len(msg) == aes.BlockSize {
+		xorBlock(&sum, s.k1[:])
+	} else {
+		xorBlock(&sum, s.k2[:])
+		sum[len(msg)] ^= 0x80
+	}
+	xorBlock(&sum, msg)
+	s.mac.Encrypt(sum[:], sum[:])
+	return
+}
+
+// s2v of RFC 5297 Section 2.4 on ad and plaintext
+func (s *siv) s2v(plaintext []byte, ad [][]byte) [aes.BlockSize]byte {
+	var zero [aes.BlockSize]byte
+	d := s.cmac(zero[:])
+	for _, a := range ad {
+		dbl(&d)
+		sum := s.cmac(a)
+		xorBlock(&d, sum[:])
+	}
+	if len(plaintext) >= aes.BlockSize {
+		// xorend, D is xored into the last block of plaintext
+		t := make([]byte, len(plaintext))
+		copy(t, plaintext)
+		n := len(t) - aes.BlockSize
+		for i := range d {
+			t[n+i] ^= d[i]
+		}
+		return s.cmac(t)
+	}
+	dbl(&d)
+	var t [aes.BlockSize]byte
+	copy(t[:], plaintext)
+	t[len(plaintext)] = 0x80
+	xorBlock(&t, d[:])
+	return s.cmac(t[:])
+}
+
+func (s *siv) xorCTR(dst, src []byte, v [aes.BlockSize]byte) {
+	// bits 31 and 63 are cleared for 32 and 64 bits counter
+	v[8] &= 0x7f
+	v[12] &= 0x7f
+	cipher.NewCTR(s.ctr, v[:]).XORKeyStream(dst, src)
+}
+
+// seal appends synthetic IV and ciphertext of plaintext to dst, ad is
+// authenticated, nonce is the last component of it if used.
+func (s *siv) seal(dst, plaintext []byte, ad ...[]byte) []byte {
+	v := s.s2v(plaintext, ad)
+	n := len(dst)
+	dst = append(dst, v[:]...)
+	dst = append(dst, plaintext...)
+	s.xorCTR(dst[n+aes.BlockSize:], plaintext, v)
+	return dst
+}
+
+// open appends plaintext of ciphertext to dst if it's authentic
+func (s *siv) open(dst, ciphertext []byte, ad ...[]byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize {
+		return nil, errOpen
+	}
+	var v [aes.BlockSize]byte
+	copy(v[:], ciphertext)
+	n := len(dst)
+	dst = append(dst, ciphertext[aes.BlockSize:]...)
+	s.xorCTR(dst[n:], ciphertext[aes.BlockSize:], v)
+	t := s.s2v(dst[n:], ad)
+	if subtle.ConstantTimeCompare(t[:], v[:]) != 1 {
+		return nil, errOpen
+	}
+	return dst, nil
+}
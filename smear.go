@@ -0,0 +1,78 @@
+package gontpd
+
+import (
+	"time"
+)
+
+const defaultLeapSmearWindow = 24 * time.Hour
+
+// leapSmear spreads a leap second linearly over window centered at leap,
+// local clock is steered to smeared time instead of inserting or deleting
+// a second, so clients never see a 61 or 59 seconds minute.
+type leapSmear struct {
+	leap   time.Time
+	window time.Duration
+	// one second for insertion, minus one second for deletion
+	sign time.Duration
+}
+
+// nextLeap returns the UTC midnight after t, leap second announced
+// by leap indicator happens at the end of the day.
+func nextLeap(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+func newLeapSmear(leap uint8, now time.Time, window time.Duration) *leapSmear {
+	s := &leapSmear{leap: nextLeap(now), window: window, sign: time.Second}
+	if leap == leapDel {
+		s.sign = -time.Second
+	}
+	return s
+}
+
+func (s *leapSmear) start() time.Time {
+	return s.leap.Add(-s.window / 2)
+}
+
+func (s *leapSmear) end() time.Time {
+	return s.leap.Add(s.window / 2)
+}
+
+// correction returns the difference between smeared time and UTC at t.
+func (s *leapSmear) correction(t time.Time) (c time.Duration) {
+	switch {
+	case t.Before(s.start()):
+	case t.Before(s.end()):
+		c = -time.Duration(float64(s.sign) *
+			float64(t.Sub(s.start())) / float64(s.window))
+	default:
+		c = -s.sign
+	}
+	if !t.Before(s.leap) {
+		c += s.sign
+	}
+	return
+}
+
+// applySmear schedules a smear when peer announces a leap second,
+// and returns offset to smeared time. Leap is never passed to kernel.
+func (d *NTPd) applySmear(offset time.Duration, leap uint8, now time.Time) time.Duration {
+	if d.smear == nil && (leap == leapIns || leap == leapDel) {
+		d.smear = newLeapSmear(leap, now, d.config().LeapSmearWindow)
+		logger().Infof("leap second at %s, smear from %s to %s",
+			d.smear.leap.Format(time.RFC3339),
+			d.smear.start().Format(time.RFC3339),
+			d.smear.end().Format(time.RFC3339))
+	}
+	if d.smear == nil {
+		return offset
+	}
+
+	offset += d.smear.correction(now)
+	if !now.Before(d.smear.end()) {
+		logger().Infof("leap smear finished")
+		d.smear = nil
+	}
+	return offset
+}
@@ -0,0 +1,66 @@
+package gontpd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextLeap(t *testing.T) {
+	now := time.Date(2016, 12, 31, 13, 0, 0, 0, time.UTC)
+	if l := nextLeap(now); !l.Equal(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error(l)
+	}
+}
+
+func TestLeapSmearCorrection(t *testing.T) {
+	leap := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	ins := newLeapSmear(leapIns, leap.Add(-time.Hour), 24*time.Hour)
+	del := newLeapSmear(leapDel, leap.Add(-time.Hour), 24*time.Hour)
+
+	gold := []struct {
+		t        time.Duration
+		ins, del time.Duration
+	}{
+		{-13 * time.Hour, 0, 0},
+		{-12 * time.Hour, 0, 0},
+		{-6 * time.Hour, -250 * time.Millisecond, 250 * time.Millisecond},
+		// UTC steps back one second at leap
+		{-time.Nanosecond, -500 * time.Millisecond, 500 * time.Millisecond},
+		{0, 500 * time.Millisecond, -500 * time.Millisecond},
+		{6 * time.Hour, 250 * time.Millisecond, -250 * time.Millisecond},
+		{12 * time.Hour, 0, 0},
+		{13 * time.Hour, 0, 0},
+	}
+
+	for _, g := range gold {
+		at := leap.Add(g.t)
+		if c := ins.correction(at); absDuration(c-g.ins) > time.Microsecond {
+			t.Errorf("insert at %s expect %s got %s", g.t, g.ins, c)
+		}
+		if c := del.correction(at); absDuration(c-g.del) > time.Microsecond {
+			t.Errorf("delete at %s expect %s got %s", g.t, g.del, c)
+		}
+	}
+}
+
+func TestApplySmear(t *testing.T) {
+	d := newTestNTPd(&Config{LeapSmear: true})
+	leap := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if off := d.applySmear(time.Millisecond, noLeap, leap.Add(-6*time.Hour)); off != time.Millisecond {
+		t.Errorf("no leap announced, offset changed %s", off)
+	}
+	d.applySmear(0, leapIns, leap.Add(-6*time.Hour))
+	if d.smear == nil || !d.smear.leap.Equal(leap) {
+		t.Fatal("smear not scheduled")
+	}
+	// peer clears leap indicator after leap, smear goes on
+	d.applySmear(0, noLeap, leap.Add(time.Hour))
+	if d.smear == nil {
+		t.Fatal("smear stopped early")
+	}
+	d.applySmear(0, noLeap, leap.Add(12*time.Hour))
+	if d.smear != nil {
+		t.Error("smear not finished")
+	}
+}
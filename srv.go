@@ -0,0 +1,225 @@
+package gontpd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ntpPort is where peers are queried
+const ntpPort = 123
+
+// minSRVTTL is the shortest interval SRV records are resolved again,
+// however small their TTL is
+const minSRVTTL = 30 * time.Second
+
+// resolvConf is where nameserver for SRV query is found
+const resolvConf = "/etc/resolv.conf"
+
+// srvRecord is a target of SRV record
+type srvRecord struct {
+	target   string
+	port     uint16
+	priority uint16
+	weight   uint16
+	ttl      time.Duration
+}
+
+// isSRV reports if peer addr is SRV name of NTP service, such as
+// _ntp._udp.example.com
+func isSRV(addr string) bool {
+	return strings.HasPrefix(addr, "_") && strings.Contains(addr, "._udp.")
+}
+
+// lookupSRV returns SRV records of name, replaced in tests. Records are
+// queried from nameserver of resolvConf for their TTL, system resolver
+// is used without TTL if it fails.
+var lookupSRV = func(ctx context.Context, name string) (recs []srvRecord, err error) {
+	if server := systemNameserver(resolvConf); server != "" {
+		recs, err = querySRV(ctx, server, name)
+		if err == nil {
+			return
+		}
+		logger().Warnf("resolve: SRV %s from %s failed: %s", name, server, err)
+	}
+	_, addrs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	for _, a := range addrs {
+		recs = append(recs, srvRecord{target: a.Target, port: a.Port,
+			priority: a.Priority, weight: a.Weight})
+	}
+	return
+}
+
+// systemNameserver returns address of the first nameserver in file
+func systemNameserver(file string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return ""
+}
+
+// querySRV sends SRV query of name to server by UDP
+func querySRV(ctx context.Context, server, name string) (recs []srvRecord, err error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return
+	}
+	id := uint16(rand.Intn(1 << 16))
+	q, err := (&dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname,
+			Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err = conn.Write(q); err != nil {
+		return
+	}
+
+	buf := make([]byte, 512)
+	for {
+		var n int
+		n, err = conn.Read(buf)
+		if err != nil {
+			return
+		}
+		var p dnsmessage.Parser
+		h, perr := p.Start(buf[:n])
+		// not the reply of our query
+		if perr != nil || h.ID != id || !h.Response {
+			continue
+		}
+		return parseSRV(&p, h)
+	}
+}
+
+// parseSRV reads SRV records from answer section of reply
+func parseSRV(p *dnsmessage.Parser, h dnsmessage.Header) (recs []srvRecord, err error) {
+	switch {
+	case h.Truncated:
+		err = errors.New("reply truncated")
+		return
+	case h.RCode != dnsmessage.RCodeSuccess:
+		err = fmt.Errorf("rcode %s", h.RCode)
+		return
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return
+	}
+	for {
+		var ah dnsmessage.ResourceHeader
+		ah, err = p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+		if ah.Type != dnsmessage.TypeSRV {
+			if err = p.SkipAnswer(); err != nil {
+				return
+			}
+			continue
+		}
+		var r dnsmessage.SRVResource
+		if r, err = p.SRVResource(); err != nil {
+			return
+		}
+		recs = append(recs, srvRecord{
+			target:   r.Target.String(),
+			port:     r.Port,
+			priority: r.Priority,
+			weight:   r.Weight,
+			ttl:      time.Duration(ah.TTL) * time.Second,
+		})
+	}
+}
+
+// srvGroups groups records by priority from the lowest, records of a
+// group are sorted by weight from the highest. Target "." means no
+// service and is dropped, RFC 2782.
+func srvGroups(recs []srvRecord) (groups [][]srvRecord) {
+	sorted := make([]srvRecord, 0, len(recs))
+	for _, r := range recs {
+		if r.target != "." && r.target != "" {
+			sorted = append(sorted, r)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].priority != sorted[j].priority {
+			return sorted[i].priority < sorted[j].priority
+		}
+		return sorted[i].weight > sorted[j].weight
+	})
+	for i, r := range sorted {
+		if i == 0 || r.priority != sorted[i-1].priority {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], r)
+	}
+	return
+}
+
+// resolveSRV resolves targets of SRV name, only those of the lowest
+// priority are used unless none of them resolves. ttl is the minimum TTL
+// of records, 0 if unknown.
+func resolveSRV(ctx context.Context, name string) (ips []net.IP, ttl time.Duration) {
+	lctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	recs, err := lookupSRV(lctx, name)
+	cancel()
+	if err != nil {
+		logger().Warnf("resolve: SRV %s failed: %s", name, err)
+		return
+	}
+	for _, r := range recs {
+		if r.ttl > 0 && (ttl == 0 || r.ttl < ttl) {
+			ttl = r.ttl
+		}
+	}
+	for _, group := range srvGroups(recs) {
+		for _, r := range group {
+			if r.port != ntpPort {
+				logger().Warnf("resolve: SRV %s target %s port %d ignored, NTP port is used",
+					name, r.target, r.port)
+			}
+			ips = append(ips, resolveHost(ctx, r.target)...)
+		}
+		if len(ips) > 0 {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,158 @@
+package gontpd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestIsSRV(t *testing.T) {
+	for _, g := range []struct {
+		addr string
+		srv  bool
+	}{
+		{"_ntp._udp.example.com", true},
+		{"_ntp._tcp.example.com", false},
+		{"ntp.udp.example.com", false},
+		{"time1.apple.com", false},
+		{"192.0.2.1", false},
+	} {
+		if srv := isSRV(g.addr); srv != g.srv {
+			t.Errorf("isSRV(%s)=%v", g.addr, srv)
+		}
+	}
+}
+
+func TestSRVGroups(t *testing.T) {
+	recs := []srvRecord{
+		{target: "c.", priority: 20, weight: 1},
+		{target: "a.", priority: 10, weight: 1},
+		{target: ".", priority: 0},
+		{target: "b.", priority: 10, weight: 5},
+	}
+	var got [][]string
+	for _, g := range srvGroups(recs) {
+		var names []string
+		for _, r := range g {
+			names = append(names, r.target)
+		}
+		got = append(got, names)
+	}
+	if want := [][]string{{"b.", "a."}, {"c."}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("groups=%v, want %v", got, want)
+	}
+}
+
+// serveSRV answers one SRV query on conn with recs
+func serveSRV(t *testing.T, conn net.PacketConn, recs []dnsmessage.SRVResource, ttl uint32) {
+	buf := make([]byte, 512)
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var q dnsmessage.Message
+	if err := q.Unpack(buf[:n]); err != nil {
+		t.Error(err)
+		return
+	}
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: q.ID, Response: true},
+		Questions: q.Questions,
+	}
+	// reply of another query is ignored
+	stale := resp
+	stale.ID++
+	for _, r := range recs {
+		r := r
+		resp.Answers = append(resp.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name,
+				Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body: &r,
+		})
+	}
+	for _, m := range []dnsmessage.Message{stale, resp} {
+		p, err := m.Pack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.WriteTo(p, addr)
+	}
+}
+
+func TestQuerySRV(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	target := dnsmessage.MustNewName("ntp1.example.com.")
+	go serveSRV(t, conn, []dnsmessage.SRVResource{
+		{Priority: 10, Weight: 5, Port: 123, Target: target},
+	}, 300)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	recs, err := querySRV(ctx, conn.LocalAddr().String(), "_ntp._udp.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []srvRecord{{target: "ntp1.example.com.", port: 123,
+		priority: 10, weight: 5, ttl: 300 * time.Second}}
+	if !reflect.DeepEqual(recs, want) {
+		t.Errorf("records=%+v, want %+v", recs, want)
+	}
+}
+
+func TestResolveSRV(t *testing.T) {
+	oldSRV, oldIP, oldBackoff := lookupSRV, lookupIP, resolveBackoff
+	defer func() { lookupSRV, lookupIP, resolveBackoff = oldSRV, oldIP, oldBackoff }()
+	resolveBackoff = time.Millisecond
+
+	lookupSRV = func(ctx context.Context, name string) ([]srvRecord, error) {
+		return []srvRecord{
+			{target: "down.example.", port: 123, priority: 10, ttl: 10 * time.Minute},
+			{target: "backup.example.", port: 123, priority: 20, ttl: 5 * time.Minute},
+			{target: "spare.example.", port: 123, priority: 30, ttl: time.Hour},
+		}, nil
+	}
+	lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		switch host {
+		case "backup.example.":
+			return []net.IP{net.ParseIP("192.0.2.2")}, nil
+		case "spare.example.":
+			return []net.IP{net.ParseIP("192.0.2.3")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	// backup is used as the lowest priority target is down
+	pool, ttl := resolvePeers(context.Background(), []string{"_ntp._udp.example.com"})
+	ips := pool["_ntp._udp.example.com"]
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.2")) {
+		t.Errorf("ips=%v, want backup target", ips)
+	}
+	if ttl != 5*time.Minute {
+		t.Errorf("ttl=%s, want 5m", ttl)
+	}
+
+	d := newTestNTPd(&Config{PeerList: Peers("_ntp._udp.example.com")})
+	cfg := d.config()
+	d.refreshPeers(context.Background(), &cfg)
+	if peers := d.peers(); len(peers) != 1 || peers[0].origin != "_ntp._udp.example.com" {
+		t.Fatalf("peers=%v", peers)
+	}
+	if i := d.resolveInterval(time.Hour); i != 5*time.Minute {
+		t.Errorf("resolve interval %s, want ttl 5m", i)
+	}
+	d.srvTTL = time.Second
+	if i := d.resolveInterval(time.Hour); i != minSRVTTL {
+		t.Errorf("resolve interval %s, want %s", i, minSRVTTL)
+	}
+}
@@ -1,25 +1,62 @@
 package gontpd
 
 import (
-	"log"
 	"net/http"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rainycape/geoip"
 )
 
 type workerStat struct {
 	CCReq   *prometheus.CounterVec
+	KoD     *prometheus.CounterVec
 	Req     prometheus.Counter
 	ACL     prometheus.Counter
 	Rate    prometheus.Counter
 	Malform prometheus.Counter
 	Unknown prometheus.Counter
+	Auth    prometheus.Counter
+	// Unsync counts client requests refused by RefuseWhenUnsync
+	Unsync  prometheus.Counter
+	Control prometheus.Counter
+	Version prometheus.Counter
+	Panic   prometheus.Counter
+	// Restart counts restarts of worker after panic
+	Restart prometheus.Counter
 	GeoDB   *geoip.GeoIP
+
+	// DropCIDR counts requests dropped by CIDR of drop table, or "ban"
+	DropCIDR *prometheus.CounterVec
+	// Restrict counts requests matched by restrict rule
+	Restrict *prometheus.CounterVec
+	// Response counts responses to client by mode, basic or interleaved
+	Response *prometheus.CounterVec
+	// NTS counts NTS authenticated responses, NTSDrop counts requests
+	// failed NTS authentication
+	NTS     prometheus.Counter
+	NTSDrop prometheus.Counter
+
+	// Malformed counts malformed requests by kind
+	Malformed   *prometheus.CounterVec
+	HWTimestamp prometheus.Gauge
+	// SocketDrops is drop counter of socket, workers of the same
+	// socket report the same value
+	SocketDrops prometheus.Gauge
+	// Latency is time from receive of request to send of response
+	Latency prometheus.Histogram
+}
+
+// latencyBuckets are buckets of response latency in seconds, from 10µs
+// to 10ms
+var latencyBuckets = []float64{
+	10e-6, 25e-6, 50e-6, 100e-6, 250e-6, 500e-6,
+	1e-3, 2.5e-3, 5e-3, 10e-3,
 }
 
-func newWorkerStat(id string) (s *workerStat) {
+func newWorkerStat(reg prometheus.Registerer, id string) (s *workerStat) {
 
 	s = &workerStat{}
 	s.CCReq = prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -29,7 +66,16 @@ func newWorkerStat(id string) (s *workerStat) {
 		Help:        "The total number of ntp request",
 		ConstLabels: prometheus.Labels{"id": id},
 	}, []string{"cc"})
-	prometheus.MustRegister(s.CCReq)
+	reg.MustRegister(s.CCReq)
+
+	s.KoD = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   "ntp",
+		Subsystem:   "requests",
+		Name:        "kod",
+		Help:        "The total number of Kiss-o'-Death response sent",
+		ConstLabels: prometheus.Labels{"id": id},
+	}, []string{"reason"})
+	reg.MustRegister(s.KoD)
 
 	s.Req = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace:   "ntp",
@@ -38,7 +84,7 @@ func newWorkerStat(id string) (s *workerStat) {
 		Help:        "The total number of ntp request",
 		ConstLabels: prometheus.Labels{"id": id},
 	})
-	prometheus.MustRegister(s.Req)
+	reg.MustRegister(s.Req)
 
 	s.ACL = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace:   "ntp",
@@ -47,7 +93,7 @@ func newWorkerStat(id string) (s *workerStat) {
 		Help:        "The total dropped ntp request",
 		ConstLabels: prometheus.Labels{"id": id, "reason": "acl"},
 	})
-	prometheus.MustRegister(s.ACL)
+	reg.MustRegister(s.ACL)
 
 	s.Rate = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace:   "ntp",
@@ -56,7 +102,7 @@ func newWorkerStat(id string) (s *workerStat) {
 		Help:        "The total dropped ntp request",
 		ConstLabels: prometheus.Labels{"id": id, "reason": "rate"},
 	})
-	prometheus.MustRegister(s.Rate)
+	reg.MustRegister(s.Rate)
 
 	s.Malform = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace:   "ntp",
@@ -65,7 +111,16 @@ func newWorkerStat(id string) (s *workerStat) {
 		Help:        "The total dropped ntp request",
 		ConstLabels: prometheus.Labels{"id": id, "reason": "malform"},
 	})
-	prometheus.MustRegister(s.Malform)
+	reg.MustRegister(s.Malform)
+
+	s.Malformed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   "ntp",
+		Subsystem:   "requests",
+		Name:        "malformed",
+		Help:        "The total number of malformed ntp request",
+		ConstLabels: prometheus.Labels{"id": id},
+	}, []string{"kind"})
+	reg.MustRegister(s.Malformed)
 
 	s.Unknown = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace:   "ntp",
@@ -74,19 +129,206 @@ func newWorkerStat(id string) (s *workerStat) {
 		Help:        "The total dropped ntp request",
 		ConstLabels: prometheus.Labels{"id": id, "reason": "unknown_method"},
 	})
-	prometheus.MustRegister(s.Unknown)
+	reg.MustRegister(s.Unknown)
+
+	s.Auth = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   "ntp",
+		Subsystem:   "requests",
+		Name:        "drop",
+		Help:        "The total dropped ntp request",
+		ConstLabels: prometheus.Labels{"id": id, "reason": "auth"},
+	})
+	reg.MustRegister(s.Auth)
+
+	s.Unsync = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   "ntp",
+		Subsystem:   "requests",
+		Name:        "refused_unsync",
+		Help:        "The total number of ntp request refused while unsynchronized",
+		ConstLabels: prometheus.Labels{"id": id},
+	})
+	reg.MustRegister(s.Unsync)
+
+	s.Version = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   "ntp",
+		Subsystem:   "requests",
+		Name:        "drop",
+		Help:        "The total dropped ntp request",
+		ConstLabels: prometheus.Labels{"id": id, "reason": "version"},
+	})
+	reg.MustRegister(s.Version)
+
+	s.Panic = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   "ntp",
+		Subsystem:   "requests",
+		Name:        "drop",
+		Help:        "The total dropped ntp request",
+		ConstLabels: prometheus.Labels{"id": id, "reason": "panic"},
+	})
+	reg.MustRegister(s.Panic)
+
+	s.Restart = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   "ntp",
+		Subsystem:   "requests",
+		Name:        "restarts",
+		Help:        "The total number of listener restarts after panic",
+		ConstLabels: prometheus.Labels{"id": id},
+	})
+	reg.MustRegister(s.Restart)
+
+	s.Control = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   "ntp",
+		Subsystem:   "requests",
+		Name:        "control",
+		Help:        "The total number of mode 6 control response sent",
+		ConstLabels: prometheus.Labels{"id": id},
+	})
+	reg.MustRegister(s.Control)
+
+	s.DropCIDR = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   "ntp",
+		Subsystem:   "requests",
+		Name:        "drop_cidr",
+		Help:        "The total dropped ntp request by CIDR of drop table",
+		ConstLabels: prometheus.Labels{"id": id},
+	}, []string{"cidr"})
+	reg.MustRegister(s.DropCIDR)
+
+	s.Restrict = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   "ntp",
+		Subsystem:   "requests",
+		Name:        "restrict",
+		Help:        "The total number of ntp request matched by restrict rule",
+		ConstLabels: prometheus.Labels{"id": id},
+	}, []string{"rule", "action"})
+	reg.MustRegister(s.Restrict)
+
+	s.Response = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   "ntp",
+		Subsystem:   "requests",
+		Name:        "responses",
+		Help:        "The total number of response to client by basic or interleaved mode",
+		ConstLabels: prometheus.Labels{"id": id},
+	}, []string{"mode"})
+	reg.MustRegister(s.Response)
+
+	s.NTS = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   "ntp",
+		Subsystem:   "requests",
+		Name:        "nts",
+		Help:        "The total number of NTS authenticated response sent",
+		ConstLabels: prometheus.Labels{"id": id},
+	})
+	reg.MustRegister(s.NTS)
+
+	s.NTSDrop = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   "ntp",
+		Subsystem:   "requests",
+		Name:        "drop",
+		Help:        "The total dropped ntp request",
+		ConstLabels: prometheus.Labels{"id": id, "reason": "nts"},
+	})
+	reg.MustRegister(s.NTSDrop)
+
+	s.HWTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   "ntp",
+		Subsystem:   "requests",
+		Name:        "hw_timestamp",
+		Help:        "Whether last request is timestamped by NIC",
+		ConstLabels: prometheus.Labels{"id": id},
+	})
+	reg.MustRegister(s.HWTimestamp)
+
+	s.SocketDrops = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   "ntp",
+		Subsystem:   "requests",
+		Name:        "socket_drops",
+		Help:        "The total number of requests dropped by socket receive buffer",
+		ConstLabels: prometheus.Labels{"id": id},
+	})
+	reg.MustRegister(s.SocketDrops)
+
+	s.Latency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace:   "ntp",
+		Subsystem:   "requests",
+		Name:        "latency_sec",
+		Help:        "The time from receive of request to send of response",
+		ConstLabels: prometheus.Labels{"id": id},
+		Buckets:     latencyBuckets,
+	})
+	reg.MustRegister(s.Latency)
 	return
 }
 
 type ntpStat struct {
-	offsetGauge prometheus.Gauge
-	dispGauge   prometheus.Gauge
-	delayGauge  prometheus.Gauge
-	pollGauge   prometheus.Gauge
-	driftGauge  prometheus.Gauge
+	reg *prometheus.Registry
+	// mux serves /metrics at Metric, nil if metrics are only pushed
+	mux *http.ServeMux
+
+	offsetGauge    prometheus.Gauge
+	dispGauge      prometheus.Gauge
+	delayGauge     prometheus.Gauge
+	pollGauge      prometheus.Gauge
+	driftGauge     prometheus.Gauge
+	loopFreqGauge  prometheus.Gauge
+	loopStateGauge *prometheus.GaugeVec
+	orphanGauge    prometheus.Gauge
+	holdoverGauge  *prometheus.GaugeVec
+	syncGauge      prometheus.Gauge
+	stepCounter    prometheus.Counter
+	slewCounter    prometheus.Counter
+	selectCounter  prometheus.Counter
+
+	stepDirCounter *prometheus.CounterVec
+	lastStepGauge  prometheus.Gauge
+	lastPollGauge  prometheus.Gauge
+	nextPollGauge  prometheus.Gauge
+
+	rejectCounter    prometheus.Counter
+	broadcastCounter prometheus.Counter
+	ntsKECounter     *prometheus.CounterVec
+	requestCounter   prometheus.Counter
+	responseCounter  prometheus.Counter
+
+	peerStateGauge   *prometheus.GaugeVec
+	peerOffsetGauge  *prometheus.GaugeVec
+	peerDelayGauge   *prometheus.GaugeVec
+	peerDispGauge    *prometheus.GaugeVec
+	peerFilterGauge  *prometheus.GaugeVec
+	peerJitterGauge  *prometheus.GaugeVec
+	peerDistGauge    *prometheus.GaugeVec
+	peerStratumGauge *prometheus.GaugeVec
+	peerReachGauge   *prometheus.GaugeVec
+	peerFailureGauge *prometheus.GaugeVec
+	peerPollCounter  *prometheus.CounterVec
+	peerFailCounter  *prometheus.CounterVec
+	peerNoisyCounter *prometheus.CounterVec
+	minStratumGauge  prometheus.Gauge
+
+	refclockOffsetGauge *prometheus.GaugeVec
+	refclockJitterGauge *prometheus.GaugeVec
+	ppsJitterGauge      prometheus.Gauge
+	ppsCounter          prometheus.Counter
 }
 
+// newNTPStat registers metrics on a registry of its own, so gontpd can
+// be embedded in binaries which use the default one.
 func newNTPStat(listen string) *ntpStat {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewBuildInfoCollector(),
+	)
+
+	buildInfo := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   "ntp",
+		Name:        "build_info",
+		Help:        "Always 1, labeled by version and commit of gontpd",
+		ConstLabels: prometheus.Labels{"version": Version, "commit": commit()},
+	})
+	buildInfo.Set(1)
+	reg.MustRegister(buildInfo)
 
 	offsetGauge := prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "ntp",
@@ -94,7 +336,7 @@ func newNTPStat(listen string) *ntpStat {
 		Name:      "offset_sec",
 		Help:      "The offset to upper peer",
 	})
-	prometheus.MustRegister(offsetGauge)
+	reg.MustRegister(offsetGauge)
 
 	dispGauge := prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "ntp",
@@ -102,7 +344,7 @@ func newNTPStat(listen string) *ntpStat {
 		Name:      "dispersion_sec",
 		Help:      "The dispersion of service",
 	})
-	prometheus.MustRegister(dispGauge)
+	reg.MustRegister(dispGauge)
 
 	delayGauge := prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "ntp",
@@ -110,7 +352,7 @@ func newNTPStat(listen string) *ntpStat {
 		Name:      "delay_sec",
 		Help:      "The root delay of service",
 	})
-	prometheus.MustRegister(delayGauge)
+	reg.MustRegister(delayGauge)
 
 	pollGauge := prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "ntp",
@@ -118,16 +360,413 @@ func newNTPStat(listen string) *ntpStat {
 		Name:      "poll_interval_sec",
 		Help:      "The poll interval of ntp",
 	})
-	prometheus.MustRegister(pollGauge)
+	reg.MustRegister(pollGauge)
+
+	driftGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ntp",
+		Subsystem: "stat",
+		Name:      "drift_ppm",
+		Help:      "The frequency correction of local clock",
+	})
+	reg.MustRegister(driftGauge)
 
-	http.Handle("/metrics", promhttp.Handler())
-	log.Printf("Listen metric: %s", listen)
-	go http.ListenAndServe(listen, nil)
+	loopFreqGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ntp",
+		Subsystem: "stat",
+		Name:      "loop_frequency_ppm",
+		Help:      "The frequency estimate of local clock by discipline loop",
+	})
+	reg.MustRegister(loopFreqGauge)
+
+	loopStateGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ntp",
+		Subsystem: "stat",
+		Name:      "loop_state",
+		Help:      "The state of discipline loop",
+	}, []string{"state"})
+	reg.MustRegister(loopStateGauge)
+
+	orphanGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ntp",
+		Subsystem: "stat",
+		Name:      "orphan",
+		Help:      "Whether serving local clock in orphan mode",
+	})
+	reg.MustRegister(orphanGauge)
+
+	holdoverGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ntp",
+		Subsystem: "stat",
+		Name:      "holdover_state",
+		Help:      "The state of serving after peers lost",
+	}, []string{"state"})
+	reg.MustRegister(holdoverGauge)
+
+	syncGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ntpd",
+		Name:      "synchronized",
+		Help:      "Whether clock is synchronized by last poll",
+	})
+	reg.MustRegister(syncGauge)
+
+	stepCounter := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   "ntp",
+		Subsystem:   "stat",
+		Name:        "clock_adjust_total",
+		Help:        "The total number of clock adjustment",
+		ConstLabels: prometheus.Labels{"type": "step"},
+	})
+	reg.MustRegister(stepCounter)
+
+	stepDirCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ntpd",
+		Name:      "clock_steps_total",
+		Help:      "The total number of clock steps by direction",
+	}, []string{"direction"})
+	reg.MustRegister(stepDirCounter)
+
+	lastStepGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ntpd",
+		Name:      "clock_last_step_seconds",
+		Help:      "Offset of the last clock step, negative is backward",
+	})
+	reg.MustRegister(lastStepGauge)
+
+	lastPollGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ntpd",
+		Name:      "last_poll_timestamp_seconds",
+		Help:      "Unix time of the end of the last poll of peers",
+	})
+	reg.MustRegister(lastPollGauge)
+
+	nextPollGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ntpd",
+		Name:      "next_poll_timestamp_seconds",
+		Help:      "Unix time the next poll of peers is scheduled at",
+	})
+	reg.MustRegister(nextPollGauge)
+
+	selectCounter := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ntp",
+		Subsystem: "stat",
+		Name:      "selected_peer_changes_total",
+		Help:      "The total number of changes of selected peer",
+	})
+	reg.MustRegister(selectCounter)
+
+	slewCounter := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   "ntp",
+		Subsystem:   "stat",
+		Name:        "clock_adjust_total",
+		Help:        "The total number of clock adjustment",
+		ConstLabels: prometheus.Labels{"type": "slew"},
+	})
+	reg.MustRegister(slewCounter)
+
+	rejectCounter := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ntp",
+		Subsystem: "stat",
+		Name:      "offset_rejected_total",
+		Help:      "The total number of offset refused by panic threshold",
+	})
+	reg.MustRegister(rejectCounter)
+
+	broadcastCounter := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ntp",
+		Subsystem: "stat",
+		Name:      "broadcast_total",
+		Help:      "The total number of broadcast packet sent",
+	})
+	reg.MustRegister(broadcastCounter)
+
+	requestCounter := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ntp",
+		Subsystem: "stat",
+		Name:      "requests_total",
+		Help:      "The total number of request passed access, rate and version checks",
+	})
+	reg.MustRegister(requestCounter)
+
+	responseCounter := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ntp",
+		Subsystem: "stat",
+		Name:      "responses_total",
+		Help:      "The total number of response sent",
+	})
+	reg.MustRegister(responseCounter)
+
+	ntsKECounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ntp",
+		Subsystem: "stat",
+		Name:      "nts_ke_total",
+		Help:      "The total number of NTS-KE session by result",
+	}, []string{"result"})
+	reg.MustRegister(ntsKECounter)
+
+	peerStateGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ntp",
+		Subsystem: "peer",
+		Name:      "state",
+		Help:      "The classification of peer in selection",
+	}, []string{"peer", "state"})
+	reg.MustRegister(peerStateGauge)
+
+	peerOffsetGauge := newPeerGauge(reg, "offset_sec", "The offset of peer by last poll")
+	peerDelayGauge := newPeerGauge(reg, "delay_sec", "The round trip delay of peer by last poll")
+	peerDispGauge := newPeerGauge(reg, "dispersion_sec", "The root dispersion of peer by last poll")
+	peerFilterGauge := newPeerGauge(reg, "filter_dispersion_sec", "The dispersion of clock filter of peer")
+	peerJitterGauge := newPeerGauge(reg, "jitter_sec", "The jitter of peer by last poll")
+	peerDistGauge := newPeerGauge(reg, "root_distance_sec", "The root distance of peer by last poll")
+	peerStratumGauge := newPeerGauge(reg, "stratum", "The stratum of peer")
+	peerReachGauge := newPeerGauge(reg, "reach", "The reach register of peer")
+	peerFailureGauge := newPeerGauge(reg, "consecutive_failures", "The consecutive polls of peer without reply")
+
+	peerPollCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ntp",
+		Subsystem: "peer",
+		Name:      "poll_total",
+		Help:      "The total number of poll to peer",
+	}, []string{"peer"})
+	reg.MustRegister(peerPollCounter)
+
+	peerFailCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ntp",
+		Subsystem: "peer",
+		Name:      "poll_failed_total",
+		Help:      "The total number of poll to peer ends up not good",
+	}, []string{"peer"})
+	reg.MustRegister(peerFailCounter)
+
+	peerNoisyCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ntp",
+		Subsystem: "peer",
+		Name:      "poll_noisy_total",
+		Help:      "The total number of poll to peer with samples dropped by max_std",
+	}, []string{"peer"})
+	reg.MustRegister(peerNoisyCounter)
+
+	minStratumGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ntp",
+		Subsystem: "stat",
+		Name:      "min_peer_stratum",
+		Help:      "The best stratum of reachable peers, 16 if there is none",
+	})
+	reg.MustRegister(minStratumGauge)
+
+	refclockOffsetGauge := newRefclockGauge(reg, "offset_sec", "The offset of refclock by last poll")
+	refclockJitterGauge := newRefclockGauge(reg, "jitter_sec", "The jitter of refclock by last poll")
+
+	ppsJitterGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ntp",
+		Subsystem: "pps",
+		Name:      "jitter_sec",
+		Help:      "The jitter of PPS by last poll",
+	})
+	reg.MustRegister(ppsJitterGauge)
+
+	ppsCounter := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ntp",
+		Subsystem: "pps",
+		Name:      "pulses_total",
+		Help:      "The total number of pulse read from PPS device",
+	})
+	reg.MustRegister(ppsCounter)
+
+	// metrics may only be pushed to PushGateway, handlers of the default
+	// mux of the host binary are never served
+	var mux *http.ServeMux
+	if listen != "" {
+		mux = http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+		logger().Infof("Listen metric: %s", listen)
+		srv := &http.Server{Addr: listen, Handler: mux}
+		go srv.ListenAndServe()
+	}
 
 	return &ntpStat{
-		offsetGauge: offsetGauge,
-		dispGauge:   dispGauge,
-		delayGauge:  delayGauge,
-		pollGauge:   pollGauge,
+		reg: reg,
+		mux: mux,
+
+		offsetGauge:    offsetGauge,
+		dispGauge:      dispGauge,
+		delayGauge:     delayGauge,
+		pollGauge:      pollGauge,
+		driftGauge:     driftGauge,
+		loopFreqGauge:  loopFreqGauge,
+		loopStateGauge: loopStateGauge,
+		orphanGauge:    orphanGauge,
+		holdoverGauge:  holdoverGauge,
+		syncGauge:      syncGauge,
+		stepCounter:    stepCounter,
+		slewCounter:    slewCounter,
+		selectCounter:  selectCounter,
+
+		stepDirCounter: stepDirCounter,
+		lastStepGauge:  lastStepGauge,
+		lastPollGauge:  lastPollGauge,
+		nextPollGauge:  nextPollGauge,
+
+		rejectCounter:    rejectCounter,
+		broadcastCounter: broadcastCounter,
+		ntsKECounter:     ntsKECounter,
+		requestCounter:   requestCounter,
+		responseCounter:  responseCounter,
+
+		peerStateGauge:   peerStateGauge,
+		peerOffsetGauge:  peerOffsetGauge,
+		peerDelayGauge:   peerDelayGauge,
+		peerDispGauge:    peerDispGauge,
+		peerFilterGauge:  peerFilterGauge,
+		peerJitterGauge:  peerJitterGauge,
+		peerDistGauge:    peerDistGauge,
+		peerStratumGauge: peerStratumGauge,
+		peerReachGauge:   peerReachGauge,
+		peerFailureGauge: peerFailureGauge,
+		peerPollCounter:  peerPollCounter,
+		peerFailCounter:  peerFailCounter,
+		peerNoisyCounter: peerNoisyCounter,
+		minStratumGauge:  minStratumGauge,
+
+		refclockOffsetGauge: refclockOffsetGauge,
+		refclockJitterGauge: refclockJitterGauge,
+		ppsJitterGauge:      ppsJitterGauge,
+		ppsCounter:          ppsCounter,
+	}
+}
+
+// unixSeconds is t as Unix time in seconds, for timestamp gauges
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+func newPeerGauge(reg prometheus.Registerer, name, help string) *prometheus.GaugeVec {
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ntp",
+		Subsystem: "peer",
+		Name:      name,
+		Help:      help,
+	}, []string{"peer"})
+	reg.MustRegister(g)
+	return g
+}
+
+func newRefclockGauge(reg prometheus.Registerer, name, help string) *prometheus.GaugeVec {
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ntp",
+		Subsystem: "refclock",
+		Name:      name,
+		Help:      help,
+	}, []string{"refclock"})
+	reg.MustRegister(g)
+	return g
+}
+
+// setLeapFunc exports seconds until next leap second by fn
+func (s *ntpStat) setLeapFunc(fn func() float64) {
+	s.reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "ntp",
+		Subsystem: "stat",
+		Name:      "next_leap_sec",
+		Help:      "Seconds until next leap second in leap file, -1 if none",
+	}, fn))
+}
+
+// setBanFunc exports number of temporary bans by fn
+func (s *ntpStat) setBanFunc(fn func() float64) {
+	s.reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "ntp",
+		Subsystem: "stat",
+		Name:      "bans",
+		Help:      "The number of temporarily banned addresses",
+	}, fn))
+}
+
+// setClientFunc exports estimated number of unique clients by fn
+func (s *ntpStat) setClientFunc(fn func() float64) {
+	s.reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "ntp",
+		Subsystem: "stat",
+		Name:      "clients",
+		Help:      "The estimated number of unique clients in last 1-2 hours",
+	}, fn))
+}
+
+// setPeer updates metrics of peer after poll, polled is false if
+// peer is disabled and not polled.
+func (s *ntpStat) setPeer(p *peer, polled bool) {
+	addr := p.addr.String()
+	if polled {
+		s.peerPollCounter.WithLabelValues(addr).Inc()
+		if !p.good {
+			s.peerFailCounter.WithLabelValues(addr).Inc()
+		}
+		if p.noisy {
+			s.peerNoisyCounter.WithLabelValues(addr).Inc()
+		}
+	}
+
+	s.peerReachGauge.WithLabelValues(addr).Set(float64(p.reach))
+	s.peerFailureGauge.WithLabelValues(addr).Set(float64(p.failures))
+	s.peerStratumGauge.WithLabelValues(addr).Set(float64(p.stratum))
+	s.peerOffsetGauge.WithLabelValues(addr).Set(p.offset.Seconds())
+	s.peerDelayGauge.WithLabelValues(addr).Set(p.delay.Seconds())
+	s.peerDispGauge.WithLabelValues(addr).Set(p.disp.Seconds())
+	s.peerFilterGauge.WithLabelValues(addr).Set(p.filterDisp.Seconds())
+	s.peerJitterGauge.WithLabelValues(addr).Set(p.jitter.Seconds())
+	s.peerDistGauge.WithLabelValues(addr).Set(p.rootDist().Seconds())
+	if p.refclock != nil && p.good {
+		s.refclockOffsetGauge.WithLabelValues(p.origin).Set(p.offset.Seconds())
+		s.refclockJitterGauge.WithLabelValues(p.origin).Set(p.jitter.Seconds())
+		if p.refclock.pps {
+			s.ppsJitterGauge.Set(p.jitter.Seconds())
+		}
+	}
+}
+
+// deletePeer removes all series of peer
+func (s *ntpStat) deletePeer(p *peer) {
+	addr := p.addr.String()
+	for _, state := range peerStates {
+		s.peerStateGauge.DeleteLabelValues(addr, state)
+	}
+	for _, g := range []*prometheus.GaugeVec{s.peerOffsetGauge, s.peerDelayGauge,
+		s.peerDispGauge, s.peerFilterGauge, s.peerJitterGauge, s.peerDistGauge,
+		s.peerStratumGauge, s.peerReachGauge, s.peerFailureGauge} {
+		g.DeleteLabelValues(addr)
+	}
+	s.peerPollCounter.DeleteLabelValues(addr)
+	s.peerFailCounter.DeleteLabelValues(addr)
+	s.peerNoisyCounter.DeleteLabelValues(addr)
+}
+
+func (s *ntpStat) setLoop(l *clockLoop) {
+	s.loopFreqGauge.Set(l.freq)
+	for i, state := range loopStates {
+		v := 0.0
+		if uint8(i) == l.state {
+			v = 1
+		}
+		s.loopStateGauge.WithLabelValues(state).Set(v)
+	}
+}
+
+func (s *ntpStat) setHoldover(state uint8) {
+	for i, name := range holdoverStates {
+		v := 0.0
+		if uint8(i) == state {
+			v = 1
+		}
+		s.holdoverGauge.WithLabelValues(name).Set(v)
+	}
+}
+
+func (s *ntpStat) setPeerState(p *peer) {
+	addr := p.addr.String()
+	for _, state := range peerStates {
+		v := 0.0
+		if state == p.state {
+			v = 1
+		}
+		s.peerStateGauge.WithLabelValues(addr, state).Set(v)
 	}
 }
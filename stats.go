@@ -0,0 +1,219 @@
+package gontpd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Stats is a snapshot of daemon state, durations are in nanoseconds
+// when encoded as JSON.
+type Stats struct {
+	// Synced is false until the clock is disciplined for the first time,
+	// Ready is false if last poll failed to sync, see NTPd.Ready
+	Synced bool `json:"synced"`
+	Ready  bool `json:"ready"`
+	// LastSync is time of last clock adjustment
+	LastSync time.Time `json:"last_sync"`
+	// Updates is clock adjustments since start, Steps is those stepped
+	Updates int `json:"updates"`
+	Steps   int `json:"steps"`
+	// RootDelay, RootDispersion, Stratum and RefID are served to clients
+	RootDelay      time.Duration `json:"root_delay"`
+	RootDispersion time.Duration `json:"root_dispersion"`
+	Stratum        uint8         `json:"stratum"`
+	RefID          string        `json:"ref_id"`
+	// Median is the sample selected by last sync, nil before first sync
+	Median *PeerStats  `json:"median"`
+	Peers  []PeerStats `json:"peers"`
+}
+
+// SyncEvent is a clock adjustment passed to Config.OnSync
+type SyncEvent struct {
+	Time time.Time
+	// Offset is corrected by stepping clock if Stepped, otherwise by
+	// slewing. Clock isn't touched if DryRun.
+	Offset  time.Duration
+	Stepped bool
+	DryRun  bool
+	// Leap is leap indicator passed to kernel, 1 to insert and 2 to
+	// delete a second at the end of UTC day
+	Leap uint8
+	// Peer is the selected sample, as Stats.Median
+	Peer PeerStats
+}
+
+// PeerStats is the state of a peer, Offset, Delay and Dispersion (root
+// dispersion) are taken from the sample with minimum round trip in clock
+// filter, FilterDispersion and Jitter are computed from all samples of it.
+type PeerStats struct {
+	Origin           string        `json:"origin"`
+	Addr             string        `json:"addr"`
+	Stratum          uint8         `json:"stratum"`
+	RefID            string        `json:"ref_id"`
+	Offset           time.Duration `json:"offset"`
+	Delay            time.Duration `json:"delay"`
+	Dispersion       time.Duration `json:"dispersion"`
+	FilterDispersion time.Duration `json:"filter_dispersion"`
+	Jitter           time.Duration `json:"jitter"`
+	Reach            uint8         `json:"reach"`
+	Poll             time.Duration `json:"poll"`
+	Failures         int           `json:"failures"`
+	TrustLevel       uint8         `json:"trust_level"`
+	Good             bool          `json:"good"`
+	State            string        `json:"state"`
+}
+
+func newPeerStats(p *peer) (ps PeerStats) {
+	ps = PeerStats{
+		Origin:           p.origin,
+		Addr:             p.addr.String(),
+		Stratum:          p.stratum,
+		Offset:           p.offset,
+		Delay:            p.delay,
+		Dispersion:       p.disp,
+		FilterDispersion: p.filterDisp,
+		Jitter:           p.jitter,
+		Reach:            p.reach,
+		Failures:         p.failures,
+		TrustLevel:       p.trustLevel,
+		Good:             p.good,
+		State:            p.state,
+	}
+	if p.sample != nil {
+		ps.RefID = formatRefID(p.stratum, p.sample.ReferenceID)
+	}
+	return
+}
+
+// Stats returns a snapshot of peers as of last poll and current selected
+// median.
+func (d *NTPd) Stats() (s Stats) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	s.Synced = d.synced
+	s.Ready = d.synced && d.healthy
+	s.LastSync = d.lastSync
+	s.Updates, s.Steps = d.updates, d.steps
+	s.RootDelay, s.RootDispersion = d.delay, d.disp
+	if t := d.loadTemplate(); t != nil {
+		s.Stratum = t[stratumPos]
+		s.RefID = servedRefID(s.Stratum, binary.BigEndian.Uint32(t[referIDPos:]), d.cfg.RefID)
+	}
+	s.Peers = make([]PeerStats, 0, len(d.peerList))
+	for _, p := range d.peerList {
+		s.Peers = append(s.Peers, p.stats)
+	}
+
+	if d.median != nil {
+		ps := medianStats(d.median)
+		s.Median = &ps
+	}
+	return
+}
+
+// medianStats returns published stats of peer of op with the selected
+// sample, mu of NTPd must be held.
+func medianStats(op *offsetPeer) PeerStats {
+	ps := op.peer.stats
+	ps.Stratum = op.resp.Stratum
+	ps.Offset = op.resp.ClockOffset
+	ps.Delay = op.resp.RTT
+	ps.Dispersion = op.resp.RootDispersion
+	return ps
+}
+
+// tally codes of WritePeers by peer state, selected peer is '*'
+var peerTally = map[string]byte{
+	stateSurvivor:    '+',
+	stateFalseticker: 'x',
+	stateNoSelect:    '-',
+	stateSelf:        '!',
+}
+
+// WritePeers writes peers of s as a table like `ntpq -pn`: tally code,
+// remote, refid, stratum, poll (s), reach (octal), delay, offset and
+// jitter (ms). Fields are separated by spaces and never empty, the
+// tally code is one of '*' (selected), '+' (survivor), 'x'
+// (falseticker), '-' (noselect), '!' (self) and ' ' (unreachable).
+func (s Stats) WritePeers(w io.Writer) (err error) {
+	_, err = fmt.Fprintf(w, "%-40s %-15s %2s %5s %5s %9s %9s %9s\n",
+		" remote", "refid", "st", "poll", "reach", "delay", "offset", "jitter")
+	if err != nil {
+		return
+	}
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	for _, p := range s.Peers {
+		tally, ok := peerTally[p.State]
+		if !ok {
+			tally = ' '
+		}
+		if s.Median != nil && s.Median.Addr == p.Addr {
+			tally = '*'
+		}
+		refID := p.RefID
+		if refID == "" {
+			refID = "-"
+		}
+		_, err = fmt.Fprintf(w, "%c%-39s %-15s %2d %5d %5o %9.3f %9.3f %9.3f\n",
+			tally, p.Addr, refID, p.Stratum, int64(p.Poll/time.Second), p.Reach,
+			ms(p.Delay), ms(p.Offset), ms(p.Jitter))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (d *NTPd) serveStatsJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(d.Stats())
+	if err != nil && debug {
+		logger().Errorf("stats encode failed: %s", err)
+	}
+}
+
+// serveReady responds 200 only if d is Ready, for readiness probe
+func (d *NTPd) serveReady(w http.ResponseWriter, r *http.Request) {
+	if !d.Ready() {
+		http.Error(w, "not synchronized", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+var publishOnce sync.Once
+
+// serveStats serves JSON snapshot on /stats, expvar on /debug/vars and
+// readiness on /ready, it shares the server with metric if they listen
+// on the same address.
+func (d *NTPd) serveStats(addr string) {
+	publishOnce.Do(func() {
+		expvar.Publish("gontpd", expvar.Func(func() interface{} {
+			return d.Stats()
+		}))
+	})
+
+	if d.stat != nil && d.stat.mux != nil && addr == d.cfg.Metric {
+		d.handleStats(d.stat.mux)
+		return
+	}
+
+	mux := http.NewServeMux()
+	d.handleStats(mux)
+	logger().Infof("Listen stat: %s", addr)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go srv.ListenAndServe()
+}
+
+// handleStats adds handlers of serveStats to mux
+func (d *NTPd) handleStats(mux *http.ServeMux) {
+	mux.HandleFunc("/stats", d.serveStatsJSON)
+	mux.HandleFunc("/ready", d.serveReady)
+	mux.Handle("/debug/vars", expvar.Handler())
+}
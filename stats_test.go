@@ -0,0 +1,195 @@
+package gontpd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	ms := time.Millisecond
+	d := newTestNTPd(&Config{},
+		newTestPeer("192.0.2.1", 0, 5*ms),
+		newTestPeer("192.0.2.2", ms, 5*ms),
+		newTestPeer("192.0.2.3", 2*ms, 5*ms))
+
+	s := d.Stats()
+	if s.Median != nil || len(s.Peers) != 3 {
+		t.Fatalf("before sync: %+v", s)
+	}
+
+	op := d.find()
+	if op == nil {
+		t.Fatal("no median")
+	}
+	d.setTemplate(op)
+	d.updateState(op)
+
+	s = d.Stats()
+	if !s.Synced || !s.Ready || s.LastSync.IsZero() ||
+		s.RootDelay != rootDelay(op) || s.RootDispersion != rootDispersion(op, d.precision) {
+		t.Errorf("after sync: %+v", s)
+	}
+	if s.Median == nil || s.Median.Addr != op.peer.addr.String() ||
+		s.Median.Offset != op.resp.ClockOffset {
+		t.Fatalf("median=%+v expect %s", s.Median, op.peer.addr)
+	}
+	for _, p := range s.Peers {
+		if p.State != stateSurvivor || !p.Good {
+			t.Errorf("peer %+v should be good survivor", p)
+		}
+	}
+}
+
+func TestServeStatsJSON(t *testing.T) {
+	d := newTestNTPd(&Config{}, newTestPeer("192.0.2.1", time.Millisecond, 0))
+	rec := httptest.NewRecorder()
+	d.serveStatsJSON(rec, httptest.NewRequest("GET", "/stats", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("content type %q", ct)
+	}
+	var s Stats
+	if err := json.NewDecoder(rec.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Peers) != 1 || s.Peers[0].Addr != "192.0.2.1" {
+		t.Errorf("bad stats %+v", s)
+	}
+}
+
+func TestMetricMux(t *testing.T) {
+	addr := "127.0.0.1:0"
+	d := newTestNTPd(&Config{Metric: addr, StatAddr: addr})
+	d.stat = newNTPStat(addr)
+	// another instance in the same binary
+	newNTPStat(addr)
+	d.serveStats(addr)
+
+	for _, path := range []string{"/metrics", "/stats", "/ready", "/debug/vars"} {
+		req := httptest.NewRequest("GET", path, nil)
+		if _, pattern := d.stat.mux.Handler(req); pattern != path {
+			t.Errorf("%s is not served with metrics", path)
+		}
+		// expvar adds /debug/vars to the default mux by itself
+		if _, pattern := http.DefaultServeMux.Handler(req); pattern == path && path != "/debug/vars" {
+			t.Errorf("%s is on the default mux", path)
+		}
+	}
+}
+
+func TestServeReady(t *testing.T) {
+	ms := time.Millisecond
+	d := newTestNTPd(&Config{},
+		newTestPeer("192.0.2.1", 0, 5*ms),
+		newTestPeer("192.0.2.2", ms, 5*ms),
+		newTestPeer("192.0.2.3", 2*ms, 5*ms))
+
+	code := func() int {
+		rec := httptest.NewRecorder()
+		d.serveReady(rec, httptest.NewRequest("GET", "/ready", nil))
+		return rec.Code
+	}
+
+	if c := code(); c != 503 {
+		t.Errorf("before sync code=%d", c)
+	}
+	d.updateState(d.find())
+	if c := code(); c != 200 {
+		t.Errorf("after sync code=%d", c)
+	}
+	d.setHealthy(false)
+	if c := code(); c != 503 {
+		t.Errorf("lost median code=%d", c)
+	}
+}
+
+func TestOnSync(t *testing.T) {
+	ms := time.Millisecond
+	var events []SyncEvent
+	cfg := &Config{DryRun: true, OnSync: func(e SyncEvent) {
+		events = append(events, e)
+	}}
+	d := newTestNTPd(cfg,
+		newTestPeer("192.0.2.1", 0, 5*ms),
+		newTestPeer("192.0.2.2", ms, 5*ms),
+		newTestPeer("192.0.2.3", 2*ms, 5*ms))
+	op := d.find()
+	if op == nil {
+		t.Fatal("no median")
+	}
+
+	ctx := context.Background()
+	for _, c := range []struct {
+		offset  time.Duration
+		stepped bool
+		err     error
+	}{
+		{ms, false, nil},
+		{time.Second, true, nil},
+		{2 * cfg.PanicThreshold, false, errPanicOffset},
+	} {
+		n := len(events)
+		if err := d.syncTo(ctx, op, c.offset, leapIns, cfg); err != c.err {
+			t.Fatalf("%s: err=%v, want %v", c.offset, err, c.err)
+		}
+		if c.err != nil {
+			if len(events) != n {
+				t.Errorf("%s: OnSync called on error", c.offset)
+			}
+			continue
+		}
+		if len(events) != n+1 {
+			t.Fatalf("%s: OnSync not called", c.offset)
+		}
+		e := events[n]
+		if e.Offset != c.offset || e.Stepped != c.stepped || !e.DryRun ||
+			e.Leap != leapIns || e.Peer.Addr != op.peer.addr.String() {
+			t.Errorf("%s: event %+v", c.offset, e)
+		}
+	}
+}
+
+func TestWritePeers(t *testing.T) {
+	ms := time.Millisecond
+	s := Stats{
+		Peers: []PeerStats{
+			{Addr: "192.0.2.1", RefID: "GPS", Stratum: 1, Poll: 64 * time.Second, Reach: 0xff,
+				Delay: 1834 * time.Microsecond, Offset: 21 * time.Microsecond, Jitter: ms,
+				State: stateSurvivor},
+			{Addr: "2001:db8::1", RefID: "192.0.2.9", Stratum: 2, Poll: 16 * time.Second, Reach: 1,
+				Offset: -10 * ms, State: stateFalseticker},
+			{Addr: "192.0.2.3", State: stateUnreachable},
+		},
+	}
+	s.Median = &s.Peers[0]
+
+	var b bytes.Buffer
+	if err := s.WritePeers(&b); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("%d lines:\n%s", len(lines), b.String())
+	}
+	want := [][]string{
+		{"remote", "refid", "st", "poll", "reach", "delay", "offset", "jitter"},
+		{"*192.0.2.1", "GPS", "1", "64", "377", "1.834", "0.021", "1.000"},
+		{"x2001:db8::1", "192.0.2.9", "2", "16", "1", "0.000", "-10.000", "0.000"},
+		{"192.0.2.3", "-", "0", "0", "0", "0.000", "0.000", "0.000"},
+	}
+	for i, l := range lines {
+		if got := strings.Fields(l); strings.Join(got, " ") != strings.Join(want[i], " ") {
+			t.Errorf("line %d: %q, want %v", i, l, want[i])
+		}
+	}
+	// tally code is the first column
+	if lines[3][0] != ' ' {
+		t.Errorf("unreachable tally %q", lines[3][0])
+	}
+}
@@ -0,0 +1,89 @@
+package gontpd
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	noLeap uint8 = iota
+	leapIns
+	leapDel
+	notSync
+)
+
+var (
+	getOffsetFailed  = errors.New("getoffset failed -1")
+	syncOffsetFailed = errors.New("syncoffset failed -1")
+	errPanicOffset   = errors.New("offset over panic threshold")
+	// errNoFrequency is returned where kernel frequency can't be
+	// read or set
+	errNoFrequency = errors.New("frequency adjustment not supported")
+)
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// dryRunClock logs what syncClock would do with offset d without
+// touching the clock
+func dryRunClock(d time.Duration, leap uint8, cfg *Config) (stepped bool, err error) {
+	if err = checkPanic(d, cfg); err != nil {
+		return
+	}
+	stepped = absDuration(d) >= cfg.StepThreshold
+	action := "slew"
+	if stepped {
+		action = "step"
+	}
+	logger().Infof("dry run: would %s clock by %s leap=%d", action, d, leap)
+	return
+}
+
+const (
+	// shiftPLL is SHIFT_PLL of Linux, kernel PLL corrects
+	// offset/2^(shiftPLL+constant) every second
+	shiftPLL = 2
+	// minTimeConst and maxTimeConst bound time constant of kernel PLL
+	minTimeConst = 2
+	maxTimeConst = 10
+)
+
+// slewConstant returns time constant of kernel PLL for offset d, larger
+// offset is slewed faster. Constant is raised until slew rate is at most
+// maxRate ppm, and offset is clamped if it's still too fast.
+func slewConstant(d time.Duration, maxRate float64) (con int64, offset time.Duration) {
+	con = 6 - int64(absDuration(d)/(20*time.Millisecond))
+	if con < minTimeConst {
+		con = minTimeConst
+	}
+	rate := func(con int64) float64 {
+		return absDuration(d).Seconds() / float64(int64(1)<<(shiftPLL+con)) * 1e6
+	}
+	for con < maxTimeConst && rate(con) > maxRate {
+		con++
+	}
+	offset = d
+	if rate(con) > maxRate {
+		max := time.Duration(maxRate / 1e6 * float64(int64(1)<<(shiftPLL+con)) * float64(time.Second))
+		if d > 0 {
+			offset = max
+		} else {
+			offset = -max
+		}
+	}
+	return
+}
+
+// checkPanic refuses offset d over panic threshold unless force
+func checkPanic(d time.Duration, cfg *Config) error {
+	if absDuration(d) >= cfg.PanicThreshold && !cfg.ForceUpdate {
+		logger().Warnf("offset %s is over panic threshold %s, refuse to set clock",
+			d, cfg.PanicThreshold)
+		return errPanicOffset
+	}
+	return nil
+}
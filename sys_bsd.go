@@ -0,0 +1,58 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package gontpd
+
+import (
+	"syscall"
+	"time"
+)
+
+func setOffset(d time.Duration) (err error) {
+	tv := syscall.NsecToTimeval(time.Now().Add(d).UnixNano())
+	return syscall.Settimeofday(&tv)
+}
+
+// syncClock slews the clock by adjtime(2) if offset d is smaller than
+// step threshold, otherwise steps it, it's also stepped if kernel has no
+// adjtime. Offset over panic threshold is refused unless force.
+// adjtime replaces the remaining delta of last call, and it can't
+// schedule leap second so leap is ignored.
+func syncClock(d time.Duration, leap uint8, cfg *Config) (stepped bool, err error) {
+	if err = checkPanic(d, cfg); err != nil {
+		return
+	}
+
+	if absDuration(d) < cfg.StepThreshold {
+		if debug {
+			logger().Debugf("set offset slew offset=%s", d)
+		}
+		delta := syscall.NsecToTimeval(d.Nanoseconds())
+		err = syscall.Adjtime(&delta, nil)
+		if err != syscall.ENOSYS {
+			return
+		}
+		logger().Warnf("adjtime not supported, step offset=%s", d)
+	}
+
+	if debug {
+		logger().Debugf("step offset=%s", d)
+	}
+	stepped = true
+	err = setOffset(d)
+	return
+}
+
+// getFrequency is not supported without ntp_adjtime
+func getFrequency() (ppm float64, err error) {
+	err = errNoFrequency
+	return
+}
+
+func setFrequency(ppm float64) error {
+	return errNoFrequency
+}
+
+func setLoopFrequency(ppm float64, leap uint8) error {
+	return errNoFrequency
+}
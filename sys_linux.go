@@ -1,44 +1,19 @@
 package gontpd
 
 import (
-	"errors"
-	"log"
-	"math"
 	"strings"
 	"syscall"
 	"time"
 )
 
-const (
-	maxAdjust = 128 * time.Millisecond
-)
-
-const (
-	noLeap uint8 = iota
-	leapIns
-	leapDel
-	notSync
-)
-
-var (
-	getOffsetFailed      = errors.New("getoffset failed -1")
-	syncOffsetFailed     = errors.New("syncoffset failed -1")
-	overflowOffsetAdjust = errors.New("overflow offset to adjust")
-)
-
-func absDuration(d time.Duration) time.Duration {
-	if d < 0 {
-		return -d
-	}
-	return d
-}
-
 func setOffset(d time.Duration) (err error) {
 	tv := syscall.NsecToTimeval(time.Now().Add(d).UnixNano())
 	return syscall.Settimeofday(&tv)
 }
 
-func syncClock(d time.Duration, leap uint8, force bool) (err error) {
+// syncClock slews the clock if offset d is smaller than step threshold,
+// otherwise steps it. Offset over panic threshold is refused unless force.
+func syncClock(d time.Duration, leap uint8, cfg *Config) (stepped bool, err error) {
 
 	old, err := getOffset()
 	if err != nil {
@@ -46,7 +21,7 @@ func syncClock(d time.Duration, leap uint8, force bool) (err error) {
 	}
 
 	if debug {
-		log.Print("old=", old, " d=", d)
+		logger().Debugf("old=%s d=%s", old, d)
 	}
 
 	d += old
@@ -54,30 +29,41 @@ func syncClock(d time.Duration, leap uint8, force bool) (err error) {
 	tmx := &syscall.Timex{}
 	offsetNsec := d.Nanoseconds()
 	if debug {
-		log.Printf("%s < %s : %v", absDuration(d), maxAdjust, absDuration(d) < maxAdjust)
+		logger().Debugf("%s < %s : %v", absDuration(d), cfg.StepThreshold, absDuration(d) < cfg.StepThreshold)
 	}
-	if absDuration(d) < maxAdjust {
-		con := 6 - int64(absDuration(d)/(20*time.Millisecond))
-		if con < 2 {
-			con = 2
-		}
+
+	if err = checkPanic(d, cfg); err != nil {
+		return
+	}
+
+	if absDuration(d) >= cfg.StepThreshold {
 		if debug {
-			log.Printf("set offset slew offset=%s const=%d", d, con)
+			logger().Debugf("step offset=%s", d)
 		}
-		tmx.Modes = adjNANO | adjOFFSET | adjMAXERROR | adjESTERROR | adjTIMECONST
-		tmx.Offset = offsetNsec
-		tmx.Maxerror = 0
-		tmx.Esterror = 0
-		tmx.Constant = con
-	} else {
-		if force {
-			if debug {
-				log.Printf("force update offset=%s", d)
-			}
-			return setOffset(d)
-		}
-		return overflowOffsetAdjust
+		stepped = true
+		err = setOffset(d)
+		return
+	}
+
+	con, slewed := slewConstant(d, cfg.MaxSlewRate)
+	if slewed != d {
+		logger().Infof("slew of %s clamped to %s by max slew rate %.0f ppm",
+			d, slewed, cfg.MaxSlewRate)
+		d = slewed
+		offsetNsec = d.Nanoseconds()
+	}
+	if debug {
+		logger().Debugf("set offset slew offset=%s const=%d", d, con)
 	}
+	// kernel PLL must be enabled to apply offset and to track
+	// the frequency error of local oscillator
+	tmx.Modes = adjNANO | adjOFFSET | adjMAXERROR | adjESTERROR |
+		adjTIMECONST | adjSTATUS
+	tmx.Status = staPLL
+	tmx.Offset = offsetNsec
+	tmx.Maxerror = 0
+	tmx.Esterror = 0
+	tmx.Constant = con
 
 	switch leap {
 	case leapIns:
@@ -97,6 +83,53 @@ func syncClock(d time.Duration, leap uint8, force bool) (err error) {
 	return
 }
 
+// freqScale is the scale of timex.freq, 1 ppm = 1<<16
+const freqScale = 1 << 16
+
+// getFrequency returns the kernel frequency correction in ppm
+func getFrequency() (ppm float64, err error) {
+	tmx := &syscall.Timex{}
+	rc, err := syscall.Adjtimex(tmx)
+	if rc == -1 {
+		err = getOffsetFailed
+	}
+	ppm = float64(tmx.Freq) / freqScale
+	return
+}
+
+// setFrequency sets the kernel frequency correction in ppm
+func setFrequency(ppm float64) (err error) {
+	tmx := &syscall.Timex{
+		Modes: adjFREQUENCY,
+		Freq:  int64(ppm * freqScale),
+	}
+	rc, err := syscall.Adjtimex(tmx)
+	if rc == -1 {
+		err = syncOffsetFailed
+	}
+	return
+}
+
+// setLoopFrequency sets kernel frequency correction to ppm with kernel
+// PLL disabled, clock is then steered by clockLoop only.
+func setLoopFrequency(ppm float64, leap uint8) (err error) {
+	tmx := &syscall.Timex{
+		Modes: adjFREQUENCY | adjMAXERROR | adjESTERROR | adjSTATUS,
+		Freq:  int64(ppm * freqScale),
+	}
+	switch leap {
+	case leapIns:
+		tmx.Status |= staINS
+	case leapDel:
+		tmx.Status |= staDEL
+	}
+	rc, err := syscall.Adjtimex(tmx)
+	if rc == -1 {
+		err = syncOffsetFailed
+	}
+	return
+}
+
 func getOffset() (offset time.Duration, err error) {
 	tmx := &syscall.Timex{
 		Status: staNANO,
@@ -222,10 +255,3 @@ func statusToString(s int32) (status string) {
 	}
 	return strings.Join(buf, ", ")
 }
-
-func systemPrecision() int8 {
-	tmx := &syscall.Timex{}
-	syscall.Adjtimex(tmx)
-	// linux 1 for usec
-	return int8(math.Log2(float64(tmx.Precision) * 1e-6))
-}
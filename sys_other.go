@@ -0,0 +1,34 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package gontpd
+
+import (
+	"errors"
+	"time"
+)
+
+var errNoClockSync = errors.New("clock sync not supported")
+
+// syncClock never sets the clock, which should be disciplined by the
+// system, only refuses offset over panic threshold.
+func syncClock(d time.Duration, leap uint8, cfg *Config) (stepped bool, err error) {
+	if err = checkPanic(d, cfg); err != nil {
+		return
+	}
+	err = errNoClockSync
+	return
+}
+
+func getFrequency() (ppm float64, err error) {
+	err = errNoFrequency
+	return
+}
+
+func setFrequency(ppm float64) error {
+	return errNoFrequency
+}
+
+func setLoopFrequency(ppm float64, leap uint8) error {
+	return errNoFrequency
+}
@@ -0,0 +1,30 @@
+package gontpd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlewConstant(t *testing.T) {
+	ms := time.Millisecond
+	for _, g := range []struct {
+		d       time.Duration
+		maxRate float64
+		con     int64
+		offset  time.Duration
+	}{
+		{ms, 500, 6, ms},
+		// 100ms/2^(2+2) is 6250 ppm, 100ms/2^(2+6) is 390 ppm
+		{100 * ms, 500, 6, 100 * ms},
+		{-100 * ms, 500, 6, -100 * ms},
+		{100 * ms, 1, maxTimeConst, 4096 * time.Microsecond},
+		{-100 * ms, 1, maxTimeConst, -4096 * time.Microsecond},
+		{100 * ms, 50, 9, 100 * ms},
+	} {
+		con, offset := slewConstant(g.d, g.maxRate)
+		if con != g.con || offset != g.offset {
+			t.Errorf("offset %s rate %.0f ppm: constant %d offset %s, expect %d %s",
+				g.d, g.maxRate, con, offset, g.con, g.offset)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package gontpd
+
+import (
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	rxTimestampNone = "user"
+	rxTimestampNS   = "kernel"
+	rxTimestamping  = "timestamping"
+)
+
+// oobSize holds one SCM_TIMESTAMPING message of 3 timespecs and
+// SO_RXQ_OVFL drop counter
+var oobSize = unix.CmsgSpace(3*int(unsafe.Sizeof(unix.Timespec{}))) +
+	unix.CmsgSpace(4)
+
+// enableRxTimestamp asks kernel to timestamp received packets, hardware
+// timestamp is delivered if NIC is configured to support it, software
+// one otherwise. It falls back to SO_TIMESTAMPNS then user space time.
+func enableRxTimestamp(fd int) string {
+	flags := unix.SOF_TIMESTAMPING_RX_HARDWARE | unix.SOF_TIMESTAMPING_RAW_HARDWARE |
+		unix.SOF_TIMESTAMPING_RX_SOFTWARE | unix.SOF_TIMESTAMPING_SOFTWARE
+	if unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPING, flags) == nil {
+		return rxTimestamping
+	}
+	if unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1) == nil {
+		return rxTimestampNS
+	}
+	return rxTimestampNone
+}
+
+// enableRxDrops asks kernel to report packets dropped by socket
+// in control message, it's sent once any packet is dropped
+func enableRxDrops(fd int) error {
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RXQ_OVFL, 1)
+}
+
+// parseRx parses receive timestamp and drop counter in control message oob
+func parseRx(oob []byte) (rx rxInfo) {
+	if len(oob) == 0 {
+		return
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+	size := int(unsafe.Sizeof(unix.Timespec{}))
+	for _, m := range msgs {
+		if m.Header.Level != unix.SOL_SOCKET {
+			continue
+		}
+		switch m.Header.Type {
+		case unix.SO_RXQ_OVFL:
+			if len(m.Data) < 4 {
+				continue
+			}
+			rx.drops = *(*uint32)(unsafe.Pointer(&m.Data[0]))
+			rx.hasDrops = true
+		case unix.SCM_TIMESTAMPNS:
+			if len(m.Data) < size {
+				continue
+			}
+			ts := (*unix.Timespec)(unsafe.Pointer(&m.Data[0]))
+			rx.time, rx.ok = time.Unix(ts.Unix()), true
+		case unix.SCM_TIMESTAMPING:
+			if len(m.Data) < 3*size {
+				continue
+			}
+			// software, deprecated and raw hardware timestamp
+			sw := (*unix.Timespec)(unsafe.Pointer(&m.Data[0]))
+			raw := (*unix.Timespec)(unsafe.Pointer(&m.Data[2*size]))
+			if raw.Sec != 0 || raw.Nsec != 0 {
+				rx.time, rx.hw, rx.ok = time.Unix(raw.Unix()), true, true
+			} else if sw.Sec != 0 || sw.Nsec != 0 {
+				rx.time, rx.ok = time.Unix(sw.Unix()), true
+			}
+		}
+	}
+	return
+}
+
+// setSockBuf sets SO_RCVBUF or SO_SNDBUF (opt) of fd to size, it's forced
+// over net.core.rmem_max or wmem_max by force option if permitted.
+// Returns buffer size applied by kernel, which is doubled for overhead.
+func setSockBuf(fd, opt, force, size int) (applied int, err error) {
+	if unix.SetsockoptInt(fd, unix.SOL_SOCKET, force, size) != nil {
+		err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, opt, size)
+		if err != nil {
+			return
+		}
+	}
+	return unix.GetsockoptInt(fd, unix.SOL_SOCKET, opt)
+}
+
+func setRecvBuf(fd, size int) (int, error) {
+	return setSockBuf(fd, unix.SO_RCVBUF, unix.SO_RCVBUFFORCE, size)
+}
+
+func setSendBuf(fd, size int) (int, error) {
+	return setSockBuf(fd, unix.SO_SNDBUF, unix.SO_SNDBUFFORCE, size)
+}
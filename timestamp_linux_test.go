@@ -0,0 +1,122 @@
+package gontpd
+
+import (
+	"net"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestRxTimestampParse(t *testing.T) {
+	size := int(unsafe.Sizeof(unix.Timespec{}))
+	sw := unix.NsecToTimespec(time.Date(2020, 1, 1, 0, 0, 0, 100, time.UTC).UnixNano())
+	hwt := unix.NsecToTimespec(time.Date(2020, 1, 1, 0, 0, 0, 200, time.UTC).UnixNano())
+
+	drops := make([]byte, unix.CmsgSpace(4))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&drops[0]))
+	h.Level, h.Type = unix.SOL_SOCKET, unix.SO_RXQ_OVFL
+	h.SetLen(unix.CmsgLen(4))
+	*(*uint32)(unsafe.Pointer(&drops[unix.CmsgLen(0)])) = 42
+
+	build := func(typ int, ts []unix.Timespec) []byte {
+		oob := make([]byte, unix.CmsgSpace(len(ts)*size))
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		h.Level = unix.SOL_SOCKET
+		h.Type = int32(typ)
+		h.SetLen(unix.CmsgLen(len(ts) * size))
+		for i := range ts {
+			*(*unix.Timespec)(unsafe.Pointer(&oob[unix.CmsgLen(0)+i*size])) = ts[i]
+		}
+		return oob
+	}
+
+	for _, c := range []struct {
+		name string
+		oob  []byte
+		ns   int
+		hw   bool
+		ok   bool
+	}{
+		{"empty", nil, 0, false, false},
+		{"ns", build(unix.SCM_TIMESTAMPNS, []unix.Timespec{sw}), 100, false, true},
+		{"software", build(unix.SCM_TIMESTAMPING, []unix.Timespec{sw, {}, {}}), 100, false, true},
+		{"hardware", build(unix.SCM_TIMESTAMPING, []unix.Timespec{sw, {}, hwt}), 200, true, true},
+		{"zero", build(unix.SCM_TIMESTAMPING, []unix.Timespec{{}, {}, {}}), 0, false, false},
+	} {
+		rx := parseRx(c.oob)
+		if rx.ok != c.ok || rx.hw != c.hw || (rx.ok && rx.time.Nanosecond() != c.ns) {
+			t.Errorf("%s: got %s hw=%v ok=%v", c.name, rx.time, rx.hw, rx.ok)
+		}
+		if rx.hasDrops {
+			t.Errorf("%s: got drops %d", c.name, rx.drops)
+		}
+	}
+
+	rx := parseRx(append(build(unix.SCM_TIMESTAMPNS, []unix.Timespec{sw}), drops...))
+	if !rx.ok || !rx.hasDrops || rx.drops != 42 {
+		t.Errorf("got %+v, want timestamp and 42 drops", rx)
+	}
+}
+
+func TestRxTimestampLoopback(t *testing.T) {
+	d := &NTPd{cfg: &Config{}}
+	conn, err := d.makeConn("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	before := time.Now()
+	if _, err = client.Write(make([]byte, headerSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	p := make([]byte, maxPacketSize)
+	oob := make([]byte, oobSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, oobn, _, _, err := conn.ReadMsgUDP(p, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rx := parseRx(oob[:oobn])
+	// drop counter is only sent if it's not zero
+	if rx.hasDrops {
+		t.Errorf("drops=%d", rx.drops)
+	}
+	if !rx.ok {
+		t.Skip("kernel timestamp not supported")
+	}
+	if rx.time.Before(before.Add(-time.Second)) || rx.time.After(time.Now()) {
+		t.Errorf("timestamp %s out of range since %s", rx.time, before)
+	}
+}
+
+func TestSockBuf(t *testing.T) {
+	d := &NTPd{cfg: &Config{RecvBufBytes: 1 << 16, SendBufBytes: 1 << 15}}
+	conn, err := d.makeConn("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Control(func(fd uintptr) {
+		// kernel doubles the size for bookkeeping overhead
+		if n, _ := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF); n < 1<<16 {
+			t.Errorf("receive buffer %d", n)
+		}
+		if n, _ := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF); n < 1<<15 {
+			t.Errorf("send buffer %d", n)
+		}
+	})
+}
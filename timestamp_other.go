@@ -0,0 +1,38 @@
+//go:build !linux
+// +build !linux
+
+package gontpd
+
+import "syscall"
+
+const rxTimestampNone = "user"
+
+var oobSize = 1
+
+func enableRxTimestamp(fd int) string {
+	return rxTimestampNone
+}
+
+func enableRxDrops(fd int) error {
+	return nil
+}
+
+func parseRx(oob []byte) (rx rxInfo) {
+	return
+}
+
+func setSockBuf(fd, opt, size int) (applied int, err error) {
+	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, opt, size)
+	if err != nil {
+		return
+	}
+	return syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, opt)
+}
+
+func setRecvBuf(fd, size int) (int, error) {
+	return setSockBuf(fd, syscall.SO_RCVBUF, size)
+}
+
+func setSendBuf(fd, size int) (int, error) {
+	return setSockBuf(fd, syscall.SO_SNDBUF, size)
+}
@@ -0,0 +1,106 @@
+package gontpd
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName is the instrumentation name of spans of gontpd
+const tracerName = "github.com/mengzhuo/gontpd"
+
+// startSpan starts span name under ctx by Tracer of config, span is a
+// no-op and nothing is allocated without Tracer.
+func (d *NTPd) startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	if d.tracer == nil {
+		return ctx, noop.Span{}
+	}
+	return d.tracer.Start(ctx, name)
+}
+
+func durationAttr(key string, v time.Duration) attribute.KeyValue {
+	return attribute.Float64(key, v.Seconds())
+}
+
+// endPeerSpan ends span of peer update with the result of it
+func endPeerSpan(span trace.Span, p *peer) {
+	defer span.End()
+	if !span.IsRecording() {
+		return
+	}
+	span.SetAttributes(
+		attribute.String("ntp.peer", p.addr.String()),
+		attribute.String("ntp.origin", p.origin),
+		attribute.Bool("ntp.good", p.good),
+		attribute.Int("ntp.reach", int(p.reach)),
+	)
+	if !p.good {
+		span.SetStatus(codes.Error, "no good sample")
+		return
+	}
+	span.SetAttributes(
+		durationAttr("ntp.offset_sec", p.offset),
+		durationAttr("ntp.delay_sec", p.delay),
+		durationAttr("ntp.jitter_sec", p.jitter),
+		attribute.Int("ntp.stratum", int(p.stratum)),
+	)
+}
+
+// traceFind runs find in span which tells the selected peer and how many
+// peers survived selection
+func (d *NTPd) traceFind(ctx context.Context) (op *offsetPeer) {
+	_, span := d.startSpan(ctx, "find")
+	defer span.End()
+	op = d.find()
+	if !span.IsRecording() {
+		return
+	}
+	var survivors, falsetickers int
+	for _, p := range d.peers() {
+		switch p.state {
+		case stateSurvivor:
+			survivors++
+		case stateFalseticker:
+			falsetickers++
+		}
+	}
+	span.SetAttributes(
+		attribute.Int("ntp.survivors", survivors),
+		attribute.Int("ntp.falsetickers", falsetickers),
+	)
+	if op == nil {
+		span.SetStatus(codes.Error, errNoMedian.Error())
+		return
+	}
+	span.SetAttributes(
+		attribute.String("ntp.peer", op.peer.addr.String()),
+		durationAttr("ntp.offset_sec", op.resp.ClockOffset),
+		durationAttr("ntp.root_distance_sec", op.rootDist),
+	)
+	return
+}
+
+// traceAdjust runs adjust in span
+func (d *NTPd) traceAdjust(ctx context.Context, offset time.Duration, leap uint8, cfg *Config) (stepped bool, err error) {
+	_, span := d.startSpan(ctx, "adjust")
+	defer span.End()
+	stepped, err = d.adjust(offset, leap, cfg)
+	if !span.IsRecording() {
+		return
+	}
+	span.SetAttributes(
+		durationAttr("ntp.offset_sec", offset),
+		attribute.Int("ntp.leap", int(leap)),
+		attribute.Bool("ntp.dry_run", cfg.DryRun),
+		attribute.Bool("ntp.stepped", stepped),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return
+}
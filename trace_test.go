@@ -0,0 +1,83 @@
+package gontpd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/beevik/ntp"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracePoll(t *testing.T) {
+	old := queryInterval
+	queryInterval = time.Millisecond
+	defer func() { queryInterval = old }()
+
+	var peers []*peer
+	for i, addr := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		p := newPeer(addr, net.ParseIP(addr))
+		offset := time.Duration(i) * time.Millisecond
+		p.query = func(string, ntp.QueryOptions) (*ntp.Response, error) {
+			return &ntp.Response{Stratum: 2, ClockOffset: offset,
+				RTT: time.Millisecond, RootDispersion: time.Millisecond}, nil
+		}
+		peers = append(peers, p)
+	}
+	d := newTestNTPd(&Config{}, peers...)
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	d.tracer = tp.Tracer(tracerName)
+
+	ctx, cycle := d.startSpan(context.Background(), "poll")
+	d.poll(ctx)
+	op := d.traceFind(ctx)
+	cycle.End()
+	if op == nil {
+		t.Fatal("no median")
+	}
+
+	names := map[string]int{}
+	for _, s := range rec.Ended() {
+		names[s.Name()]++
+		if s.Name() == "poll" {
+			continue
+		}
+		if s.Parent().SpanID() != cycle.SpanContext().SpanID() {
+			t.Errorf("%s is not child of poll", s.Name())
+		}
+		if s.Name() != "find" {
+			continue
+		}
+		found := false
+		for _, kv := range s.Attributes() {
+			if kv == attribute.String("ntp.peer", op.peer.addr.String()) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("find span has no selected peer: %v", s.Attributes())
+		}
+	}
+	if names["poll"] != 1 || names["peer"] != len(peers) || names["find"] != 1 {
+		t.Errorf("spans %v", names)
+	}
+}
+
+func TestTraceDisabled(t *testing.T) {
+	d := &NTPd{}
+	ctx := context.Background()
+	allocs := testing.AllocsPerRun(100, func() {
+		_, span := d.startSpan(ctx, "poll")
+		if span.IsRecording() {
+			t.Fatal("recording without tracer")
+		}
+		span.End()
+	})
+	if allocs != 0 {
+		t.Errorf("%.1f allocs without tracer", allocs)
+	}
+}
@@ -0,0 +1,235 @@
+package gontpd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// ValidationError is every problem of config found by Validate
+type ValidationError []error
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validate checks all fields of cfg up front, zero values are valid as
+// they are replaced by defaults. It returns ValidationError listing every
+// problem, or nil if there's none.
+func (cfg *Config) Validate() error {
+	var errs []error
+	add := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	if cfg.DisciplineDisabled && cfg.Oneshot {
+		add("invalid Oneshot: discipline is disabled")
+	}
+	if cfg.DSCP > maxDSCP {
+		add("invalid DSCP: %d is over %d", cfg.DSCP, maxDSCP)
+	}
+	switch cfg.Discipline {
+	case "", disciplineKernel, disciplineLoop:
+	default:
+		add("invalid Discipline: %q", cfg.Discipline)
+	}
+	if cfg.MaxSlewRate > maxFreq {
+		add("invalid MaxSlewRate: %g ppm is over %d ppm", cfg.MaxSlewRate, maxFreq)
+	}
+	if cfg.MakeStep.Limit < 0 || cfg.MakeStep.Threshold < 0 {
+		add("invalid MakeStep: threshold %s limit %d",
+			cfg.MakeStep.Threshold, cfg.MakeStep.Limit)
+	}
+	if cfg.MaxOffset != 0 && cfg.PanicThreshold != 0 && cfg.MaxOffset != cfg.PanicThreshold {
+		add("invalid MaxOffset: %s differs from PanicThreshold %s, set only one of them",
+			cfg.MaxOffset, cfg.PanicThreshold)
+	}
+	if cfg.MinSources < 0 {
+		add("invalid MinSources: %d is less than 1", cfg.MinSources)
+	}
+	if cfg.MinCandidates < 0 {
+		add("invalid MinCandidates: %d is less than 1", cfg.MinCandidates)
+	}
+
+	for _, p := range []struct {
+		name string
+		poll uint8
+	}{{"MinPoll", cfg.MinPoll}, {"MaxPoll", cfg.MaxPoll}} {
+		if p.poll != 0 && (p.poll < minPoll || p.poll > maxPoll) {
+			add("invalid %s: %d not in [%d, %d]", p.name, p.poll, minPoll, maxPoll)
+		}
+	}
+	if cfg.MinPoll != 0 && cfg.MaxPoll != 0 && cfg.MinPoll > cfg.MaxPoll {
+		add("invalid MinPoll: %d is over MaxPoll %d", cfg.MinPoll, cfg.MaxPoll)
+	}
+	if cfg.MaxStd < 0 {
+		add("invalid MaxStd: %s is negative", cfg.MaxStd)
+	}
+	if cfg.RateSize < 0 {
+		add("invalid RateSize: %d is negative", cfg.RateSize)
+	}
+
+	if _, err := newDropTable(cfg.DropCIDR); err != nil {
+		add("invalid DropCIDR: %s", err)
+	}
+	if _, err := newDropTable(cfg.AllowCIDR); err != nil {
+		add("invalid AllowCIDR: %s", err)
+	}
+	if _, err := newRestrictTable(cfg.Restrict, cfg.RestrictDefault); err != nil {
+		add("invalid Restrict: %s", err)
+	}
+	if err := validateListenAddr(cfg.Metric); err != nil {
+		add("invalid Metric: %s", err)
+	}
+	if err := validateListenAddr(cfg.StatAddr); err != nil {
+		add("invalid StatAddr: %s", err)
+	}
+	if cfg.MaxStratumServed >= invalidStratum {
+		add("invalid MaxStratumServed: %d not in [1, %d]", cfg.MaxStratumServed, invalidStratum-1)
+	}
+	if err := validatePushGateway(cfg.PushGateway); err != nil {
+		add("invalid PushGateway: %s", err)
+	}
+	if err := validateQuerySource(cfg.QuerySourceAddr); err != nil {
+		add("invalid QuerySourceAddr: %s", err)
+	}
+
+	if cfg.DisciplineDisabled {
+		errs = append(errs, validateLocal(cfg)...)
+	} else {
+		errs = append(errs, validatePeers(cfg)...)
+	}
+	if len(errs) > 0 {
+		return ValidationError(errs)
+	}
+	return nil
+}
+
+// validateListenAddr checks host:port of HTTP listener, empty addr
+// disables it
+func validateListenAddr(addr string) (err error) {
+	if addr == "" {
+		return
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	_, err = net.LookupPort("tcp", port)
+	return
+}
+
+// validatePushGateway checks gateway is an absolute http(s) URL
+func validatePushGateway(gateway string) (err error) {
+	if gateway == "" {
+		return
+	}
+	u, err := url.Parse(gateway)
+	if err != nil {
+		return
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		err = fmt.Errorf("%q is not a http(s) URL", gateway)
+	}
+	return
+}
+
+// validateQuerySource checks addrs are IP addresses of this host, one of
+// each family at most.
+func validateQuerySource(addrs []string) (err error) {
+	families := map[bool]string{}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("%q is not an IP address", addr)
+		}
+		v4 := ip.To4() != nil
+		if other, ok := families[v4]; ok {
+			return fmt.Errorf("%s and %s are of the same family", other, addr)
+		}
+		families[v4] = addr
+		// bound only if it's assigned to us
+		conn, lerr := net.ListenPacket("udp", net.JoinHostPort(addr, "0"))
+		if lerr != nil {
+			return lerr
+		}
+		conn.Close()
+	}
+	return
+}
+
+// validatePeers checks PeerList, Pools and Refclocks, one of them is
+// required unless peers are found by BroadcastClient
+func validatePeers(cfg *Config) (errs []error) {
+	if len(cfg.PeerList) == 0 && len(cfg.Pools) == 0 && len(cfg.Refclocks) == 0 &&
+		!cfg.BroadcastClient {
+		errs = append(errs, errors.New("invalid PeerList: no peer configured"))
+	}
+	for _, s := range cfg.PeerList {
+		if s.Addr == "" {
+			errs = append(errs, errors.New("invalid PeerList: empty addr"))
+			continue
+		}
+		for _, poll := range []uint8{s.MinPoll, s.MaxPoll} {
+			if poll != 0 && (poll < minPoll || poll > maxPoll) {
+				errs = append(errs, fmt.Errorf("invalid PeerList: poll %d of %s not in [%d, %d]",
+					poll, s.Addr, minPoll, maxPoll))
+			}
+		}
+		if s.MinPoll != 0 && s.MaxPoll != 0 && s.MinPoll > s.MaxPoll {
+			errs = append(errs, fmt.Errorf("invalid PeerList: min_poll %d of %s is over max_poll %d",
+				s.MinPoll, s.Addr, s.MaxPoll))
+		}
+		if s.MaxStd < 0 {
+			errs = append(errs, fmt.Errorf("invalid PeerList: max_std %s of %s is negative",
+				s.MaxStd, s.Addr))
+		}
+	}
+	units := map[int]bool{}
+	for _, rc := range cfg.Refclocks {
+		if rc.Unit < 0 || rc.Unit > maxRefclockUnit || units[rc.Unit] {
+			errs = append(errs, fmt.Errorf("invalid Refclocks: unit %d", rc.Unit))
+			continue
+		}
+		units[rc.Unit] = true
+		if rc.RefID == "" {
+			continue
+		}
+		if _, err := parseRefID(rc.RefID); err != nil {
+			errs = append(errs, fmt.Errorf("invalid Refclocks: %s", err))
+		}
+	}
+	for _, ps := range cfg.Pools {
+		if ps.Hostname == "" {
+			errs = append(errs, errors.New("invalid Pools: empty hostname"))
+		}
+	}
+	// RefID replaces refid of sys peer
+	if cfg.RefID != "" {
+		if _, err := parseRefID(cfg.RefID); err != nil {
+			errs = append(errs, fmt.Errorf("invalid RefID: %s", err))
+		}
+	}
+	return
+}
+
+// validateLocal checks config of serving local clock
+func validateLocal(cfg *Config) (errs []error) {
+	if cfg.ServerDisabled {
+		errs = append(errs, errors.New("invalid DisciplineDisabled: server is disabled too"))
+	}
+	if cfg.Stratum == 0 || cfg.Stratum >= invalidStratum {
+		errs = append(errs, fmt.Errorf("invalid Stratum: %d not in [1, %d]",
+			cfg.Stratum, invalidStratum-1))
+	}
+	if _, err := parseRefID(cfg.RefID); err != nil {
+		errs = append(errs, fmt.Errorf("invalid RefID: %s", err))
+	}
+	return
+}
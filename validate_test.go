@@ -0,0 +1,75 @@
+package gontpd
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	for _, g := range []struct {
+		cfg    *Config
+		fields []string
+	}{
+		{&Config{PeerList: Peers("time1.apple.com")}, nil},
+		{&Config{PeerList: Peers("time1.apple.com"), MinPoll: 10, MaxPoll: 8}, []string{"MinPoll"}},
+		{&Config{PeerList: Peers("time1.apple.com"), MaxPoll: 17}, []string{"MaxPoll"}},
+		{&Config{PeerList: Peers("time1.apple.com"), MaxStd: -1}, []string{"MaxStd"}},
+		{&Config{PeerList: []PeerSpec{{Addr: "192.0.2.1", MaxStd: -1}}}, []string{"PeerList: max_std"}},
+		{&Config{PeerList: Peers("time1.apple.com"), RateSize: -1}, []string{"RateSize"}},
+		{&Config{PeerList: Peers("time1.apple.com"), MaxOffset: time.Minute}, nil},
+		{&Config{PeerList: Peers("time1.apple.com"), MaxOffset: time.Minute,
+			PanicThreshold: time.Minute}, nil},
+		{&Config{PeerList: Peers("time1.apple.com"), MaxOffset: time.Minute,
+			PanicThreshold: time.Hour}, []string{"MaxOffset"}},
+		{&Config{PeerList: Peers("time1.apple.com"), Metric: "7370"}, []string{"Metric"}},
+		{&Config{PeerList: Peers("time1.apple.com"), StatAddr: ":nope"}, []string{"StatAddr"}},
+		{&Config{PeerList: Peers("time1.apple.com"), PushGateway: "pushgateway:9091"},
+			[]string{"PushGateway"}},
+		{&Config{PeerList: Peers("time1.apple.com"), PushGateway: "http://pushgateway:9091"}, nil},
+		{&Config{PeerList: Peers("time1.apple.com"), QuerySourceAddr: []string{"127.0.0.1"}}, nil},
+		{&Config{PeerList: Peers("time1.apple.com"), QuerySourceAddr: []string{"eth0"}},
+			[]string{"QuerySourceAddr"}},
+		{&Config{PeerList: Peers("time1.apple.com"), QuerySourceAddr: []string{"127.0.0.1", "127.0.0.2"}},
+			[]string{"QuerySourceAddr"}},
+		// not assigned to us
+		{&Config{PeerList: Peers("time1.apple.com"), QuerySourceAddr: []string{"192.0.2.1"}},
+			[]string{"QuerySourceAddr"}},
+		{&Config{PeerList: Peers("time1.apple.com"), RefID: "GPS"}, nil},
+		{&Config{PeerList: Peers("time1.apple.com"), RefID: "GNSS1"}, []string{"RefID"}},
+		{&Config{PeerList: Peers("time1.apple.com"), MaxStratumServed: 16},
+			[]string{"MaxStratumServed"}},
+		{&Config{PeerList: Peers("time1.apple.com"), AllowCIDR: []string{"10.0.0.0/33"}},
+			[]string{"AllowCIDR"}},
+		// every problem is reported at once
+		{&Config{DropCIDR: []string{"10.0.0.1"}, Metric: "localhost", MinPoll: 3},
+			[]string{"DropCIDR", "Metric", "MinPoll", "PeerList"}},
+	} {
+		err := g.cfg.Validate()
+		if len(g.fields) == 0 {
+			if err != nil {
+				t.Errorf("cfg=%+v err=%s", g.cfg, err)
+			}
+			continue
+		}
+		verr, ok := err.(ValidationError)
+		if !ok || len(verr) != len(g.fields) {
+			t.Errorf("cfg=%+v err=%v, want %d errors", g.cfg, err, len(g.fields))
+			continue
+		}
+		for _, f := range g.fields {
+			if !strings.Contains(err.Error(), "invalid "+f) {
+				t.Errorf("error %q should name field %s", err, f)
+			}
+		}
+	}
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	d := newTestNTPd(&Config{PeerList: Peers("127.0.0.1")})
+	d.cfg.MinPoll, d.cfg.MaxPoll = 10, 6
+	if err := d.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "MinPoll") {
+		t.Errorf("run with invalid config err=%v", err)
+	}
+}
@@ -0,0 +1,23 @@
+package gontpd
+
+// runtime/debug is renamed since debug is the build flag of logging
+import rtdebug "runtime/debug"
+
+// Version is the version of gontpd, it's set by
+// -ldflags "-X github.com/mengzhuo/gontpd.Version=v1.0.0"
+var Version = "dev"
+
+// commit returns VCS revision that the binary is built from, or
+// "unknown" if it's not recorded, i.e. built by go test.
+func commit() string {
+	info, ok := rtdebug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			return s.Value
+		}
+	}
+	return "unknown"
+}